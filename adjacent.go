@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"os"
+)
+
+// adjacent is set by -adjacent: like uniq, a line is a duplicate only if its
+// key equals the key of the line right before it.
+var adjacent bool
+
+// adjacentSet remembers only the last key added, so it takes no memory
+// beyond one key and keeps no state between runs. processStream adds every
+// new key, so Has compares each key with the previous line's.
+type adjacentSet struct {
+	last []byte
+	seen bool
+}
+
+func (s *adjacentSet) Has(key []byte) bool {
+	return s.seen && bytes.Equal(key, s.last)
+}
+
+func (s *adjacentSet) Add(key []byte) {
+	s.last = append(s.last[:0], key...)
+	s.seen = true
+}
+
+func (s *adjacentSet) AddIfNotHasTS(key []byte) bool {
+	if s.Has(key) {
+		return false
+	}
+	s.Add(key)
+	return true
+}
+
+// checkAdjacentFlags rejects the flags -adjacent cannot be combined with:
+// those that need a filter or state shared across lines that are not
+// neighbors.
+func checkAdjacentFlags() {
+	var conflict string
+	switch {
+	case exact:
+		conflict = "-exact"
+	case baseFile != "":
+		conflict = "-base"
+	case seedFile != "":
+		conflict = "-seed-file"
+	case resume:
+		conflict = "-resume"
+	case twoPass:
+		conflict = "-two-pass"
+	case walFile != "":
+		conflict = "-wal"
+	case shingleSize > 0:
+		conflict = "-shingle"
+	case withCounts:
+		conflict = "-with-counts"
+	}
+	if conflict != "" {
+		logErrorf("-adjacent cannot be combined with %s", conflict)
+		os.Exit(2)
+	}
+}
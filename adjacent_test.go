@@ -0,0 +1,40 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAdjacentMatchesUniq(t *testing.T) {
+	in := "a\na\nb\nb\nb\na\nc\n\n\nc\na\n"
+	want := "a\nb\na\nc\n\nc\na\n"
+	dir := t.TempDir()
+	if got := mustRun(t, dir, in, "-adjacent"); got != want {
+		t.Errorf("output %q, want %q", got, want)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "bloom.gz")); !os.IsNotExist(err) {
+		t.Errorf("-adjacent touched the state file: %v", err)
+	}
+	// A second run remembers nothing.
+	if got := mustRun(t, dir, "c\n", "-adjacent"); got != "c\n" {
+		t.Errorf("second run emitted %q, want c", got)
+	}
+
+	uniq, err := exec.LookPath("uniq")
+	if err != nil {
+		t.Skip("no uniq to compare with")
+	}
+	input, _ := syntheticStream(5000, 3)
+	cmd := exec.Command(uniq)
+	cmd.Stdin = strings.NewReader(input)
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := mustRun(t, t.TempDir(), input, "-adjacent"); got != string(out) {
+		t.Errorf("output differs from uniq's: %d lines against %d", lineCount(got), lineCount(string(out)))
+	}
+}
@@ -33,23 +33,41 @@
 package bbloom
 
 import (
+	"bufio"
 	"bytes"
+	"encoding/base64"
 	"encoding/binary"
 	"encoding/json"
+	"expvar"
+	"fmt"
 	"io"
 	"log"
 	"math"
+	"math/bits"
+	"math/rand"
+	"runtime/debug"
 	"sync"
-	"unsafe"
+	"sync/atomic"
 )
 
 // helper
 // not needed anymore by Set
 // var mask = []uint8{1, 2, 4, 8, 16, 32, 64, 128}
 
+// MinSize is the smallest filter, in bits. The constructors round smaller
+// sizes up to it, so a filter for a handful of entries still takes 512 bits
+// (64 bytes) and holds more than was asked for at the requested rate.
+const MinSize = 512
+
+// MaxSize is the largest filter the validating constructors build, in bits:
+// 2^40 bits, 128 GiB. Larger requests almost always come from a mistyped
+// entry count or rate, and would otherwise fail in make with an opaque
+// out-of-memory panic.
+const MaxSize = 1 << 40
+
 func getSize(ui64 uint64) (size uint64, exponent uint64) {
-	if ui64 < uint64(512) {
-		ui64 = uint64(512)
+	if ui64 < MinSize {
+		ui64 = MinSize
 	}
 	size = uint64(1)
 	for size < ui64 {
@@ -59,6 +77,45 @@ func getSize(ui64 uint64) (size uint64, exponent uint64) {
 	return size, exponent
 }
 
+// getSizeDown is getSize rounding down: the largest power of two at or below
+// ui64, but at least MinSize.
+func getSizeDown(ui64 uint64) (size uint64, exponent uint64) {
+	if ui64 < MinSize {
+		ui64 = MinSize
+	}
+	exponent = uint64(63 - bits.LeadingZeros64(ui64))
+	return uint64(1) << exponent, exponent
+}
+
+// checkSize returns an error if a filter of bits bits is over MaxSize, or
+// over the Go memory limit (GOMEMLIMIT) when one is set.
+func checkSize(bits float64) error {
+	bytes := bits / 8
+	if bits > MaxSize {
+		return fmt.Errorf("needs ~%s, over the %s limit", formatBytes(bytes), formatBytes(MaxSize/8))
+	}
+	if limit := debug.SetMemoryLimit(-1); limit < math.MaxInt64 && bytes > float64(limit) {
+		return fmt.Errorf("needs ~%s, over the memory limit of %s", formatBytes(bytes), formatBytes(float64(limit)))
+	}
+	return nil
+}
+
+// formatBytes formats n bytes with a binary unit, as in "1.5 GiB".
+func formatBytes(n float64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB", "PiB", "EiB"}
+	i := 0
+	for n >= 1024 && i < len(units)-1 {
+		n /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.3g %s", n, units[i])
+}
+
+// roundUpBits returns the size New gives a filter asked for bits bits.
+func roundUpBits(bits float64) float64 {
+	return math.Max(math.Exp2(math.Ceil(math.Log2(bits))), MinSize)
+}
+
 func calcSizeByWrongPositives(numEntries, wrongs float64) (uint64, uint64) {
 	size := -1 * numEntries * math.Log(wrongs) / math.Pow(float64(0.69314718056), 2)
 	locs := math.Ceil(float64(0.69314718056) * size / numEntries)
@@ -67,6 +124,11 @@ func calcSizeByWrongPositives(numEntries, wrongs float64) (uint64, uint64) {
 
 // New
 // returns a new bloomfilter
+// The second parameter is overloaded: below 1 it is a false positive rate,
+// from 1 up a literal number of hash locations. So New(n, 1.0) is a filter
+// with one hash location, not one with a 100% false positive rate, and a
+// rate of 0 or less is fed to the sizing formula as is. NewWithFPR and
+// NewWithLocs take one meaning each and validate it.
 func New(params ...float64) (bloomfilter Bloom) {
 	var entries, locs uint64
 	if len(params) == 2 {
@@ -81,6 +143,7 @@ func New(params ...float64) (bloomfilter Bloom) {
 	size, exponent := getSize(uint64(entries))
 	bloomfilter = Bloom{
 		Mtx:     &sync.Mutex{},
+		ops:     &opCounters{},
 		sizeExp: exponent,
 		size:    size - 1,
 		setLocs: locs,
@@ -90,45 +153,205 @@ func New(params ...float64) (bloomfilter Bloom) {
 	return bloomfilter
 }
 
+// NewWithFPR returns a filter sized for entries entries at false positive
+// rate fpr, which must lie strictly between 0 and 1. It is never smaller than
+// MinSize bits, so for very few entries the rate is better than asked for.
+func NewWithFPR(entries, fpr float64) (Bloom, error) {
+	if !(entries >= 1) {
+		return Bloom{}, fmt.Errorf("bbloom: need at least 1 entry, got %v", entries)
+	}
+	if !(fpr > 0 && fpr < 1) {
+		return Bloom{}, fmt.Errorf("bbloom: false positive rate %v is not between 0 and 1", fpr)
+	}
+	bits := -entries * math.Log(fpr) / math.Pow(float64(0.69314718056), 2)
+	if err := checkSize(roundUpBits(bits)); err != nil {
+		return Bloom{}, fmt.Errorf("bbloom: %g entries at false positive rate %g %w; reduce the entries or raise the rate", entries, fpr, err)
+	}
+	return New(entries, fpr), nil
+}
+
+// NewWithFPRRoundDown is NewWithFPR, except that the bit size is rounded
+// down to a power of two instead of up, for tight memory budgets: it uses at
+// most the optimal number of bits, rather than up to twice as many, and has a
+// higher false positive rate at entries in exchange. The number of hash
+// locations is chosen for the smaller size. Capacity and ExpectedFPR report
+// what the filter achieves.
+func NewWithFPRRoundDown(entries, fpr float64) (Bloom, error) {
+	if !(entries >= 1) {
+		return Bloom{}, fmt.Errorf("bbloom: need at least 1 entry, got %v", entries)
+	}
+	if !(fpr > 0 && fpr < 1) {
+		return Bloom{}, fmt.Errorf("bbloom: false positive rate %v is not between 0 and 1", fpr)
+	}
+	bits := -entries * math.Log(fpr) / math.Pow(float64(0.69314718056), 2)
+	if err := checkSize(math.Max(math.Exp2(math.Floor(math.Log2(bits))), MinSize)); err != nil {
+		return Bloom{}, fmt.Errorf("bbloom: %g entries at false positive rate %g %w; reduce the entries or raise the rate", entries, fpr, err)
+	}
+	bitsWanted, _ := calcSizeByWrongPositives(entries, fpr)
+	size, _ := getSizeDown(bitsWanted)
+	locs := max(math.Round(float64(0.69314718056)*float64(size)/entries), 1)
+	// New rounds up; size is already a power of two, so it stays.
+	return New(float64(size), locs), nil
+}
+
+// Capacity returns how many entries the filter can hold before its expected
+// false positive rate exceeds fpr.
+func (bl *Bloom) Capacity(fpr float64) uint64 {
+	return CapacityOf(bl.size+1, bl.setLocs, fpr)
+}
+
+// ExpectedFPR returns the false positive rate the filter is expected to have
+// once it holds n entries.
+func (bl *Bloom) ExpectedFPR(n float64) float64 {
+	return ExpectedFPROf(bl.size+1, bl.setLocs, n)
+}
+
+// NewWithLocs returns a filter of entries bits, rounded up to a power of two
+// and at least MinSize, with locs hash locations. locs must be a whole number
+// of at least 1.
+func NewWithLocs(entries, locs float64) (Bloom, error) {
+	if !(entries >= 1) {
+		return Bloom{}, fmt.Errorf("bbloom: need at least 1 entry, got %v", entries)
+	}
+	if !(locs >= 1) || locs != math.Trunc(locs) {
+		return Bloom{}, fmt.Errorf("bbloom: hash locations %v is not a whole number of at least 1", locs)
+	}
+	if err := checkSize(roundUpBits(entries)); err != nil {
+		return Bloom{}, fmt.Errorf("bbloom: a filter of %g bits %w; reduce its size", entries, err)
+	}
+	return New(entries, locs), nil
+}
+
 // NewWithBoolset
 // takes a []byte slice and number of locs per entry
 // returns the bloomfilter with a bitset populated according to the input []byte
+// The bytes are decoded as little-endian 64-bit words, the layout JSONMarshal
+// writes. Before this was made explicit the bytes were copied in native byte
+// order, so filters exported on big-endian machines by older versions load
+// with their bits scrambled; on little-endian machines nothing changed.
 func NewWithBoolset(bs *[]byte, locs uint64) (bloomfilter Bloom) {
-	bloomfilter = New(float64(len(*bs)<<3), float64(locs))
-	for i, b := range *bs {
-		*(*uint8)(unsafe.Pointer(uintptr(unsafe.Pointer(&bloomfilter.bitset[0])) + uintptr(i))) = b
+	words := make([]uint64, (len(*bs)+7)>>3)
+	var word [8]byte
+	for i := range words {
+		n := copy(word[:], (*bs)[i<<3:])
+		clear(word[n:])
+		words[i] = binary.LittleEndian.Uint64(word[:])
 	}
+	return NewWithBitset(words, locs)
+}
+
+// NewWithBitset returns a filter with locs hash locations whose bitset is a
+// copy of words, for callers that already hold the decoded words.
+func NewWithBitset(words []uint64, locs uint64) (bloomfilter Bloom) {
+	bloomfilter = New(float64(len(words)<<6), float64(locs))
+	copy(bloomfilter.bitset, words)
 	return bloomfilter
 }
 
+// NewFromBuffer returns a filter whose bitset is buf itself, without copying,
+// so the caller controls where the memory lives (an arena, shared memory).
+// len(buf) must be a power of two of at least 8 words (MinSize bits), the
+// same minimum New uses, and locs must be at least 1. The buffer's contents
+// are used as they are; pass a zeroed buffer for an empty filter. The caller
+// must not resize or reslice buf while the filter is in use. For
+// memory-mapped buffers, Warm faults the pages in ahead of the first queries.
+func NewFromBuffer(buf []uint64, locs uint64) (Bloom, error) {
+	n := uint64(len(buf))
+	if n<<6 < MinSize || n&(n-1) != 0 {
+		return Bloom{}, fmt.Errorf("bbloom: buffer length %d is not a power of two of at least 8 words", n)
+	}
+	if locs < 1 {
+		return Bloom{}, fmt.Errorf("bbloom: need at least 1 hash location, got %d", locs)
+	}
+	size := n << 6
+	exponent := uint64(bits.TrailingZeros64(size))
+	return Bloom{
+		Mtx:      &sync.Mutex{},
+		ops:      &opCounters{},
+		bitset:   buf,
+		external: true,
+		sizeExp:  exponent,
+		size:     size - 1,
+		setLocs:  locs,
+		shift:    64 - exponent,
+	}, nil
+}
+
 // bloomJSONImExport
 // Im/Export structure used by JSONMarshal / JSONUnmarshal
 type bloomJSONImExport struct {
 	FilterSet []byte
 	SetLocs   uint64
+	// Shift is only written for halved filters, whose hash split no
+	// longer follows from the size.
+	Shift uint64 `json:",omitempty"`
+	// Hash names the hash; it is only written for hashes other than
+	// SipHash.
+	Hash string `json:",omitempty"`
 }
 
 // JSONUnmarshal
 // takes JSON-Object (type bloomJSONImExport) as []bytes
 // returns Bloom object
+// It cannot report errors: malformed input, including an unknown Hash,
+// yields an empty filter. Use BinaryUnmarshal when that matters.
 func JSONUnmarshal(dbData []byte) Bloom {
 	bloomImEx := bloomJSONImExport{}
 	json.Unmarshal(dbData, &bloomImEx)
+	hash := SipHash
+	if bloomImEx.Hash != "" {
+		var err error
+		if hash, err = ParseHash(bloomImEx.Hash); err != nil {
+			bloomImEx = bloomJSONImExport{}
+		}
+	}
 	buf := bytes.NewBuffer(bloomImEx.FilterSet)
 	bs := buf.Bytes()
 	bf := NewWithBoolset(&bs, bloomImEx.SetLocs)
+	if bloomImEx.Shift != 0 {
+		bf.shift = bloomImEx.Shift
+	}
+	bf.HashFunc = hash
 	return bf
 }
 
 // Bloom filter
 type Bloom struct {
-	Mtx     *sync.Mutex
+	Mtx *sync.Mutex
+	// ElemNum counts the entries added. Filters saved before it was fixed
+	// to count once per entry hold setLocs times the real number.
 	ElemNum uint64
-	bitset  []uint64
-	sizeExp uint64
-	size    uint64
-	setLocs uint64
-	shift   uint64
+	// Namespace, if set, is prepended to every entry before hashing so the
+	// same value added under different namespaces sets different bits. The
+	// prefix is a plain concatenation: namespace "a" with entry "bc" hashes
+	// like namespace "ab" with entry "c", so end namespaces with a separator
+	// that cannot start an entry. Namespace is not serialized.
+	Namespace []byte
+	// HashFunc is the hash the bit locations are derived from. Set it on an
+	// empty filter, before anything is added; it is saved with the filter,
+	// so a loaded filter keeps the hash it was built with.
+	HashFunc Hash
+	// SipKey, if set, replaces DefaultSipKey when HashFunc is SipHash, so
+	// that which entries collide cannot be worked out without it. Like
+	// Namespace it is not serialized: a saved filter must be used with the
+	// key it was built with, or it finds none of its entries.
+	SipKey *SipKey
+	ops    *opCounters
+	prof   *opProfile
+	bitset []uint64
+	// external is set when bitset is caller memory from NewFromBuffer.
+	external bool
+	sizeExp  uint64
+	size     uint64
+	setLocs  uint64
+	shift    uint64
+}
+
+// opCounters counts filter operations for Metrics. It is shared by copies of
+// a Bloom, so Has, which has a value receiver, can count as well.
+type opCounters struct {
+	adds    atomic.Uint64
+	queries atomic.Uint64
 }
 
 // <--- http://www.cse.yorku.ca/~oz/hash.html
@@ -151,11 +374,18 @@ type Bloom struct {
 // Add
 // set the bit(s) for entry; Adds an entry to the Bloom filter
 func (bl *Bloom) Add(entry []byte) {
-	l, h := bl.sipHash(entry)
+	if bl.prof != nil {
+		bl.addProfiled(entry)
+		return
+	}
+	if bl.ops != nil {
+		bl.ops.adds.Add(1)
+	}
+	l, h := bl.hash(bl.key(entry))
 	for i := uint64(0); i < bl.setLocs; i++ {
 		bl.set((h + i*l) & bl.size)
-		bl.ElemNum++
 	}
+	bl.ElemNum++
 }
 
 // AddTS
@@ -170,7 +400,13 @@ func (bl *Bloom) AddTS(entry []byte) {
 // check if bit(s) for entry is/are set
 // returns true if the entry was added to the Bloom Filter
 func (bl Bloom) Has(entry []byte) bool {
-	l, h := bl.sipHash(entry)
+	if bl.prof != nil {
+		return bl.hasProfiled(entry)
+	}
+	if bl.ops != nil {
+		bl.ops.queries.Add(1)
+	}
+	l, h := bl.hash(bl.key(entry))
 	res := true
 	for i := uint64(0); i < bl.setLocs; i++ {
 		res = res && bl.isSet((h+i*l)&bl.size)
@@ -186,6 +422,35 @@ func (bl Bloom) Has(entry []byte) bool {
 	return res
 }
 
+// HasProfile is a diagnostic, early-exit variant of Has. It reports whether
+// entry is present and how many hash locations were checked: for a negative
+// answer, the 1-based index of the first unset bit; for a positive one, all
+// of them. Has keeps the full loop (see the note there), so comparing the two
+// on a workload shows whether early exit would pay off. HasProfile is not
+// counted in Metrics.
+func (bl *Bloom) HasProfile(entry []byte) (has bool, checked uint64) {
+	l, h := bl.hash(bl.key(entry))
+	for i := uint64(0); i < bl.setLocs; i++ {
+		if !bl.isSet((h + i*l) & bl.size) {
+			return false, i + 1
+		}
+	}
+	return true, bl.setLocs
+}
+
+// Positions returns the bit indexes Add sets for entry, in the order it
+// sets them, Namespace and SipKey applied. Two entries with the same
+// positions are indistinguishable to the filter. Positions may repeat when
+// the double hashing wraps around a small filter.
+func (bl *Bloom) Positions(entry []byte) []uint64 {
+	l, h := bl.hash(bl.key(entry))
+	pos := make([]uint64, bl.setLocs)
+	for i := range pos {
+		pos[i] = (h + uint64(i)*l) & bl.size
+	}
+	return pos
+}
+
 // HasTS
 // Thread safe: Mutex.Lock the bloomfilter for the time of processing the entry
 func (bl *Bloom) HasTS(entry []byte) bool {
@@ -194,11 +459,36 @@ func (bl *Bloom) HasTS(entry []byte) bool {
 	return bl.Has(entry)
 }
 
+// HasWithConfidence is Has plus a confidence estimate for the answer. A
+// negative answer is always certain (Bloom filters have no false negatives),
+// so its confidence is 1. For a positive answer the confidence is
+// 1 - EstimatedFPR(): the probability that an entry which was never added
+// would not have been reported present at the current fill. It is not the
+// posterior probability that this particular entry was added, which would
+// also depend on how often absent entries are queried. Confidence falls as
+// the filter fills up. Computing it scans the bitset, so it is O(size); for
+// bulk queries call EstimatedFPR once and reuse it.
+func (bl *Bloom) HasWithConfidence(entry []byte) (bool, float64) {
+	if !bl.Has(entry) {
+		return false, 1
+	}
+	return true, 1 - bl.EstimatedFPR()
+}
+
+// key returns entry prefixed with the filter's Namespace, if any.
+func (bl *Bloom) key(entry []byte) []byte {
+	if len(bl.Namespace) == 0 {
+		return entry
+	}
+	k := make([]byte, 0, len(bl.Namespace)+len(entry))
+	return append(append(k, bl.Namespace...), entry...)
+}
+
 // AddIfNotHas
 // Only Add entry if it's not present in the bloomfilter
 // returns true if entry was added
 // returns false if entry was allready registered in the bloomfilter
-func (bl Bloom) AddIfNotHas(entry []byte) (added bool) {
+func (bl *Bloom) AddIfNotHas(entry []byte) (added bool) {
 	if bl.Has(entry) {
 		return added
 	}
@@ -206,6 +496,35 @@ func (bl Bloom) AddIfNotHas(entry []byte) (added bool) {
 	return true
 }
 
+// AddIfNotHasAtomic
+// Thread safe without the mutex: each bit is tested and set with one atomic
+// OR, and entry counts as added if any of its bits was unset before. Calls
+// for different entries may run concurrently and never lose bits; callers
+// must not run calls for the same entry concurrently (route equal entries to
+// one goroutine), or both may report added. Do not mix with Add or Has on
+// other goroutines at the same time.
+// returns true if entry was added
+func (bl *Bloom) AddIfNotHasAtomic(entry []byte) (added bool) {
+	if bl.ops != nil {
+		bl.ops.queries.Add(1)
+	}
+	l, h := bl.hash(bl.key(entry))
+	for i := uint64(0); i < bl.setLocs; i++ {
+		idx := (h + i*l) & bl.size
+		mask := uint64(1) << (idx % 64)
+		if atomic.OrUint64(&bl.bitset[idx>>6], mask)&mask == 0 {
+			added = true
+		}
+	}
+	if added {
+		atomic.AddUint64(&bl.ElemNum, 1)
+		if bl.ops != nil {
+			bl.ops.adds.Add(1)
+		}
+	}
+	return added
+}
+
 // AddIfNotHasTS
 // Tread safe: Only Add entry if it's not present in the bloomfilter
 // returns true if entry was added
@@ -231,6 +550,164 @@ func (bl *Bloom) Clear() {
 	}
 }
 
+// Halve folds the filter to half its size by ORing the upper half of the
+// bitset into the lower half, reclaiming memory when the filter turned out
+// larger than needed. Every entry present before is still present.
+//
+// The false positive rate rises: a fill ratio f becomes about 1-(1-f)^2,
+// roughly 2f while the filter is sparse, and the rate is that raised to the
+// number of hash locations. Halve fails on a filter already at MinSize.
+//
+// The hash is still split at the original shift; only the index mask
+// shrinks, so each bit index maps to itself modulo the new size. Halved
+// filters therefore keep a shift smaller than 64-sizeExp.
+func (bl *Bloom) Halve() error {
+	n := len(bl.bitset)
+	if n<<6 <= MinSize {
+		return fmt.Errorf("bbloom: cannot halve a filter of %d bits", n<<6)
+	}
+	half := make([]uint64, n/2)
+	for i := range half {
+		half[i] = bl.bitset[i] | bl.bitset[i+n/2]
+	}
+	bl.bitset = half
+	bl.external = false
+	bl.sizeExp--
+	bl.size = uint64(n/2)<<6 - 1
+	return nil
+}
+
+// FillRatio returns the fraction of bits set in the bitset. It scans the
+// whole bitset, so it is O(size).
+func (bl *Bloom) FillRatio() float64 {
+	var set int
+	for _, w := range bl.bitset {
+		set += bits.OnesCount64(w)
+	}
+	return float64(set) / float64(len(bl.bitset)<<6)
+}
+
+// EstimatedFPR returns the false positive rate implied by the current fill:
+// the probability that all setLocs bits probed for an absent entry are set.
+func (bl *Bloom) EstimatedFPR() float64 {
+	return math.Pow(bl.FillRatio(), float64(bl.setLocs))
+}
+
+// RemainingCapacity estimates how many more distinct entries can be added
+// before EstimatedFPR reaches targetFPR, from the current fill rather than
+// ElemNum, so it holds for loaded, merged and decayed filters alike. It is
+// the number of entries that would take the fill from where it is to the
+// fill whose FPR is targetFPR; zero or negative means the target is already
+// reached, by about that many entries. targetFPR must be between 0 and 1.
+func (bl *Bloom) RemainingCapacity(targetFPR float64) int64 {
+	fill := bl.FillRatio()
+	if fill >= 1 {
+		return 0
+	}
+	m, k := float64(len(bl.bitset)<<6), float64(bl.setLocs)
+	target := math.Pow(targetFPR, 1/k)
+	n := math.Floor(entriesAtFill(m, k, target) - entriesAtFill(m, k, fill))
+	if n >= math.MaxInt64 {
+		return math.MaxInt64
+	}
+	return int64(n)
+}
+
+// Equal reports whether other has the same geometry (size, hash locations)
+// and exactly the same bits set. ElemNum and Namespace are not compared.
+func (bl *Bloom) Equal(other *Bloom) bool {
+	if bl.sizeExp != other.sizeExp || bl.size != other.size ||
+		bl.setLocs != other.setLocs || bl.shift != other.shift ||
+		bl.HashFunc != other.HashFunc ||
+		len(bl.bitset) != len(other.bitset) {
+		return false
+	}
+	for i, w := range bl.bitset {
+		if w != other.bitset[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// HammingDistance returns the number of bits that differ between the two
+// bitsets, for diagnosing near-equal filters. Geometry is not checked: if the
+// bitsets differ in length, every set bit in the longer one's extra words
+// counts as a difference.
+func (bl *Bloom) HammingDistance(other *Bloom) uint64 {
+	a, b := bl.bitset, other.bitset
+	if len(a) < len(b) {
+		a, b = b, a
+	}
+	var d int
+	for i, w := range a {
+		if i < len(b) {
+			w ^= b[i]
+		}
+		d += bits.OnesCount64(w)
+	}
+	return uint64(d)
+}
+
+// BloomMetrics is a point-in-time snapshot of a filter's usage and accuracy.
+type BloomMetrics struct {
+	Adds         uint64  // Add calls since the filter was created or loaded
+	Queries      uint64  // Has calls since the filter was created or loaded
+	FillRatio    float64 // fraction of bits set
+	EstimatedFPR float64 // false positive rate implied by FillRatio
+	SizeBits     uint64  // bitset size in bits
+	HashLocs     uint64  // bits set per entry
+}
+
+// Metrics returns the filter's current metrics. The counters are cheap, but
+// FillRatio and EstimatedFPR are computed on demand by a popcount over the
+// whole bitset, so Metrics is O(size).
+func (bl *Bloom) Metrics() BloomMetrics {
+	m := BloomMetrics{
+		FillRatio: bl.FillRatio(),
+		SizeBits:  uint64(len(bl.bitset)) << 6,
+		HashLocs:  bl.setLocs,
+	}
+	m.EstimatedFPR = math.Pow(m.FillRatio, float64(bl.setLocs))
+	if bl.ops != nil {
+		m.Adds = bl.ops.adds.Load()
+		m.Queries = bl.ops.queries.Load()
+	}
+	return m
+}
+
+// PublishExpvar publishes the filter's Metrics in expvar under name, so they
+// appear in /debug/vars and are recomputed on every read. As with
+// expvar.Publish, it panics if name is already registered.
+func (bl *Bloom) PublishExpvar(name string) {
+	expvar.Publish(name, expvar.Func(func() any { return bl.Metrics() }))
+}
+
+// probePrefix starts every entry generated by Probe.
+const probePrefix = "\x00bbloom-probe\x00"
+
+// Probe measures the false positive rate empirically: it queries n
+// pseudo-random entries derived from seed and returns the fraction the filter
+// reports as present. Each probe entry is probePrefix followed by eight random
+// bytes; the result is only a false positive rate if no inserted entry shares
+// that prefix, i.e. the probe keyspace is disjoint from the inserted keys.
+func (bl *Bloom) Probe(n int, seed int64) float64 {
+	if n <= 0 {
+		return 0
+	}
+	rng := rand.New(rand.NewSource(seed))
+	key := make([]byte, len(probePrefix)+8)
+	copy(key, probePrefix)
+	hits := 0
+	for i := 0; i < n; i++ {
+		binary.LittleEndian.PutUint64(key[len(probePrefix):], rng.Uint64())
+		if bl.Has(key) {
+			hits++
+		}
+	}
+	return float64(hits) / float64(n)
+}
+
 // Set
 // set the bit[idx] of bitsit
 func (bl *Bloom) set(idx uint64) {
@@ -253,9 +730,15 @@ func (bl *Bloom) isSet(idx uint64) bool {
 func (bl Bloom) JSONMarshal() []byte {
 	bloomImEx := bloomJSONImExport{}
 	bloomImEx.SetLocs = uint64(bl.setLocs)
+	if bl.shift != 64-bl.sizeExp {
+		bloomImEx.Shift = bl.shift
+	}
+	if bl.HashFunc != SipHash {
+		bloomImEx.Hash = bl.HashFunc.String()
+	}
 	bloomImEx.FilterSet = make([]byte, len(bl.bitset)<<3)
-	for i := range bloomImEx.FilterSet {
-		bloomImEx.FilterSet[i] = *(*byte)(unsafe.Pointer(uintptr(unsafe.Pointer(&bl.bitset[0])) + uintptr(i)))
+	for i, w := range bl.bitset {
+		binary.LittleEndian.PutUint64(bloomImEx.FilterSet[i<<3:], w)
 	}
 	data, err := json.Marshal(bloomImEx)
 	if err != nil {
@@ -264,6 +747,50 @@ func (bl Bloom) JSONMarshal() []byte {
 	return data
 }
 
+// JSONMarshalTS
+// Thread safe: Mutex.Lock the bloomfilter for the time of the marshalling
+func (bl *Bloom) JSONMarshalTS() []byte {
+	bl.Mtx.Lock()
+	defer bl.Mtx.Unlock()
+	return bl.JSONMarshal()
+}
+
+// JSONEncode writes the same JSON object as JSONMarshal to w, but streams
+// the base64 of the bitset in small chunks instead of building it in memory,
+// so encoding a filter of several gigabytes costs no extra memory. It holds
+// Mtx for the whole write, so writers using the TS methods wait until it is
+// done; it must not be called with Mtx already held.
+func (bl *Bloom) JSONEncode(w io.Writer) error {
+	bl.Mtx.Lock()
+	defer bl.Mtx.Unlock()
+
+	bw := bufio.NewWriter(w)
+	bw.WriteString(`{"FilterSet":"`)
+	enc := base64.NewEncoder(base64.StdEncoding, bw)
+	var chunk [512 << 3]byte
+	for i := 0; i < len(bl.bitset); i += 512 {
+		words := bl.bitset[i:min(i+512, len(bl.bitset))]
+		for j, word := range words {
+			binary.LittleEndian.PutUint64(chunk[j<<3:], word)
+		}
+		if _, err := enc.Write(chunk[:len(words)<<3]); err != nil {
+			return err
+		}
+	}
+	if err := enc.Close(); err != nil {
+		return err
+	}
+	fmt.Fprintf(bw, `","SetLocs":%d`, bl.setLocs)
+	if bl.shift != 64-bl.sizeExp {
+		fmt.Fprintf(bw, `,"Shift":%d`, bl.shift)
+	}
+	if bl.HashFunc != SipHash {
+		fmt.Fprintf(bw, `,"Hash":%q`, bl.HashFunc)
+	}
+	bw.WriteString("}")
+	return bw.Flush()
+}
+
 // // alternative hashFn
 // func (bl Bloom) fnv64a(b *[]byte) (l, h uint64) {
 // 	h64 := fnv.New64a()
@@ -292,7 +819,10 @@ func (bl Bloom) JSONMarshal() []byte {
 func (bl *Bloom) BinaryMarshal(w io.Writer) error {
 	// Save main config fields
 	// Order: sizeExp, size, setLocs, shift, ElemNum, bitset length, then bitset
-	if err := binary.Write(w, binary.LittleEndian, bl.sizeExp); err != nil {
+	// The hash is kept in the top byte of sizeExp, which is otherwise at most
+	// 64, so SipHash filters are written exactly as before hashes could be
+	// chosen. Older versions misread filters with any other hash.
+	if err := binary.Write(w, binary.LittleEndian, bl.sizeExp|uint64(bl.HashFunc)<<56); err != nil {
 		return err
 	}
 	if err := binary.Write(w, binary.LittleEndian, bl.size); err != nil {
@@ -319,29 +849,46 @@ func (bl *Bloom) BinaryMarshal(w io.Writer) error {
 func BinaryUnmarshal(r io.Reader) (Bloom, error) {
 	bl := Bloom{
 		Mtx: &sync.Mutex{},
+		ops: &opCounters{},
 	}
-	if err := binary.Read(r, binary.LittleEndian, &bl.sizeExp); err != nil {
-		return bl, err
-	}
-	if err := binary.Read(r, binary.LittleEndian, &bl.size); err != nil {
-		return bl, err
-	}
-	if err := binary.Read(r, binary.LittleEndian, &bl.setLocs); err != nil {
-		return bl, err
-	}
-	if err := binary.Read(r, binary.LittleEndian, &bl.shift); err != nil {
-		return bl, err
-	}
-	if err := binary.Read(r, binary.LittleEndian, &bl.ElemNum); err != nil {
-		return bl, err
-	}
-	var length uint64
-	if err := binary.Read(r, binary.LittleEndian, &length); err != nil {
+	hdr, err := ReadBinaryHeader(r)
+	if err != nil {
 		return bl, err
 	}
+	bl.sizeExp, bl.size, bl.setLocs, bl.shift = hdr.SizeExp, hdr.Size, hdr.SetLocs, hdr.Shift
+	bl.ElemNum, bl.HashFunc = hdr.ElemNum, hdr.Hash
+	length := hdr.Words
 	bl.bitset = make([]uint64, length)
 	if err := binary.Read(r, binary.LittleEndian, bl.bitset); err != nil {
 		return bl, err
 	}
 	return bl, nil
 }
+
+// MarshalText implements encoding.TextMarshaler: the BinaryMarshal form of
+// the filter in standard base64, so a small filter can be embedded in a
+// config file or an environment variable, or sit in a JSON or YAML struct
+// field. The text is 4/3 of the binary size, about size/6 bytes for a filter
+// of size bits (170 KiB for a million bits), so keep it to small filters.
+func (bl Bloom) MarshalText() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := base64.NewEncoder(base64.StdEncoding, &buf)
+	if err := bl.BinaryMarshal(enc); err != nil {
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler for the form written by
+// MarshalText, replacing the filter with the decoded one.
+func (bl *Bloom) UnmarshalText(text []byte) error {
+	dec, err := BinaryUnmarshal(base64.NewDecoder(base64.StdEncoding, bytes.NewReader(text)))
+	if err != nil {
+		return fmt.Errorf("bbloom: decoding text filter: %w", err)
+	}
+	*bl = dec
+	return nil
+}
@@ -0,0 +1,533 @@
+package bbloom
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fill adds the entries key-0 to key-(n-1) to bl.
+func fill(bl *Bloom, n int) {
+	for i := range n {
+		bl.Add(fmt.Appendf(nil, "key-%d", i))
+	}
+}
+
+func TestNamespaceKeepsValuesApart(t *testing.T) {
+	a := New(1000, 0.001)
+	a.Namespace = []byte("a:")
+	b := New(1000, 0.001)
+	b.Namespace = []byte("b:")
+	a.Add([]byte("value"))
+	b.Add([]byte("value"))
+	if a.Equal(&b) {
+		t.Fatal("the same value set the same bits under different namespaces")
+	}
+	if !a.Has([]byte("value")) {
+		t.Fatal("value missing under its own namespace")
+	}
+
+	// One filter shared by both namespaces, as with a state file reused
+	// across runs with a different -namespace each.
+	shared := New(1000, 0.001)
+	shared.Namespace = []byte("a:")
+	shared.Add([]byte("value"))
+	shared.Namespace = []byte("b:")
+	if shared.Has([]byte("value")) {
+		t.Fatal("value added under namespace a: is present under b:")
+	}
+	if !shared.AddIfNotHas([]byte("value")) {
+		t.Fatal("value under namespace b: was not added")
+	}
+}
+
+func TestProbeMatchesAnalyticRate(t *testing.T) {
+	bl := New(10000, 0.01)
+	// Twice the design load, for a rate high enough to measure closely.
+	const n = 20000
+	fill(&bl, n)
+	want := bl.ExpectedFPR(n)
+	got := bl.Probe(200000, 1)
+	if math.Abs(got-want) > 0.15*want {
+		t.Errorf("probed FPR %g, analytic %g", got, want)
+	}
+	if empty := New(10000, 0.01); empty.Probe(10000, 1) != 0 {
+		t.Error("an empty filter reported a probe as present")
+	}
+}
+
+func TestConfidenceFallsAsFilterFills(t *testing.T) {
+	bl := New(1000, 0.01)
+	probe := []byte("key-0")
+	bl.Add(probe)
+	prev := 2.0
+	for step := range 5 {
+		fill(&bl, 1000*(step+1))
+		has, conf := bl.HasWithConfidence(probe)
+		if !has {
+			t.Fatal("added entry reported absent")
+		}
+		if conf >= prev {
+			t.Fatalf("confidence %g after %d entries, not below %g before", conf, 1000*(step+1), prev)
+		}
+		prev = conf
+	}
+	// An absent answer is certain; a saturated filter may say present.
+	if has, conf := bl.HasWithConfidence([]byte("never added")); !has && conf != 1 {
+		t.Errorf("absent entry: confidence %g, want 1", conf)
+	}
+}
+
+func TestEqualAndHammingDistance(t *testing.T) {
+	a, b := New(1000, 0.01), New(1000, 0.01)
+	fill(&a, 500)
+	fill(&b, 500)
+	if !a.Equal(&b) || a.HammingDistance(&b) != 0 {
+		t.Fatal("filters built from the same keys differ")
+	}
+
+	other := New(4000, 0.01)
+	fill(&other, 500)
+	if a.Equal(&other) {
+		t.Error("filters of different sizes reported equal")
+	}
+	locs := New(1000, 3)
+	if a.Equal(&locs) {
+		t.Error("filters with different hash locations reported equal")
+	}
+
+	for idx := uint64(0); idx <= b.size; idx++ {
+		if !b.isSet(idx) {
+			b.set(idx)
+			break
+		}
+	}
+	if a.Equal(&b) {
+		t.Error("filters one bit apart reported equal")
+	}
+	if d := a.HammingDistance(&b); d != 1 {
+		t.Errorf("Hamming distance %d, want 1", d)
+	}
+}
+
+func TestNewFromBufferWritesIntoBuffer(t *testing.T) {
+	buf := make([]uint64, 1024)
+	bl, err := NewFromBuffer(buf, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bl.Add([]byte("entry"))
+	set := 0
+	for _, w := range buf {
+		set += bits.OnesCount64(w)
+	}
+	if set == 0 || set > 4 {
+		t.Fatalf("Add set %d bits in the caller's buffer, want 1 to 4", set)
+	}
+	if !bl.Has([]byte("entry")) {
+		t.Fatal("entry missing")
+	}
+	// A filter over a copy of the buffer sees the same entry.
+	cp, _ := NewFromBuffer(append([]uint64(nil), buf...), 4)
+	if !cp.Has([]byte("entry")) {
+		t.Error("entry missing from a filter over a copy of the buffer")
+	}
+
+	for _, n := range []int{0, 7, 12} {
+		if _, err := NewFromBuffer(make([]uint64, n), 4); err == nil {
+			t.Errorf("buffer of %d words accepted", n)
+		}
+	}
+	if _, err := NewFromBuffer(buf, 0); err == nil {
+		t.Error("0 hash locations accepted")
+	}
+}
+
+func TestMetricsCountOperations(t *testing.T) {
+	bl := New(1000, 0.01)
+	fill(&bl, 500)
+	for i := range 300 {
+		bl.Has(fmt.Appendf(nil, "key-%d", i))
+	}
+	m := bl.Metrics()
+	if m.Adds != 500 || m.Queries != 300 {
+		t.Errorf("Adds %d, Queries %d; want 500 and 300", m.Adds, m.Queries)
+	}
+	if m.SizeBits != bl.size+1 || m.HashLocs != bl.setLocs {
+		t.Errorf("SizeBits %d, HashLocs %d; want %d and %d", m.SizeBits, m.HashLocs, bl.size+1, bl.setLocs)
+	}
+	if m.FillRatio != bl.FillRatio() || m.FillRatio == 0 {
+		t.Errorf("FillRatio %g, want %g", m.FillRatio, bl.FillRatio())
+	}
+
+	bl.PublishExpvar("bbloom_test_metrics")
+	var published BloomMetrics
+	if err := json.Unmarshal([]byte(expvar.Get("bbloom_test_metrics").String()), &published); err != nil {
+		t.Fatal(err)
+	}
+	if published.Adds != 500 {
+		t.Errorf("expvar Adds %d, want 500", published.Adds)
+	}
+}
+
+func TestBoolsetMatchesBitset(t *testing.T) {
+	src := New(4096, 0.01)
+	fill(&src, 300)
+	words := src.Snapshot()
+	bs := make([]byte, 0, len(words)*8)
+	for _, w := range words {
+		bs = binary.LittleEndian.AppendUint64(bs, w)
+	}
+	fromBytes := NewWithBoolset(&bs, src.setLocs)
+	fromWords := NewWithBitset(words, src.setLocs)
+	if !fromBytes.Equal(&fromWords) || !fromBytes.Equal(&src) {
+		t.Fatal("NewWithBoolset and NewWithBitset built different filters from the same bits")
+	}
+	// The bytes are little-endian words whatever the machine, so the JSON
+	// export, which goes through NewWithBoolset, round-trips.
+	js := JSONUnmarshal(src.JSONMarshal())
+	if !js.Equal(&src) {
+		t.Fatal("JSON round trip changed the filter")
+	}
+}
+
+func TestHasProfile(t *testing.T) {
+	bl := New(1000, 0.01)
+	fill(&bl, 1000)
+	for i := range 1000 {
+		has, checked := bl.HasProfile(fmt.Appendf(nil, "key-%d", i))
+		if !has || checked != bl.setLocs {
+			t.Fatalf("added key: has %v after %d checks, want true after %d", has, checked, bl.setLocs)
+		}
+	}
+	for i := range 1000 {
+		key := fmt.Appendf(nil, "absent-%d", i)
+		has, checked := bl.HasProfile(key)
+		if has != bl.Has(key) {
+			t.Fatalf("HasProfile and Has disagree on %s", key)
+		}
+		if !has && (checked < 1 || checked > bl.setLocs) {
+			t.Fatalf("absent key: %d checks, want 1 to %d", checked, bl.setLocs)
+		}
+	}
+}
+
+// hitRateKeys returns n keys of which the share hit were added to bl.
+func hitRateKeys(bl *Bloom, n int, hit float64) [][]byte {
+	keys := make([][]byte, n)
+	for i := range keys {
+		if float64(i) < hit*float64(n) {
+			keys[i] = fmt.Appendf(nil, "key-%d", i)
+		} else {
+			keys[i] = fmt.Appendf(nil, "absent-%d", i)
+		}
+	}
+	return keys
+}
+
+// BenchmarkHasEarlyExit compares Has, which always checks every hash
+// location, with the early-exit HasProfile at several hit rates.
+func BenchmarkHasEarlyExit(b *testing.B) {
+	const n = 1 << 16
+	bl := New(n, 0.01)
+	fill(&bl, n)
+	for _, hit := range []float64{0, 0.5, 0.9, 1} {
+		keys := hitRateKeys(&bl, n, hit)
+		b.Run(fmt.Sprintf("hit=%g/full", hit), func(b *testing.B) {
+			for i := range b.N {
+				bl.Has(keys[i%n])
+			}
+		})
+		b.Run(fmt.Sprintf("hit=%g/early", hit), func(b *testing.B) {
+			for i := range b.N {
+				bl.HasProfile(keys[i%n])
+			}
+		})
+	}
+}
+
+func TestHalveKeepsMembership(t *testing.T) {
+	bl := New(1<<14, 0.01)
+	fill(&bl, 2000)
+	for range 3 {
+		size := bl.size + 1
+		if err := bl.Halve(); err != nil {
+			t.Fatal(err)
+		}
+		if bl.size+1 != size/2 {
+			t.Fatalf("size %d after halving %d", bl.size+1, size)
+		}
+		for i := range 2000 {
+			if !bl.Has(fmt.Appendf(nil, "key-%d", i)) {
+				t.Fatalf("key-%d lost after halving to %d bits", i, bl.size+1)
+			}
+		}
+	}
+	// The halved geometry survives serialization.
+	var buf bytes.Buffer
+	if err := bl.BinaryMarshal(&buf); err != nil {
+		t.Fatal(err)
+	}
+	back, err := BinaryUnmarshal(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !back.Has([]byte("key-0")) || !back.Equal(&bl) {
+		t.Error("halved filter changed in a binary round trip")
+	}
+
+	small := New(MinSize, 3)
+	if err := small.Halve(); err == nil {
+		t.Error("halving a filter of MinSize bits succeeded")
+	}
+}
+
+func TestConstructorsValidate(t *testing.T) {
+	for _, fpr := range []float64{0, 1, -0.1, 1.5, math.NaN()} {
+		if _, err := NewWithFPR(1000, fpr); err == nil {
+			t.Errorf("NewWithFPR accepted rate %v", fpr)
+		}
+		if _, err := NewWithFPRRoundDown(1000, fpr); err == nil {
+			t.Errorf("NewWithFPRRoundDown accepted rate %v", fpr)
+		}
+	}
+	for _, n := range []float64{0, 0.5, -1, math.NaN()} {
+		if _, err := NewWithFPR(n, 0.01); err == nil {
+			t.Errorf("NewWithFPR accepted %v entries", n)
+		}
+	}
+	for _, locs := range []float64{0, 1.5, -2} {
+		if _, err := NewWithLocs(1000, locs); err == nil {
+			t.Errorf("NewWithLocs accepted %v locations", locs)
+		}
+	}
+	// Just inside the bounds works.
+	for _, fpr := range []float64{1e-9, 0.999} {
+		bl, err := NewWithFPR(1000, fpr)
+		if err != nil {
+			t.Errorf("NewWithFPR rejected rate %v: %v", fpr, err)
+			continue
+		}
+		bl.Add([]byte("entry"))
+		if !bl.Has([]byte("entry")) {
+			t.Errorf("rate %v: entry missing", fpr)
+		}
+	}
+	// New keeps its overloaded meaning: 1 is one hash location.
+	if bl := New(1000, 1); bl.setLocs != 1 {
+		t.Errorf("New(1000, 1) has %d hash locations, want 1", bl.setLocs)
+	}
+}
+
+func TestJSONEncodeRoundTrips(t *testing.T) {
+	halved := New(1<<16, 0.01)
+	fill(&halved, 1000)
+	if err := halved.Halve(); err != nil {
+		t.Fatal(err)
+	}
+	murmur := New(1<<16, 0.01)
+	murmur.HashFunc = Murmur3
+	fill(&murmur, 1000)
+	plain := New(1<<16, 0.01)
+	fill(&plain, 1000)
+	for name, bl := range map[string]*Bloom{"plain": &plain, "halved": &halved, "murmur3": &murmur} {
+		var buf bytes.Buffer
+		if err := bl.JSONEncode(&buf); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf.Bytes(), bl.JSONMarshal()) {
+			t.Errorf("%s: JSONEncode and JSONMarshal differ", name)
+		}
+		back := JSONUnmarshal(buf.Bytes())
+		if !back.Equal(bl) {
+			t.Errorf("%s: filter changed in a JSONEncode round trip", name)
+		}
+	}
+
+	// JSONMarshalTS and JSONEncode lock out concurrent writers.
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := range 5000 {
+			plain.AddTS(fmt.Appendf(nil, "more-%d", i))
+		}
+	}()
+	for range 20 {
+		if back := JSONUnmarshal(plain.JSONMarshalTS()); !back.Has([]byte("key-0")) {
+			t.Fatal("key-0 missing from a snapshot taken during adds")
+		}
+		plain.JSONEncode(io.Discard)
+	}
+	wg.Wait()
+}
+
+func TestTextRoundTrip(t *testing.T) {
+	bl := New(2048, 0.01)
+	fill(&bl, 100)
+	text, err := bl.MarshalText()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var back Bloom
+	if err := back.UnmarshalText(text); err != nil {
+		t.Fatal(err)
+	}
+	if !back.Equal(&bl) {
+		t.Fatal("filter changed in a text round trip")
+	}
+	if err := back.UnmarshalText([]byte("not base64!")); err == nil {
+		t.Error("invalid text accepted")
+	}
+
+	// As a struct field, the filter is a string in JSON (and in YAML, whose
+	// libraries use the same encoding.TextMarshaler interface).
+	type config struct {
+		Name   string
+		Filter Bloom
+	}
+	data, err := json.Marshal(config{Name: "allow", Filter: bl})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var raw map[string]any
+	json.Unmarshal(data, &raw)
+	if _, ok := raw["Filter"].(string); !ok {
+		t.Fatalf("filter field encoded as %T, want a string", raw["Filter"])
+	}
+	var cfg config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		t.Fatal(err)
+	}
+	if !cfg.Filter.Equal(&bl) || !cfg.Filter.Has([]byte("key-0")) {
+		t.Error("filter changed in a JSON struct field round trip")
+	}
+}
+
+func TestRoundDownSizes(t *testing.T) {
+	// At p 0.01 an entry needs 9.59 bits, so 2^20 bits hold 109396.
+	tests := []struct {
+		entries  float64
+		up, down uint64
+	}{
+		{109000, 1 << 20, 1 << 19},
+		{110000, 1 << 21, 1 << 20},
+	}
+	for _, tt := range tests {
+		up, err := NewWithFPR(tt.entries, 0.01)
+		if err != nil {
+			t.Fatal(err)
+		}
+		down, err := NewWithFPRRoundDown(tt.entries, 0.01)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := up.Metrics().SizeBits; got != tt.up {
+			t.Errorf("%g entries rounded up: %d bits, want %d", tt.entries, got, tt.up)
+		}
+		if got := down.Metrics().SizeBits; got != tt.down {
+			t.Errorf("%g entries rounded down: %d bits, want %d", tt.entries, got, tt.down)
+		}
+		if down.ExpectedFPR(tt.entries) <= 0.01 {
+			t.Errorf("%g entries rounded down: expected FPR %g, want above the target", tt.entries, down.ExpectedFPR(tt.entries))
+		}
+		if up.ExpectedFPR(tt.entries) > 0.01 {
+			t.Errorf("%g entries rounded up: expected FPR %g, want at most the target", tt.entries, up.ExpectedFPR(tt.entries))
+		}
+	}
+}
+
+func TestTinyFiltersUseMinSize(t *testing.T) {
+	for _, build := range []func() (Bloom, error){
+		func() (Bloom, error) { return NewWithFPR(10, 0.01) },
+		func() (Bloom, error) { return NewWithFPRRoundDown(10, 0.01) },
+		func() (Bloom, error) { return NewWithLocs(10, 3) },
+		func() (Bloom, error) { return New(10, 0.01), nil },
+	} {
+		bl, err := build()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := bl.Metrics().SizeBits; got != MinSize {
+			t.Errorf("filter for 10 entries has %d bits, want MinSize (%d)", got, MinSize)
+		}
+		fill(&bl, 10)
+		for i := range 10 {
+			if !bl.Has(fmt.Appendf(nil, "key-%d", i)) {
+				t.Fatalf("key-%d missing from a tiny filter", i)
+			}
+		}
+	}
+}
+
+func TestImpossibleSizeIsDescriptive(t *testing.T) {
+	_, err := NewWithFPR(1e15, 1e-9)
+	if err == nil {
+		t.Fatal("NewWithFPR built a filter of petabytes")
+	}
+	for _, want := range []string{"PiB", "1e+15 entries", "reduce the entries or raise the rate"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not mention %q", err, want)
+		}
+	}
+	if _, err := NewWithFPRRoundDown(1e15, 1e-9); err == nil {
+		t.Error("NewWithFPRRoundDown built a filter of petabytes")
+	}
+	if _, err := NewWithLocs(1<<41, 3); err == nil || !strings.Contains(err.Error(), "reduce its size") {
+		t.Errorf("NewWithLocs over MaxSize: %v", err)
+	}
+
+	// A filter over the memory limit is refused before it is allocated.
+	defer debug.SetMemoryLimit(debug.SetMemoryLimit(1 << 20))
+	if _, err := NewWithFPR(1e7, 0.01); err == nil || !strings.Contains(err.Error(), "memory limit") {
+		t.Errorf("16 MiB filter under a 1 MiB memory limit: %v", err)
+	}
+	if _, err := NewWithFPR(1000, 0.01); err != nil {
+		t.Errorf("small filter under a 1 MiB memory limit: %v", err)
+	}
+}
+
+func TestRemainingCapacity(t *testing.T) {
+	const target = 0.01
+	bl, err := NewWithFPR(10000, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fill(&bl, 3000)
+	remaining := bl.RemainingCapacity(target)
+	if remaining <= 0 {
+		t.Fatalf("remaining capacity %d of a partly filled filter", remaining)
+	}
+	// Add that many more and the estimate lands at the target.
+	for i := range remaining {
+		bl.Add(fmt.Appendf(nil, "more-%d", i))
+	}
+	if fpr := bl.EstimatedFPR(); math.Abs(fpr-target)/target > 0.05 {
+		t.Errorf("estimated FPR %g after adding the %d remaining, want about %g", fpr, remaining, target)
+	}
+	if left := bl.RemainingCapacity(target); math.Abs(float64(left)) > float64(remaining)/100 {
+		t.Errorf("remaining capacity %d after filling to the target, want about 0", left)
+	}
+
+	// Past the target it is negative; a looser target leaves room.
+	fill(&bl, 30000)
+	if left := bl.RemainingCapacity(target); left >= 0 {
+		t.Errorf("remaining capacity %d past the target, want negative", left)
+	}
+	if left := bl.RemainingCapacity(0.5); left <= 0 {
+		t.Errorf("remaining capacity %d at rate 0.5, want room", left)
+	}
+	empty := New(10000, target)
+	if got, want := empty.RemainingCapacity(target), int64(empty.Capacity(target)); math.Abs(float64(got-want)) > float64(want)/50 {
+		t.Errorf("empty filter: remaining capacity %d, want about its capacity %d", got, want)
+	}
+}
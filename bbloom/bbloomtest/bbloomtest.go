@@ -0,0 +1,80 @@
+// Package bbloomtest implements support for testing code that uses bbloom
+// filters. It does not import testing, so it can also be used to check
+// filters outside tests, for instance after loading one in production.
+package bbloomtest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+
+	"github.com/mylh/bdedup/bbloom"
+)
+
+// GenerateRandom returns n random keys of 8 to 40 bytes. The same seed always
+// yields the same keys. Keys are drawn independently, so duplicates are
+// possible but, at these lengths, vanishingly unlikely.
+func GenerateRandom(n int, seed int64) [][]byte {
+	rng := rand.New(rand.NewSource(seed))
+	keys := make([][]byte, n)
+	for i := range keys {
+		key := make([]byte, 8+rng.Intn(33))
+		rng.Read(key)
+		keys[i] = key
+	}
+	return keys
+}
+
+// VerifyNoFalseNegatives returns an error unless bl reports every key in keys
+// as present. A Bloom filter never forgets a key it was given, so after
+// adding keys to bl, any error means it was corrupted, for instance by a
+// serialization round trip.
+func VerifyNoFalseNegatives(bl *bbloom.Bloom, keys [][]byte) error {
+	missing, first := 0, -1
+	for i, key := range keys {
+		if !bl.Has(key) {
+			if first < 0 {
+				first = i
+			}
+			missing++
+		}
+	}
+	if missing > 0 {
+		return fmt.Errorf("bbloomtest: %d of %d keys missing, first key %d (%x)", missing, len(keys), first, keys[first])
+	}
+	return nil
+}
+
+// RoundTrips returns copies of bl decoded from each of its serialized forms
+// (binary, JSON and text), keyed by the name of the form, so a test can
+// check each with VerifyNoFalseNegatives.
+func RoundTrips(bl *bbloom.Bloom) (map[string]*bbloom.Bloom, error) {
+	var buf bytes.Buffer
+	if err := bl.BinaryMarshal(&buf); err != nil {
+		return nil, fmt.Errorf("bbloomtest: binary marshal: %w", err)
+	}
+	bin, err := bbloom.BinaryUnmarshal(&buf)
+	if err != nil {
+		return nil, fmt.Errorf("bbloomtest: binary unmarshal: %w", err)
+	}
+
+	buf.Reset()
+	if err := bl.JSONEncode(&buf); err != nil {
+		return nil, fmt.Errorf("bbloomtest: JSON encode: %w", err)
+	}
+	if !json.Valid(buf.Bytes()) {
+		return nil, fmt.Errorf("bbloomtest: JSON encode produced invalid JSON")
+	}
+	js := bbloom.JSONUnmarshal(buf.Bytes())
+
+	text, err := bl.MarshalText()
+	if err != nil {
+		return nil, fmt.Errorf("bbloomtest: text marshal: %w", err)
+	}
+	var txt bbloom.Bloom
+	if err := txt.UnmarshalText(text); err != nil {
+		return nil, fmt.Errorf("bbloomtest: text unmarshal: %w", err)
+	}
+	return map[string]*bbloom.Bloom{"binary": &bin, "json": &js, "text": &txt}, nil
+}
@@ -0,0 +1,65 @@
+package bbloomtest
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/mylh/bdedup/bbloom"
+)
+
+// minMeasure is how long Measure runs each operation at least, repeating
+// passes over the keys, so that timer resolution and warm-up are noise.
+const minMeasure = 200 * time.Millisecond
+
+// Timings is the mean cost of one call of each hot-path method, as measured
+// by Measure.
+type Timings struct {
+	Add, Has, AddTS, HasTS time.Duration
+}
+
+// GenerateSized returns n random keys of exactly size bytes, for measuring
+// how costs grow with the key length. The same seed always yields the same
+// keys.
+func GenerateSized(n, size int, seed int64) [][]byte {
+	rng := rand.New(rand.NewSource(seed))
+	keys := make([][]byte, n)
+	for i := range keys {
+		keys[i] = make([]byte, size)
+		rng.Read(keys[i])
+	}
+	return keys
+}
+
+// Measure times Add, Has, AddTS and HasTS of bl over keys, in that order,
+// each in passes over all of keys until it has run for at least 200ms. Has
+// and HasTS therefore look up keys that are present. bl is modified.
+//
+// Measure does not import testing, so it serves as a baseline outside go
+// test too: run it on the machine and key sizes in use, keep the result,
+// and compare after changing the filter code or its hash. The timings
+// include reading keys from memory, so keys should be many more than fit in
+// cache if the filter will see a large working set.
+func Measure(bl *bbloom.Bloom, keys [][]byte) Timings {
+	if len(keys) == 0 {
+		return Timings{}
+	}
+	return Timings{
+		Add:   measure(keys, bl.Add),
+		Has:   measure(keys, func(k []byte) { bl.Has(k) }),
+		AddTS: measure(keys, bl.AddTS),
+		HasTS: measure(keys, func(k []byte) { bl.HasTS(k) }),
+	}
+}
+
+// measure returns the mean time of op over keys.
+func measure(keys [][]byte, op func([]byte)) time.Duration {
+	var calls int
+	start := time.Now()
+	for time.Since(start) < minMeasure {
+		for _, k := range keys {
+			op(k)
+		}
+		calls += len(keys)
+	}
+	return time.Since(start) / time.Duration(calls)
+}
@@ -0,0 +1,70 @@
+package bbloom_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/mylh/bdedup/bbloom"
+	"github.com/mylh/bdedup/bbloom/bbloomtest"
+)
+
+// benchKeySizes are the key lengths the README gives ns/op ranges for.
+var benchKeySizes = []int{16, 64, 256, 1024}
+
+const benchKeys = 1 << 16
+
+// benchmarkOp runs op over benchKeys keys of each size against a 1M-entry
+// filter; fill adds the keys first, for lookups that hit.
+func benchmarkOp(b *testing.B, fill bool, op func(bl *bbloom.Bloom, key []byte)) {
+	for _, size := range benchKeySizes {
+		b.Run(fmt.Sprintf("key=%d", size), func(b *testing.B) {
+			keys := bbloomtest.GenerateSized(benchKeys, size, 1)
+			bl := bbloom.New(1e6, 0.001)
+			if fill {
+				for _, k := range keys {
+					bl.Add(k)
+				}
+			}
+			b.SetBytes(int64(size))
+			b.ResetTimer()
+			for i := range b.N {
+				op(&bl, keys[i%benchKeys])
+			}
+		})
+	}
+}
+
+func BenchmarkAdd(b *testing.B) {
+	benchmarkOp(b, false, (*bbloom.Bloom).Add)
+}
+
+func BenchmarkHas(b *testing.B) {
+	benchmarkOp(b, true, func(bl *bbloom.Bloom, key []byte) { bl.Has(key) })
+}
+
+func BenchmarkAddTS(b *testing.B) {
+	benchmarkOp(b, false, (*bbloom.Bloom).AddTS)
+}
+
+func BenchmarkHasTS(b *testing.B) {
+	benchmarkOp(b, true, func(bl *bbloom.Bloom, key []byte) { bl.HasTS(key) })
+}
+
+func TestMeasure(t *testing.T) {
+	keys := bbloomtest.GenerateSized(1000, 64, 1)
+	for _, k := range keys {
+		if len(k) != 64 {
+			t.Fatalf("GenerateSized made a %d-byte key, want 64", len(k))
+		}
+	}
+	bl := bbloom.New(1e4, 0.01)
+	tm := bbloomtest.Measure(&bl, keys)
+	if tm.Add <= 0 || tm.Has <= 0 || tm.AddTS <= 0 || tm.HasTS <= 0 {
+		t.Errorf("Measure = %+v, want every timing positive", tm)
+	}
+	for _, k := range keys {
+		if !bl.Has(k) {
+			t.Fatalf("key %x missing after Measure", k)
+		}
+	}
+}
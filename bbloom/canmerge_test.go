@@ -0,0 +1,63 @@
+package bbloom
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCanMergeWith(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(bl *Bloom)
+		want   []string
+		// header is whether BinaryHeader.Compatible sees the mismatch too.
+		header bool
+	}{
+		{"identical", func(*Bloom) {}, nil, false},
+		// The hash split follows the size.
+		{"size", func(bl *Bloom) { *bl = New(1<<17, 4) }, []string{"filter sizes differ (65536 and 131072 bits)", "hash splits differ (shift 48 and 47)"}, true},
+		{"locations", func(bl *Bloom) { *bl = New(1<<16, 7) }, []string{"hash locations differ (4 and 7)"}, true},
+		{"hash", func(bl *Bloom) { bl.HashFunc = XXHash }, []string{"hashes differ (siphash and xxhash)"}, true},
+		{"shift", func(bl *Bloom) { bl.shift-- }, []string{"hash splits differ (shift 48 and 47)"}, true},
+		{"sipkey", func(bl *Bloom) { bl.SipKey = &SipKey{1, 2} }, []string{"SipHash keys differ"}, false},
+		{"namespace", func(bl *Bloom) { bl.Namespace = []byte("b:") }, []string{`namespaces differ ("" and "b:")`}, false},
+		{"several", func(bl *Bloom) {
+			*bl = New(1<<16, 7)
+			bl.HashFunc = XXHash
+			bl.Namespace = []byte("b:")
+		}, []string{"hash locations differ", "hashes differ", "namespaces differ"}, true},
+	}
+	for _, tt := range tests {
+		bl, other := New(1<<16, 4), New(1<<16, 4)
+		tt.change(&other)
+		ok, why := bl.CanMergeWith(&other)
+		if ok != (len(tt.want) == 0) {
+			t.Errorf("%s: CanMergeWith = %v (%q)", tt.name, ok, why)
+			continue
+		}
+		if ok && why != "" {
+			t.Errorf("%s: compatible filters give reason %q", tt.name, why)
+		}
+		parts := strings.Split(why, "; ")
+		if !ok && len(parts) != len(tt.want) {
+			t.Errorf("%s: reason %q, want %d mismatches", tt.name, why, len(tt.want))
+			continue
+		}
+		for i, want := range tt.want {
+			if !strings.HasPrefix(parts[i], want) {
+				t.Errorf("%s: reason %q, want it to start with %q", tt.name, parts[i], want)
+			}
+		}
+		if err := bl.header().Compatible(other.header()); (err != nil) != tt.header {
+			t.Errorf("%s: BinaryHeader.Compatible = %v", tt.name, err)
+		}
+	}
+
+	// The SipKey only matters to SipHash filters.
+	bl, other := New(1<<16, 4), New(1<<16, 4)
+	bl.HashFunc, other.HashFunc = XXHash, XXHash
+	other.SipKey = &SipKey{1, 2}
+	if ok, why := bl.CanMergeWith(&other); !ok {
+		t.Errorf("xxhash filters with different SipKeys: %s", why)
+	}
+}
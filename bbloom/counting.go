@@ -0,0 +1,170 @@
+package bbloom
+
+import (
+	"log"
+	"math"
+	"sync"
+)
+
+// CountingBloom is a Bloom filter with an 8-bit counter in place of each bit,
+// so entries can be removed as well as added. It counts references: Add and
+// Touch each add one, Remove drops one, and an entry is present while any of
+// its references are live. A sliding-window or TTL manager records when each
+// Add or Touch happened and calls Remove once that reference leaves the
+// window, so touching a key keeps it alive for another window.
+//
+// Counters saturate at 255 and are never decremented again after that, so a
+// cell shared by very many references stays set instead of wrapping to zero
+// and causing false negatives. Removing an entry that was never added (or
+// removing one more time than it was referenced) decrements cells that belong
+// to other entries, which can make them disappear; only remove what was added.
+type CountingBloom struct {
+	Mtx *sync.Mutex
+	// ElemNum counts the entries added as new: Touch and references added
+	// to present entries do not count, Remove does not subtract.
+	ElemNum  uint64
+	counters []uint8
+	sizeExp  uint64
+	size     uint64
+	setLocs  uint64
+	shift    uint64
+}
+
+// NewCounting
+// returns a new counting bloomfilter; params are the same as for New. It
+// takes eight times the memory of a Bloom of the same size.
+func NewCounting(params ...float64) (bloomfilter CountingBloom) {
+	var entries, locs uint64
+	if len(params) == 2 {
+		if params[1] < 1 {
+			entries, locs = calcSizeByWrongPositives(params[0], params[1])
+		} else {
+			entries, locs = uint64(params[0]), uint64(params[1])
+		}
+	} else {
+		log.Fatal("usage: NewCounting(float64(number_of_entries), float64(number_of_hashlocations)) i.e. NewCounting(float64(1000), float64(3)) or NewCounting(float64(number_of_entries), float64(number_of_hashlocations)) i.e. NewCounting(float64(1000), float64(0.03))")
+	}
+	size, exponent := getSize(entries)
+	return CountingBloom{
+		Mtx:      &sync.Mutex{},
+		counters: make([]uint8, size),
+		sizeExp:  exponent,
+		size:     size - 1,
+		setLocs:  max(locs, 1),
+		shift:    64 - exponent,
+	}
+}
+
+func (cb *CountingBloom) hash(entry []byte) (l, h uint64) {
+	hash := sipHash64(entry)
+	h = hash >> cb.shift
+	l = hash << cb.shift >> cb.shift
+	return l, h
+}
+
+// Add
+// adds a reference to entry, making it present
+func (cb *CountingBloom) Add(entry []byte) {
+	if !cb.Has(entry) {
+		cb.ElemNum++
+	}
+	cb.bump(entry)
+}
+
+// AddTS
+// Thread safe: Mutex.Lock the bloomfilter for the time of processing the entry
+func (cb *CountingBloom) AddTS(entry []byte) {
+	cb.Mtx.Lock()
+	defer cb.Mtx.Unlock()
+	cb.Add(entry)
+}
+
+// Has
+// returns true if entry has a live reference, or is a false positive.
+// Touch never changes the answer, only how many Removes it takes to make it
+// false.
+func (cb *CountingBloom) Has(entry []byte) bool {
+	l, h := cb.hash(entry)
+	for i := uint64(0); i < cb.setLocs; i++ {
+		if cb.counters[(h+i*l)&cb.size] == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// HasTS
+// Thread safe: Mutex.Lock the bloomfilter for the time of processing the entry
+func (cb *CountingBloom) HasTS(entry []byte) bool {
+	cb.Mtx.Lock()
+	defer cb.Mtx.Unlock()
+	return cb.Has(entry)
+}
+
+// Touch adds a reference to entry if it is present, refreshing its lifetime
+// under a window manager, and reports whether it was. Unlike Add it never
+// makes an absent entry present, and it does not count as a new entry.
+func (cb *CountingBloom) Touch(entry []byte) bool {
+	if !cb.Has(entry) {
+		return false
+	}
+	cb.bump(entry)
+	return true
+}
+
+// TouchTS
+// Thread safe: Mutex.Lock the bloomfilter for the time of processing the entry
+func (cb *CountingBloom) TouchTS(entry []byte) bool {
+	cb.Mtx.Lock()
+	defer cb.Mtx.Unlock()
+	return cb.Touch(entry)
+}
+
+// Remove drops one reference to entry and reports whether it was present.
+// The entry stays present until every Add and Touch of it has been removed.
+// An absent entry is left alone.
+func (cb *CountingBloom) Remove(entry []byte) bool {
+	if !cb.Has(entry) {
+		return false
+	}
+	l, h := cb.hash(entry)
+	for i := uint64(0); i < cb.setLocs; i++ {
+		if c := &cb.counters[(h+i*l)&cb.size]; *c < math.MaxUint8 {
+			*c--
+		}
+	}
+	return true
+}
+
+// RemoveTS
+// Thread safe: Mutex.Lock the bloomfilter for the time of processing the entry
+func (cb *CountingBloom) RemoveTS(entry []byte) bool {
+	cb.Mtx.Lock()
+	defer cb.Mtx.Unlock()
+	return cb.Remove(entry)
+}
+
+// References returns an upper bound on the number of live references to
+// entry: the smallest of its counters, which other entries sharing them can
+// only raise. It is 0 for an absent entry and 255 once its counters
+// saturated.
+func (cb *CountingBloom) References(entry []byte) uint8 {
+	l, h := cb.hash(entry)
+	refs := uint8(math.MaxUint8)
+	for i := uint64(0); i < cb.setLocs; i++ {
+		refs = min(refs, cb.counters[(h+i*l)&cb.size])
+	}
+	return refs
+}
+
+// bump increments the counters of entry, saturating at 255. When two of its
+// locations share a counter, it is incremented twice, and Remove decrements
+// it twice, so they stay balanced.
+func (cb *CountingBloom) bump(entry []byte) {
+	l, h := cb.hash(entry)
+	for i := uint64(0); i < cb.setLocs; i++ {
+		if c := &cb.counters[(h+i*l)&cb.size]; *c < math.MaxUint8 {
+			*c++
+		}
+	}
+}
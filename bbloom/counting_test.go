@@ -0,0 +1,61 @@
+package bbloom
+
+import "testing"
+
+func TestTouchKeepsMembership(t *testing.T) {
+	cb := NewCounting(1000, 0.001)
+	key := []byte("key")
+	if cb.Touch(key) {
+		t.Fatal("Touch reported an absent key present")
+	}
+	if cb.Has(key) || cb.References(key) != 0 {
+		t.Fatal("Touch made an absent key present")
+	}
+
+	cb.Add(key)
+	if !cb.Touch(key) || !cb.Touch(key) {
+		t.Fatal("Touch reported an added key absent")
+	}
+	if !cb.Has(key) {
+		t.Fatal("added key missing after Touch")
+	}
+	if cb.ElemNum != 1 {
+		t.Errorf("ElemNum %d after one Add and two Touches, want 1", cb.ElemNum)
+	}
+	if got := cb.References(key); got != 3 {
+		t.Errorf("%d references after one Add and two Touches, want 3", got)
+	}
+
+	// Each Touch takes one more Remove to expire.
+	for i := range 3 {
+		if !cb.Has(key) {
+			t.Fatalf("key expired after %d of 3 Removes", i)
+		}
+		cb.Remove(key)
+	}
+	if cb.Has(key) {
+		t.Error("key present after every reference was removed")
+	}
+	if cb.Remove(key) {
+		t.Error("Remove of an expired key reported it present")
+	}
+}
+
+func TestTouchLeavesOtherKeys(t *testing.T) {
+	cb := NewCounting(1000, 0.001)
+	a, b := []byte("a"), []byte("b")
+	cb.Add(a)
+	cb.Add(b)
+	for range 5 {
+		cb.TouchTS(a)
+	}
+	// b expires on its own schedule while a is kept alive.
+	cb.RemoveTS(b)
+	if cb.HasTS(b) {
+		t.Error("b present after its only reference was removed")
+	}
+	cb.RemoveTS(a)
+	if !cb.HasTS(a) {
+		t.Error("a expired although it was touched")
+	}
+}
@@ -0,0 +1,67 @@
+package bbloom
+
+import (
+	"math"
+	"sync"
+)
+
+// CountMin is a count-min sketch: an approximate frequency table in fixed
+// memory, keyed by the same siphash as the Bloom filter. Estimates never
+// undercount; with probability at least 1-delta they overcount by at most
+// epsilon times the total number of increments.
+type CountMin struct {
+	Mtx    *sync.Mutex
+	width  uint64
+	depth  uint64
+	counts []uint64
+}
+
+// NewCountMin returns a sketch for the given error bound epsilon and failure
+// probability delta. It uses ceil(e/epsilon) * ceil(ln(1/delta)) counters.
+func NewCountMin(epsilon, delta float64) CountMin {
+	width := uint64(math.Ceil(math.E / epsilon))
+	depth := uint64(math.Ceil(math.Log(1 / delta)))
+	return CountMin{
+		Mtx:    &sync.Mutex{},
+		width:  width,
+		depth:  max(depth, 1),
+		counts: make([]uint64, width*max(depth, 1)),
+	}
+}
+
+// Increment records one occurrence of entry and returns its new estimate.
+func (cm *CountMin) Increment(entry []byte) uint64 {
+	est := uint64(math.MaxUint64)
+	cm.each(entry, func(c *uint64) {
+		*c++
+		est = min(est, *c)
+	})
+	return est
+}
+
+// IncrementTS
+// Thread safe: Mutex.Lock the sketch for the time of processing the entry
+func (cm *CountMin) IncrementTS(entry []byte) uint64 {
+	cm.Mtx.Lock()
+	defer cm.Mtx.Unlock()
+	return cm.Increment(entry)
+}
+
+// Count returns the estimated number of occurrences of entry.
+func (cm *CountMin) Count(entry []byte) uint64 {
+	est := uint64(math.MaxUint64)
+	cm.each(entry, func(c *uint64) {
+		est = min(est, *c)
+	})
+	return est
+}
+
+// each calls fn with entry's counter in every row. Row indexes are derived
+// from the two 32-bit halves of one siphash by double hashing.
+func (cm *CountMin) each(entry []byte, fn func(c *uint64)) {
+	hash := sipHash64(entry)
+	h1, h2 := hash&0xffffffff, hash>>32
+	for i := uint64(0); i < cm.depth; i++ {
+		fn(&cm.counts[i*cm.width+(h1+i*h2)%cm.width])
+	}
+}
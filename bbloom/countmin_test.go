@@ -0,0 +1,37 @@
+package bbloom
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+func TestCountMinWithinErrorBound(t *testing.T) {
+	const epsilon, delta = 0.001, 0.01
+	cm := NewCountMin(epsilon, delta)
+	exact := make(map[string]uint64)
+	rng := rand.New(rand.NewSource(1))
+	const total = 100000
+	for range total {
+		// Skewed, so a few keys are frequent and most are rare.
+		key := fmt.Sprintf("key-%d", int(rng.ExpFloat64()*200))
+		exact[key]++
+		cm.Increment([]byte(key))
+	}
+	over := 0
+	for key, n := range exact {
+		est := cm.Count([]byte(key))
+		if est < n {
+			t.Fatalf("%s: estimate %d below the true count %d", key, est, n)
+		}
+		if float64(est-n) > epsilon*total {
+			over++
+		}
+	}
+	if limit := int(delta*float64(len(exact))) + 1; over > limit {
+		t.Errorf("%d of %d keys overcounted by more than %g, want at most %d", over, len(exact), epsilon*total, limit)
+	}
+	if est := cm.Count([]byte("never counted")); float64(est) > epsilon*total {
+		t.Errorf("absent key estimated at %d", est)
+	}
+}
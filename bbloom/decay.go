@@ -0,0 +1,45 @@
+package bbloom
+
+import (
+	"math"
+	"math/bits"
+	"math/rand"
+)
+
+// Decay ages the filter: it clears each set bit independently with
+// probability fraction, so entries fade out gradually instead of all at once
+// on a Clear. Calling it periodically approximates a sliding window without
+// the memory of a CountingBloom: an entry added before d decays survives them
+// with probability (1-fraction)^(d*k) for k hash locations, and recent
+// entries are the likeliest to still be present.
+//
+// This deliberately introduces false negatives: an aged entry that lost any
+// of its bits reports Has false and counts as new again. fraction is clamped
+// to [0, 1]; the same seed clears the same bits of the same filter. ElemNum
+// is scaled by the probability that an entry keeps all of its bits, so it
+// estimates the entries still present.
+func (bl *Bloom) Decay(fraction float64, seed int64) {
+	fraction = min(max(fraction, 0), 1)
+	if fraction == 0 {
+		return
+	}
+	rng := rand.New(rand.NewSource(seed))
+	for i, w := range bl.bitset {
+		for rest := w; rest != 0; rest &= rest - 1 {
+			if rng.Float64() < fraction {
+				w &^= 1 << bits.TrailingZeros64(rest)
+			}
+		}
+		bl.bitset[i] = w
+	}
+	survival := math.Pow(1-fraction, float64(bl.setLocs))
+	bl.ElemNum = uint64(math.Round(float64(bl.ElemNum) * survival))
+}
+
+// DecayTS
+// Thread safe: Mutex.Lock the bloomfilter for the time of the decay
+func (bl *Bloom) DecayTS(fraction float64, seed int64) {
+	bl.Mtx.Lock()
+	defer bl.Mtx.Unlock()
+	bl.Decay(fraction, seed)
+}
@@ -0,0 +1,59 @@
+package bbloom
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestDecayDropsFill(t *testing.T) {
+	for _, fraction := range []float64{0.1, 0.25, 0.5} {
+		bl := New(10000, 0.01)
+		fill(&bl, 10000)
+		before := bl.FillRatio()
+		bl.Decay(fraction, 1)
+		after := bl.FillRatio()
+		// Within a few standard deviations of the binomial.
+		want := before * (1 - fraction)
+		if sd := math.Sqrt(before * fraction * (1 - fraction) / float64(bl.size+1)); math.Abs(after-want) > 5*sd {
+			t.Errorf("decay %g: fill %.4f to %.4f, want about %.4f", fraction, before, after, want)
+		}
+		survival := math.Pow(1-fraction, float64(bl.setLocs))
+		if got, want := float64(bl.ElemNum), 10000*survival; math.Abs(got-want) > 1 {
+			t.Errorf("decay %g: ElemNum %v, want %v", fraction, got, want)
+		}
+	}
+
+	// Entries that kept their bits are present, the others forgotten.
+	bl := New(10000, 0.001)
+	fill(&bl, 10000)
+	bl.Decay(0.3, 2)
+	present := 0
+	for i := range 10000 {
+		if bl.Has(fmt.Appendf(nil, "key-%d", i)) {
+			present++
+		}
+	}
+	if present == 0 || present == 10000 {
+		t.Errorf("%d of 10000 entries present after a decay, want some aged out", present)
+	}
+
+	// The same seed clears the same bits; 0 clears none and 1 all.
+	a, b := New(1000, 0.01), New(1000, 0.01)
+	fill(&a, 1000)
+	fill(&b, 1000)
+	a.Decay(0.5, 7)
+	b.DecayTS(0.5, 7)
+	if !a.Equal(&b) {
+		t.Error("decays with the same seed differ")
+	}
+	before := a.FillRatio()
+	a.Decay(0, 3)
+	if a.FillRatio() != before {
+		t.Error("decay 0 cleared bits")
+	}
+	a.Decay(1.5, 3)
+	if a.FillRatio() != 0 || a.ElemNum != 0 {
+		t.Errorf("decay over 1 left fill %v and %d entries", a.FillRatio(), a.ElemNum)
+	}
+}
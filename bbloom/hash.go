@@ -0,0 +1,187 @@
+package bbloom
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+)
+
+// Hash selects the 64-bit hash a Bloom filter derives its bit locations
+// from. The zero value is SipHash, which every filter used before the hash
+// became selectable.
+type Hash uint8
+
+const (
+	// SipHash is SipHash-2-4 with the package's fixed key, DefaultSipKey,
+	// or a filter's own SipKey.
+	SipHash Hash = iota
+	// Murmur3 is the first 64 bits of MurmurHash3 x64 128 with seed 0, as
+	// most other Bloom filter implementations use it.
+	Murmur3
+	// XXHash is XXH64 with seed 0, the fastest of the three on long values.
+	XXHash
+)
+
+var hashNames = [...]string{SipHash: "siphash", Murmur3: "murmur3", XXHash: "xxhash"}
+
+// String returns the name ParseHash accepts for h.
+func (h Hash) String() string {
+	if int(h) < len(hashNames) {
+		return hashNames[h]
+	}
+	return fmt.Sprintf("Hash(%d)", uint8(h))
+}
+
+// ParseHash returns the hash called name: siphash, murmur3 or xxhash.
+func ParseHash(name string) (Hash, error) {
+	for h, n := range hashNames {
+		if n == name {
+			return Hash(h), nil
+		}
+	}
+	return 0, fmt.Errorf("bbloom: unknown hash %q (known: siphash, murmur3, xxhash)", name)
+}
+
+func (h Hash) valid() bool {
+	return int(h) < len(hashNames)
+}
+
+// Sum64 returns the 64-bit hash of p, as a filter without a SipKey hashes
+// entries. It is stable across runs and platforms, so it can also partition
+// keys.
+func (h Hash) Sum64(p []byte) uint64 {
+	switch h {
+	case Murmur3:
+		return murmur3Hash64(p)
+	case XXHash:
+		return xxHash64(p)
+	}
+	return sipHash64(p)
+}
+
+// hash returns the filter's hash of p split into the halves used for its
+// double hashing.
+func (bl *Bloom) hash(p []byte) (l, h uint64) {
+	return bl.split(bl.sum64(p))
+}
+
+// sum64 returns the filter's hash of p: HashFunc, under SipKey if set.
+func (bl *Bloom) sum64(p []byte) uint64 {
+	if bl.SipKey != nil && bl.HashFunc == SipHash {
+		return bl.SipKey.sum64(p)
+	}
+	return bl.HashFunc.Sum64(p)
+}
+
+// murmur3Hash64 returns the first half of the MurmurHash3 x64 128 digest of
+// p with seed 0.
+func murmur3Hash64(p []byte) uint64 {
+	const (
+		c1 = 0x87c37b91114253d5
+		c2 = 0x4cf5ad432745937f
+	)
+	var h1, h2 uint64
+	n := len(p)
+	for ; len(p) >= 16; p = p[16:] {
+		k1 := binary.LittleEndian.Uint64(p)
+		k2 := binary.LittleEndian.Uint64(p[8:])
+		h1 ^= bits.RotateLeft64(k1*c1, 31) * c2
+		h1 = (bits.RotateLeft64(h1, 27)+h2)*5 + 0x52dce729
+		h2 ^= bits.RotateLeft64(k2*c2, 33) * c1
+		h2 = (bits.RotateLeft64(h2, 31)+h1)*5 + 0x38495ab5
+	}
+	var k1, k2 uint64
+	for i := len(p) - 1; i >= 8; i-- {
+		k2 = k2<<8 | uint64(p[i])
+	}
+	if len(p) > 8 {
+		h2 ^= bits.RotateLeft64(k2*c2, 33) * c1
+	}
+	for i := min(len(p), 8) - 1; i >= 0; i-- {
+		k1 = k1<<8 | uint64(p[i])
+	}
+	if len(p) > 0 {
+		h1 ^= bits.RotateLeft64(k1*c1, 31) * c2
+	}
+	h1 ^= uint64(n)
+	h2 ^= uint64(n)
+	h1 += h2
+	h2 += h1
+	h1 = fmix64(h1)
+	h2 = fmix64(h2)
+	return h1 + h2
+}
+
+func fmix64(k uint64) uint64 {
+	k ^= k >> 33
+	k *= 0xff51afd7ed558ccd
+	k ^= k >> 33
+	k *= 0xc4ceb9fe1a85ec53
+	k ^= k >> 33
+	return k
+}
+
+const (
+	xxPrime1 = 11400714785074694791
+	xxPrime2 = 14029467366897019727
+	xxPrime3 = 1609587929392839161
+	xxPrime4 = 9650029242287828579
+	xxPrime5 = 2870177450012600261
+)
+
+// xxHash64 returns the XXH64 digest of p with seed 0.
+func xxHash64(p []byte) uint64 {
+	n := len(p)
+	var h uint64
+	if n >= 32 {
+		prime1 := uint64(xxPrime1)
+		v1 := prime1 + xxPrime2
+		v2 := uint64(xxPrime2)
+		v3 := uint64(0)
+		v4 := -prime1
+		for ; len(p) >= 32; p = p[32:] {
+			v1 = xxRound(v1, binary.LittleEndian.Uint64(p))
+			v2 = xxRound(v2, binary.LittleEndian.Uint64(p[8:]))
+			v3 = xxRound(v3, binary.LittleEndian.Uint64(p[16:]))
+			v4 = xxRound(v4, binary.LittleEndian.Uint64(p[24:]))
+		}
+		h = bits.RotateLeft64(v1, 1) + bits.RotateLeft64(v2, 7) + bits.RotateLeft64(v3, 12) + bits.RotateLeft64(v4, 18)
+		h = xxMerge(h, v1)
+		h = xxMerge(h, v2)
+		h = xxMerge(h, v3)
+		h = xxMerge(h, v4)
+	} else {
+		h = xxPrime5
+	}
+	h += uint64(n)
+	for ; len(p) >= 8; p = p[8:] {
+		h ^= xxRound(0, binary.LittleEndian.Uint64(p))
+		h = bits.RotateLeft64(h, 27)*xxPrime1 + xxPrime4
+	}
+	if len(p) >= 4 {
+		h ^= uint64(binary.LittleEndian.Uint32(p)) * xxPrime1
+		h = bits.RotateLeft64(h, 23)*xxPrime2 + xxPrime3
+		p = p[4:]
+	}
+	for _, b := range p {
+		h ^= uint64(b) * xxPrime5
+		h = bits.RotateLeft64(h, 11) * xxPrime1
+	}
+	h ^= h >> 33
+	h *= xxPrime2
+	h ^= h >> 29
+	h *= xxPrime3
+	h ^= h >> 32
+	return h
+}
+
+func xxRound(acc, input uint64) uint64 {
+	acc += input * xxPrime2
+	acc = bits.RotateLeft64(acc, 31)
+	return acc * xxPrime1
+}
+
+func xxMerge(acc, val uint64) uint64 {
+	acc ^= xxRound(0, val)
+	return acc*xxPrime1 + xxPrime4
+}
@@ -0,0 +1,43 @@
+package bbloom
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestHashBackendsRoundTrip(t *testing.T) {
+	filters := make(map[Hash]*Bloom)
+	for _, h := range []Hash{SipHash, Murmur3, XXHash} {
+		parsed, err := ParseHash(h.String())
+		if err != nil || parsed != h {
+			t.Fatalf("ParseHash(%q) = %v, %v", h.String(), parsed, err)
+		}
+		bl := New(4096, 0.01)
+		bl.HashFunc = h
+		fill(&bl, 300)
+		var buf bytes.Buffer
+		if err := bl.BinaryMarshal(&buf); err != nil {
+			t.Fatal(err)
+		}
+		back, err := BinaryUnmarshal(&buf)
+		if err != nil {
+			t.Fatalf("%s: %v", h, err)
+		}
+		if back.HashFunc != h || !back.Equal(&bl) {
+			t.Errorf("%s: filter changed in a binary round trip", h)
+		}
+		if js := JSONUnmarshal(bl.JSONMarshal()); js.HashFunc != h || !js.Equal(&bl) {
+			t.Errorf("%s: filter changed in a JSON round trip", h)
+		}
+		filters[h] = &bl
+	}
+	if filters[SipHash].Equal(filters[Murmur3]) || filters[Murmur3].Equal(filters[XXHash]) {
+		t.Error("different hashes set the same bits")
+	}
+	if ok, _ := filters[SipHash].CanMergeWith(filters[XXHash]); ok {
+		t.Error("filters of different hashes reported mergeable")
+	}
+	if _, err := ParseHash("md5"); err == nil {
+		t.Error("unknown hash accepted")
+	}
+}
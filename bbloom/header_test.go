@@ -0,0 +1,82 @@
+package bbloom
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+// Offsets of the header fields written by BinaryMarshal.
+const (
+	offSizeExp = 8 * iota
+	offSize
+	offSetLocs
+	offShift
+	offElemNum
+	offWords
+)
+
+func TestBinaryUnmarshalRejectsInconsistentHeaders(t *testing.T) {
+	bl := New(1000, 0.01)
+	fill(&bl, 100)
+	var buf bytes.Buffer
+	if err := bl.BinaryMarshal(&buf); err != nil {
+		t.Fatal(err)
+	}
+	valid := buf.Bytes()
+	bits := bl.size + 1
+	exp := bl.sizeExp
+
+	tests := []struct {
+		name  string
+		field int
+		value uint64
+	}{
+		{"bitset not a power of two", offWords, bits/64 + 1},
+		{"bitset below the minimum size", offWords, 4},
+		{"bitset of a huge size", offWords, 1 << 60},
+		{"empty bitset", offWords, 0},
+		{"size not the bitset's", offSize, bits - 2},
+		{"size of another bitset", offSize, 2*bits - 1},
+		{"exponent off by one", offSizeExp, exp + 1},
+		{"exponent over 63", offSizeExp, 64},
+		{"no hash locations", offSetLocs, 0},
+		{"more hash locations than bits", offSetLocs, bits + 1},
+		{"no hash split", offShift, 0},
+		{"hash split too wide", offShift, 64 - exp + 1},
+	}
+	for _, tt := range tests {
+		data := bytes.Clone(valid)
+		binary.LittleEndian.PutUint64(data[tt.field:], tt.value)
+		_, err := BinaryUnmarshal(bytes.NewReader(data))
+		if err == nil || !strings.Contains(err.Error(), "corrupt filter header") {
+			t.Errorf("%s: %v, want a corrupt header error", tt.name, err)
+		}
+	}
+
+	data := bytes.Clone(valid)
+	data[offSizeExp+7] = 0xff
+	if _, err := BinaryUnmarshal(bytes.NewReader(data)); err == nil || !strings.Contains(err.Error(), "unknown hash") {
+		t.Errorf("unknown hash: %v", err)
+	}
+	if _, err := BinaryUnmarshal(bytes.NewReader(valid[:len(valid)-8])); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("truncated bitset: %v, want an unexpected EOF", err)
+	}
+	if _, err := BinaryUnmarshal(bytes.NewReader(valid[:20])); err == nil {
+		t.Error("truncated header read")
+	}
+
+	// A narrower hash split, as halving leaves, is consistent.
+	data = bytes.Clone(valid)
+	binary.LittleEndian.PutUint64(data[offShift:], 64-exp-1)
+	if _, err := BinaryUnmarshal(bytes.NewReader(data)); err != nil {
+		t.Errorf("narrower hash split: %v", err)
+	}
+	back, err := BinaryUnmarshal(bytes.NewReader(valid))
+	if err != nil || !back.Equal(&bl) {
+		t.Errorf("valid filter: %v", err)
+	}
+}
@@ -0,0 +1,65 @@
+package bbloom
+
+import (
+	"math"
+	"math/bits"
+	"sync"
+)
+
+// HyperLogLog estimates the number of distinct entries added to it in fixed
+// memory, keyed by the same siphash as the Bloom filter. With 2^precision
+// registers its standard error is about 1.04/sqrt(2^precision).
+type HyperLogLog struct {
+	Mtx       *sync.Mutex
+	precision uint8
+	registers []uint8
+}
+
+// NewHyperLogLog returns an empty sketch with 2^precision one-byte
+// registers. precision is clamped to [4, 18].
+func NewHyperLogLog(precision uint8) HyperLogLog {
+	precision = min(max(precision, 4), 18)
+	return HyperLogLog{
+		Mtx:       &sync.Mutex{},
+		precision: precision,
+		registers: make([]uint8, 1<<precision),
+	}
+}
+
+// Add records entry.
+func (hll *HyperLogLog) Add(entry []byte) {
+	hash := sipHash64(entry)
+	idx := hash >> (64 - hll.precision)
+	// The guard bit bounds the rank when the remaining bits are all zero.
+	rank := uint8(bits.LeadingZeros64(hash<<hll.precision|1<<(hll.precision-1))) + 1
+	if rank > hll.registers[idx] {
+		hll.registers[idx] = rank
+	}
+}
+
+// AddTS
+// Thread safe: Mutex.Lock the sketch for the time of processing the entry
+func (hll *HyperLogLog) AddTS(entry []byte) {
+	hll.Mtx.Lock()
+	defer hll.Mtx.Unlock()
+	hll.Add(entry)
+}
+
+// Count returns the estimated number of distinct entries added so far. Small
+// cardinalities, where registers are still empty, use linear counting.
+func (hll *HyperLogLog) Count() uint64 {
+	m := float64(len(hll.registers))
+	var sum float64
+	var zeros int
+	for _, r := range hll.registers {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+	est := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if est <= 2.5*m && zeros > 0 {
+		est = m * math.Log(m/float64(zeros))
+	}
+	return uint64(est + 0.5)
+}
@@ -0,0 +1,27 @@
+package bbloom
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestHyperLogLogWithinStandardError(t *testing.T) {
+	for _, precision := range []uint8{10, 14} {
+		se := 1.04 / math.Sqrt(float64(uint64(1)<<precision))
+		for _, distinct := range []int{100, 10000, 200000} {
+			hll := NewHyperLogLog(precision)
+			for i := range distinct {
+				key := fmt.Appendf(nil, "key-%d", i)
+				// Repeats must not count.
+				hll.Add(key)
+				hll.Add(key)
+			}
+			got := float64(hll.Count())
+			if rel := math.Abs(got-float64(distinct)) / float64(distinct); rel > 3*se {
+				t.Errorf("precision %d, %d distinct: estimate %g, off by %.2f%%, over three standard errors (%.2f%%)",
+					precision, distinct, got, 100*rel, 300*se)
+			}
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package bbloom
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+)
+
+// JSONDecode reads a filter written by JSONMarshal or JSONEncode from r. It
+// is JSONUnmarshal with errors: malformed JSON, an unknown hash, or a bitset
+// or hash split that no filter could have had are reported instead of
+// yielding an empty or resized filter. The geometry is rebuilt the way
+// NewFromBuffer derives it from the bitset length, with the saved hash
+// split for halved filters, so the result is Equal to the filter that was
+// encoded. JSON does not store ElemNum; it is estimated from the fill.
+func JSONDecode(r io.Reader) (Bloom, error) {
+	var imEx bloomJSONImExport
+	if err := json.NewDecoder(r).Decode(&imEx); err != nil {
+		return Bloom{}, fmt.Errorf("bbloom: decoding JSON filter: %w", err)
+	}
+	hash := SipHash
+	if imEx.Hash != "" {
+		var err error
+		if hash, err = ParseHash(imEx.Hash); err != nil {
+			return Bloom{}, err
+		}
+	}
+	if len(imEx.FilterSet)%8 != 0 {
+		return Bloom{}, fmt.Errorf("bbloom: JSON bitset of %d bytes is not whole 64-bit words", len(imEx.FilterSet))
+	}
+	words := make([]uint64, len(imEx.FilterSet)>>3)
+	for i := range words {
+		words[i] = binary.LittleEndian.Uint64(imEx.FilterSet[i<<3:])
+	}
+	bl, err := NewFromBuffer(words, imEx.SetLocs)
+	if err != nil {
+		return Bloom{}, err
+	}
+	bl.external = false
+	if imEx.Shift != 0 {
+		if imEx.Shift > bl.shift {
+			return Bloom{}, fmt.Errorf("bbloom: JSON hash split %d does not fit a filter of %d bits", imEx.Shift, bl.size+1)
+		}
+		bl.shift = imEx.Shift
+	}
+	bl.HashFunc = hash
+	bl.ElemNum = bl.estimateElems()
+	return bl, nil
+}
+
+// estimateElems estimates the number of entries added from the fill ratio,
+// n = -m/k * ln(1 - fill), for filters whose count was not kept. A full
+// filter gives no estimate and counts as m entries.
+func (bl *Bloom) estimateElems() uint64 {
+	fill := bl.FillRatio()
+	m := float64(len(bl.bitset) << 6)
+	if fill >= 1 {
+		return uint64(m)
+	}
+	return uint64(math.Round(entriesAtFill(m, float64(bl.setLocs), fill)))
+}
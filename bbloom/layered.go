@@ -0,0 +1,51 @@
+package bbloom
+
+// Layered composes a read-only base filter with a mutable overlay. An entry
+// counts as seen if either filter has it, and new entries are only ever added
+// to the overlay, so the base (e.g. an allowlist of keys to always suppress)
+// is never modified. Unlike merging the two filters, nothing is copied into
+// the overlay: entries found in the base are not added to it.
+type Layered struct {
+	Base    *Bloom
+	Overlay *Bloom
+}
+
+// Seen reports whether entry is in the base or the overlay, adding it to the
+// overlay if it is in neither.
+func (ly *Layered) Seen(entry []byte) bool {
+	return !ly.AddIfNotHas(entry)
+}
+
+// SeenTS
+// Thread safe: locks the overlay while testing and adding entry; the base is
+// only read and needs no lock.
+func (ly *Layered) SeenTS(entry []byte) bool {
+	return !ly.AddIfNotHasTS(entry)
+}
+
+// Has reports whether entry is in the base or the overlay.
+func (ly *Layered) Has(entry []byte) bool {
+	return ly.Base.Has(entry) || ly.Overlay.Has(entry)
+}
+
+// Add adds entry to the overlay.
+func (ly *Layered) Add(entry []byte) {
+	ly.Overlay.Add(entry)
+}
+
+// AddIfNotHas adds entry to the overlay unless either filter has it and
+// reports whether it was added.
+func (ly *Layered) AddIfNotHas(entry []byte) bool {
+	return !ly.Base.Has(entry) && ly.Overlay.AddIfNotHas(entry)
+}
+
+// AddIfNotHasTS is the thread safe variant of AddIfNotHas.
+func (ly *Layered) AddIfNotHasTS(entry []byte) bool {
+	return !ly.Base.Has(entry) && ly.Overlay.AddIfNotHasTS(entry)
+}
+
+// AddIfNotHasAtomic is the lock-free variant of AddIfNotHas; see
+// Bloom.AddIfNotHasAtomic for the rules on concurrent use.
+func (ly *Layered) AddIfNotHasAtomic(entry []byte) bool {
+	return !ly.Base.Has(entry) && ly.Overlay.AddIfNotHasAtomic(entry)
+}
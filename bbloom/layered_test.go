@@ -0,0 +1,29 @@
+package bbloom
+
+import "testing"
+
+func TestLayeredNeverAddsToBase(t *testing.T) {
+	base, overlay := New(1000, 0.001), New(1000, 0.001)
+	base.Add([]byte("in base"))
+	before := base.Snapshot()
+	ly := Layered{Base: &base, Overlay: &overlay}
+
+	if !ly.Seen([]byte("in base")) {
+		t.Error("key only in the base reported unseen")
+	}
+	if overlay.Has([]byte("in base")) {
+		t.Error("key found in the base was copied into the overlay")
+	}
+	if ly.Seen([]byte("new")) {
+		t.Error("new key reported seen")
+	}
+	if !overlay.Has([]byte("new")) || !ly.Has([]byte("new")) {
+		t.Error("new key not added to the overlay")
+	}
+	after := base.Snapshot()
+	for i := range before {
+		if before[i] != after[i] {
+			t.Fatal("the base changed")
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package bbloom
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// BinaryHeader is the fixed-size header BinaryMarshal writes ahead of the
+// bitset. Reading it alone is enough to check whether serialized filters can
+// be merged before reading any of their bits.
+type BinaryHeader struct {
+	SizeExp uint64
+	Size    uint64
+	SetLocs uint64
+	Shift   uint64
+	ElemNum uint64
+	// Words is the length of the bitset that follows, in 64-bit words.
+	Words uint64
+	Hash  Hash
+}
+
+// ReadBinaryHeader reads the header of a filter serialized by BinaryMarshal,
+// leaving r at the start of its bitset. A header whose fields contradict
+// each other (see BinaryHeader.Check) is an error, so a corrupt file fails
+// here rather than with an index out of range in a later Has or Add.
+func ReadBinaryHeader(r io.Reader) (BinaryHeader, error) {
+	var fields [6]uint64
+	if err := binary.Read(r, binary.LittleEndian, &fields); err != nil {
+		return BinaryHeader{}, err
+	}
+	hdr := BinaryHeader{
+		SizeExp: fields[0] & (1<<56 - 1),
+		Size:    fields[1],
+		SetLocs: fields[2],
+		Shift:   fields[3],
+		ElemNum: fields[4],
+		Words:   fields[5],
+		Hash:    Hash(fields[0] >> 56),
+	}
+	if !hdr.Hash.valid() {
+		return hdr, fmt.Errorf("bbloom: unknown hash %d in serialized filter", uint8(hdr.Hash))
+	}
+	if err := hdr.Check(); err != nil {
+		return hdr, err
+	}
+	return hdr, nil
+}
+
+// Check returns an error if the header could not have been written for any
+// filter: the bitset must be a power of two words of at least MinSize bits,
+// Size must be its bit mask, 2^SizeExp - 1, so every bit index lands inside
+// it, there must be between 1 and Size+1 hash locations, and the hash split
+// Shift must be 64 - SizeExp, or less for a halved filter, but at least 1.
+func (h BinaryHeader) Check() error {
+	bits := h.Words << 6
+	switch {
+	case h.Words == 0 || h.Words&(h.Words-1) != 0 || h.Words > 1<<57 || bits < MinSize:
+		return fmt.Errorf("bbloom: corrupt filter header: bitset of %d words is not a power of two of at least %d bits", h.Words, MinSize)
+	case h.SizeExp >= 64 || uint64(1)<<h.SizeExp != bits || h.Size != bits-1:
+		return fmt.Errorf("bbloom: corrupt filter header: size %d and exponent %d do not match a bitset of %d bits", h.Size+1, h.SizeExp, bits)
+	case h.SetLocs < 1 || h.SetLocs > bits:
+		return fmt.Errorf("bbloom: corrupt filter header: %d hash locations for %d bits", h.SetLocs, bits)
+	case h.Shift < 1 || h.Shift > 64-h.SizeExp:
+		return fmt.Errorf("bbloom: corrupt filter header: hash split %d does not fit a filter of %d bits", h.Shift, bits)
+	}
+	return nil
+}
+
+// Compatible reports why filters with headers h and o cannot be merged, or
+// nil if they can: they need the same size, hash locations, hash and hash
+// split. Every difference is listed, not only the first.
+func (h BinaryHeader) Compatible(o BinaryHeader) error {
+	if why := h.mismatches(o); len(why) > 0 {
+		return errors.New("bbloom: " + strings.Join(why, "; "))
+	}
+	return nil
+}
+
+func (h BinaryHeader) mismatches(o BinaryHeader) []string {
+	var why []string
+	if h.Size != o.Size || h.SizeExp != o.SizeExp || h.Words != o.Words {
+		why = append(why, fmt.Sprintf("filter sizes differ (%d and %d bits)", h.Size+1, o.Size+1))
+	}
+	if h.SetLocs != o.SetLocs {
+		why = append(why, fmt.Sprintf("hash locations differ (%d and %d)", h.SetLocs, o.SetLocs))
+	}
+	if h.Hash != o.Hash {
+		why = append(why, fmt.Sprintf("hashes differ (%s and %s)", h.Hash, o.Hash))
+	}
+	if h.Shift != o.Shift {
+		why = append(why, fmt.Sprintf("hash splits differ (shift %d and %d)", h.Shift, o.Shift))
+	}
+	return why
+}
+
+// CanMergeWith reports whether bl and other can be merged, intersected or
+// compared, and if not, why. Besides the geometry and hash Compatible
+// checks, their SipKeys and Namespaces, which act as hash seeds, must match:
+// a different one hashes every entry elsewhere, so the bits would combine
+// but the result would answer for neither. The keys themselves are not
+// reported. Filters sized for different entry
+// counts never match; without the keys, one cannot be rebuilt at the
+// other's size, so size both from the larger count up front. The reason is
+// empty when they can be merged.
+func (bl *Bloom) CanMergeWith(other *Bloom) (bool, string) {
+	why := bl.header().mismatches(other.header())
+	if bl.HashFunc == SipHash && bl.sipKey() != other.sipKey() {
+		why = append(why, "SipHash keys differ")
+	}
+	if !bytes.Equal(bl.Namespace, other.Namespace) {
+		why = append(why, fmt.Sprintf("namespaces differ (%q and %q)", bl.Namespace, other.Namespace))
+	}
+	return len(why) == 0, strings.Join(why, "; ")
+}
+
+// sipKey returns the SipHash key bl uses.
+func (bl *Bloom) sipKey() SipKey {
+	if bl.SipKey != nil {
+		return *bl.SipKey
+	}
+	return DefaultSipKey
+}
+
+// header returns the header BinaryMarshal would write for bl.
+func (bl *Bloom) header() BinaryHeader {
+	return BinaryHeader{
+		SizeExp: bl.sizeExp,
+		Size:    bl.size,
+		SetLocs: bl.setLocs,
+		Shift:   bl.shift,
+		ElemNum: bl.ElemNum,
+		Words:   uint64(len(bl.bitset)),
+		Hash:    bl.HashFunc,
+	}
+}
+
+// MergeBinary ORs the filter serialized by BinaryMarshal in r into bl, so bl
+// afterwards holds the entries of both. The other filter's bitset is read a
+// chunk at a time, never as a whole, so merging costs no memory beyond bl.
+// Both filters must have the same geometry and hash (see
+// BinaryHeader.Compatible); on a mismatch nothing is merged. ElemNum becomes
+// the sum of both counts, which overcounts entries present in both. If r
+// fails partway through the bitset, bl holds part of the other filter's bits
+// and should be discarded; merging the same filter again is harmless.
+func (bl *Bloom) MergeBinary(r io.Reader) error {
+	hdr, err := ReadBinaryHeader(r)
+	if err != nil {
+		return err
+	}
+	if err := bl.header().Compatible(hdr); err != nil {
+		return err
+	}
+	var chunk [512]uint64
+	for i := 0; i < len(bl.bitset); i += len(chunk) {
+		words := chunk[:min(len(chunk), len(bl.bitset)-i)]
+		if err := binary.Read(r, binary.LittleEndian, words); err != nil {
+			return err
+		}
+		for j, w := range words {
+			bl.bitset[i+j] |= w
+		}
+	}
+	bl.ElemNum += hdr.ElemNum
+	return nil
+}
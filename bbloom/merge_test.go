@@ -0,0 +1,74 @@
+package bbloom
+
+import (
+	"bytes"
+	"io"
+	"runtime"
+	"testing"
+)
+
+// heapSampler passes reads through and records the live heap, after a
+// collection, at a few points while they go on.
+type heapSampler struct {
+	r     io.Reader
+	n     int
+	every int
+	peak  uint64
+}
+
+func (s *heapSampler) Read(p []byte) (int, error) {
+	s.n += len(p)
+	if s.n >= s.every {
+		s.n = 0
+		var ms runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&ms)
+		s.peak = max(s.peak, ms.HeapAlloc)
+	}
+	return s.r.Read(p)
+}
+
+func TestMergeBinaryStreams(t *testing.T) {
+	const bits = 1 << 27 // 16 MiB
+	other := New(bits, 4)
+	for i := range 1000 {
+		other.Add([]byte{byte(i), byte(i >> 8), 'o'})
+	}
+	var buf bytes.Buffer
+	if err := other.BinaryMarshal(&buf); err != nil {
+		t.Fatal(err)
+	}
+	other = Bloom{} // only the serialized form stays live
+
+	bl := New(bits, 4)
+	for i := range 1000 {
+		bl.Add([]byte{byte(i), byte(i >> 8), 'b'})
+	}
+	var ms runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&ms)
+	src := &heapSampler{r: &buf, every: bits / 8 / 5}
+	if err := bl.MergeBinary(src); err != nil {
+		t.Fatal(err)
+	}
+	if src.peak == 0 {
+		t.Fatal("no heap samples taken")
+	}
+	if grew := int64(src.peak) - int64(ms.HeapAlloc); grew > 1<<20 {
+		t.Errorf("live heap grew by %d bytes while merging a %d-byte filter", grew, bits/8)
+	}
+	for i := range 1000 {
+		for _, tag := range []byte{'o', 'b'} {
+			if !bl.Has([]byte{byte(i), byte(i >> 8), tag}) {
+				t.Fatalf("entry %d%c missing after the merge", i, tag)
+			}
+		}
+	}
+
+	small := New(1024, 4)
+	buf.Reset()
+	small.BinaryMarshal(&buf)
+	if err := bl.MergeBinary(&buf); err == nil {
+		t.Error("merged a filter of another size")
+	}
+}
@@ -0,0 +1,62 @@
+package bbloom
+
+import (
+	"fmt"
+	"math/bits"
+	"strings"
+)
+
+// WordPopcounts returns the number of set bits in each 64-bit word of the
+// bitset. For a filter loaded with well-spread keys the counts follow a
+// binomial distribution around 64*FillRatio(); words far off that, or a
+// lopsided spread, point to positions the hash is correlating.
+func (bl *Bloom) WordPopcounts() []uint8 {
+	pops := make([]uint8, len(bl.bitset))
+	for i, w := range bl.bitset {
+		pops[i] = uint8(bits.OnesCount64(w))
+	}
+	return pops
+}
+
+// OccupancyBucket counts the words whose popcount lies in [Lo, Hi].
+type OccupancyBucket struct {
+	Lo, Hi int
+	Words  uint64
+}
+
+// Occupancy is a histogram of word popcounts, in ascending order.
+type Occupancy []OccupancyBucket
+
+// OccupancyHistogram groups pops, as returned by WordPopcounts, into n
+// buckets of equal width over the possible popcounts 0 to 64. n is clamped
+// to [1, 65]; with 65 each popcount gets its own bucket.
+func OccupancyHistogram(pops []uint8, n int) Occupancy {
+	n = min(max(n, 1), 65)
+	hist := make(Occupancy, n)
+	for i := range hist {
+		hist[i].Lo = i * 65 / n
+		hist[i].Hi = (i+1)*65/n - 1
+	}
+	for _, p := range pops {
+		hist[int(p)*n/65].Words++
+	}
+	return hist
+}
+
+// String renders the histogram one bucket per line as the popcount range,
+// the number of words and a bar scaled to the largest bucket.
+func (h Occupancy) String() string {
+	var most uint64
+	for _, b := range h {
+		most = max(most, b.Words)
+	}
+	var sb strings.Builder
+	for _, b := range h {
+		bar := 0
+		if most > 0 {
+			bar = int(b.Words * 50 / most)
+		}
+		fmt.Fprintf(&sb, "%2d-%-2d %12d %s\n", b.Lo, b.Hi, b.Words, strings.Repeat("#", bar))
+	}
+	return sb.String()
+}
@@ -0,0 +1,56 @@
+package bbloom
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestOccupancyIsEvenForRandomKeys(t *testing.T) {
+	bl := New(1<<16, 4)
+	rng := rand.New(rand.NewSource(1))
+	key := make([]byte, 16)
+	// About half the bits set.
+	for range 11000 {
+		rng.Read(key)
+		bl.Add(key)
+	}
+	pops := bl.WordPopcounts()
+	if len(pops) != len(bl.bitset) {
+		t.Fatalf("%d popcounts for %d words", len(pops), len(bl.bitset))
+	}
+	f := bl.FillRatio()
+	var sum, sumSq float64
+	for _, p := range pops {
+		sum += float64(p)
+		sumSq += float64(p) * float64(p)
+	}
+	n := float64(len(pops))
+	mean, variance := sum/n, sumSq/n-(sum/n)*(sum/n)
+	// Word popcounts of well-spread bits are binomial(64, f).
+	if want := 64 * f; math.Abs(mean-want) > 0.01*want {
+		t.Errorf("mean popcount %g, want %g", mean, want)
+	}
+	if want := 64 * f * (1 - f); math.Abs(variance-want) > 0.15*want {
+		t.Errorf("popcount variance %g, want about %g", variance, want)
+	}
+
+	hist := OccupancyHistogram(pops, 65)
+	var total uint64
+	for i, b := range hist {
+		if b.Lo != i || b.Hi != i {
+			t.Fatalf("bucket %d covers %d-%d", i, b.Lo, b.Hi)
+		}
+		total += b.Words
+		// Nothing beyond six standard deviations from the mean.
+		if b.Words > 0 && math.Abs(float64(i)-64*f) > 6*math.Sqrt(64*f*(1-f)) {
+			t.Errorf("%d words with popcount %d, far from the mean %g", b.Words, i, 64*f)
+		}
+	}
+	if total != uint64(len(pops)) {
+		t.Errorf("histogram counts %d words, want %d", total, len(pops))
+	}
+	if h := OccupancyHistogram(pops, 4); h[0].Lo != 0 || h[3].Hi != 64 {
+		t.Errorf("4 buckets cover %d-%d, want 0-64", h[0].Lo, h[3].Hi)
+	}
+}
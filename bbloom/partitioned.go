@@ -0,0 +1,182 @@
+package bbloom
+
+import (
+	"encoding/binary"
+	"io"
+	"log"
+	"math/bits"
+	"sync"
+)
+
+// PartitionedBloom is a Bloom filter whose bitset is split into setLocs
+// equal partitions, one per hash location: location i only ever sets a bit
+// in partition i. Every entry sets exactly setLocs distinct bits, so the fill
+// of each partition, and with it the false positive rate, is more
+// predictable than in Bloom, where locations may collide. Each partition is a
+// power of two bits, so at equal expected entries it may use up to setLocs
+// times 512 bits more than Bloom.
+type PartitionedBloom struct {
+	Mtx *sync.Mutex
+	// ElemNum counts the entries added.
+	ElemNum uint64
+	bitset  []uint64
+	partExp uint64
+	part    uint64
+	setLocs uint64
+	shift   uint64
+}
+
+// NewPartitioned
+// returns a new partitioned bloomfilter; params are the same as for New
+func NewPartitioned(params ...float64) (bloomfilter PartitionedBloom) {
+	var entries, locs uint64
+	if len(params) == 2 {
+		if params[1] < 1 {
+			entries, locs = calcSizeByWrongPositives(params[0], params[1])
+		} else {
+			entries, locs = uint64(params[0]), uint64(params[1])
+		}
+	} else {
+		log.Fatal("usage: NewPartitioned(float64(number_of_entries), float64(number_of_hashlocations)) i.e. NewPartitioned(float64(1000), float64(3)) or NewPartitioned(float64(number_of_entries), float64(number_of_hashlocations)) i.e. NewPartitioned(float64(1000), float64(0.03))")
+	}
+	locs = max(locs, 1)
+	size, exponent := getSize(entries / locs)
+	return PartitionedBloom{
+		Mtx:     &sync.Mutex{},
+		bitset:  make([]uint64, locs*size>>6),
+		partExp: exponent,
+		part:    size - 1,
+		setLocs: locs,
+		shift:   64 - exponent,
+	}
+}
+
+// index returns the bit of entry in partition i.
+func (pb *PartitionedBloom) index(l, h, i uint64) uint64 {
+	return i<<pb.partExp | (h+i*l)&pb.part
+}
+
+func (pb *PartitionedBloom) hash(entry []byte) (l, h uint64) {
+	hash := sipHash64(entry)
+	return hash << pb.shift >> pb.shift, hash >> pb.shift
+}
+
+// Add
+// set the bit(s) for entry; Adds an entry to the Bloom filter
+func (pb *PartitionedBloom) Add(entry []byte) {
+	l, h := pb.hash(entry)
+	for i := uint64(0); i < pb.setLocs; i++ {
+		idx := pb.index(l, h, i)
+		pb.bitset[idx>>6] |= 1 << (idx % 64)
+	}
+	pb.ElemNum++
+}
+
+// AddTS
+// Thread safe: Mutex.Lock the bloomfilter for the time of processing the entry
+func (pb *PartitionedBloom) AddTS(entry []byte) {
+	pb.Mtx.Lock()
+	defer pb.Mtx.Unlock()
+	pb.Add(entry)
+}
+
+// Has
+// check if bit(s) for entry is/are set
+// returns true if the entry was added to the Bloom Filter
+func (pb *PartitionedBloom) Has(entry []byte) bool {
+	l, h := pb.hash(entry)
+	res := true
+	for i := uint64(0); i < pb.setLocs; i++ {
+		idx := pb.index(l, h, i)
+		res = res && pb.bitset[idx>>6]&(1<<(idx%64)) != 0
+	}
+	return res
+}
+
+// HasTS
+// Thread safe: Mutex.Lock the bloomfilter for the time of processing the entry
+func (pb *PartitionedBloom) HasTS(entry []byte) bool {
+	pb.Mtx.Lock()
+	defer pb.Mtx.Unlock()
+	return pb.Has(entry)
+}
+
+// AddIfNotHas
+// Only Add entry if it's not present in the bloomfilter
+// returns true if entry was added
+func (pb *PartitionedBloom) AddIfNotHas(entry []byte) (added bool) {
+	if pb.Has(entry) {
+		return false
+	}
+	pb.Add(entry)
+	return true
+}
+
+// AddIfNotHasTS
+// Tread safe: Only Add entry if it's not present in the bloomfilter
+// returns true if entry was added
+func (pb *PartitionedBloom) AddIfNotHasTS(entry []byte) (added bool) {
+	pb.Mtx.Lock()
+	defer pb.Mtx.Unlock()
+	return pb.AddIfNotHas(entry)
+}
+
+// Clear
+// resets the Bloom filter
+func (pb *PartitionedBloom) Clear() {
+	clear(pb.bitset)
+}
+
+// FillRatio returns the fraction of bits set across all partitions.
+func (pb *PartitionedBloom) FillRatio() float64 {
+	var set int
+	for _, w := range pb.bitset {
+		set += bits.OnesCount64(w)
+	}
+	return float64(set) / float64(len(pb.bitset)<<6)
+}
+
+// EstimatedFPR returns the false positive rate implied by the current fill:
+// the product of the fill ratios of the partitions.
+func (pb *PartitionedBloom) EstimatedFPR() float64 {
+	words := len(pb.bitset) / int(pb.setLocs)
+	fpr := 1.0
+	for p := 0; p < int(pb.setLocs); p++ {
+		var set int
+		for _, w := range pb.bitset[p*words : (p+1)*words] {
+			set += bits.OnesCount64(w)
+		}
+		fpr *= float64(set) / float64(words<<6)
+	}
+	return fpr
+}
+
+// BinaryMarshal serializes the filter in the same layout as
+// Bloom.BinaryMarshal, with the partition geometry in the size fields. The
+// layout does not record which kind of filter wrote it; read it back with
+// BinaryUnmarshalPartitioned.
+func (pb *PartitionedBloom) BinaryMarshal(w io.Writer) error {
+	for _, v := range []uint64{pb.partExp, pb.part, pb.setLocs, pb.shift, pb.ElemNum, uint64(len(pb.bitset))} {
+		if err := binary.Write(w, binary.LittleEndian, v); err != nil {
+			return err
+		}
+	}
+	return binary.Write(w, binary.LittleEndian, pb.bitset)
+}
+
+// BinaryUnmarshalPartitioned deserializes a filter written by
+// PartitionedBloom.BinaryMarshal.
+func BinaryUnmarshalPartitioned(r io.Reader) (PartitionedBloom, error) {
+	pb := PartitionedBloom{Mtx: &sync.Mutex{}}
+	var length uint64
+	for _, v := range []*uint64{&pb.partExp, &pb.part, &pb.setLocs, &pb.shift, &pb.ElemNum, &length} {
+		if err := binary.Read(r, binary.LittleEndian, v); err != nil {
+			return pb, err
+		}
+	}
+	pb.bitset = make([]uint64, length)
+	if err := binary.Read(r, binary.LittleEndian, pb.bitset); err != nil {
+		return pb, err
+	}
+	return pb, nil
+}
@@ -0,0 +1,60 @@
+package bbloom
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestPartitionedMatchesStandardFPR(t *testing.T) {
+	const bits, locs, n, probes = 1 << 16, 4, 8000, 200000
+	// Equal memory: four partitions of 2^14 bits against one of 2^16.
+	pb := NewPartitioned(bits, locs)
+	bl := New(bits, locs)
+	if len(pb.bitset) != len(bl.bitset) {
+		t.Fatalf("partitioned filter has %d words, standard %d", len(pb.bitset), len(bl.bitset))
+	}
+	for i := range n {
+		key := fmt.Appendf(nil, "key-%d", i)
+		pb.Add(key)
+		bl.Add(key)
+	}
+	for i := range n {
+		if !pb.Has(fmt.Appendf(nil, "key-%d", i)) {
+			t.Fatalf("key-%d missing from the partitioned filter", i)
+		}
+	}
+	var pbHits, blHits int
+	for i := range probes {
+		key := fmt.Appendf(nil, "absent-%d", i)
+		if pb.Has(key) {
+			pbHits++
+		}
+		if bl.Has(key) {
+			blHits++
+		}
+	}
+	// Both should be near (1-e^(-kn/m))^k.
+	want := math.Pow(1-math.Exp(-locs*n/float64(bits)), locs)
+	for name, hits := range map[string]int{"partitioned": pbHits, "standard": blHits} {
+		if got := float64(hits) / probes; math.Abs(got-want) > 0.15*want {
+			t.Errorf("%s: measured FPR %g, expected %g", name, got, want)
+		}
+	}
+	if est := pb.EstimatedFPR(); math.Abs(est-want) > 0.15*want {
+		t.Errorf("partitioned EstimatedFPR %g, expected %g", est, want)
+	}
+
+	var buf bytes.Buffer
+	if err := pb.BinaryMarshal(&buf); err != nil {
+		t.Fatal(err)
+	}
+	back, err := BinaryUnmarshalPartitioned(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if back.ElemNum != pb.ElemNum || !back.Has([]byte("key-0")) || back.FillRatio() != pb.FillRatio() {
+		t.Error("partitioned filter changed in a binary round trip")
+	}
+}
@@ -0,0 +1,88 @@
+package bbloom
+
+import "sync/atomic"
+
+// split returns the halves of sum used for the filter's double hashing.
+func (bl *Bloom) split(sum uint64) (l, h uint64) {
+	return sum << bl.shift >> bl.shift, sum >> bl.shift
+}
+
+// AddHash sets the bits for the entry whose hash is sum, for callers that
+// have already hashed their entries: with sum = bl.Sum(entry) it sets
+// exactly the bits Add(entry) sets. The Namespace is not applied, as it is
+// part of what is hashed.
+func (bl *Bloom) AddHash(sum uint64) {
+	if bl.ops != nil {
+		bl.ops.adds.Add(1)
+	}
+	l, h := bl.split(sum)
+	for i := uint64(0); i < bl.setLocs; i++ {
+		bl.set((h + i*l) & bl.size)
+	}
+	bl.ElemNum++
+}
+
+// HasHash is Has for the entry whose hash is sum; see AddHash.
+func (bl *Bloom) HasHash(sum uint64) bool {
+	if bl.ops != nil {
+		bl.ops.queries.Add(1)
+	}
+	l, h := bl.split(sum)
+	res := true
+	for i := uint64(0); i < bl.setLocs; i++ {
+		res = res && bl.isSet((h+i*l)&bl.size)
+	}
+	return res
+}
+
+// Sum returns the hash Add computes for entry, Namespace and SipKey
+// included, so AddHash(Sum(entry)) sets exactly the bits Add(entry) sets. It
+// only reads the hash settings, so any number of goroutines can hash entries
+// while one of them owns the bits, without a lock.
+func (bl *Bloom) Sum(entry []byte) uint64 {
+	return bl.sum64(bl.key(entry))
+}
+
+// AddIfNotHasHash is AddIfNotHas for the entry whose hash is sum. Like
+// AddIfNotHas it does not lock.
+func (bl *Bloom) AddIfNotHasHash(sum uint64) (added bool) {
+	if bl.HasHash(sum) {
+		return false
+	}
+	bl.AddHash(sum)
+	return true
+}
+
+// AddIfNotHasHashTS is AddIfNotHasTS for the entry whose hash is sum.
+func (bl *Bloom) AddIfNotHasHashTS(sum uint64) (added bool) {
+	bl.Mtx.Lock()
+	defer bl.Mtx.Unlock()
+	if bl.HasHash(sum) {
+		return false
+	}
+	bl.AddHash(sum)
+	return true
+}
+
+// AddIfNotHasHashAtomic is AddIfNotHasAtomic for the entry whose hash is
+// sum, with the same rules for concurrent calls.
+func (bl *Bloom) AddIfNotHasHashAtomic(sum uint64) (added bool) {
+	if bl.ops != nil {
+		bl.ops.queries.Add(1)
+	}
+	l, h := bl.split(sum)
+	for i := uint64(0); i < bl.setLocs; i++ {
+		idx := (h + i*l) & bl.size
+		mask := uint64(1) << (idx % 64)
+		if atomic.OrUint64(&bl.bitset[idx>>6], mask)&mask == 0 {
+			added = true
+		}
+	}
+	if added {
+		atomic.AddUint64(&bl.ElemNum, 1)
+		if bl.ops != nil {
+			bl.ops.adds.Add(1)
+		}
+	}
+	return added
+}
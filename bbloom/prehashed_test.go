@@ -0,0 +1,33 @@
+package bbloom
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestAddHashMatchesAdd(t *testing.T) {
+	for _, hash := range []Hash{SipHash, Murmur3, XXHash} {
+		for _, sipKey := range []*SipKey{nil, {K0: 1, K1: 2}} {
+			name := fmt.Sprintf("%s, key %v", hash, sipKey)
+			byKey, byHash := New(1000, 0.01), New(1000, 0.01)
+			for _, bl := range []*Bloom{&byKey, &byHash} {
+				bl.HashFunc, bl.SipKey, bl.Namespace = hash, sipKey, []byte("ns:")
+			}
+			for i := range 500 {
+				key := fmt.Appendf(nil, "key-%d", i)
+				byKey.Add(key)
+				if !byHash.AddIfNotHasHash(byHash.Sum(key)) {
+					t.Fatalf("%s: key-%d present before it was added", name, i)
+				}
+			}
+			if !byKey.Equal(&byHash) || byKey.ElemNum != byHash.ElemNum {
+				t.Errorf("%s: AddHash set other bits than Add", name)
+			}
+			for i := range 500 {
+				if !byHash.HasHash(byKey.Sum(fmt.Appendf(nil, "key-%d", i))) {
+					t.Fatalf("%s: key-%d missing by its hash", name, i)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package bbloom
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// opProfile accumulates the time Add and Has spend hashing and setting or
+// testing bits. It is shared by copies of a Bloom, like opCounters.
+type opProfile struct {
+	hash atomic.Int64
+	bits atomic.Int64
+}
+
+// EnableProfile makes Add and Has time their hashing and their bit
+// accesses, for Profile to report. Timing costs two clock reads per call,
+// which is a noticeable share of a call, so leave it off outside profiling
+// runs; a filter that never enabled it only pays a nil check.
+func (bl *Bloom) EnableProfile() {
+	bl.prof = &opProfile{}
+}
+
+// Profile returns the time Add and Has have spent hashing and on bits since
+// EnableProfile, or zeros if it was never called.
+func (bl *Bloom) Profile() (hashing, bits time.Duration) {
+	if bl.prof == nil {
+		return 0, 0
+	}
+	return time.Duration(bl.prof.hash.Load()), time.Duration(bl.prof.bits.Load())
+}
+
+// addProfiled is Add with timing.
+func (bl *Bloom) addProfiled(entry []byte) {
+	if bl.ops != nil {
+		bl.ops.adds.Add(1)
+	}
+	t0 := time.Now()
+	l, h := bl.hash(bl.key(entry))
+	t1 := time.Now()
+	for i := uint64(0); i < bl.setLocs; i++ {
+		bl.set((h + i*l) & bl.size)
+	}
+	bl.ElemNum++
+	bl.prof.hash.Add(int64(t1.Sub(t0)))
+	bl.prof.bits.Add(int64(time.Since(t1)))
+}
+
+// hasProfiled is Has with timing.
+func (bl *Bloom) hasProfiled(entry []byte) bool {
+	if bl.ops != nil {
+		bl.ops.queries.Add(1)
+	}
+	t0 := time.Now()
+	l, h := bl.hash(bl.key(entry))
+	t1 := time.Now()
+	res := true
+	for i := uint64(0); i < bl.setLocs; i++ {
+		res = res && bl.isSet((h+i*l)&bl.size)
+	}
+	bl.prof.hash.Add(int64(t1.Sub(t0)))
+	bl.prof.bits.Add(int64(time.Since(t1)))
+	return res
+}
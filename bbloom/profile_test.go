@@ -0,0 +1,19 @@
+package bbloom
+
+import "testing"
+
+func TestProfileTimesOperations(t *testing.T) {
+	bl := New(1<<16, 0.01)
+	if h, b := bl.Profile(); h != 0 || b != 0 {
+		t.Fatalf("unprofiled filter reports %v hashing and %v bits", h, b)
+	}
+	bl.EnableProfile()
+	fill(&bl, 20000)
+	if !bl.Has([]byte("key-1")) {
+		t.Fatal("key-1 missing from a profiled filter")
+	}
+	hashing, bits := bl.Profile()
+	if hashing <= 0 || bits <= 0 {
+		t.Errorf("profile after 20000 adds: %v hashing, %v bits; want both above zero", hashing, bits)
+	}
+}
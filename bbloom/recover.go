@@ -0,0 +1,52 @@
+package bbloom
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// ErrTruncated is returned by BinaryUnmarshalPartial, wrapping the read
+// error, when the bitset ends early. The filter returned with it is usable.
+var ErrTruncated = errors.New("bbloom: serialized filter is truncated")
+
+// BinaryUnmarshalPartial is BinaryUnmarshal for a stream that may have been
+// cut short, as by a crash while the filter was written. If the bitset ends
+// early, it returns the filter with every whole word that could be read and
+// the rest clear, how many words those were, and an error wrapping
+// ErrTruncated. Lost bits can only turn present into absent: some entries
+// that were added test as absent, but false positives do not increase.
+// ElemNum is the count in the header, which overstates what is left. The
+// header itself must be complete and valid; if not, the error is returned
+// as from BinaryUnmarshal, without a filter.
+func BinaryUnmarshalPartial(r io.Reader) (Bloom, uint64, error) {
+	bl := Bloom{
+		Mtx: &sync.Mutex{},
+		ops: &opCounters{},
+	}
+	hdr, err := ReadBinaryHeader(r)
+	if err != nil {
+		return Bloom{}, 0, err
+	}
+	bl.sizeExp, bl.size, bl.setLocs, bl.shift = hdr.SizeExp, hdr.Size, hdr.SetLocs, hdr.Shift
+	bl.ElemNum, bl.HashFunc = hdr.ElemNum, hdr.Hash
+	bl.bitset = make([]uint64, hdr.Words)
+	var buf [4096]byte
+	var words uint64
+	for words < hdr.Words {
+		n, err := io.ReadFull(r, buf[:8*min(uint64(len(buf)/8), hdr.Words-words)])
+		for i := 0; i+8 <= n; i += 8 {
+			bl.bitset[words] = binary.LittleEndian.Uint64(buf[i:])
+			words++
+		}
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return bl, words, fmt.Errorf("%w after %d of %d words: %w", ErrTruncated, words, hdr.Words, err)
+		}
+	}
+	return bl, words, nil
+}
@@ -0,0 +1,63 @@
+package bbloom
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"testing"
+)
+
+func TestBinaryUnmarshalPartial(t *testing.T) {
+	const n = 20000
+	bl := New(float64(n), 0.01)
+	fill(&bl, n)
+	var buf bytes.Buffer
+	if err := bl.BinaryMarshal(&buf); err != nil {
+		t.Fatal(err)
+	}
+	full := buf.Bytes()
+	words := uint64(len(bl.bitset))
+	header := len(full) - 8*int(words)
+
+	got, read, err := BinaryUnmarshalPartial(bytes.NewReader(full))
+	if err != nil || read != words {
+		t.Fatalf("whole stream: %d of %d words, error %v", read, words, err)
+	}
+	if !slices.Equal(got.bitset, bl.bitset) {
+		t.Error("whole stream: bitset differs")
+	}
+
+	for _, frac := range []float64{0.99, 0.9, 0.5} {
+		// Cut partway into a word, which is dropped.
+		cut := header + int(frac*float64(8*words)) + 3
+		got, read, err := BinaryUnmarshalPartial(bytes.NewReader(full[:cut]))
+		if !errors.Is(err, ErrTruncated) {
+			t.Fatalf("cut at %g: error %v, want ErrTruncated", frac, err)
+		}
+		if want := uint64(cut-header) / 8; read != want {
+			t.Errorf("cut at %g: %d words recovered, want %d", frac, read, want)
+		}
+		for i, w := range got.bitset {
+			if want := bl.bitset[i]; uint64(i) < read && w != want || uint64(i) >= read && w != 0 {
+				t.Fatalf("cut at %g: word %d is %x", frac, i, w)
+			}
+		}
+		var kept int
+		for i := range n {
+			if got.Has(fmt.Appendf(nil, "key-%d", i)) {
+				kept++
+			}
+		}
+		// A key survives if all its locations were recovered.
+		want := math.Pow(float64(read)/float64(words), float64(bl.setLocs)) * n
+		if math.Abs(float64(kept)-want) > 0.05*n {
+			t.Errorf("cut at %g: %d of %d keys kept, want about %.0f", frac, kept, n, want)
+		}
+	}
+
+	if _, _, err := BinaryUnmarshalPartial(bytes.NewReader(full[:header-1])); err == nil || errors.Is(err, ErrTruncated) {
+		t.Errorf("header cut short: error %v, want a plain error", err)
+	}
+}
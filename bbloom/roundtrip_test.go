@@ -0,0 +1,65 @@
+package bbloom_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/mylh/bdedup/bbloom"
+	"github.com/mylh/bdedup/bbloom/bbloomtest"
+)
+
+func TestSerializationKeepsEveryKey(t *testing.T) {
+	keys := bbloomtest.GenerateRandom(5000, 1)
+	for _, hash := range []bbloom.Hash{bbloom.SipHash, bbloom.Murmur3, bbloom.XXHash} {
+		bl, err := bbloom.NewWithFPR(float64(len(keys)), 0.01)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bl.HashFunc = hash
+		for _, key := range keys {
+			bl.Add(key)
+		}
+		if err := bbloomtest.VerifyNoFalseNegatives(&bl, keys); err != nil {
+			t.Fatalf("%s: %v", hash, err)
+		}
+		copies, err := bbloomtest.RoundTrips(&bl)
+		if err != nil {
+			t.Fatalf("%s: %v", hash, err)
+		}
+		for form, decoded := range copies {
+			if err := bbloomtest.VerifyNoFalseNegatives(decoded, keys); err != nil {
+				t.Errorf("%s, %s round trip: %v", hash, form, err)
+			}
+		}
+	}
+}
+
+func TestVerifyNoFalseNegativesReportsMissingKeys(t *testing.T) {
+	keys := bbloomtest.GenerateRandom(100, 2)
+	bl := bbloom.New(1000, 0.001)
+	for _, key := range keys[:50] {
+		bl.Add(key)
+	}
+	if err := bbloomtest.VerifyNoFalseNegatives(&bl, keys[:50]); err != nil {
+		t.Errorf("added keys: %v", err)
+	}
+	if err := bbloomtest.VerifyNoFalseNegatives(&bl, keys); err == nil {
+		t.Error("keys never added were not reported")
+	}
+}
+
+func TestGenerateRandomIsSeeded(t *testing.T) {
+	a, b := bbloomtest.GenerateRandom(100, 7), bbloomtest.GenerateRandom(100, 7)
+	c := bbloomtest.GenerateRandom(100, 8)
+	for i := range a {
+		if len(a[i]) < 8 || len(a[i]) > 40 {
+			t.Errorf("key %d is %d bytes, want 8 to 40", i, len(a[i]))
+		}
+		if !bytes.Equal(a[i], b[i]) {
+			t.Fatalf("key %d differs between runs with the same seed", i)
+		}
+	}
+	if bytes.Equal(a[0], c[0]) {
+		t.Error("different seeds gave the same first key")
+	}
+}
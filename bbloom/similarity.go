@@ -0,0 +1,49 @@
+package bbloom
+
+import (
+	"errors"
+	"math/bits"
+)
+
+// ErrSaturated is returned by JaccardSimilarity when every bit of the union
+// of the filters is set, so nothing can be told about their contents.
+var ErrSaturated = errors.New("bbloom: filters are saturated")
+
+// JaccardSimilarity estimates the Jaccard index |A∩B| / |A∪B| of the entry
+// sets of bl and other without enumerating them. Comparing the bits alone
+// would overstate it, since unrelated entries share bits as a filter fills,
+// so the sizes of A, B and A∪B are first estimated from the fill of each
+// bitset and of their OR, n = -m/k * ln(1 - fill), and |A∩B| is taken as
+// |A| + |B| - |A∪B|. Both filters must have the same geometry, hash and
+// Namespace (see CanMergeWith). Two empty filters have index 1.
+//
+// The estimate is within about 0.001 of the true index while the filters
+// are at most three quarters full. As they saturate, ln(1 - fill) magnifies
+// the noise in each fill, and the intersection, a small difference of large
+// estimates, carries all of it: at 95% fill and beyond expect errors of
+// around 0.01, and disjoint sets no longer score exactly 0. A full union
+// returns ErrSaturated. Neither filter is locked.
+func (bl *Bloom) JaccardSimilarity(other *Bloom) (float64, error) {
+	if ok, why := bl.CanMergeWith(other); !ok {
+		return 0, errors.New("bbloom: " + why)
+	}
+	var a, b, union int
+	for i, w := range bl.bitset {
+		o := other.bitset[i]
+		a += bits.OnesCount64(w)
+		b += bits.OnesCount64(o)
+		union += bits.OnesCount64(w | o)
+	}
+	size := len(bl.bitset) << 6
+	switch union {
+	case 0:
+		return 1, nil
+	case size:
+		return 0, ErrSaturated
+	}
+	m, k := float64(size), float64(bl.setLocs)
+	na := entriesAtFill(m, k, float64(a)/m)
+	nb := entriesAtFill(m, k, float64(b)/m)
+	nu := entriesAtFill(m, k, float64(union)/m)
+	return min(max(na+nb-nu, 0)/nu, 1), nil
+}
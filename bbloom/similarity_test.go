@@ -0,0 +1,51 @@
+package bbloom
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestJaccardSimilarity(t *testing.T) {
+	// A holds 0 to 9999, B holds shared of those and fresh ones.
+	const n = 10000
+	for _, shared := range []int{0, 2500, 5000, 8000, n} {
+		a, b := New(n*2, 0.001), New(n*2, 0.001)
+		fill(&a, n)
+		for i := range n {
+			if i < shared {
+				b.Add(fmt.Appendf(nil, "key-%d", i))
+			} else {
+				b.Add(fmt.Appendf(nil, "other-%d", i))
+			}
+		}
+		want := float64(shared) / float64(2*n-shared)
+		got, err := a.JaccardSimilarity(&b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if math.Abs(got-want) > 0.01 {
+			t.Errorf("%d of %d shared: index %.4f, want %.4f", shared, n, got, want)
+		}
+		if back, _ := b.JaccardSimilarity(&a); back != got {
+			t.Errorf("%d shared: index %v one way, %v the other", shared, got, back)
+		}
+	}
+
+	empty, other := New(1000, 0.01), New(1000, 0.01)
+	if got, err := empty.JaccardSimilarity(&other); err != nil || got != 1 {
+		t.Errorf("two empty filters: %v, %v; want 1", got, err)
+	}
+	small := New(100, 0.01)
+	if _, err := empty.JaccardSimilarity(&small); err == nil {
+		t.Error("filters of different sizes compared")
+	}
+	full := New(100, 0.01)
+	for i := range full.bitset {
+		full.bitset[i] = math.MaxUint64
+	}
+	if _, err := full.JaccardSimilarity(&small); !errors.Is(err, ErrSaturated) {
+		t.Errorf("saturated union: %v, want ErrSaturated", err)
+	}
+}
@@ -10,14 +10,28 @@
 
 package bbloom
 
-// Hash returns the 64-bit SipHash-2-4 of the given byte slice with two 64-bit
-// parts of 128-bit key: k0 and k1.
-func (bl Bloom) sipHash(p []byte) (l, h uint64) {
+// SipKey is a 128-bit SipHash key, as two 64-bit halves.
+type SipKey struct {
+	K0, K1 uint64
+}
+
+// DefaultSipKey is the package's fixed SipHash key, used by every filter
+// whose SipKey is not set and by the other sketches in this package.
+var DefaultSipKey = SipKey{K0: 0xdeadbeaf, K1: 0xfaebdaed}
+
+// sipHash64 returns the full 64-bit SipHash-2-4 of p under DefaultSipKey.
+// It is shared by the Bloom filter and the other sketches in this package.
+func sipHash64(p []byte) uint64 {
+	return DefaultSipKey.sum64(p)
+}
+
+// sum64 returns the full 64-bit SipHash-2-4 of p under k.
+func (k SipKey) sum64(p []byte) uint64 {
 	// Initialization.
-	v0 := uint64(8317987320269560794) // k0 ^ 0x736f6d6570736575
-	v1 := uint64(7237128889637516672) // k1 ^ 0x646f72616e646f6d
-	v2 := uint64(7816392314733513934) // k0 ^ 0x6c7967656e657261
-	v3 := uint64(8387220255325274014) // k1 ^ 0x7465646279746573
+	v0 := k.K0 ^ 0x736f6d6570736575
+	v1 := k.K1 ^ 0x646f72616e646f6d
+	v2 := k.K0 ^ 0x6c7967656e657261
+	v3 := k.K1 ^ 0x7465646279746573
 	t := uint64(len(p)) << 56
 
 	// Compression.
@@ -215,11 +229,5 @@ func (bl Bloom) sipHash(p []byte) (l, h uint64) {
 	v1 ^= v2
 	v2 = v2<<32 | v2>>32
 
-	// return v0 ^ v1 ^ v2 ^ v3
-
-	hash := v0 ^ v1 ^ v2 ^ v3
-	h = hash >> bl.shift
-	l = hash << bl.shift >> bl.shift
-	return l, h
-
+	return v0 ^ v1 ^ v2 ^ v3
 }
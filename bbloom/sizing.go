@@ -0,0 +1,78 @@
+package bbloom
+
+import (
+	"fmt"
+	"math"
+)
+
+// SizeWithFPR returns the size in bits and the number of hash locations of
+// the filter NewWithFPR(entries, fpr) would build, with the same errors, but
+// without allocating it, for planning memory.
+func SizeWithFPR(entries, fpr float64) (bits, locs uint64, err error) {
+	if !(entries >= 1) {
+		return 0, 0, fmt.Errorf("bbloom: need at least 1 entry, got %v", entries)
+	}
+	if !(fpr > 0 && fpr < 1) {
+		return 0, 0, fmt.Errorf("bbloom: false positive rate %v is not between 0 and 1", fpr)
+	}
+	raw, locs := calcSizeByWrongPositives(entries, fpr)
+	bits, _ = getSize(raw)
+	if err := checkSize(float64(bits)); err != nil {
+		return 0, 0, fmt.Errorf("bbloom: %g entries at false positive rate %g %w; reduce the entries or raise the rate", entries, fpr, err)
+	}
+	return bits, locs, nil
+}
+
+// CapacityOf is Capacity for a filter of bits bits with locs hash locations.
+func CapacityOf(bits, locs uint64, fpr float64) uint64 {
+	m, k := float64(bits), float64(locs)
+	// Solve (1 - e^(-k*n/m))^k = fpr for n.
+	return uint64(-m / k * math.Log(1-math.Pow(fpr, 1/k)))
+}
+
+// ExpectedFPROf is ExpectedFPR for a filter of bits bits with locs hash
+// locations.
+func ExpectedFPROf(bits, locs uint64, n float64) float64 {
+	m, k := float64(bits), float64(locs)
+	return math.Pow(1-math.Exp(-k*n/m), k)
+}
+
+// entriesAtFill returns the number of entries expected to fill fill of the
+// m bits of a filter with k hash locations, n = -m/k * ln(1 - fill).
+func entriesAtFill(m, k, fill float64) float64 {
+	return -m / k * math.Log1p(-fill)
+}
+
+// NewBestEffort returns the filter NewWithFPR(entries, targetFPR) would
+// build if it fits in maxBits bits, and otherwise the most accurate filter
+// that does: the largest power of two bits within maxBits (and MaxSize),
+// with the number of hash locations that minimizes the false positive rate
+// at entries. achievedFPR is ExpectedFPR(entries) of the result, at most
+// targetFPR when the target fits and above it when it does not, so callers
+// can tell the two apart. The rate is a property of a filter holding a
+// number of entries, so entries is needed as well as the cap. maxBits must
+// be at least MinSize.
+func NewBestEffort(entries float64, maxBits uint64, targetFPR float64) (bl Bloom, achievedFPR float64, err error) {
+	if maxBits < MinSize {
+		return Bloom{}, 0, fmt.Errorf("bbloom: memory cap of %d bits is below the smallest filter, %d bits", maxBits, MinSize)
+	}
+	bits, locs, err := SizeWithFPR(entries, targetFPR)
+	if err == nil && bits <= maxBits {
+		bl, err = NewWithFPR(entries, targetFPR)
+		return bl, ExpectedFPROf(bits, locs, entries), err
+	}
+	if !(entries >= 1) || !(targetFPR > 0 && targetFPR < 1) {
+		// Invalid arguments rather than a size over the cap.
+		return Bloom{}, 0, err
+	}
+	bits, _ = getSizeDown(min(maxBits, MaxSize))
+	// The optimal k = m/n * ln 2, rounded to whichever neighbor does better.
+	k := max(math.Floor(float64(bits)/entries*math.Ln2), 1)
+	if ExpectedFPROf(bits, uint64(k+1), entries) < ExpectedFPROf(bits, uint64(k), entries) {
+		k++
+	}
+	if bl, err = NewWithLocs(float64(bits), k); err != nil {
+		return Bloom{}, 0, err
+	}
+	return bl, ExpectedFPROf(bits, uint64(k), entries), nil
+}
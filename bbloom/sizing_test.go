@@ -0,0 +1,62 @@
+package bbloom
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestNewBestEffort(t *testing.T) {
+	const entries = 200000
+
+	// The target fits: the filter NewWithFPR builds.
+	bl, achieved, err := NewBestEffort(entries, 1<<24, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := NewWithFPR(entries, 0.01)
+	if bl.size != want.size || bl.setLocs != want.setLocs || achieved > 0.01 {
+		t.Errorf("feasible target: %d bits, %d locations at %g; want NewWithFPR's %d and %d within 0.01",
+			bl.size+1, bl.setLocs, achieved, want.size+1, want.setLocs)
+	}
+
+	// 1e-6 needs about 5.75M bits; a cap of 2M, not a power of two, gets 2^20.
+	bl, achieved, err = NewBestEffort(entries, 2000000, 1e-6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bl.size+1 != 1<<20 {
+		t.Errorf("infeasible target: %d bits, want the 2^20 within the cap", bl.size+1)
+	}
+	if achieved <= 1e-6 || achieved != bl.ExpectedFPR(entries) {
+		t.Errorf("infeasible target: achieved %g, want its expected rate above 1e-6", achieved)
+	}
+	// No other number of hash locations does better at this size.
+	k := bl.setLocs
+	for _, other := range []uint64{k - 1, k + 1} {
+		if rate := ExpectedFPROf(bl.size+1, other, entries); rate < achieved {
+			t.Errorf("%d hash locations give %g, better than the chosen %d's %g", other, rate, k, achieved)
+		}
+	}
+	// The reported rate is what the filter does once full.
+	for i := range entries {
+		bl.Add(fmt.Appendf(nil, "key-%d", i))
+	}
+	const probes = 200000
+	hits := 0
+	for i := range probes {
+		if bl.Has(fmt.Appendf(nil, "absent-%d", i)) {
+			hits++
+		}
+	}
+	if measured := float64(hits) / probes; math.Abs(measured-achieved) > 3*math.Sqrt(achieved/probes)+achieved/10 {
+		t.Errorf("measured false positive rate %g, reported %g", measured, achieved)
+	}
+
+	if _, _, err := NewBestEffort(entries, MinSize-1, 0.01); err == nil {
+		t.Error("cap below the smallest filter accepted")
+	}
+	if _, _, err := NewBestEffort(entries, 1<<20, 1.5); err == nil {
+		t.Error("rate 1.5 accepted")
+	}
+}
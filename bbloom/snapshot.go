@@ -0,0 +1,41 @@
+package bbloom
+
+import (
+	"slices"
+	"sync"
+)
+
+// Snapshot returns a copy of the bitset taken with Mtx held, so it reflects
+// exactly the entries added by TS methods that finished before it. The lock
+// is held only for the copy, so a slow serialization of the copy does not
+// stall writers the way JSONEncode, which holds Mtx throughout, does. Adds
+// through AddIfNotHasAtomic do not take Mtx; a snapshot taken while they run
+// may hold only some of the bits of an entry being added.
+func (bl *Bloom) Snapshot() []uint64 {
+	bl.Mtx.Lock()
+	defer bl.Mtx.Unlock()
+	return slices.Clone(bl.bitset)
+}
+
+// SnapshotFilter returns an independent filter holding a Snapshot of bl,
+// with its geometry, hash, Namespace, SipKey and ElemNum as of the same
+// instant, for checkpointing a live filter: serialize the copy with
+// BinaryMarshal while adds continue on bl. It costs a second bitset of
+// memory while it lives.
+func (bl *Bloom) SnapshotFilter() Bloom {
+	bl.Mtx.Lock()
+	defer bl.Mtx.Unlock()
+	return Bloom{
+		Mtx:       &sync.Mutex{},
+		ElemNum:   bl.ElemNum,
+		Namespace: bl.Namespace,
+		HashFunc:  bl.HashFunc,
+		SipKey:    bl.SipKey,
+		ops:       &opCounters{},
+		bitset:    slices.Clone(bl.bitset),
+		sizeExp:   bl.sizeExp,
+		size:      bl.size,
+		setLocs:   bl.setLocs,
+		shift:     bl.shift,
+	}
+}
@@ -0,0 +1,82 @@
+package bbloom
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// TestSnapshotDuringAdds is meant for go test -race: it snapshots while
+// writers add, and checks each snapshot holds every add that finished
+// before it and nothing the live filter lacks.
+func TestSnapshotDuringAdds(t *testing.T) {
+	const writers, perWriter = 4, 5000
+	bl := New(float64(writers*perWriter), 0.001)
+	var done [writers]atomic.Int64
+	var wg sync.WaitGroup
+	for w := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range perWriter {
+				bl.AddTS(fmt.Appendf(nil, "w%d-%d", w, i))
+				done[w].Store(int64(i + 1))
+				// Let the snapshots in between adds.
+				runtime.Gosched()
+			}
+		}()
+	}
+
+	// Snapshot about every thousand adds until the writers are done.
+	var snaps []Bloom
+	var finished [][writers]int64
+	for next := int64(0); next < writers*perWriter; {
+		var before [writers]int64
+		var total int64
+		for w := range writers {
+			before[w] = done[w].Load()
+			total += before[w]
+		}
+		if total < next {
+			runtime.Gosched()
+			continue
+		}
+		snaps = append(snaps, bl.SnapshotFilter())
+		finished = append(finished, before)
+		next = total + 1000
+	}
+	wg.Wait()
+	if len(snaps) < 3 {
+		t.Fatalf("took %d snapshots, want several during the adds", len(snaps))
+	}
+
+	prev := New(float64(writers*perWriter), 0.001)
+	for s, snap := range snaps {
+		for w := range writers {
+			for i := range finished[s][w] {
+				if !snap.Has(fmt.Appendf(nil, "w%d-%d", w, i)) {
+					t.Fatalf("snapshot %d lacks w%d-%d, added before it was taken", s, w, i)
+				}
+			}
+		}
+		for i, word := range snap.bitset {
+			if word&^bl.bitset[i] != 0 {
+				t.Fatalf("snapshot %d has bits the filter lacks", s)
+			}
+			if prev.bitset[i]&^word != 0 {
+				t.Fatalf("snapshot %d lost bits an earlier one had", s)
+			}
+		}
+		if snap.ElemNum < prev.ElemNum || snap.ElemNum > bl.ElemNum {
+			t.Errorf("snapshot %d counts %d entries, want between %d and %d", s, snap.ElemNum, prev.ElemNum, bl.ElemNum)
+		}
+		prev = snap
+	}
+
+	// Snapshot copies the same bits as SnapshotFilter.
+	if bits := bl.Snapshot(); len(bits) != len(bl.bitset) || &bits[0] == &bl.bitset[0] {
+		t.Error("Snapshot did not copy the bitset")
+	}
+}
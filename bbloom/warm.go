@@ -0,0 +1,36 @@
+package bbloom
+
+import "context"
+
+// warmStride is the number of words between touches in Warm: one per 4 KiB
+// page, the smallest page size the filter is likely to be mapped with.
+const warmStride = 4096 / 8
+
+// warmCheck is the number of words Warm touches between checks of ctx.
+const warmCheck = 1 << 17
+
+// warmSink keeps the loads in Warm from being optimized away.
+var warmSink uint64
+
+// Warm reads the bitset front to back so that a filter whose memory came
+// from NewFromBuffer, such as a memory-mapped file, is faulted in by one
+// sequential pass instead of by the first random queries. It touches one
+// word per page and returns ctx.Err() if ctx is done before it finishes.
+// Filters whose bitset was allocated by this package are already resident,
+// and Warm returns nil for them without reading anything.
+func (bl *Bloom) Warm(ctx context.Context) error {
+	if !bl.external {
+		return nil
+	}
+	var sum uint64
+	for i := 0; i < len(bl.bitset); i += warmStride {
+		if i%warmCheck == 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+		sum += bl.bitset[i]
+	}
+	warmSink = sum
+	return nil
+}
@@ -0,0 +1,61 @@
+package bbloom
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestWarm(t *testing.T) {
+	bl, err := NewFromBuffer(make([]uint64, 1<<20), 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bl.Add([]byte("entry"))
+	if err := bl.Warm(context.Background()); err != nil {
+		t.Fatalf("Warm: %v", err)
+	}
+	if !bl.Has([]byte("entry")) {
+		t.Fatal("entry missing after Warm")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := bl.Warm(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("Warm with a canceled context: %v, want context.Canceled", err)
+	}
+	// A filter that allocated its own bitset has nothing to fault in.
+	own := New(1<<20, 4)
+	if err := own.Warm(ctx); err != nil {
+		t.Errorf("Warm of an allocated filter: %v, want nil", err)
+	}
+}
+
+// BenchmarkFirstQueries times the first queries of a filter over a freshly
+// allocated, not yet touched buffer, with and without Warm beforehand.
+func BenchmarkFirstQueries(b *testing.B) {
+	const words = 32 << 20 >> 3 // 32 MiB
+	keys := make([][]byte, 1000)
+	for i := range keys {
+		keys[i] = fmt.Appendf(nil, "key-%d", i)
+	}
+	for _, warm := range []bool{false, true} {
+		b.Run(fmt.Sprintf("warm=%v", warm), func(b *testing.B) {
+			for range b.N {
+				b.StopTimer()
+				bl, err := NewFromBuffer(make([]uint64, words), 4)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if warm {
+					bl.Warm(context.Background())
+				}
+				b.StartTimer()
+				for _, key := range keys {
+					bl.Has(key)
+				}
+			}
+		})
+	}
+}
@@ -2,207 +2,1452 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"compress/gzip"
+	"errors"
 	"flag"
 	"fmt"
+	"hash/maphash"
 	"io"
+	"io/fs"
+	"math"
 	"os"
 	"runtime"
 	"sync"
+	"time"
+	"unicode/utf8"
 
 	"github.com/mylh/bdedup/bbloom" // Import the bbloom package for Bloom filter functionality
+	"github.com/mylh/bdedup/diskset"
 )
 
+// keySet is the membership structure lines are deduplicated against: a Bloom
+// filter by default, or a disk-backed exact set with -exact.
+type keySet interface {
+	Has(entry []byte) bool
+	Add(entry []byte)
+	AddIfNotHasTS(entry []byte) bool
+}
+
 var (
-	inputFile     string
-	outputFile    string
-	stateFile     string
-	numValues     float64
-	falsePositive float64
-	returnSeen    bool
-	concurrency   int
-	noGzip        bool
+	inputFile         string
+	outputFile        string
+	stateFile         string
+	numValues         float64
+	falsePositive     float64
+	returnSeen        bool
+	concurrency       int
+	noGzip            bool
+	exact             bool
+	exitOnDup         bool
+	ignoreBadState    bool
+	strict            bool
+	flushInterval     time.Duration
+	annotate          bool
+	newTag            string
+	seenTag           string
+	seedFile          string
+	learnFile         string
+	withCounts        bool
+	noTrailingNewline bool
+	reverse           bool
+	skipErrors        bool
+	baseFile          string
+	showStats         bool
+	summaryOnly       bool
+	showInfo          bool
+	jsonOutput        bool
+	statsToStdout     bool
+	chanBuffer        int
+	twoPass           bool
+	cardinality       bool
+	outputCompress    string
+	chunkLines        int
+	walFile           string
+	walSync           int
+	resume            bool
+	checkpointEvery   int
+	dupLinesFile      string
+	roundDown         bool
+	hashFunc          bbloom.Hash
+	hashSet           bool
+	profileRun        bool
+	recoverState      bool
+	// stateRecovered is set when readBloomFilter recovered the -state file
+	// from a truncated one under -recover-state, so that it is written back
+	// whole.
+	stateRecovered bool
 )
 
 func init() {
 	flag.StringVar(&inputFile, "input", "", "Input file (default: stdin)")
+	flag.BoolVar(&preHashed, "pre-hashed", false, "Keys are 64-bit hashes in 16 hex digits, used for the filter's bits without hashing again")
+	flag.StringVar(&keyInputFile, "key-input", "", "File whose lines are the keys of the input lines, in the same order")
+	flag.IntVar(&skipLines, "skip", 0, "Read but do not process the first N input lines")
+	flag.IntVar(&takeLines, "take", 0, "Process at most M input lines after -skip, then stop reading (0: no limit)")
 	flag.StringVar(&outputFile, "output", "", "Output file (default: stdout)")
 	flag.StringVar(&stateFile, "state", "bloom.gz", "Bloom filter state file")
 	flag.Float64Var(&numValues, "n", 1000000, "Expected number of values")
 	flag.Float64Var(&falsePositive, "p", 0.01, "False positive probability")
 	flag.BoolVar(&returnSeen, "seen", false, "Return only seen items (default: return new items)")
-	flag.IntVar(&concurrency, "concurrency", runtime.NumCPU(), "Number of concurrent workers")
+	flag.IntVar(&concurrency, "concurrency", runtime.NumCPU(), "Number of concurrent workers (1 disables parallel processing)")
 	flag.BoolVar(&noGzip, "no-gzip", false, "Disable gzip compression for state file")
+	flag.BoolVar(&exact, "exact", false, "Use an exact disk-backed set instead of a Bloom filter")
+	flag.IntVar(&minCount, "min-count", 0, "Emit up to this many copies of each key before treating it as a duplicate (0: one)")
+	flag.Uint64Var(&maxAdds, "max-adds", 0, "Stop adding keys to the filter after this many in one run, still emitting by what it holds (0: no limit)")
+	flag.BoolVar(&adjacent, "adjacent", false, "Like uniq, only drop lines whose key equals the previous line's; no filter or state")
+	flag.DurationVar(&flushInterval, "flush-interval", time.Second, "Flush buffered output at this interval (0: only when the buffer fills)")
+	flag.BoolVar(&annotate, "annotate", false, "Emit every line, prefixed with -new-tag or -seen-tag")
+	flag.StringVar(&newTag, "new-tag", "NEW\t", "Prefix for new lines under -annotate")
+	flag.StringVar(&seenTag, "seen-tag", "SEEN\t", "Prefix for seen lines under -annotate")
+	flag.StringVar(&seedFile, "seed-file", "", "File whose lines are added to the filter before processing")
+	flag.StringVar(&learnFile, "learn", "", "Same as -seed-file: learn the keys of this file without writing its lines, then filter the input")
+	flag.BoolVar(&withCounts, "with-counts", false, "Emit each new line as count<TAB>line once the input ends")
+	flag.BoolVar(&reverse, "reverse", false, "Process lines last to first, so the last occurrence is kept")
+	flag.BoolVar(&noTrailingNewline, "no-trailing-newline", false, "End the output without a line ending if the input's last line had none")
+	flag.Func("record-delimiter", "Split the input into records on this string instead of lines, e.g. \"\\n\\n\" for paragraphs (default: newline)", parseRecordDelimiter)
+	flag.BoolVar(&skipErrors, "skip-errors", false, "Skip and count bad input records instead of stopping")
+	flag.StringVar(&baseFile, "base", "", "Read-only Bloom filter of keys to always treat as seen")
+	flag.BoolVar(&showStats, "stats", false, "Print run and filter statistics to stderr at the end")
+	flag.BoolVar(&summaryOnly, "summary-only", false, "Write no output lines, only the -stats summary; the filter is still updated and saved")
+	flag.BoolVar(&showInfo, "info", false, "Print information about the state filter and exit")
+	flag.BoolVar(&queryOnly, "query-only", false, "Write each input line with yes or no for whether it is in the -state filter, or with -seen only those that are; never adds to or saves the filter")
+	flag.BoolVar(&jsonOutput, "json", false, "Print -stats and -info as a single JSON object")
+	flag.BoolVar(&statsToStdout, "stats-to-stdout", false, "Print -stats, -cardinality and -key-length-stats to stdout, after the output when that is stdout too")
+	flag.IntVar(&chanBuffer, "chan-buffer", defaultChanBuffer, "Channel buffer per worker in parallel mode, in batches of -chunk-lines (0: unbuffered)")
+	flag.IntVar(&chunkLines, "chunk-lines", 1, "Lines sent to a worker at once in parallel mode")
+	flag.IntVar(&shardField, "shard-field", 0, "1-based field whose value routes each line to one of -shard-count filters, e.g. a tenant ID")
+	flag.IntVar(&shardCount, "shard-count", 0, "Number of filters under -shard-field, each saved to the state file with its number, as bloom.0.gz (at most 256)")
+	flag.BoolVar(&verify, "verify", false, "After the run, read the -output back and check that every line's key is in the filter")
+	flag.BoolVar(&verifyExact, "verify-exact", false, "-verify, and also check with an exact set that no key was emitted as new twice")
+	flag.BoolVar(&parallelHash, "parallel-hash", false, "In parallel mode, only hash keys on the workers and set the filter bits on one goroutine, for long keys")
+	flag.BoolVar(&twoPass, "two-pass", false, "Size a new filter from a first pass over the -input file (requires a seekable input)")
+	flag.BoolVar(&cardinality, "cardinality", false, "Estimate the number of distinct input keys and print it at the end")
+	flag.BoolVar(&keyLengthStats, "key-length-stats", false, "Report the min, mean, max and approximate p50, p90 and p99 of the key lengths at the end")
+	flag.BoolVar(&tune, "tune", false, "Estimate the distinct keys of the input as a sample, print the -n and -p to use and exit")
+	flag.Var(&readBuffer, "read-buffer", "Size of the reads the input is taken in, e.g. 1MiB; 0 to read as the scanner asks (default: 256KiB)")
+	flag.Var(&tuneMemory, "tune-memory", "Memory budget for -tune, e.g. 512MiB; report the -p it allows instead of the memory -p needs")
+	flag.IntVar(&minLen, "min-len", 0, "Reject lines shorter than this many bytes")
+	flag.IntVar(&maxLen, "max-len", 0, "Reject lines longer than this many bytes (0: no limit)")
+	flag.IntVar(&requireFields, "require-fields", 0, "Reject lines without exactly this many -delimiter separated fields (0: no check)")
+	flag.Func("no-match", "What to do with lines -key-regex does not match: line to key them on the whole line, drop to reject them, or pass to write them without deduplicating them (default: line)", parseNoMatch)
+	flag.StringVar(&rejectOutput, "reject-output", "", "File receiving rejected lines (default: drop them)")
+	flag.Func("input-charset", "Charset of the input, e.g. latin1 or utf-16le, transcoded to UTF-8 before processing; a BOM overrides it (default: bytes as they are)", parseInputCharset)
+	flag.Func("output-charset", "Charset to transcode the output to from UTF-8, e.g. latin1 (default: utf-8)", parseOutputCharset)
+	flag.StringVar(&outputCompress, "output-compress", "none", "Compress the output with this codec: none or gzip")
+	flag.StringVar(&splitPrefix, "split-output", "", "Write output lines to PREFIX.0 to PREFIX.K-1 by a stable hash of the key instead of -output")
+	flag.IntVar(&splitCount, "splits", 0, "Number of -split-output files")
+	flag.StringVar(&walFile, "wal", "", "Append every newly seen key to this log, for rebuilding with compact -from-wal")
+	flag.Float64Var(&growAt, "grow-at", 0, "Rebuild the filter at twice the size from the -wal log once its fill ratio reaches this (0: never)")
+	flag.IntVar(&walSync, "wal-sync", 1000, "Fsync the -wal log after this many keys (0: only at exit)")
+	flag.BoolVar(&resume, "resume", false, "Checkpoint progress next to -state and continue an interrupted run from it (requires a seekable -input)")
+	flag.IntVar(&checkpointEvery, "checkpoint-every", 1000000, "Lines between -resume checkpoints")
+	flag.IntVar(&shingleSize, "shingle", 0, "Treat lines as duplicates by overlapping windows of this many key bytes (0: exact keys)")
+	flag.Float64Var(&shingleThreshold, "shingle-threshold", 0.8, "Fraction of a line's -shingle windows that must have been seen for it to be a duplicate")
+	flag.StringVar(&deltaFile, "delta-output", "", "File receiving the lines whose keys this run added to the filter, even under -seen")
+	flag.StringVar(&dupLinesFile, "dup-lines", "", "File receiving the 1-based input line number of every duplicate")
+	flag.Func("hash", "Hash of a new filter: siphash, murmur3 or xxhash (default: siphash, or the state file's)", parseHash)
+	flag.BoolVar(&roundDown, "round-down", false, "Round a new filter's size down to a power of two instead of up, trading accuracy for memory")
+	registerKeyFlags(flag.CommandLine)
+	flag.BoolVar(&profileRun, "profile", false, "Print where the run's time went (input, filter hashing and bits, output, state) to stderr; runs on one worker")
+	flag.BoolVar(&exitOnDup, "exit-on-dup", false, "Exit with status 1 if any duplicate was seen")
+	registerRetryFlags(flag.CommandLine)
+	registerLogFlags(flag.CommandLine)
+	flag.BoolVar(&ignoreBadState, "ignore-bad-state", false, "Start with a fresh filter if the state file cannot be read")
+	flag.BoolVar(&recoverState, "recover-state", false, "Keep the readable part of a state file whose bitset is cut short, and save it whole")
+	flag.BoolVar(&strict, "strict", false, "Exit instead of warning when the state filter's estimated false positive rate is well above -p")
 	flag.Usage = func() {
 		fmt.Fprintf(flag.CommandLine.Output(),
 			`Efficient command-line deduplication tool that uses a Bloom filter for high-performance duplicate detection in large datasets or streams.
 
 Usage: %[1]s [options]
+       %[1]s compact -rebuild-from uniques.txt [-state old.gz] [-o new.gz] [-p 0.01]
+       %[1]s compact -from-wal keys.wal [-state old.gz] [-o new.gz] [-p 0.01]
+       %[1]s merge -o merged.gz shard1.gz shard2.gz ...
+       %[1]s serve [-state bloom.gz] [-addr localhost:8080] [-save-every 1m]
+       %[1]s diff -a old.txt -b new.txt [-added | -removed] [-o out.txt] [-save filter.gz]
+       %[1]s export -wal keys.wal [-o keys.txt]
+       %[1]s convert -in old.json -out new.gz
+       %[1]s diag-collisions -input sample.txt [-n 1000000] [-p 0.01] [-top 10]
 
 Options:
   -input         Input file (default: stdin)
+  -pre-hashed    Keys are 64-bit hashes in 16 hex digits, used for the filter's bits without hashing again (default: false)
+  -key-input     File whose lines are the keys of the input lines, in the same order (default: keys from the input)
+  -skip          Read but do not process the first N input lines (default: 0)
+  -take          Process at most M input lines after -skip, then stop reading, 0 for no limit (default: 0)
   -output        Output file (default: stdout)
   -state         Bloom filter state file (default: bloom.gz)
   -n             Expected number of values (default: 1000000)
   -p             False positive probability (default: 0.01)
   -seen          Return only seen items (default: return new items)
-  -concurrency   Number of concurrent workers (default: number of CPUs)
+  -concurrency   Number of concurrent workers, 1 to process sequentially (default: number of CPUs)
+  -chan-buffer   Channel buffer per worker in parallel mode, in batches of -chunk-lines, 0 for unbuffered (default: 256)
+  -chunk-lines   Lines sent to a worker at once in parallel mode (default: 1)
+  -shard-field   1-based field whose value routes each line to one of -shard-count filters, e.g. a tenant ID (default: none)
+  -shard-count   Number of filters under -shard-field, each saved to the state file with its number, as bloom.0.gz, at most 256 (default: none)
+  -verify        After the run, read the -output back and check that every line's key is in the filter (default: false)
+  -verify-exact  -verify, and also check with an exact set that no key was emitted as new twice (default: false)
+  -parallel-hash  In parallel mode, only hash keys on the workers and set the filter bits on one goroutine, for long keys (default: false)
+  -two-pass      Size a new filter from a first pass over the -input file, which must be seekable (default: false)
+  -cardinality   Estimate the number of distinct input keys and print it at the end (default: false)
+  -key-length-stats  Report the min, mean, max and approximate p50, p90 and p99 of the key lengths at the end (default: false)
+  -tune          Estimate the distinct keys of the input as a sample, print the -n and -p to use and exit (default: false)
+  -read-buffer   Size of the reads the input is taken in, e.g. 1MiB, 0 to read as the scanner asks; lines are still limited to 64 KiB (default: 256KiB)
+  -tune-memory   Memory budget for -tune, e.g. 512MiB; report the -p it allows instead of the memory -p needs (default: none)
+  -min-len       Reject lines shorter than this many bytes (default: 0)
+  -max-len       Reject lines longer than this many bytes, 0 for no limit (default: 0)
+  -require-fields  Reject lines without exactly this many -delimiter separated fields, 0 for no check (default: 0)
+  -no-match      Lines -key-regex does not match: line to key them on the whole line, drop to reject them, pass to write them without deduplicating them (default: line)
+  -reject-output  File receiving rejected lines (default: drop them)
+  -input-charset  Charset of the input, e.g. latin1 or utf-16le, transcoded to UTF-8 before processing; a BOM overrides it (default: bytes as they are)
+  -output-charset  Charset to transcode the output to from UTF-8, e.g. latin1 (default: utf-8)
+  -output-compress  Compress the output with this codec: none or gzip (default: none)
+  -split-output  Write output lines to PREFIX.0 to PREFIX.K-1 by a stable hash of the key instead of -output (default: none)
+  -splits        Number of -split-output files (default: 0)
+  -wal           Append every newly seen key to this log, for rebuilding with compact -from-wal (default: none)
+  -grow-at       Rebuild the filter at twice the size from the -wal log once its fill ratio reaches this, 0 for never (default: 0)
+  -wal-sync      Fsync the -wal log after this many keys, 0 for only at exit (default: 1000)
+  -resume        Checkpoint progress next to -state and continue an interrupted run from it; needs a seekable -input (default: false)
+  -checkpoint-every  Lines between -resume checkpoints (default: 1000000)
+  -shingle       Treat lines as duplicates by overlapping windows of this many key bytes, 0 for exact keys (default: 0)
+  -shingle-threshold  Fraction of a line's -shingle windows that must have been seen for it to be a duplicate (default: 0.8)
+  -delta-output  File receiving the lines whose keys this run added to the filter; the output itself without -seen (default: none)
+  -dup-lines     File receiving the 1-based input line number of every duplicate (default: none)
+  -hash          Hash of a new filter: siphash, murmur3 or xxhash; an existing filter must match (default: siphash, or the state file's)
+  -round-down    Round a new filter's size down to a power of two instead of up, trading accuracy for memory (default: false)
   -no-gzip       Disable gzip compression for state file (default: false)
+  -min-count     Emit up to this many copies of each key before treating it as a duplicate, 0 for one (default: 0)
+  -max-adds      Stop adding keys to the filter after this many in one run, still emitting by what it holds, 0 for no limit (default: 0)
+  -adjacent      Like uniq, only drop lines whose key equals the previous line's; uses no filter or state (default: false)
+  -exact         Use an exact disk-backed set stored in -state instead of a Bloom filter (default: false)
+  -namespace     Prefix prepended to every key before hashing (default: none)
+  -profile       Print where the run's time went (input, filter hashing and bits, output, state) to stderr; runs on one worker (default: false)
+  -exit-on-dup   Exit with status 1 if any duplicate was seen (default: false)
+  -ignore-bad-state  Warn and start with a fresh filter if the state file cannot be read (default: false)
+  -recover-state  Keep the readable part of a state file whose bitset is cut short, and save it whole (default: false)
+  -io-retries    Retry a failed state load or save this many times (default: 0)
+  -io-retry-delay  Wait before the first -io-retries retry, doubling for each one after it (default: 1s)
+  -log-level     Least severe diagnostics to log: debug, info, warn or error (default: info)
+  -log-format    Format of diagnostics on stderr: plain, text or json (default: plain)
+  -strict        Exit instead of warning when the state filter's estimated false positive rate is over twice -p (default: false)
+  -flush-interval  Flush buffered output at this interval, 0 to flush only when full (default: 1s)
+  -annotate      Emit every line, prefixed with -new-tag or -seen-tag (default: false)
+  -new-tag       Prefix for new lines under -annotate (default: "NEW\t")
+  -seen-tag      Prefix for seen lines under -annotate (default: "SEEN\t")
+  -seed-file     File whose lines are added to the filter before processing (default: none)
+  -learn         Same as -seed-file: learn the keys of this file without writing its lines, then filter the input (default: none)
+  -with-counts   Emit each new line as count<TAB>line once the input ends (default: false)
+  -reverse       Process lines last to first, so the last occurrence is kept (default: false)
+  -no-trailing-newline  End the output without a line ending if the input's last line had none (default: false)
+  -record-delimiter  Split the input into records on this string instead of lines, e.g. "\n\n" for paragraphs (default: newline)
+  -skip-errors   Skip and count bad input records (lines over 64 KiB) instead of stopping (default: false)
+  -base          Read-only Bloom filter of keys to always treat as seen; never modified (default: none)
+  -stats         Print run and filter statistics to stderr at the end (default: false)
+  -summary-only  Write no output lines, only the -stats summary; the filter is still updated and saved (default: false)
+  -info          Print information about the state filter and exit (default: false)
+  -query-only    Write each input line with yes or no for whether it is in the -state filter, or with -seen only those that are; never adds to or saves the filter (default: false)
+  -json          Print -stats and -info as a single JSON object (default: false)
+  -stats-to-stdout  Print -stats, -cardinality and -key-length-stats to stdout, after the output when that is stdout too (default: false)
+  -field         Comma-separated 1-based fields forming the key, e.g. 1,3 (default: whole line)
+  -delimiter     Field delimiter for -field (default: tab, or comma for -input-format csv)
+  -input-format  Input record format: lines, or csv for quoted fields that may span lines (default: lines)
+  -key-sep       Separator joining the -field values into the key (default: the delimiter)
+  -trim-trailing  Drop trailing delimiters from lines before deriving keys, so padded records match (default: false)
+  -normalize-unicode  Normalize keys to Unicode NFC, so composed and decomposed accents match (default: false)
+  -fold          Lowercase keys and strip accents from Latin letters, so José matches jose (default: false)
+  -key-regex     Regexp whose first capture group, or whole match, in the line is the key, e.g. user=(\w+) (default: whole line)
+  -mask          Regexp whose matches in the key are replaced by a placeholder before hashing (default: none)
+  -transform     Pipeline applied to the key before hashing, e.g. lower|trim|prefix:id=|take:16 (default: none)
+
+Environment:
+  BDEDUP_SEED    SipHash key as two 64-bit hex numbers, k0:k1; every run on a state file must use the same one (default: built-in key)
 
 Examples:
   cat data.txt | %[1]s -n 10000 -p 0.001 > deduped.txt
   %[1]s -input infile -output outfile -state mystate.gz
+  %[1]s -exact -input infile -output outfile -state seen.set
+  %[1]s -field 1,3 -delimiter , -input events.csv
 
 `, os.Args[0])
 	}
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "compact" {
+		compactMain(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "diff" {
+		diffMain(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "merge" {
+		mergeMain(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "serve" {
+		serveMain(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "export" {
+		exportMain(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "convert" {
+		convertMain(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "diag-collisions" {
+		diagCollisionsMain(os.Args[2:])
+		return
+	}
 	flag.Parse()
 
-	hasNewItems := false
-	bf := loadBloomFilter()
+	os.Exit(run())
+}
+
+// run deduplicates the input and returns the exit status: 1 on an error, or
+// if -exit-on-dup is set and a duplicate was seen. State and output are
+// finalized by its deferred calls before it returns.
+func run() (status int) {
+	if learnFile != "" {
+		if seedFile != "" && seedFile != learnFile {
+			logErrorf("-learn is another name for -seed-file; give only one of them")
+			os.Exit(2)
+		}
+		seedFile = learnFile
+	}
+	if chanBuffer < 0 {
+		logErrorf("-chan-buffer must not be negative")
+		os.Exit(2)
+	}
+	if walSync < 0 {
+		logErrorf("-wal-sync must not be negative")
+		os.Exit(2)
+	}
+	if chunkLines < 1 {
+		logErrorf("-chunk-lines must be at least 1")
+		os.Exit(2)
+	}
+	if profileRun {
+		// Deferred first, so the report follows the state save.
+		prof = newRunProfile()
+		defer prof.report(os.Stderr)
+	}
+	if resume {
+		checkResumeFlags()
+	}
+	checkWindowFlags()
+	checkKeyRegexFlags()
+	checkCharsetFlags()
+	if deltaFile != "" {
+		checkDeltaFlags()
+	}
+	if parallelHash {
+		checkParallelHashFlags()
+	}
+	if shardField != 0 || shardCount != 0 {
+		checkShardFlags()
+	}
+	if verify || verifyExact {
+		checkVerifyFlags()
+	}
+	if maxAdds > 0 {
+		checkMaxAddsFlags()
+	}
+	if keyInputFile != "" {
+		checkKeyInputFlags()
+	}
+	if preHashed {
+		checkPreHashedFlags()
+	}
+	if growAt != 0 {
+		checkGrowFlags()
+	}
+	if adjacent {
+		checkAdjacentFlags()
+	}
+	if splitPrefix != "" {
+		checkSplitFlags()
+	}
+	if noTrailingNewline && (reverse || splitPrefix != "") {
+		logErrorf("-no-trailing-newline cannot be combined with -reverse or -split-output")
+		os.Exit(2)
+	}
+	if recordDelimiter != "" && (csvInput() || reverse || skipErrors) {
+		logErrorf("-record-delimiter cannot be combined with -input-format csv, -reverse or -skip-errors")
+		os.Exit(2)
+	}
+	if csvInput() {
+		if reverse {
+			logErrorf("-reverse cannot be combined with -input-format csv")
+			os.Exit(2)
+		}
+		if r, _ := utf8.DecodeRuneInString(delimiter()); utf8.RuneCountInString(delimiter()) != 1 || r == '"' || r == '\r' || r == '\n' {
+			logErrorf("-delimiter must be a single character other than a quote or line break for -input-format csv")
+			os.Exit(2)
+		}
+	}
+	if minCount < 0 {
+		logErrorf("-min-count must not be negative")
+		os.Exit(2)
+	}
+	if minCount > 0 && (shingleSize > 0 || adjacent) {
+		logErrorf("-min-count cannot be combined with -shingle or -adjacent")
+		os.Exit(2)
+	}
+	if shingleSize < 0 || !(shingleThreshold > 0 && shingleThreshold <= 1) {
+		logErrorf("-shingle must not be negative and -shingle-threshold must be in (0, 1]")
+		os.Exit(2)
+	}
+	if summaryOnly {
+		if outputFile != "" || splitPrefix != "" {
+			logErrorf("-summary-only cannot be combined with -output or -split-output")
+			os.Exit(2)
+		}
+		showStats = true
+	}
+	if readBuffer > maxReadBuffer {
+		logErrorf("-read-buffer must be at most %v", byteSize(maxReadBuffer))
+		os.Exit(2)
+	}
+	if tuneMemory > 0 && !tune {
+		logErrorf("-tune-memory requires -tune")
+		os.Exit(2)
+	}
+	if tune {
+		return runTune()
+	}
+	if queryOnly {
+		checkQueryFlags()
+		return runQuery()
+	}
+	// -exit-on-dup sets the status after every other deferred call, so that
+	// they can tell a run that found duplicates from one that failed.
+	var dupSeen bool
 	defer func() {
-		if hasNewItems {
-			saveBloomFilter(bf)
+		if status == 0 && dupSeen {
+			status = 1
 		}
 	}()
+	hasNewItems := false
+	var from resumePoint
+	var set keySet
+	var describe func() *filterInfo
+	if adjacent {
+		set = &adjacentSet{}
+		describe = func() *filterInfo { return &filterInfo{Kind: "adjacent"} }
+	} else if exact {
+		if baseFile != "" {
+			logErrorf("-base cannot be combined with -exact")
+			os.Exit(2)
+		}
+		if twoPass {
+			logErrorf("-two-pass cannot be combined with -exact")
+			os.Exit(2)
+		}
+		ds := openExactSet()
+		defer closeExactSet(ds, &status)
+		set = ds
+		describe = func() *filterInfo { return &filterInfo{Kind: "exact"} }
+	} else if shardField != 0 {
+		shards = loadShards(stateFile, shardCount)
+		defer func() {
+			if err := shards.save(stateFile); err != nil {
+				logErrorf("%v", err)
+				status = 1
+			}
+		}()
+		set = shards
+		describe = shards.info
+	} else {
+		if twoPass {
+			sizeFromInput()
+		}
+		var bf bbloom.Bloom
+		resuming := false
+		if resume {
+			bf, from, resuming = loadCheckpoint(checkpointPath())
+			// The checkpoint is only dropped once the run has finished
+			// and the state file is saved, even if -exit-on-dup then
+			// sets status 1.
+			defer func() {
+				if status == 0 {
+					os.Remove(checkpointPath())
+				}
+			}()
+		}
+		if resuming {
+			// The checkpointed filter may hold keys the state file lacks.
+			hasNewItems = true
+		} else {
+			t := time.Now()
+			bf = loadBloomFilter(stateFile)
+			if prof != nil {
+				prof.stateLoad += time.Since(t)
+			}
+			hasNewItems = stateRecovered
+		}
+		checkHash(&bf, "state file "+stateFile)
+		defer func() {
+			if hasNewItems {
+				t := time.Now()
+				if err := saveBloomFilter(stateFile, bf); err != nil {
+					logErrorf("%v", err)
+					status = 1
+				}
+				if prof != nil {
+					prof.stateSave += time.Since(t)
+				}
+			}
+		}()
+		set = &bf
+		if preHashed {
+			set = preHashedSet{&bf}
+		}
+		describe = func() *filterInfo { return bloomInfo(&bf) }
+		if prof != nil {
+			prof.watch(&bf)
+		}
+		if growAt != 0 {
+			growth = newGrower(&bf)
+		}
+		if resume {
+			checkpoints = &checkpointer{path: checkpointPath(), bf: &bf, base: from.input, every: checkpointEvery}
+		}
+		if baseFile != "" {
+			t := time.Now()
+			base := loadBaseFilter(baseFile)
+			if prof != nil {
+				prof.stateLoad += time.Since(t)
+				prof.watch(&base)
+			}
+			set = &bbloom.Layered{Base: &base, Overlay: &bf}
+		}
+	}
+
+	if shingleSize > 0 {
+		set = &shingleSet{set: set}
+	}
+	if maxAdds > 0 {
+		capped := &cappedSet{set: set}
+		defer capped.report()
+		set = capped
+	}
+	if minCount > 0 {
+		set = newMinCountSet(set)
+	}
+
+	if showInfo {
+		if err := printSummary(os.Stdout, summary{Filter: describe()}); err != nil {
+			logErrorf("writing info: %v", err)
+			status = 1
+		}
+		return status
+	}
+
+	if walFile != "" {
+		var err error
+		if wal, err = openWAL(walFile, walSync); err != nil {
+			logErrorf("opening WAL: %v", err)
+			os.Exit(1)
+		}
+		defer func() {
+			if err := wal.Close(); err != nil {
+				logErrorf("writing WAL: %v", err)
+				status = 1
+			}
+		}()
+	}
+
+	if seedFile != "" && seedSet(seedFile, set) {
+		hasNewItems = true
+	}
 
 	var input io.Reader = os.Stdin
 	var output io.Writer = os.Stdout
 
+	if file := openKeyInput(); file != nil {
+		defer file.Close()
+	}
+
 	if inputFile != "" {
 		file, err := os.Open(inputFile)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error opening input file: %v\n", err)
+			logErrorf("opening input file: %v", err)
 			os.Exit(1)
 		}
 		defer file.Close()
+		if from.input > 0 {
+			seekInput(file, from)
+		}
+		if checkpoints != nil {
+			checkpoints.stamp(file)
+		}
 		input = file
 	}
+	input = decodeInput(input)
 
+	if reverse {
+		var err error
+		if input, err = reverseInput(input); err != nil {
+			logErrorf("reading input: %v", err)
+			os.Exit(1)
+		}
+	}
+
+	var outFile *os.File
 	if outputFile != "" {
-		file, err := os.Create(outputFile)
+		var err error
+		if resume {
+			outFile = openResumedOutput(outputFile, from.output)
+		} else if outFile, err = os.Create(outputFile); err != nil {
+			logErrorf("creating output file: %v", err)
+			os.Exit(1)
+		}
+		defer outFile.Close()
+		output = outFile
+	}
+
+	if summaryOnly {
+		output = io.Discard
+	}
+	// Under -split-output, the shards are compressed instead.
+	if outputCompress != "none" && splitPrefix == "" {
+		cw, err := newCompressor(outputCompress, output)
+		if err != nil {
+			logErrorf("-output-compress: %v", err)
+			os.Exit(2)
+		}
+		// Registered before out's Close, so it runs after out is flushed;
+		// the -output-charset encoder below, registered later, closes first.
+		defer func() {
+			if err := cw.Close(); err != nil {
+				logErrorf("writing output: %v", err)
+				status = 1
+			}
+		}()
+		output = cw
+	}
+	if outputEncoding != nil {
+		ew := encodeOutput(output)
+		defer func() {
+			if err := ew.Close(); err != nil {
+				logErrorf("writing output: %v", err)
+				status = 1
+			}
+		}()
+		output = ew
+	}
+	if prof != nil {
+		output = profiledWriter{w: output, p: prof}
+	}
+
+	out := newFlushWriter(output, flushInterval)
+	defer func() {
+		if err := out.Close(); err != nil {
+			logErrorf("writing output: %v", err)
+			status = 1
+		}
+	}()
+
+	if splitPrefix != "" {
+		var err error
+		if splits, err = openSplitOutput(splitPrefix, splitCount); err != nil {
+			logErrorf("creating split output: %v", err)
+			os.Exit(1)
+		}
+		defer func() {
+			if err := splits.Close(); err != nil {
+				logErrorf("writing split output: %v", err)
+				status = 1
+			}
+		}()
+	}
+
+	if rejectOutput != "" {
+		file, err := os.Create(rejectOutput)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error creating output file: %v\n", err)
+			logErrorf("creating reject output file: %v", err)
 			os.Exit(1)
 		}
 		defer file.Close()
-		output = file
+		rw := newFlushWriter(file, flushInterval)
+		defer func() {
+			if err := rw.Close(); err != nil {
+				logErrorf("writing rejected lines: %v", err)
+				status = 1
+			}
+		}()
+		rejects = rw
 	}
 
-	if inputFile != "" {
-		processInParallel(input, output, &bf, &hasNewItems)
-	} else {
-		processStream(input, output, &bf, &hasNewItems)
+	if dupLinesFile != "" {
+		file, err := os.Create(dupLinesFile)
+		if err != nil {
+			logErrorf("creating duplicate line numbers file: %v", err)
+			os.Exit(1)
+		}
+		defer file.Close()
+		dw := newFlushWriter(file, flushInterval)
+		defer func() {
+			if err := dw.Close(); err != nil {
+				logErrorf("writing duplicate line numbers: %v", err)
+				status = 1
+			}
+		}()
+		dupLines = dw
 	}
-}
 
-func loadBloomFilter() bbloom.Bloom {
-	if _, err := os.Stat(stateFile); os.IsNotExist(err) {
-		return bbloom.New(numValues, falsePositive)
+	if deltaFile != "" {
+		file, err := os.Create(deltaFile)
+		if err != nil {
+			logErrorf("creating delta output file: %v", err)
+			os.Exit(1)
+		}
+		defer file.Close()
+		dw := newFlushWriter(file, flushInterval)
+		defer func() {
+			if err := dw.Close(); err != nil {
+				logErrorf("writing delta output: %v", err)
+				status = 1
+			}
+		}()
+		deltaLines = dw
+	}
+
+	// final is where the last output lines are written: out, or out with
+	// its last line ending held back under -no-trailing-newline.
+	var final io.Writer = out
+	var held *heldEndWriter
+	if noTrailingNewline {
+		held = &heldEndWriter{w: out, end: []byte(recordEnd())}
+		final = held
+	}
+	// records is the output's single writer: every output record goes
+	// through it, whichever goroutine produced it.
+	records := newRecordWriter(final, parallelRun())
+	if checkpoints != nil {
+		checkpoints.records, checkpoints.out, checkpoints.file = records, out, outFile
+	}
+	var processed io.Writer = records
+	var spool *countSpool
+	if withCounts {
+		if returnSeen || annotate {
+			logErrorf("-with-counts cannot be combined with -seen or -annotate")
+			os.Exit(2)
+		}
+		cm := bbloom.NewCountMin(countEpsilon, countDelta)
+		lineCounts = &cm
+		var err error
+		if spool, err = newCountSpool(); err != nil {
+			logErrorf("creating count spool: %v", err)
+			os.Exit(1)
+		}
+		defer spool.Close()
+		processed = spool
+	}
+	if cardinality {
+		hll := bbloom.NewHyperLogLog(hllPrecision)
+		distinctKeys = &hll
+	}
+	if keyLengthStats {
+		keyLengths = &lengthHistogram{}
 	}
 
-	file, err := os.Open(stateFile)
+	var st runStats
+	var err error
+	switch {
+	case parallelRun() && parallelHash:
+		err = processHashedInParallel(input, processed, set.(*bbloom.Bloom), &st)
+	case parallelRun():
+		err = processInParallel(input, processed, set, &st)
+	default:
+		err = processStream(input, processed, set, &st)
+	}
+	// Read before the spool is scanned below, which would overwrite it.
+	inputTerminated := lastRecordTerminated
+	if st.Unique > 0 {
+		hasNewItems = true
+	}
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error opening state file: %v\n", err)
-		os.Exit(1)
+		logErrorf("reading input: %v", err)
+		status = 1
+	}
+	if checkpoints != nil && checkpoints.err != nil {
+		logErrorf("writing checkpoint: %v", checkpoints.err)
+		status = 1
+	}
+	if skippedRecords > 0 {
+		logInfof("Skipped %d bad records", skippedRecords)
+	}
+	if rejectedLines > 0 {
+		st.Rejected = uint64(rejectedLines)
+		logInfof("Rejected %d invalid lines", rejectedLines)
 	}
-	defer file.Close()
 
-	var reader io.Reader = file
-	if !noGzip {
-		gz, err := gzip.NewReader(file)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error creating gzip reader: %v\n", err)
-			os.Exit(1)
+	if spool != nil {
+		if err := spool.finish(records); err != nil {
+			logErrorf("writing counts: %v", err)
+			status = 1
+		}
+	}
+	if err := records.Close(); err != nil {
+		logErrorf("writing output: %v", err)
+		status = 1
+	}
+	if held != nil {
+		if err := held.finish(inputTerminated); err != nil {
+			logErrorf("writing output: %v", err)
+			status = 1
+		}
+	}
+	if verify {
+		if err := out.Flush(); err != nil {
+			logErrorf("writing output: %v", err)
+			status = 1
+		} else if err := verifyOutput(outputFile, set); err != nil {
+			logErrorf("%v", err)
+			status = 1
 		}
-		defer gz.Close()
-		reader = gz
 	}
 
-	bf, err := bbloom.BinaryUnmarshal(reader)
+	if showStats || cardinality || keyLengthStats {
+		var s summary
+		if showStats {
+			s.Run, s.Filter = &st, describe()
+		}
+		if distinctKeys != nil {
+			n := distinctKeys.Count()
+			s.DistinctEstimate = &n
+		}
+		if keyLengths != nil {
+			s.KeyLengths = keyLengths.summary()
+		}
+		// Stats sent to stdout go through the output writer when that is
+		// stdout too, so they always follow the deduplicated lines.
+		var w io.Writer = os.Stderr
+		if statsToStdout {
+			w = os.Stdout
+			if outputFile == "" && !summaryOnly {
+				w = out
+			}
+		}
+		if err := printSummary(w, s); err != nil {
+			logErrorf("writing stats: %v", err)
+			status = 1
+		}
+	}
+
+	dupSeen = exitOnDup && st.Duplicates > 0
+	return status
+}
+
+func loadBloomFilter(path string) bbloom.Bloom {
+	bf, err := readBloomFilter(path)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error reading or decoding state file: %v\n", err)
+		if !ignoreBadState {
+			logErrorf("%v", err)
+			os.Exit(1)
+		}
+		logWarnf("%v; starting with a fresh filter", err)
+		return newBloomFilter(numValues)
+	}
+	checkWear(&bf, path)
+	return bf
+}
+
+// wornFactor is how far a loaded filter's estimated false positive rate may
+// exceed -p before checkWear complains.
+const wornFactor = 2
+
+// checkWear warns, or exits under -strict, if the filter read from path is
+// so full that its estimated false positive rate is more than wornFactor
+// times -p: a run on it would drop noticeably more new lines as duplicates
+// than asked for.
+func checkWear(bf *bbloom.Bloom, path string) {
+	fpr := bf.EstimatedFPR()
+	if fpr <= wornFactor*falsePositive {
+		return
+	}
+	msg := fmt.Sprintf("state file %s has an estimated false positive rate of %.4g, over %dx the -p %g; rebuild it with bdedup compact or start a larger filter",
+		path, fpr, wornFactor, falsePositive)
+	if strict {
+		logErrorf("%s", msg)
 		os.Exit(1)
 	}
+	logWarnf("%s", msg)
+}
 
+// newBloomFilter returns an empty filter sized for n entries at the -p false
+// positive rate, exiting on an invalid size or rate.
+// With -round-down it reports the capacity and rate the smaller filter gets.
+func newBloomFilter(n float64) bbloom.Bloom {
+	newFilter := bbloom.NewWithFPR
+	if roundDown {
+		newFilter = bbloom.NewWithFPRRoundDown
+	}
+	bf, err := newFilter(n, falsePositive)
+	if err != nil {
+		logErrorf("invalid -n or -p: %v", err)
+		os.Exit(2)
+	}
+	bf.HashFunc = hashFunc
+	applySipKey(&bf)
+	if m := bf.Metrics(); m.SizeBits == bbloom.MinSize && bf.Capacity(falsePositive) > uint64(n) {
+		logWarnf("-n %g is below the smallest filter; using the minimum %d bits, room for %d entries at -p %g",
+			n, bbloom.MinSize, bf.Capacity(falsePositive), falsePositive)
+	}
+	if roundDown {
+		m := bf.Metrics()
+		logInfof("New filter: %d bits, %d hash locations; capacity %d at -p %g, expected FPR %.6g at -n %g",
+			m.SizeBits, m.HashLocs, bf.Capacity(falsePositive), falsePositive, bf.ExpectedFPR(n), n)
+	}
 	return bf
 }
 
-func saveBloomFilter(bf bbloom.Bloom) {
-	file, err := os.Create(stateFile)
+// parseHash parses -hash.
+func parseHash(s string) error {
+	h, err := bbloom.ParseHash(s)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error creating state file: %v\n", err)
+		return err
+	}
+	hashFunc, hashSet = h, true
+	return nil
+}
+
+// checkHash exits if -hash was given and the loaded filter was built with a
+// different hash, whose bit locations the requested one would not find.
+// Without -hash a loaded filter keeps its own hash.
+func checkHash(bf *bbloom.Bloom, what string) {
+	if hashSet && bf.HashFunc != hashFunc {
+		logErrorf("%s uses the %s hash, but -hash is %s", what, bf.HashFunc, hashFunc)
+		os.Exit(2)
+	}
+}
+
+// loadBaseFilter loads the -base filter, which unlike the state file must
+// already exist.
+func loadBaseFilter(path string) bbloom.Bloom {
+	if _, err := os.Stat(path); err != nil {
+		logErrorf("opening base filter: %v", err)
+		os.Exit(1)
+	}
+	bf, err := readBloomFilter(path)
+	if err != nil {
+		logErrorf("loading base filter: %v", err)
+		os.Exit(1)
+	}
+	checkHash(&bf, "base filter "+path)
+	return bf
+}
+
+// sizeFromInput sets -n to the estimated number of distinct keys in the
+// -input and -seed-file files, so that a new filter is sized for them. An
+// existing state file keeps its geometry and the pass is skipped.
+func sizeFromInput() {
+	if inputFile == "" {
+		logErrorf("-two-pass requires a seekable -input file")
+		os.Exit(2)
+	}
+	if _, err := os.Stat(stateFile); err == nil {
+		logWarnf("-two-pass ignored, state file %s already exists", stateFile)
 		return
 	}
-	defer file.Close()
+	// The keys of the input are in -key-input when it is given.
+	paths := []string{inputFile}
+	if keyInputFile != "" {
+		paths[0] = keyInputFile
+	}
+	if seedFile != "" {
+		paths = append(paths, seedFile)
+	}
+	n, err := estimateDistinct(paths...)
+	if err != nil {
+		logErrorf("estimating distinct input lines: %v", err)
+		os.Exit(1)
+	}
+	numValues = max(float64(n)*twoPassMargin, 1)
+}
 
-	var writer io.Writer = file
-	if !noGzip {
-		gz := gzip.NewWriter(file)
-		defer gz.Close()
-		writer = gz
+// readBloomFilter reads the filter persisted at path, or returns a new one
+// sized by -n and -p if the file does not exist. With -io-retries, a failed
+// read is retried from the start. Under -recover-state, a file whose bitset
+// is cut short yields the part that could be read.
+func readBloomFilter(path string) (bbloom.Bloom, error) {
+	var bf bbloom.Bloom
+	var merged int
+	var recovered uint64
+	var truncated bool
+	start := time.Now()
+	err := retryIO("loading state file "+path, func() error {
+		reader, err := openState(path)
+		if err != nil {
+			return err
+		}
+		defer reader.Close()
+		if recoverState {
+			bf, recovered, err = bbloom.BinaryUnmarshalPartial(reader)
+			if errors.Is(err, bbloom.ErrTruncated) {
+				truncated = true
+				return nil
+			}
+		} else {
+			bf, err = bbloom.BinaryUnmarshal(reader)
+		}
+		if err != nil {
+			return fmt.Errorf("reading or decoding state file: %w", err)
+		}
+		if merged, err = mergeConcatenated(&bf, reader); err != nil {
+			return fmt.Errorf("reading or decoding state file: %w", err)
+		}
+		return nil
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		logger.Debug("no saved state", "path", path)
+		return newBloomFilter(numValues), nil
+	}
+	if errors.Is(err, errEmptyState) {
+		logWarnf("state file %s is empty; starting with a new filter", path)
+		return newBloomFilter(numValues), nil
 	}
+	if err != nil {
+		return bbloom.Bloom{}, err
+	}
+	applySipKey(&bf)
+	if truncated {
+		// A key is kept only if all of its hash locations were recovered.
+		m := bf.Metrics()
+		frac := float64(recovered) / float64(m.SizeBits/64)
+		logWarnf("state file %s is truncated; recovered %.1f%% of the bitset, keeping about %.1f%% of its keys; the rest will pass as new",
+			path, 100*frac, 100*math.Pow(frac, float64(m.HashLocs)))
+		if path == stateFile {
+			stateRecovered = true
+		}
+	}
+	if merged > 0 {
+		logInfof("State file %s holds %d concatenated filters; merged them", path, merged+1)
+	}
+	logger.Debug("loaded state", "path", path, "elements", bf.ElemNum, "elapsed", time.Since(start))
+	return bf, nil
+}
 
-	if err := bf.BinaryMarshal(writer); err != nil {
-		fmt.Fprintf(os.Stderr, "Error writing state file: %v\n", err)
+// mergeConcatenated ORs into bf every further filter r holds after the one
+// read from it, and returns how many there were. A state file made by
+// concatenating others, as with cat a.gz b.gz > all.gz, decompresses to
+// their filters one after another, since gzip reads every member of a file
+// as one stream; they must all match bf's geometry. Anything else after the
+// first filter is an error rather than being ignored.
+func mergeConcatenated(bf *bbloom.Bloom, r io.Reader) (int, error) {
+	br := bufio.NewReader(r)
+	for n := 0; ; n++ {
+		if _, err := br.Peek(1); err == io.EOF {
+			return n, nil
+		} else if err != nil {
+			return n, err
+		}
+		if err := bf.MergeBinary(br); err != nil {
+			return n, fmt.Errorf("concatenated filter %d: %w", n+2, err)
+		}
+	}
+}
+
+// errEmptyState is returned for a state file of zero bytes, such as one
+// created with touch to reserve the name. It holds no filter, so it is read
+// as a new one, like a missing file.
+var errEmptyState = errors.New("state file is empty")
+
+// openState opens the filter persisted at path for reading, decompressing it
+// unless -no-gzip is set.
+func openState(path string) (io.ReadCloser, error) {
+	file, err := openStore(path).Load()
+	if err != nil {
+		return nil, fmt.Errorf("opening state file: %w", err)
+	}
+	br := bufio.NewReader(file)
+	if _, err := br.Peek(1); err == io.EOF {
+		file.Close()
+		return nil, errEmptyState
+	}
+	if noGzip {
+		return struct {
+			io.Reader
+			io.Closer
+		}{br, file}, nil
+	}
+	gz, err := gzip.NewReader(br)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("creating gzip reader: %w", err)
 	}
+	return stateReader{gz, file}, nil
 }
 
-func processStream(input io.Reader, output io.Writer, bf *bbloom.Bloom, hasNewItems *bool) {
-	scanner := bufio.NewScanner(input)
+// stateReader reads decompressed state and closes the stored state under it.
+type stateReader struct {
+	*gzip.Reader
+	stored io.Closer
+}
+
+func (r stateReader) Close() error {
+	r.Reader.Close()
+	return r.stored.Close()
+}
+
+// saveBloomFilter persists bf at path. With -io-retries, a failed save is
+// retried from the start.
+func saveBloomFilter(path string, bf bbloom.Bloom) error {
+	start := time.Now()
+	err := retryIO("saving state file "+path, func() error {
+		return writeBloomFilter(path, bf)
+	})
+	if err == nil {
+		logger.Debug("saved state", "path", path, "elements", bf.ElemNum, "elapsed", time.Since(start))
+	}
+	return err
+}
+
+func writeBloomFilter(path string, bf bbloom.Bloom) error {
+	stored, err := openStore(path).Save()
+	if err != nil {
+		return fmt.Errorf("creating state file: %w", err)
+	}
+
+	writer, err := newCompressor(stateCodec(), stored)
+	if err == nil {
+		err = bf.BinaryMarshal(writer)
+		if cerr := writer.Close(); err == nil {
+			err = cerr
+		}
+	}
+	// The store may commit on Close, so it is closed exactly once, and its
+	// error matters even after a failed write.
+	if cerr := stored.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("writing state file: %w", err)
+	}
+	return nil
+}
+
+func openExactSet() *diskset.Set {
+	ds, err := diskset.Open(stateFile)
+	if err != nil {
+		logErrorf("opening exact set: %v", err)
+		os.Exit(1)
+	}
+	return ds
+}
+
+func closeExactSet(ds *diskset.Set, status *int) {
+	if err := ds.Close(); err != nil {
+		logErrorf("writing exact set: %v", err)
+		*status = 1
+	}
+}
+
+// seedSet adds the key of every line in path to set and reports whether any
+// of them was new.
+func seedSet(path string, set keySet) (added bool) {
+	file, err := os.Open(path)
+	if err != nil {
+		logErrorf("opening seed file: %v", err)
+		os.Exit(1)
+	}
+	defer file.Close()
+
+	scanner := newLineScanner(file)
 	for scanner.Scan() {
-		line := scanner.Bytes()
-		hasNew := !bf.Has(line)
-		if returnSeen != hasNew {
-			fmt.Fprintln(output, scanner.Text())
+		if passedLine(scanner.Bytes()) {
+			continue
+		}
+		key := dedupKey(scanner.Bytes())
+		if !set.Has(key) {
+			set.Add(key)
+			if wal != nil {
+				wal.append(key)
+			}
+			added = true
 		}
+	}
+	if err := scanner.Err(); err != nil {
+		logErrorf("reading seed file: %v", err)
+		os.Exit(1)
+	}
+	return added
+}
+
+// dupLines receives the line numbers of duplicates when -dup-lines is set.
+var dupLines io.Writer
+
+// recordDupLine writes the 1-based input line number of a duplicate. Lines
+// dropped by -skip-errors and rejected by validation still count, so the
+// numbers match the input file.
+func recordDupLine(lineNo uint64) {
+	fmt.Fprintln(dupLines, lineNo)
+}
+
+// emit writes line to output if the mode selects it: new lines by default,
+// seen lines with -seen, or every line tagged with its decision under
+// -annotate. Under -split-output it goes to the shard of key instead, except
+// with -with-counts, whose spool is split when it is written out.
+func emit(output io.Writer, line string, key []byte, hasNew bool) {
+	if splits != nil && !withCounts {
+		output = splits.shard(key)
+	}
+	switch {
+	case annotate:
+		tag := seenTag
 		if hasNew {
-			*hasNewItems = true
-			bf.Add(line)
+			tag = newTag
 		}
+		fmt.Fprint(output, tag+line+recordEnd())
+	case returnSeen != hasNew:
+		fmt.Fprint(output, line+recordEnd())
+	}
+}
+
+func processStream(input io.Reader, output io.Writer, bf keySet, st *runStats) error {
+	// bufio.ScanLines drops the \r of a \r\n ending, so CRLF and LF inputs
+	// produce identical keys.
+	var consumed int64
+	var scanned uint64
+	scanner := newOffsetScanner(input, &consumed)
+	if prof != nil {
+		scanner = profiledScanner{scanner, prof}
+	}
+	scanner = withKeyInput(scanner)
+	for !windowDone(scanned) && scanner.Scan() {
+		scanned++
+		if beforeWindow(scanned) {
+			continue
+		}
+		if validateLines() && !validLine(scanner.Bytes()) {
+			rejectLine(scanner.Bytes())
+			if checkpoints != nil {
+				checkpoints.lineDone(consumed)
+			}
+			continue
+		}
+		key := recordKey(scanner)
+		if lineCounts != nil {
+			lineCounts.Increment(key)
+		}
+		if distinctKeys != nil {
+			distinctKeys.Add(key)
+		}
+		if keyLengths != nil {
+			keyLengths.add(len(key))
+		}
+		passed := passedLine(scanner.Bytes())
+		hasNew := passed || !bf.Has(key)
+		line := scanner.Text()
+		emit(output, line, key, hasNew)
+		switch {
+		case passed:
+		case hasNew:
+			bf.Add(key)
+			if deltaLines != nil {
+				recordDelta(line)
+			}
+			if wal != nil {
+				wal.append(key)
+			}
+			if growth != nil {
+				growth.keyAdded()
+			}
+		case dupLines != nil:
+			recordDupLine(scanned + uint64(skippedRecords))
+		}
+		st.record(hasNew)
+		if checkpoints != nil {
+			checkpoints.lineDone(consumed)
+		}
+	}
+	return scanner.Err()
+}
+
+// job is one input line tagged with its position in the input.
+type job struct {
+	seq    uint64
+	lineNo uint64
+	line   string
+	key    []byte
+	passed bool // under -no-match pass: new, and not to be added
+}
+
+// result is a job together with its dedup decision.
+type result struct {
+	seq    uint64
+	lineNo uint64
+	line   string
+	key    []byte
+	hasNew bool
+	passed bool
+}
+
+// reorderWindow is the number of lines per worker that may be in flight
+// ahead of the next line to be written, bounding the reorder buffer.
+const reorderWindow = 1024
+
+// defaultChanBuffer is the default -chan-buffer. Each worker's queue holds
+// this many batches of -chunk-lines lines, so the reader rarely waits on a
+// busy worker while others are idle, and the shared results channel holds
+// this many per worker, so workers rarely wait on the writer.
+const defaultChanBuffer = 256
+
+// parallelRun reports whether run processes the input on -concurrency
+// workers. Checkpoints need the filter to reflect exactly the lines before
+// the offset, so -resume processes sequentially. So does -shingle: near
+// duplicates have different keys, which may land on different workers.
+// -profile does so that its timings add up to the run time, and -adjacent
+// compares each line with the one before it, and -grow-at replaces the
+// filter, which workers cannot share while it happens. -parallel-hash
+// rejects all of them.
+func parallelRun() bool {
+	if concurrency <= 1 {
+		return false
 	}
+	return parallelHash || !resume && shingleSize == 0 && !profileRun && !adjacent && growth == nil
 }
 
-func processInParallel(input io.Reader, output io.Writer, bf *bbloom.Bloom, hasNewItems *bool) {
+// lockFreeSet is implemented by sets whose AddIfNotHasAtomic can be called
+// concurrently for different keys without a global lock.
+type lockFreeSet interface {
+	AddIfNotHasAtomic(entry []byte) bool
+}
+
+// processInParallel dedups lines on concurrency workers and writes the
+// results in input order. Lines are routed to workers by a hash of their key,
+// so every copy of a key is handled by the same worker in input order and
+// the first occurrence is always the one treated as new, exactly as in
+// sequential processing. Workers only race on different keys, which lets a
+// Bloom filter set bits with atomic operations instead of a global lock.
+// The decisions are applied in sequence order by the single writer loop below.
+// Lines travel to and from the workers in batches of up to -chunk-lines.
+func processInParallel(input io.Reader, output io.Writer, bf keySet, st *runStats) error {
 	var wg sync.WaitGroup
-	lines := make(chan string)
-	results := make(chan string)
+	queues := make([]chan []job, concurrency)
+	results := make(chan []result, concurrency*chanBuffer)
+	window := make(chan struct{}, concurrency*max(reorderWindow, 2*chunkLines))
 
-	for i := 0; i < concurrency; i++ {
+	add := bf.AddIfNotHasTS
+	if lf, ok := bf.(lockFreeSet); ok {
+		add = lf.AddIfNotHasAtomic
+	}
+	for i := range queues {
+		queues[i] = make(chan []job, chanBuffer)
 		wg.Add(1)
-		go worker(&wg, lines, results, bf, hasNewItems)
+		go worker(&wg, queues[i], results, add)
 	}
 
+	var readErr error
 	go func() {
-		scanner := bufio.NewScanner(input)
-		for scanner.Scan() {
-			lines <- scanner.Text()
+		seed := maphash.MakeSeed()
+		scanner := withKeyInput(newLineScanner(input))
+		// Each worker's lines are collected into a batch of up to
+		// -chunk-lines before being sent.
+		batches := make([][]job, concurrency)
+		send := func(i int) {
+			if len(batches[i]) > 0 {
+				queues[i] <- batches[i]
+				batches[i] = make([]job, 0, chunkLines)
+			}
+		}
+		var seq, scanned uint64
+		for !windowDone(scanned) && scanner.Scan() {
+			scanned++
+			if beforeWindow(scanned) {
+				continue
+			}
+			if validateLines() && !validLine(scanner.Bytes()) {
+				rejectLine(scanner.Bytes())
+				continue
+			}
+			select {
+			case window <- struct{}{}:
+			default:
+				// The writer may be waiting for a line in an unsent
+				// batch; send them all before blocking on the window.
+				for i := range batches {
+					send(i)
+				}
+				window <- struct{}{}
+			}
+			line := scanner.Text()
+			// The key may share the scanner's buffer, which the next
+			// Scan overwrites while a worker still holds the job.
+			key := bytes.Clone(recordKey(scanner))
+			i := int(maphash.Bytes(seed, key) % uint64(concurrency))
+			lineNo := scanned + uint64(skippedRecords)
+			batches[i] = append(batches[i], job{seq: seq, lineNo: lineNo, line: line, key: key, passed: passedLine(scanner.Bytes())})
+			if len(batches[i]) >= chunkLines {
+				send(i)
+			}
+			seq++
+		}
+		readErr = scanner.Err()
+		for i, q := range queues {
+			send(i)
+			close(q)
 		}
-		close(lines)
 	}()
 
+	// results is closed only once every worker has returned, so with any
+	// buffer size the loop below drains all buffered results before ending.
 	go func() {
 		wg.Wait()
 		close(results)
 	}()
 
-	for result := range results {
-		fmt.Fprintln(output, result)
+	pending := make(map[uint64]result)
+	var next uint64
+	for batch := range results {
+		for _, r := range batch {
+			pending[r.seq] = r
+		}
+		for {
+			r, ok := pending[next]
+			if !ok {
+				break
+			}
+			delete(pending, next)
+			next++
+			<-window
+			emit(output, r.line, r.key, r.hasNew)
+			if keyLengths != nil {
+				keyLengths.add(len(r.key))
+			}
+			if r.hasNew && !r.passed && wal != nil {
+				wal.append(r.key)
+			}
+			if r.hasNew && !r.passed && deltaLines != nil {
+				recordDelta(r.line)
+			}
+			if !r.hasNew && dupLines != nil {
+				recordDupLine(r.lineNo)
+			}
+			st.record(r.hasNew)
+		}
 	}
+	return readErr
 }
 
-func worker(wg *sync.WaitGroup, lines <-chan string, results chan<- string, bf *bbloom.Bloom, hasNewItems *bool) {
+func worker(wg *sync.WaitGroup, batches <-chan []job, results chan<- []result, add func([]byte) bool) {
 	defer wg.Done()
-	for line := range lines {
-		hasNew := !bf.HasTS([]byte(line))
-		if returnSeen != hasNew {
-			results <- line
-		}
-		if hasNew {
-			*hasNewItems = true
-			bf.AddTS([]byte(line))
+	for batch := range batches {
+		rs := make([]result, len(batch))
+		for i, j := range batch {
+			if lineCounts != nil {
+				lineCounts.IncrementTS(j.key)
+			}
+			if distinctKeys != nil {
+				distinctKeys.AddTS(j.key)
+			}
+			rs[i] = result{seq: j.seq, lineNo: j.lineNo, line: j.line, key: j.key, hasNew: j.passed || add(j.key), passed: j.passed}
 		}
+		results <- rs
 	}
 }
@@ -0,0 +1,483 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/mylh/bdedup/bbloom"
+)
+
+// TestMain runs main instead of the tests when runBdedup starts the test
+// binary as the command, so the tests drive the real command line, flags,
+// exit status and all.
+func TestMain(m *testing.M) {
+	if os.Getenv("BDEDUP_TEST_MAIN") == "1" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// cmdResult is what one run of the command produced.
+type cmdResult struct {
+	stdout, stderr string
+	code           int
+}
+
+// runBdedup runs the command with args in dir, feeding it stdin. Relative
+// paths, the default state file included, are resolved in dir.
+func runBdedup(t *testing.T, dir, stdin string, args ...string) cmdResult {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "BDEDUP_TEST_MAIN=1")
+	cmd.Stdin = strings.NewReader(stdin)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	err := cmd.Run()
+	res := cmdResult{stdout: stdout.String(), stderr: stderr.String()}
+	if err != nil {
+		exit, ok := err.(*exec.ExitError)
+		if !ok {
+			t.Fatalf("running bdedup %s: %v", strings.Join(args, " "), err)
+		}
+		res.code = exit.ExitCode()
+	}
+	return res
+}
+
+// mustRun is runBdedup for runs expected to succeed.
+func mustRun(t *testing.T, dir, stdin string, args ...string) string {
+	t.Helper()
+	res := runBdedup(t, dir, stdin, args...)
+	if res.code != 0 {
+		t.Fatalf("bdedup %s: exit status %d\n%s", strings.Join(args, " "), res.code, res.stderr)
+	}
+	return res.stdout
+}
+
+// writeFile writes content to name in dir and returns its path.
+func writeFile(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// numbered returns the lines prefix0 to prefix(n-1), each newline-terminated.
+func numbered(prefix string, n int) string {
+	var b strings.Builder
+	for i := range n {
+		fmt.Fprintf(&b, "%s%d\n", prefix, i)
+	}
+	return b.String()
+}
+
+// loadState reads the filter saved at path.
+func loadState(t *testing.T, path string) bbloom.Bloom {
+	t.Helper()
+	if _, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	}
+	bf, err := readBloomFilter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bf
+}
+
+// lineCount returns the number of newline-terminated lines in s.
+func lineCount(s string) int {
+	return strings.Count(s, "\n")
+}
+
+func TestExactHasNoFalsePositives(t *testing.T) {
+	dir := t.TempDir()
+	const n = 50000
+	keys := numbered("key-", n)
+	// Every key twice, far more keys than a filter sized for 100 holds.
+	input := keys + keys
+	got := mustRun(t, dir, input, "-exact", "-state", "exact.set", "-n", "100")
+	if got != keys {
+		t.Fatalf("-exact emitted %d lines, want the %d distinct keys in order", lineCount(got), n)
+	}
+	lossy := mustRun(t, dir, keys, "-state", "lossy.gz", "-n", "100")
+	if lineCount(lossy) == n {
+		t.Errorf("a filter sized for 100 kept all %d keys; the test input is too small to show false positives", n)
+	}
+
+	// The set persists: only keys it has not seen are new in the next run.
+	got = mustRun(t, dir, numbered("key-", n+10), "-exact", "-state", "exact.set")
+	if want := numbered("key-", n+10)[len(keys):]; got != want {
+		t.Errorf("second -exact run emitted %q, want %q", got, want)
+	}
+}
+
+func TestExitOnDup(t *testing.T) {
+	dir := t.TempDir()
+	if res := runBdedup(t, dir, "a\nb\nc\n", "-exit-on-dup", "-state", "unique.gz"); res.code != 0 {
+		t.Errorf("all-unique input: exit status %d, want 0\n%s", res.code, res.stderr)
+	}
+	res := runBdedup(t, dir, "a\nb\na\n", "-exit-on-dup", "-state", "dup.gz")
+	if res.code != 1 {
+		t.Errorf("input with a duplicate: exit status %d, want 1", res.code)
+	}
+	if res.stdout != "a\nb\n" {
+		t.Errorf("input with a duplicate: output %q, want the unique lines still written", res.stdout)
+	}
+	// Without the flag, duplicates are no error.
+	if res := runBdedup(t, dir, "a\nb\na\n", "-state", "plain.gz"); res.code != 0 {
+		t.Errorf("duplicate without -exit-on-dup: exit status %d, want 0", res.code)
+	}
+}
+
+func TestIgnoreBadState(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "bad.gz", "not a state file\n")
+	res := runBdedup(t, dir, "a\nb\na\n", "-state", "bad.gz")
+	if res.code != 1 || res.stdout != "" {
+		t.Fatalf("corrupt state: exit status %d, output %q; want 1 and no output", res.code, res.stdout)
+	}
+	if got, _ := os.ReadFile(filepath.Join(dir, "bad.gz")); string(got) != "not a state file\n" {
+		t.Fatal("corrupt state file was overwritten without -ignore-bad-state")
+	}
+
+	res = runBdedup(t, dir, "a\nb\na\n", "-state", "bad.gz", "-ignore-bad-state")
+	if res.code != 0 || res.stdout != "a\nb\n" {
+		t.Fatalf("-ignore-bad-state: exit status %d, output %q; want 0 and a fresh dedup", res.code, res.stdout)
+	}
+	if !strings.Contains(res.stderr, "fresh filter") {
+		t.Errorf("-ignore-bad-state logged %q, want a warning about the fresh filter", res.stderr)
+	}
+	// The fresh filter replaced the corrupt one.
+	bf := loadState(t, filepath.Join(dir, "bad.gz"))
+	if !bf.Has([]byte("a")) || !bf.Has([]byte("b")) {
+		t.Error("the saved filter lacks the run's keys")
+	}
+}
+
+// mapSet is an exact keySet for checking dedup decisions without false
+// positives.
+type mapSet struct {
+	mu   sync.Mutex
+	keys map[string]bool
+}
+
+func newMapSet() *mapSet {
+	return &mapSet{keys: make(map[string]bool)}
+}
+
+func (s *mapSet) Has(key []byte) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.keys[string(key)]
+}
+
+func (s *mapSet) Add(key []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys[string(key)] = true
+}
+
+func (s *mapSet) AddIfNotHasTS(key []byte) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.keys[string(key)] {
+		return false
+	}
+	s.keys[string(key)] = true
+	return true
+}
+
+// syntheticStream returns n lines drawn from distinct keys with repeats,
+// and the first occurrence of each in input order.
+func syntheticStream(n, distinct int) (input, uniques string) {
+	var in, out strings.Builder
+	seen := make(map[int]bool)
+	rng := rand.New(rand.NewSource(1))
+	for range n {
+		k := rng.Intn(distinct)
+		fmt.Fprintf(&in, "line-%d\n", k)
+		if !seen[k] {
+			seen[k] = true
+			fmt.Fprintf(&out, "line-%d\n", k)
+		}
+	}
+	return in.String(), out.String()
+}
+
+func TestProcessInParallel(t *testing.T) {
+	defer func(c int) { concurrency = c }(concurrency)
+	concurrency = 4
+	input, want := syntheticStream(200000, 50000)
+	bf := bbloom.New(1e6, 1e-9)
+	for name, set := range map[string]keySet{"exact": newMapSet(), "bloom": &bf} {
+		var out bytes.Buffer
+		var st runStats
+		if err := processInParallel(strings.NewReader(input), &out, set, &st); err != nil {
+			t.Fatal(err)
+		}
+		if out.String() != want {
+			t.Errorf("%s: parallel output differs from the first occurrences in input order", name)
+		}
+		if st.Lines != 200000 || st.Unique != uint64(lineCount(want)) {
+			t.Errorf("%s: stats %+v, want %d lines and %d unique", name, st, 200000, lineCount(want))
+		}
+	}
+}
+
+func TestAnnotate(t *testing.T) {
+	in := "a\nb\na\nc\nb\n"
+	want := "NEW\ta\nNEW\tb\nSEEN\ta\nNEW\tc\nSEEN\tb\n"
+	for _, c := range []string{"1", "4"} {
+		if got := mustRun(t, t.TempDir(), in, "-annotate", "-concurrency", c); got != want {
+			t.Errorf("-concurrency %s: output %q, want %q", c, got, want)
+		}
+	}
+	got := mustRun(t, t.TempDir(), in, "-annotate", "-new-tag", "+ ", "-seen-tag", "= ")
+	if want := "+ a\n+ b\n= a\n+ c\n= b\n"; got != want {
+		t.Errorf("custom tags: output %q, want %q", got, want)
+	}
+}
+
+func TestSeedFile(t *testing.T) {
+	dir := t.TempDir()
+	seed := writeFile(t, dir, "deny.txt", "a\nb\n")
+	got := mustRun(t, dir, "a\nc\nb\nd\nc\n", "-seed-file", seed)
+	if got != "c\nd\n" {
+		t.Fatalf("output %q, want the lines not in the seed file", got)
+	}
+	// The seeded keys were saved along with the new ones.
+	if got := mustRun(t, dir, "a\nb\nc\nd\ne\n"); got != "e\n" {
+		t.Errorf("next run emitted %q, want only e", got)
+	}
+}
+
+func TestLearn(t *testing.T) {
+	dir := t.TempDir()
+	learn := writeFile(t, dir, "known.txt", "id=1 old\nid=2 old\n")
+	// The learned lines' keys suppress input lines with the same key.
+	got := mustRun(t, dir, "id=1 new\nid=3 new\nid=2 new\nid=3 again\n", "-learn", learn, "-key-regex", `id=(\d+)`)
+	if got != "id=3 new\n" {
+		t.Fatalf("output %q, want only the line whose key was not learned", got)
+	}
+	if got := mustRun(t, dir, "id=1\nid=4\n", "-key-regex", `id=(\d+)`); got != "id=4\n" {
+		t.Errorf("next run emitted %q, want only id=4", got)
+	}
+	if res := runBdedup(t, dir, "a\n", "-learn", learn, "-seed-file", "other.txt"); res.code != 2 {
+		t.Errorf("-learn with another -seed-file: exit status %d, want 2", res.code)
+	}
+	if got := mustRun(t, t.TempDir(), "id=1 old\nx\n", "-learn", learn, "-seed-file", learn); got != "x\n" {
+		t.Errorf("-learn and -seed-file naming one file: output %q, want x", got)
+	}
+}
+
+func TestBaseIsNeverAddedTo(t *testing.T) {
+	dir := t.TempDir()
+	mustRun(t, dir, "allow-1\nallow-2\n", "-state", "base.gz")
+	before, err := os.ReadFile(filepath.Join(dir, "base.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := mustRun(t, dir, "allow-1\nx\nallow-2\ny\nx\n", "-base", "base.gz", "-state", "run.gz")
+	if got != "x\ny\n" {
+		t.Fatalf("output %q, want the keys absent from the base", got)
+	}
+	if after, _ := os.ReadFile(filepath.Join(dir, "base.gz")); !bytes.Equal(before, after) {
+		t.Error("the base file changed")
+	}
+	run := loadState(t, filepath.Join(dir, "run.gz"))
+	if run.Has([]byte("allow-1")) {
+		t.Error("a key present only in the base was added to the state")
+	}
+	if !run.Has([]byte("x")) {
+		t.Error("a new key was not added to the state")
+	}
+}
+
+func TestParallelRunsAreReproducible(t *testing.T) {
+	input, _ := syntheticStream(100000, 30000)
+	var first cmdResult
+	for i := range 5 {
+		res := runBdedup(t, t.TempDir(), input, "-concurrency", "4", "-chunk-lines", "64", "-stats", "-json")
+		if res.code != 0 {
+			t.Fatalf("run %d: exit status %d\n%s", i, res.code, res.stderr)
+		}
+		if i == 0 {
+			first = res
+			continue
+		}
+		if res.stdout != first.stdout {
+			t.Errorf("run %d: output differs from the first run", i)
+		}
+		if res.stderr != first.stderr {
+			t.Errorf("run %d: stats %s differ from the first run's %s", i, res.stderr, first.stderr)
+		}
+	}
+}
+
+// benchmarkParallel runs processInParallel over input on a fresh filter per
+// iteration, reporting throughput in input bytes.
+func benchmarkParallel(b *testing.B, input string) {
+	b.SetBytes(int64(len(input)))
+	for range b.N {
+		b.StopTimer()
+		bf := bbloom.New(1e6, 0.001)
+		b.StartTimer()
+		if err := processInParallel(strings.NewReader(input), io.Discard, &bf, &runStats{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkParallelDedup runs the parallel path at the default settings
+// for several worker counts.
+func BenchmarkParallelDedup(b *testing.B) {
+	defer func(c, buf, n int) { concurrency, chanBuffer, chunkLines = c, buf, n }(concurrency, chanBuffer, chunkLines)
+	chanBuffer, chunkLines = defaultChanBuffer, 1
+	input, _ := syntheticStream(100000, 50000)
+	for _, c := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("concurrency=%d", c), func(b *testing.B) {
+			concurrency = c
+			benchmarkParallel(b, input)
+		})
+	}
+}
+
+func BenchmarkChanBuffer(b *testing.B) {
+	defer func(c, buf int) { concurrency, chanBuffer = c, buf }(concurrency, chanBuffer)
+	concurrency = 4
+	input, _ := syntheticStream(100000, 50000)
+	for _, buf := range []int{0, 1, 64, defaultChanBuffer} {
+		b.Run(fmt.Sprintf("buffer=%d", buf), func(b *testing.B) {
+			chanBuffer = buf
+			benchmarkParallel(b, input)
+		})
+	}
+}
+
+func TestChunkLinesKeepsOrder(t *testing.T) {
+	input, want := syntheticStream(50000, 10000)
+	for _, n := range []string{"1", "7", "1000"} {
+		got := mustRun(t, t.TempDir(), input, "-concurrency", "4", "-chunk-lines", n)
+		if got != want {
+			t.Errorf("-chunk-lines %s: output differs from the first occurrences in input order", n)
+		}
+	}
+	if res := runBdedup(t, t.TempDir(), "a\n", "-chunk-lines", "0"); res.code != 2 {
+		t.Errorf("-chunk-lines 0: exit status %d, want 2", res.code)
+	}
+}
+
+func BenchmarkChunkLines(b *testing.B) {
+	defer func(c, n int) { concurrency, chunkLines = c, n }(concurrency, chunkLines)
+	concurrency = 4
+	input, _ := syntheticStream(100000, 50000)
+	for _, n := range []int{1, 16, 256} {
+		b.Run(fmt.Sprintf("chunk=%d", n), func(b *testing.B) {
+			chunkLines = n
+			benchmarkParallel(b, input)
+		})
+	}
+}
+
+func TestInvalidRateExits(t *testing.T) {
+	for _, p := range []string{"0", "1", "-0.5"} {
+		res := runBdedup(t, t.TempDir(), "a\n", "-p", p)
+		if res.code != 2 || !strings.Contains(res.stderr, "invalid -n or -p") {
+			t.Errorf("-p %s: exit status %d, %q; want 2 and an invalid -p error", p, res.code, res.stderr)
+		}
+	}
+}
+
+func TestImpossibleSizeExits(t *testing.T) {
+	res := runBdedup(t, t.TempDir(), "a\n", "-n", "1e15", "-p", "1e-9")
+	if res.code != 2 || !strings.Contains(res.stderr, "reduce the entries or raise the rate") {
+		t.Errorf("petabyte filter: exit status %d, %q; want 2 and advice", res.code, res.stderr)
+	}
+	if strings.Contains(res.stderr, "panic") {
+		t.Errorf("petabyte filter panicked: %s", res.stderr)
+	}
+}
+
+func TestDupLines(t *testing.T) {
+	in := "a\nb\na\nc\nb\nb\nd\n"
+	for _, c := range []string{"1", "4"} {
+		dir := t.TempDir()
+		mustRun(t, dir, in, "-dup-lines", "dups.txt", "-concurrency", c)
+		got, err := os.ReadFile(filepath.Join(dir, "dups.txt"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != "3\n5\n6\n" {
+			t.Errorf("-concurrency %s: duplicate line numbers %q, want 3, 5 and 6", c, got)
+		}
+	}
+	// Rejected lines keep their numbers.
+	dir := t.TempDir()
+	mustRun(t, dir, "a\n\nb\na\n", "-dup-lines", "dups.txt", "-min-len", "1")
+	if got, _ := os.ReadFile(filepath.Join(dir, "dups.txt")); string(got) != "4\n" {
+		t.Errorf("with a rejected line: duplicate line numbers %q, want 4", got)
+	}
+}
+
+func TestHashMismatchRejected(t *testing.T) {
+	dir := t.TempDir()
+	mustRun(t, dir, "a\n", "-hash", "murmur3")
+	res := runBdedup(t, dir, "a\nb\n", "-hash", "xxhash")
+	if res.code != 2 || !strings.Contains(res.stderr, "uses the murmur3 hash") {
+		t.Errorf("loading a murmur3 filter with -hash xxhash: exit status %d, %q; want 2 and a hash mismatch", res.code, res.stderr)
+	}
+	// Without -hash, the filter's own hash is used.
+	if got := mustRun(t, dir, "a\nb\n"); got != "b\n" {
+		t.Errorf("run without -hash emitted %q, want b only", got)
+	}
+	if got := mustRun(t, dir, "a\nb\nc\n", "-hash", "murmur3"); got != "c\n" {
+		t.Errorf("run with the matching -hash emitted %q, want c only", got)
+	}
+}
+
+func TestTinyN(t *testing.T) {
+	dir := t.TempDir()
+	res := runBdedup(t, dir, numbered("k", 10)+numbered("k", 10), "-n", "10")
+	if res.code != 0 || res.stdout != numbered("k", 10) {
+		t.Fatalf("-n 10: exit status %d, output %q", res.code, res.stdout)
+	}
+	if !strings.Contains(res.stderr, "below the smallest filter") {
+		t.Errorf("-n 10 logged %q, want a note about the minimum size", res.stderr)
+	}
+}
+
+func TestWornStateWarns(t *testing.T) {
+	dir := t.TempDir()
+	res := runBdedup(t, dir, numbered("key-", 100), "-n", "10000")
+	if res.code != 0 || strings.Contains(res.stderr, "estimated false positive rate") {
+		t.Fatalf("fresh filter: exit status %d, log %q; want no warning", res.code, res.stderr)
+	}
+	res = runBdedup(t, dir, "", "-n", "10000")
+	if strings.Contains(res.stderr, "estimated false positive rate") {
+		t.Errorf("healthy state warned: %q", res.stderr)
+	}
+
+	// Far more keys than the filter was sized for.
+	dir = t.TempDir()
+	mustRun(t, dir, numbered("key-", 5000), "-n", "50")
+	res = runBdedup(t, dir, "new\n", "-n", "50")
+	if res.code != 0 || !strings.Contains(res.stderr, "estimated false positive rate") {
+		t.Errorf("saturated state: exit status %d, log %q; want 0 and a warning", res.code, res.stderr)
+	}
+	res = runBdedup(t, dir, "new\n", "-n", "50", "-strict")
+	if res.code != 1 || res.stdout != "" {
+		t.Errorf("saturated state with -strict: exit status %d, output %q; want 1 and no output", res.code, res.stdout)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/mylh/bdedup/bbloom"
+)
+
+// hllPrecision gives the -two-pass and -cardinality estimates a standard
+// error of about 0.8%.
+const hllPrecision = 14
+
+// distinctKeys counts every key when -cardinality is set.
+var distinctKeys *bbloom.HyperLogLog
+
+// twoPassMargin over-sizes the filter relative to the -two-pass estimate,
+// covering a few standard errors of the sketch.
+const twoPassMargin = 1.05
+
+// estimateDistinct reads the regular files at paths once and returns the
+// estimated number of distinct keys across them.
+func estimateDistinct(paths ...string) (uint64, error) {
+	hll := bbloom.NewHyperLogLog(hllPrecision)
+	for _, path := range paths {
+		file, err := os.Open(path)
+		if err != nil {
+			return 0, err
+		}
+		info, err := file.Stat()
+		if err == nil && !info.Mode().IsRegular() {
+			err = fmt.Errorf("%s is not a regular file", path)
+		}
+		if err == nil {
+			_, err = addDistinct(&hll, file, path == inputFile || path == keyInputFile)
+		}
+		file.Close()
+		if err != nil {
+			return 0, err
+		}
+	}
+	return hll.Count(), nil
+}
+
+// addDistinct adds the key of every record in r to hll and returns the
+// number of records added. With window, only the -skip/-take window of r is
+// counted, as that is all of the input that is processed.
+func addDistinct(hll *bbloom.HyperLogLog, r io.Reader, window bool) (uint64, error) {
+	scanner := newLineScanner(r)
+	var scanned, added uint64
+	for !(window && windowDone(scanned)) && scanner.Scan() {
+		scanned++
+		if window && beforeWindow(scanned) {
+			continue
+		}
+		hll.Add(dedupKey(scanner.Bytes()))
+		added++
+	}
+	return added, scanner.Err()
+}
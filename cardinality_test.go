@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"path/filepath"
+	"testing"
+)
+
+func TestTwoPassSizesFilter(t *testing.T) {
+	dir := t.TempDir()
+	input, uniques := syntheticStream(300000, 100000)
+	distinct := uint64(lineCount(uniques))
+	path := writeFile(t, dir, "in.txt", input)
+	// The default -n is far off; the first pass replaces it.
+	mustRun(t, dir, "", "-two-pass", "-input", path, "-p", "0.01")
+	bf := loadState(t, filepath.Join(dir, "bloom.gz"))
+	got := bf.Capacity(0.01)
+	// A power-of-two size holds up to twice the estimate.
+	if got < distinct || got > 3*distinct {
+		t.Errorf("filter holds %d entries at p 0.01, want about %d", got, distinct)
+	}
+}
+
+func TestCardinalityEstimate(t *testing.T) {
+	input, uniques := syntheticStream(50000, 20000)
+	res := runBdedup(t, t.TempDir(), input, "-cardinality")
+	var est float64
+	if _, err := fmt.Sscanf(res.stderr, "Distinct (est.): %g", &est); err != nil {
+		t.Fatalf("-cardinality printed %q: %v", res.stderr, err)
+	}
+	// About 0.8% standard error at the precision used.
+	if want := float64(lineCount(uniques)); math.Abs(est-want) > 0.03*want {
+		t.Errorf("estimate %g, true distinct count %g", est, want)
+	}
+}
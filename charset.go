@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/ianaindex"
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/transform"
+)
+
+// inputEncoding is the -input-charset, or nil to take the input bytes as
+// they are. outputEncoding is the -output-charset, or nil for UTF-8.
+var (
+	inputEncoding  encoding.Encoding
+	outputEncoding encoding.Encoding
+)
+
+// lookupCharset returns the encoding with the IANA name or alias s, such as
+// latin1, windows-1252, utf-16le or shift_jis.
+func lookupCharset(s string) (encoding.Encoding, error) {
+	enc, err := ianaindex.IANA.Encoding(s)
+	if err != nil || enc == nil {
+		return nil, fmt.Errorf("unknown or unsupported charset %q", s)
+	}
+	return enc, nil
+}
+
+// parseInputCharset parses -input-charset. Even utf-8 is kept, so that a
+// BOM naming another encoding is still honored.
+func parseInputCharset(s string) (err error) {
+	inputEncoding, err = lookupCharset(s)
+	return err
+}
+
+// parseOutputCharset parses -output-charset.
+func parseOutputCharset(s string) (err error) {
+	if outputEncoding, err = lookupCharset(s); outputEncoding == unicode.UTF8 {
+		outputEncoding = nil
+	}
+	return err
+}
+
+// checkCharsetFlags exits if -input-charset or -output-charset is combined
+// with options that work on byte offsets of the raw input or output, which
+// transcoding changes.
+func checkCharsetFlags() {
+	if inputEncoding != nil && (reverse || resume) {
+		logErrorf("-input-charset cannot be combined with -reverse or -resume")
+		os.Exit(2)
+	}
+	if outputEncoding != nil && (resume || splitPrefix != "") {
+		logErrorf("-output-charset cannot be combined with -resume or -split-output")
+		os.Exit(2)
+	}
+}
+
+// decodeInput returns r transcoded from -input-charset to UTF-8, or r itself
+// without -input-charset. A UTF-8 or UTF-16 byte order mark at the start
+// overrides the charset, and is dropped. Bytes that are invalid in the
+// charset become U+FFFD.
+func decodeInput(r io.Reader) io.Reader {
+	if inputEncoding == nil {
+		return r
+	}
+	return transform.NewReader(r, unicode.BOMOverride(inputEncoding.NewDecoder()))
+}
+
+// encodeOutput returns w transcoding UTF-8 to -output-charset, or w itself
+// without one. Characters the charset cannot represent are written as its
+// substitute, the control character SUB (0x1A) for single-byte charsets.
+// Closing the result flushes it but does not close w.
+func encodeOutput(w io.Writer) io.WriteCloser {
+	if outputEncoding == nil {
+		return nopWriteCloser{w}
+	}
+	return transform.NewWriter(w, encoding.ReplaceUnsupported(outputEncoding.NewEncoder()))
+}
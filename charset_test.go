@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/unicode"
+)
+
+func TestInputCharset(t *testing.T) {
+	encode := func(enc interface{ String(string) (string, error) }, s string) string {
+		t.Helper()
+		out, err := enc.String(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return out
+	}
+	latin1 := charmap.ISO8859_1.NewEncoder()
+	utf16le := unicode.UTF16(unicode.LittleEndian, unicode.UseBOM).NewEncoder()
+	utf16be := unicode.UTF16(unicode.BigEndian, unicode.IgnoreBOM).NewEncoder()
+
+	dir := t.TempDir()
+	mustRun(t, dir, "café\nnaïve\n")
+	tests := []struct {
+		name, in string
+		args     []string
+	}{
+		{"latin1", encode(latin1, "café\nnaïve\nsoupçon\n"), []string{"-input-charset", "latin1"}},
+		{"utf-16le", encode(utf16le, "café\nnaïve\nsoupçon\n"), []string{"-input-charset", "utf-16le"}},
+		{"utf-16be", encode(utf16be, "café\r\nnaïve\r\nsoupçon\r\n"), []string{"-input-charset", "utf-16be"}},
+		// The BOM overrides the charset given.
+		{"utf-16le with a latin1 flag", encode(utf16le, "café\nnaïve\nsoupçon\n"), []string{"-input-charset", "latin1"}},
+	}
+	for _, tt := range tests {
+		// Each run adds soupçon, so start from the UTF-8 state each time.
+		state := tt.name + ".gz"
+		mustRun(t, dir, "café\nnaïve\n", "-state", state)
+		got := mustRun(t, dir, tt.in, append(tt.args, "-state", state)...)
+		if got != "soupçon\n" {
+			t.Errorf("%s: output %q, want only the new line, in UTF-8", tt.name, got)
+		}
+	}
+
+	// Latin-1 and UTF-8 copies of the same text in one run.
+	mixed := encode(latin1, "café\n") + "café\n"
+	if got := mustRun(t, t.TempDir(), mixed); got != mixed {
+		t.Errorf("without -input-charset: output %q, want both encodings as distinct", got)
+	}
+
+	// Output transcoded back to Latin-1.
+	got := mustRun(t, t.TempDir(), encode(latin1, "café\ncafé\n"), "-input-charset", "latin1", "-output-charset", "latin1")
+	if got != encode(latin1, "café\n") {
+		t.Errorf("-output-charset latin1: output %q", got)
+	}
+
+	if res := runBdedup(t, t.TempDir(), "", "-input-charset", "klingon"); res.code != 2 {
+		t.Errorf("unknown charset exited %d, want 2", res.code)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// codecs maps codec names to constructors of compressing writers. The state
+// file and -output-compress both go through it.
+var codecs = map[string]func(io.Writer) io.WriteCloser{
+	"none": func(w io.Writer) io.WriteCloser { return nopWriteCloser{w} },
+	"gzip": func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) },
+}
+
+// newCompressor wraps w in the named codec. Closing the result finishes the
+// compressed stream but does not close w.
+func newCompressor(codec string, w io.Writer) (io.WriteCloser, error) {
+	newWriter, ok := codecs[codec]
+	if !ok {
+		names := make([]string, 0, len(codecs))
+		for name := range codecs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown codec %q (supported: %s)", codec, strings.Join(names, ", "))
+	}
+	return newWriter(w), nil
+}
+
+// stateCodec returns the codec of the state file.
+func stateCodec() string {
+	if noGzip {
+		return "none"
+	}
+	return "gzip"
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// gunzip returns the decompressed content of a gzip stream.
+func gunzip(t *testing.T, r io.Reader) string {
+	t.Helper()
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestOutputCompress(t *testing.T) {
+	input, want := syntheticStream(20000, 5000)
+	for _, c := range []string{"1", "4"} {
+		dir := t.TempDir()
+		got := mustRun(t, dir, input, "-output-compress", "gzip", "-concurrency", c)
+		if out := gunzip(t, strings.NewReader(got)); out != want {
+			t.Errorf("-concurrency %s: stdout decompresses to %d lines, want the %d unique ones", c, lineCount(out), lineCount(want))
+		}
+
+		mustRun(t, dir, input, "-output-compress", "gzip", "-concurrency", c, "-output", "out.gz", "-state", "file.gz")
+		f, err := os.Open(filepath.Join(dir, "out.gz"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out := gunzip(t, f); out != want {
+			t.Errorf("-concurrency %s: -output file decompresses to %d lines, want the %d unique ones", c, lineCount(out), lineCount(want))
+		}
+		f.Close()
+	}
+	if res := runBdedup(t, t.TempDir(), "a\n", "-output-compress", "lz9"); res.code != 2 {
+		t.Errorf("unknown codec: exit status %d, want 2", res.code)
+	}
+}
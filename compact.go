@@ -0,0 +1,133 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/mylh/bdedup/bbloom"
+)
+
+// compactMain implements "bdedup compact": it rebuilds a filter sized for the
+// actual number of known unique lines, replacing one that has grown too full
+// to be accurate.
+func compactMain(args []string) {
+	fs := flag.NewFlagSet("compact", flag.ExitOnError)
+	var rebuildFrom, fromWAL, out string
+	fs.StringVar(&stateFile, "state", "bloom.gz", "Bloom filter state file being replaced")
+	fs.StringVar(&rebuildFrom, "rebuild-from", "", "File of known unique lines to rebuild the filter from")
+	fs.StringVar(&fromWAL, "from-wal", "", "Log written with -wal to rebuild the filter from, instead of -rebuild-from")
+	fs.StringVar(&out, "o", "", "Rebuilt state file (default: overwrite -state)")
+	fs.Float64Var(&falsePositive, "p", 0.01, "False positive probability of the rebuilt filter")
+	fs.Func("hash", "Hash of the rebuilt filter: siphash, murmur3 or xxhash (default: siphash)", parseHash)
+	fs.BoolVar(&roundDown, "round-down", false, "Round the rebuilt filter's size down to a power of two instead of up")
+	fs.BoolVar(&noGzip, "no-gzip", false, "Disable gzip compression for state files")
+	registerRetryFlags(fs)
+	registerLogFlags(fs)
+	registerKeyFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), `Rebuild a correctly-sized Bloom filter from a file of known unique lines
+or from the keys logged with -wal.
+
+Usage: %[1]s compact -rebuild-from uniques.txt [-state old.gz] [-o new.gz] [-p 0.01]
+       %[1]s compact -from-wal keys.wal [-state old.gz] [-o new.gz] [-p 0.01]
+
+Options:
+`, os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	checkKeyRegexFlags()
+
+	if (rebuildFrom == "") == (fromWAL == "") {
+		logErrorf("compact requires one of -rebuild-from or -from-wal")
+		fs.Usage()
+		os.Exit(2)
+	}
+	if out == "" {
+		out = stateFile
+	}
+
+	var bf bbloom.Bloom
+	var count int
+	if fromWAL != "" {
+		bf, count = rebuildFromWAL(fromWAL)
+	} else {
+		bf, count = filterFromLines(rebuildFrom, "rebuild file")
+	}
+
+	if _, err := os.Stat(stateFile); err == nil {
+		// Read directly: the old filter is expected to be worn out.
+		old, err := readBloomFilter(stateFile)
+		if err != nil {
+			logErrorf("%v", err)
+			os.Exit(1)
+		}
+		logInfof("Old filter:     fill %.4f, estimated FPR %.6f", old.FillRatio(), old.EstimatedFPR())
+	}
+	logInfof("Rebuilt filter: fill %.4f, estimated FPR %.6f (%d keys)", bf.FillRatio(), bf.EstimatedFPR(), count)
+
+	if err := saveBloomFilter(out, bf); err != nil {
+		logErrorf("%v", err)
+		os.Exit(1)
+	}
+}
+
+// filterFromLines builds a filter holding the key of every line in path,
+// sized for the number of lines. what names the file in error messages.
+func filterFromLines(path, what string) (bbloom.Bloom, int) {
+	file, err := os.Open(path)
+	if err != nil {
+		logErrorf("opening %s: %v", what, err)
+		os.Exit(1)
+	}
+	defer file.Close()
+
+	count, err := countLines(file)
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		logErrorf("reading %s: %v", what, err)
+		os.Exit(1)
+	}
+
+	bf := newBloomFilter(float64(max(count, 1)))
+	scanner := newLineScanner(file)
+	for scanner.Scan() {
+		bf.Add(dedupKey(scanner.Bytes()))
+	}
+	if err := scanner.Err(); err != nil {
+		logErrorf("reading %s: %v", what, err)
+		os.Exit(1)
+	}
+	return bf, count
+}
+
+// rebuildFromWAL builds a filter holding every key logged in path, sized for
+// the number of keys. The keys are added as logged, without applying the
+// key flags again.
+func rebuildFromWAL(path string) (bbloom.Bloom, int) {
+	count, err := readWAL(path, func([]byte) {})
+	if err != nil {
+		logErrorf("reading WAL: %v", err)
+		os.Exit(1)
+	}
+	bf := newBloomFilter(float64(max(count, 1)))
+	if _, err := readWAL(path, bf.Add); err != nil {
+		logErrorf("reading WAL: %v", err)
+		os.Exit(1)
+	}
+	return bf, count
+}
+
+// countLines returns the number of lines in r.
+func countLines(r io.Reader) (int, error) {
+	count := 0
+	scanner := newLineScanner(r)
+	for scanner.Scan() {
+		count++
+	}
+	return count, scanner.Err()
+}
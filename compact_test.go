@@ -0,0 +1,31 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCompactRebuildsSaturatedFilter(t *testing.T) {
+	dir := t.TempDir()
+	const n = 20000
+	keys := numbered("key-", n)
+	// A filter sized for 500 keys is saturated by 20000.
+	mustRun(t, dir, keys, "-state", "full.gz", "-n", "500")
+	full := loadState(t, filepath.Join(dir, "full.gz"))
+	if fpr := full.Probe(20000, 1); fpr < 0.5 {
+		t.Fatalf("probed FPR of the saturated filter is %g; it is not saturated", fpr)
+	}
+
+	uniques := writeFile(t, dir, "uniques.txt", keys)
+	mustRun(t, dir, "", "compact", "-state", "full.gz", "-rebuild-from", uniques, "-o", "compact.gz", "-p", "0.01")
+	rebuilt := loadState(t, filepath.Join(dir, "compact.gz"))
+	for _, key := range strings.Split(strings.TrimSuffix(keys, "\n"), "\n") {
+		if !rebuilt.Has([]byte(key)) {
+			t.Fatalf("%s missing from the rebuilt filter", key)
+		}
+	}
+	if fpr := rebuilt.Probe(100000, 1); fpr > 0.02 {
+		t.Errorf("probed FPR of the rebuilt filter is %g, want about 0.01", fpr)
+	}
+}
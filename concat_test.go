@@ -0,0 +1,78 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mylh/bdedup/bbloom"
+)
+
+// concatFiles writes the contents of the files names in dir, one after
+// another, to dir/out, as cat would.
+func concatFiles(t *testing.T, dir, out string, names ...string) {
+	t.Helper()
+	var all []byte
+	for _, name := range names {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		all = append(all, data...)
+	}
+	if err := os.WriteFile(filepath.Join(dir, out), all, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConcatenatedState(t *testing.T) {
+	for _, gz := range []bool{true, false} {
+		var extra []string
+		if !gz {
+			extra = []string{"-no-gzip"}
+		}
+		dir := t.TempDir()
+		mustRun(t, dir, numbered("a-", 500), append(extra, "-state", "a.gz", "-n", "10000")...)
+		mustRun(t, dir, numbered("b-", 500), append(extra, "-state", "b.gz", "-n", "10000")...)
+		mustRun(t, dir, "c\n", append(extra, "-state", "c.gz", "-n", "10000")...)
+		concatFiles(t, dir, "all.gz", "a.gz", "b.gz", "c.gz")
+
+		// Every member counts, not only the first.
+		all := loadStateWith(t, filepath.Join(dir, "all.gz"), gz)
+		for _, key := range []string{"a-0", "a-499", "b-0", "b-499", "c"} {
+			if !all.Has([]byte(key)) {
+				t.Errorf("gzip %v: %s missing from the concatenated state", gz, key)
+			}
+		}
+		res := runBdedup(t, dir, numbered("a-", 500)+numbered("b-", 500)+"c\nd\n", append(extra, "-state", "all.gz", "-n", "10000")...)
+		if res.stdout != "d\n" || !strings.Contains(res.stderr, "3 concatenated filters") {
+			t.Errorf("gzip %v: run on the concatenated state emitted %q, logged %q", gz, res.stdout, res.stderr)
+		}
+
+		// Filters of another geometry cannot be merged.
+		mustRun(t, dir, "x\n", append(extra, "-state", "small.gz", "-n", "100")...)
+		concatFiles(t, dir, "mixed.gz", "a.gz", "small.gz")
+		if res := runBdedup(t, dir, "a-0\n", append(extra, "-state", "mixed.gz", "-n", "10000")...); res.code != 1 || res.stdout != "" {
+			t.Errorf("gzip %v: mixed geometries: exit status %d, output %q; want 1 and no output", gz, res.code, res.stdout)
+		}
+	}
+
+	// Trailing bytes after the filter are an error, not ignored.
+	dir := t.TempDir()
+	mustRun(t, dir, "a\n", "-no-gzip", "-state", "a.bin")
+	writeFile(t, dir, "junk", "junk")
+	concatFiles(t, dir, "trailing.bin", "a.bin", "junk")
+	if res := runBdedup(t, dir, "a\n", "-no-gzip", "-state", "trailing.bin"); res.code != 1 {
+		t.Errorf("trailing junk: exit status %d, want 1", res.code)
+	}
+}
+
+// loadStateWith reads the filter saved at path, compressed or not.
+func loadStateWith(t *testing.T, path string, gz bool) bbloom.Bloom {
+	t.Helper()
+	saved := noGzip
+	noGzip = !gz
+	defer func() { noGzip = saved }()
+	return loadState(t, path)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/mylh/bdedup/bbloom"
+)
+
+// gzipMagic starts every gzip stream.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// convertMain implements "bdedup convert": it rewrites a filter saved with
+// JSONMarshal as a binary state file, or a binary state file as JSON, without
+// the input it was built from. The result is read back and compared with the
+// source, so a conversion that would change the filter fails instead.
+func convertMain(args []string) {
+	fs := flag.NewFlagSet("convert", flag.ExitOnError)
+	var in, out string
+	fs.StringVar(&in, "in", "", "Filter to convert, JSON or binary, gzipped or not")
+	fs.StringVar(&out, "out", "", "Converted filter: binary state file for JSON input, JSON for binary input")
+	fs.BoolVar(&noGzip, "no-gzip", false, "Disable gzip compression for a binary -out state file")
+	registerRetryFlags(fs)
+	registerLogFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), `Convert a Bloom filter between the JSON format of JSONMarshal and the binary
+state file format. The input format is detected from its content; the output
+is the other one.
+
+Usage: %[1]s convert -in old.json -out new.gz
+
+Options:
+`, os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if in == "" || out == "" {
+		logErrorf("convert requires -in and -out")
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	bf, isJSON, err := readAnyFilter(in)
+	if err != nil {
+		logErrorf("reading %s: %v", in, err)
+		os.Exit(1)
+	}
+
+	var back bbloom.Bloom
+	if isJSON {
+		if err := saveBloomFilter(out, bf); err != nil {
+			logErrorf("%v", err)
+			os.Exit(1)
+		}
+		back, err = readBloomFilter(out)
+	} else {
+		if err := writeJSONFilter(out, &bf); err != nil {
+			logErrorf("writing %s: %v", out, err)
+			os.Exit(1)
+		}
+		back, _, err = readAnyFilter(out)
+	}
+	if err != nil {
+		logErrorf("reading back %s: %v", out, err)
+		os.Exit(1)
+	}
+	if !bf.Equal(&back) {
+		logErrorf("%s does not hold the same filter as %s", out, in)
+		os.Exit(1)
+	}
+
+	from, to := "binary", "JSON"
+	if isJSON {
+		from, to = to, from
+	}
+	m := bf.Metrics()
+	logInfof("Converted %s filter %s to %s %s: %d bits, %d hash locations, %s hash, %d entries",
+		from, in, to, out, m.SizeBits, m.HashLocs, bf.HashFunc, bf.ElemNum)
+}
+
+// readAnyFilter reads the filter at path in either format, decompressing it
+// first if it is gzipped, and reports whether it was JSON. A binary filter
+// starts with its size exponent as a little-endian word, so its second byte
+// is zero, which JSON text never contains.
+func readAnyFilter(path string) (bf bbloom.Bloom, isJSON bool, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return bf, false, err
+	}
+	defer file.Close()
+	br := bufio.NewReader(file)
+	if magic, _ := br.Peek(len(gzipMagic)); bytes.Equal(magic, gzipMagic) {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return bf, false, err
+		}
+		defer gz.Close()
+		br = bufio.NewReader(gz)
+	}
+	head, err := br.Peek(2)
+	if len(head) == 0 {
+		if err == io.EOF {
+			err = fmt.Errorf("empty filter file")
+		}
+		return bf, false, err
+	}
+	if len(head) == 2 && head[1] == 0 {
+		bf, err = bbloom.BinaryUnmarshal(br)
+		return bf, false, err
+	}
+	bf, err = bbloom.JSONDecode(br)
+	return bf, true, err
+}
+
+// writeJSONFilter writes bf to path as JSONMarshal would.
+func writeJSONFilter(path string, bf *bbloom.Bloom) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := bf.JSONEncode(file); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
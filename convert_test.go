@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mylh/bdedup/bbloom"
+)
+
+func TestConvertJSONToBinary(t *testing.T) {
+	dir := t.TempDir()
+	bf := bbloom.New(5000, 0.001)
+	bf.HashFunc = bbloom.XXHash
+	for i := range 3000 {
+		bf.Add(fmt.Appendf(nil, "key-%d", i))
+	}
+	var js bytes.Buffer
+	if err := bf.JSONEncode(&js); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, dir, "old.json", js.String())
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write(js.Bytes())
+	zw.Close()
+	writeFile(t, dir, "old.json.gz", gz.String())
+
+	for _, in := range []string{"old.json", "old.json.gz"} {
+		out := in + ".state.gz"
+		mustRun(t, dir, "", "convert", "-in", in, "-out", out)
+		got := loadState(t, filepath.Join(dir, out))
+		if !got.Equal(&bf) || got.HashFunc != bbloom.XXHash {
+			t.Errorf("%s: converted filter differs from the JSON one", in)
+		}
+		// JSON has no entry count; it is estimated from the fill.
+		if got.ElemNum < 2950 || got.ElemNum > 3050 {
+			t.Errorf("%s: converted filter counts %d entries, want about 3000", in, got.ElemNum)
+		}
+		for i := range 3000 {
+			if !got.Has(fmt.Appendf(nil, "key-%d", i)) {
+				t.Fatalf("%s: key-%d missing after conversion", in, i)
+			}
+		}
+		// The converted state deduplicates against the old keys.
+		if out := mustRun(t, dir, numbered("key-", 3001), "-state", out); out != "key-3000\n" {
+			t.Errorf("%s: run on the converted state emitted %q, want key-3000 only", in, out)
+		}
+	}
+
+	// And back: binary in, JSON out.
+	mustRun(t, dir, "", "convert", "-in", "old.json.state.gz", "-out", "back.json")
+	back, isJSON, err := readAnyFilter(filepath.Join(dir, "back.json"))
+	if err != nil || !isJSON {
+		t.Fatalf("back.json: JSON %v, %v", isJSON, err)
+	}
+	// The run above added key-3000 to the state.
+	if state := loadState(t, filepath.Join(dir, "old.json.state.gz")); !back.Equal(&state) {
+		t.Error("JSON converted from the binary state differs from it")
+	}
+
+	writeFile(t, dir, "empty", "")
+	if res := runBdedup(t, dir, "", "convert", "-in", "empty", "-out", "x.gz"); res.code != 1 {
+		t.Errorf("converting an empty file exited %d, want 1", res.code)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "x.gz")); !os.IsNotExist(err) {
+		t.Errorf("failed conversion wrote its output: %v", err)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/mylh/bdedup/bbloom"
+)
+
+// Count-min sketch parameters for -with-counts: estimates exceed the true
+// count by at most countEpsilon times the number of input lines with
+// probability 1-countDelta, using about 1 MiB of counters.
+const (
+	countEpsilon = 0.0001
+	countDelta   = 0.01
+)
+
+// lineCounts counts every key when -with-counts is set.
+var lineCounts *bbloom.CountMin
+
+// countSpool holds the first occurrence of each new line on disk until the
+// end of input, when the final counts are known.
+type countSpool struct {
+	file *os.File
+	buf  *bufio.Writer
+}
+
+func newCountSpool() (*countSpool, error) {
+	file, err := os.CreateTemp("", "bdedup-counts-*")
+	if err != nil {
+		return nil, err
+	}
+	return &countSpool{file: file, buf: bufio.NewWriter(file)}, nil
+}
+
+func (cs *countSpool) Write(p []byte) (int, error) {
+	return cs.buf.Write(p)
+}
+
+// finish writes every spooled line to out, or its -split-output shard, as
+// "count\tline", each followed by the record end.
+func (cs *countSpool) finish(out io.Writer) error {
+	if err := cs.buf.Flush(); err != nil {
+		return err
+	}
+	if _, err := cs.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	scanner := newLineScanner(cs.file)
+	for scanner.Scan() {
+		// The same key the line was counted under, shard tag included.
+		key := recordKey(scanner)
+		w := out
+		if splits != nil {
+			w = splits.shard(key)
+		}
+		if _, err := fmt.Fprintf(w, "%d\t%s%s", lineCounts.Count(key), scanner.Bytes(), recordEnd()); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// Close closes and removes the spool file.
+func (cs *countSpool) Close() error {
+	err := cs.file.Close()
+	os.Remove(cs.file.Name())
+	return err
+}
@@ -0,0 +1,13 @@
+package main
+
+import "testing"
+
+func TestWithCounts(t *testing.T) {
+	in := "a\nb\na\nc\na\nb\n"
+	want := "3\ta\n2\tb\n1\tc\n"
+	for _, c := range []string{"1", "4"} {
+		if got := mustRun(t, t.TempDir(), in, "-with-counts", "-concurrency", c); got != want {
+			t.Errorf("-concurrency %s: output %q, want %q", c, got, want)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"io"
+	"unicode/utf8"
+)
+
+// csvInput reports whether records are read as CSV (-input-format csv)
+// rather than as lines.
+func csvInput() bool {
+	return inputFormat == "csv"
+}
+
+// csvScanner reads CSV records, which may span several lines. Bytes returns
+// a record exactly as it appeared in the input, quotes included, without its
+// final line ending, so it can be written out unchanged.
+type csvScanner struct {
+	in       *recordingReader
+	src      *bufio.Reader
+	bom      int64 // length of the byte order mark skipped, or -1 before the first Scan
+	r        *csv.Reader
+	consumed *int64
+	raw      []byte
+	err      error
+	record   int
+}
+
+// recordingReader keeps the bytes read through it from offset base on, so
+// the raw text of a record can be cut out once the CSV reader has parsed it.
+type recordingReader struct {
+	r    io.Reader
+	buf  []byte
+	base int64
+}
+
+func (rr *recordingReader) Read(p []byte) (int, error) {
+	n, err := rr.r.Read(p)
+	rr.buf = append(rr.buf, p[:n]...)
+	return n, err
+}
+
+// take returns the recorded bytes up to input offset end and forgets them.
+func (rr *recordingReader) take(end int64) []byte {
+	raw := rr.buf[:end-rr.base]
+	rr.buf = rr.buf[end-rr.base:]
+	rr.base = end
+	return raw
+}
+
+func newCSVScanner(r io.Reader, consumed *int64) *csvScanner {
+	src := bufio.NewReaderSize(r, max(int(readBuffer), 4096))
+	in := &recordingReader{r: src}
+	cr := csv.NewReader(in)
+	cr.Comma, _ = utf8.DecodeRuneInString(delimiter())
+	cr.FieldsPerRecord = -1
+	cr.ReuseRecord = true
+	return &csvScanner{in: in, src: src, bom: -1, r: cr, consumed: consumed}
+}
+
+// skipBOM drops a byte order mark at the start of the input before the CSV
+// reader sees it, since a quoted first field would not parse after one. It
+// peeks a byte at a time so as not to wait for input the first record does
+// not need.
+func (cs *csvScanner) skipBOM() {
+	cs.bom = 0
+	for n := 1; n <= len(utf8BOM); n++ {
+		b, err := cs.src.Peek(n)
+		if err != nil || !bytes.HasPrefix(utf8BOM, b) {
+			return
+		}
+	}
+	cs.src.Discard(len(utf8BOM))
+	cs.bom = int64(len(utf8BOM))
+}
+
+func (cs *csvScanner) Scan() bool {
+	if cs.bom < 0 {
+		cs.skipBOM()
+	}
+	for {
+		_, err := cs.r.Read()
+		if err == io.EOF {
+			return false
+		}
+		end := cs.r.InputOffset()
+		raw := cs.in.take(end)
+		if cs.consumed != nil {
+			*cs.consumed = cs.bom + end
+		}
+		cs.record++
+		var perr *csv.ParseError
+		if err != nil && skipErrors && errors.As(err, &perr) {
+			skippedRecords++
+			logWarnf("skipping record %d: %v", cs.record, err)
+			continue
+		}
+		if err != nil {
+			cs.err = err
+			return false
+		}
+		// The CSV reader skips blank lines before a record; they belong to
+		// no record and are dropped.
+		for len(raw) > 0 && (raw[0] == '\n' || raw[0] == '\r') {
+			raw = raw[1:]
+		}
+		lastRecordTerminated = bytes.HasSuffix(raw, []byte("\n"))
+		raw = bytes.TrimSuffix(raw, []byte("\n"))
+		cs.raw = bytes.TrimSuffix(raw, []byte("\r"))
+		return true
+	}
+}
+
+func (cs *csvScanner) Bytes() []byte { return cs.raw }
+func (cs *csvScanner) Text() string  { return string(cs.raw) }
+func (cs *csvScanner) Err() error    { return cs.err }
+
+// parseCSVRecord splits a raw record, as returned by csvScanner, into its
+// fields. A record that does not parse is treated as a single field.
+func parseCSVRecord(raw []byte) [][]byte {
+	cr := csv.NewReader(bytes.NewReader(raw))
+	cr.Comma, _ = utf8.DecodeRuneInString(delimiter())
+	cr.FieldsPerRecord = -1
+	rec, err := cr.Read()
+	if err != nil {
+		return [][]byte{raw}
+	}
+	fields := make([][]byte, len(rec))
+	for i, f := range rec {
+		fields[i] = []byte(f)
+	}
+	return fields
+}
+
+// appendCSVField appends f to key, quoted as CSV requires, so that keys
+// built from different fields never collide.
+func appendCSVField(key, f []byte, comma string) []byte {
+	if !bytes.ContainsAny(f, comma+"\"\r\n") {
+		return append(key, f...)
+	}
+	key = append(key, '"')
+	key = append(key, bytes.ReplaceAll(f, []byte(`"`), []byte(`""`))...)
+	return append(key, '"')
+}
@@ -0,0 +1,47 @@
+package main
+
+import "testing"
+
+func TestCSVQuotedFields(t *testing.T) {
+	tests := []struct {
+		name, field, in, want string
+	}{
+		{
+			"comma inside quotes",
+			"1",
+			// A naive split gives "x for both.
+			"\"x,1\",p\n\"x,2\",q\n",
+			"\"x,1\",p\n\"x,2\",q\n",
+		},
+		{
+			"quoting does not change the value",
+			"1",
+			"\"x\",1\nx,2\n",
+			"\"x\",1\n",
+		},
+		{
+			"escaped quotes",
+			"2",
+			"1,\"said \"\"hi\"\"\"\n2,\"said \"\"hi\"\"\"\n3,said hi\n",
+			"1,\"said \"\"hi\"\"\"\n3,said hi\n",
+		},
+		{
+			"newline inside quotes",
+			"2",
+			"1,\"multi\nline\"\n2,\"multi\nline\"\n3,multi\n",
+			"1,\"multi\nline\"\n3,multi\n",
+		},
+		{
+			"record kept byte for byte",
+			"1",
+			"1,\"Smith, John\",\"a \"\"b\"\"\"\n1,x,y\n",
+			"1,\"Smith, John\",\"a \"\"b\"\"\"\n",
+		},
+	}
+	for _, tt := range tests {
+		got := mustRun(t, t.TempDir(), tt.in, "-input-format", "csv", "-field", tt.field)
+		if got != tt.want {
+			t.Errorf("%s: output %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
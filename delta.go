@@ -0,0 +1,28 @@
+package main
+
+import (
+	"io"
+	"os"
+)
+
+var deltaFile string
+
+// deltaLines receives, when -delta-output is set, every line whose key the
+// run added to the filter: the lines counted as unique. Without -seen they
+// are the lines written to the output; with -seen, exactly the ones that
+// were not.
+var deltaLines io.Writer
+
+// checkDeltaFlags exits if -delta-output is combined with a mode that adds
+// nothing to a filter.
+func checkDeltaFlags() {
+	if queryOnly || adjacent {
+		logErrorf("-delta-output cannot be combined with -query-only or -adjacent")
+		os.Exit(2)
+	}
+}
+
+// recordDelta writes line to the -delta-output file.
+func recordDelta(line string) {
+	io.WriteString(deltaLines, line+recordEnd())
+}
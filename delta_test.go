@@ -0,0 +1,49 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestDeltaOutput(t *testing.T) {
+	for _, c := range []string{"1", "4"} {
+		dir := t.TempDir()
+		in := "a\nc\nb\nd\nc\n"
+		readDelta := func() string {
+			t.Helper()
+			data, err := os.ReadFile(filepath.Join(dir, "delta.txt"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return string(data)
+		}
+
+		// Without -seen the delta is the output.
+		out := mustRun(t, dir, in, "-delta-output", "delta.txt", "-concurrency", c, "-state", "plain.gz")
+		if delta := readDelta(); delta != out || out != "a\nc\nb\nd\n" {
+			t.Errorf("-concurrency %s: output %q and delta %q, want both the new lines", c, out, delta)
+		}
+
+		// With -seen the output is what was already held, the delta what
+		// was added: they split the distinct lines between them.
+		mustRun(t, dir, "a\nb\n", "-state", "seen.gz")
+		out = mustRun(t, dir, in, "-seen", "-delta-output", "delta.txt", "-concurrency", c, "-state", "seen.gz")
+		if delta := readDelta(); out != "a\nb\nc\n" || delta != "c\nd\n" {
+			t.Errorf("-concurrency %s -seen: output %q and delta %q, want a, b, c and c, d", c, out, delta)
+		}
+
+		// The delta of a run is exactly what the next run finds present.
+		delta := strings.Split(strings.TrimSuffix(readDelta(), "\n"), "\n")
+		present := strings.Split(strings.TrimSuffix(mustRun(t, dir, "c\nd\ne\n", "-seen", "-state", "seen.gz"), "\n"), "\n")
+		if !slices.Equal(delta, present) {
+			t.Errorf("-concurrency %s: delta %q, but %q present afterwards", c, delta, present)
+		}
+	}
+
+	if res := runBdedup(t, t.TempDir(), "a\n", "-delta-output", "d", "-adjacent"); res.code != 2 {
+		t.Errorf("-delta-output -adjacent exited %d, want 2", res.code)
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"cmp"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"slices"
+
+	"github.com/mylh/bdedup/bbloom"
+)
+
+// diagCollisionsMain implements "bdedup diag-collisions": it adds a sample
+// of keys to a fresh filter and reports how often they collide, to tell a
+// hash that spreads keys badly from a filter that is simply too small.
+func diagCollisionsMain(args []string) {
+	fs := flag.NewFlagSet("diag-collisions", flag.ExitOnError)
+	var top int
+	fs.StringVar(&inputFile, "input", "", "Sample of lines to analyze (default: stdin)")
+	fs.Float64Var(&numValues, "n", 0, "Expected number of values the filter is sized for (default: the sample's distinct keys)")
+	fs.Float64Var(&falsePositive, "p", 0.01, "False positive probability the filter is sized for")
+	fs.Func("hash", "Hash of the filter: siphash, murmur3 or xxhash (default: siphash)", parseHash)
+	fs.IntVar(&top, "top", 10, "Number of most-set bit positions to list")
+	registerLogFlags(fs)
+	registerKeyFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), `Add a sample of keys to a fresh filter and report how many pairs share their
+full hash or all of their bit positions, how many were false positives, and
+the bit positions set most often, each against what a uniform hash would
+give. Size the filter with the -n, -p and -hash of the filter in question.
+
+Usage: %[1]s diag-collisions -input sample.txt [-n 1000000] [-p 0.01] [-top 10]
+
+Options:
+`, os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	checkKeyRegexFlags()
+	if numValues < 0 || top < 0 {
+		logErrorf("-n and -top must not be negative")
+		os.Exit(2)
+	}
+
+	var input io.Reader = os.Stdin
+	if inputFile != "" {
+		file, err := os.Open(inputFile)
+		if err != nil {
+			logErrorf("opening input file: %v", err)
+			os.Exit(1)
+		}
+		defer file.Close()
+		input = file
+	}
+	// The sample is held in memory, so that repeated keys are told apart
+	// from false positives exactly.
+	var keys []string
+	seen := make(map[string]struct{})
+	var lines int
+	scanner := newLineScanner(input)
+	for scanner.Scan() {
+		lines++
+		key := string(dedupKey(scanner.Bytes()))
+		if _, ok := seen[key]; !ok {
+			seen[key] = struct{}{}
+			keys = append(keys, key)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		logErrorf("reading input: %v", err)
+		os.Exit(1)
+	}
+	if len(keys) == 0 {
+		logErrorf("the sample has no keys")
+		os.Exit(1)
+	}
+	if numValues == 0 {
+		numValues = float64(len(keys))
+	}
+	bf := newBloomFilter(numValues)
+	r := diagCollisions(&bf, keys)
+	r.lines = lines
+	if err := r.print(os.Stdout, top); err != nil {
+		logErrorf("writing report: %v", err)
+		os.Exit(1)
+	}
+}
+
+// collisionReport is what diag-collisions found for a sample of distinct
+// keys.
+type collisionReport struct {
+	lines, keys     int
+	sizeBits, locs  uint64
+	hash            string
+	hashPairs       uint64 // pairs with equal 64-bit hashes
+	positionPairs   uint64 // pairs with equal bit positions, hashPairs included
+	falsePositives  int
+	expectedFP      float64 // expected falsePositives for a uniform hash
+	bitCounts       map[uint64]int
+	expectedPerBit  float64
+	positionExample [2]string
+}
+
+// diagCollisions adds keys, which must be distinct, to bf one by one. A key
+// bf already reports as present is a false positive. Keys are also grouped
+// by their hash and by their set of bit positions, to count the pairs that
+// no filter of this geometry could tell apart.
+func diagCollisions(bf *bbloom.Bloom, keys []string) *collisionReport {
+	m := bf.Metrics()
+	r := &collisionReport{
+		keys:      len(keys),
+		sizeBits:  m.SizeBits,
+		locs:      m.HashLocs,
+		hash:      bf.HashFunc.String(),
+		bitCounts: make(map[uint64]int),
+	}
+	bySum := make(map[uint64]int)
+	// byPositions maps a set of bit positions to the first key with it
+	// and the number of keys with it so far.
+	type group struct {
+		first string
+		n     int
+	}
+	byPositions := make(map[string]*group)
+	k, size := float64(m.HashLocs), float64(m.SizeBits)
+	for i, key := range keys {
+		entry := []byte(key)
+		if bf.Has(entry) {
+			r.falsePositives++
+		}
+		// The chance that i keys set all k bits of a new one.
+		r.expectedFP += math.Pow(-math.Expm1(-k*float64(i)/size), k)
+
+		sum := bf.Sum(entry)
+		r.hashPairs += uint64(bySum[sum])
+		bySum[sum]++
+
+		pos := bf.Positions(entry)
+		for _, p := range pos {
+			r.bitCounts[p]++
+		}
+		slices.Sort(pos)
+		sig := fmt.Sprint(slices.Compact(pos))
+		g, ok := byPositions[sig]
+		if !ok {
+			g = &group{first: key}
+			byPositions[sig] = g
+		} else if r.positionExample[0] == "" {
+			r.positionExample = [2]string{g.first, key}
+		}
+		r.positionPairs += uint64(g.n)
+		g.n++
+
+		bf.Add(entry)
+	}
+	r.expectedPerBit = float64(len(keys)) * k / size
+	return r
+}
+
+// pairs returns the number of unordered pairs among n keys.
+func pairs(n int) float64 {
+	return float64(n) * float64(n-1) / 2
+}
+
+// unlikely reports whether observed is well above the expected mean of a
+// Poisson count, beyond what chance plausibly gives.
+func unlikely(observed, expected float64) bool {
+	return observed > expected+4*math.Sqrt(expected)+2
+}
+
+func (r *collisionReport) print(w io.Writer, top int) error {
+	// Two keys share all positions when both halves of their hash agree
+	// modulo the size, or walk the same positions in reverse order; with
+	// one location, when that one agrees.
+	expectedHash := pairs(r.keys) / math.Exp2(64)
+	expectedPos := pairs(r.keys) / float64(r.sizeBits)
+	if r.locs > 1 {
+		expectedPos *= 2 / float64(r.sizeBits)
+	}
+	var err error
+	line := func(format string, args ...any) {
+		if err == nil {
+			_, err = fmt.Fprintf(w, format, args...)
+		}
+	}
+	line("Sample:          %d lines, %d distinct keys\n", r.lines, r.keys)
+	line("Filter:          bloom, %d bits, %d hash locations, %s\n", r.sizeBits, r.locs, r.hash)
+	line("Hash collisions: %d pairs share the full 64-bit hash (uniform hash: %.3g)\n", r.hashPairs, expectedHash)
+	line("Same positions:  %d pairs share all bit positions (uniform hash: %.3g)\n", r.positionPairs, expectedPos)
+	if r.positionExample[0] != "" {
+		line("                 e.g. %q and %q\n", r.positionExample[0], r.positionExample[1])
+	}
+	line("False positives: %d of %d keys (%.4g%%) were present before being added (uniform hash: %.4g%%)\n",
+		r.falsePositives, r.keys, 100*float64(r.falsePositives)/float64(r.keys), 100*r.expectedFP/float64(r.keys))
+
+	type bitCount struct {
+		pos   uint64
+		count int
+	}
+	counts := make([]bitCount, 0, len(r.bitCounts))
+	for p, c := range r.bitCounts {
+		counts = append(counts, bitCount{p, c})
+	}
+	slices.SortFunc(counts, func(a, b bitCount) int {
+		return cmp.Or(cmp.Compare(b.count, a.count), cmp.Compare(a.pos, b.pos))
+	})
+	if top > 0 && len(counts) > 0 {
+		line("Most-set bits:   mean %.3g keys per bit\n", r.expectedPerBit)
+		for _, c := range counts[:min(top, len(counts))] {
+			line("  bit %-12d %d keys\n", c.pos, c.count)
+		}
+	}
+
+	var verdict string
+	switch {
+	case unlikely(float64(r.hashPairs), expectedHash) || unlikely(float64(r.positionPairs), expectedPos):
+		verdict = "more keys collide than a uniform hash allows; suspect the hash or the key options (try another -hash)"
+	case unlikely(float64(r.falsePositives), r.expectedFP):
+		verdict = "more false positives than a uniform hash gives at this size; suspect the hash (try another -hash)"
+	case r.falsePositives > 0:
+		verdict = "false positives are what this size gives; if they are too many, the filter is too small for its load, so raise -n or lower -p"
+	default:
+		verdict = "no collisions or false positives in this sample"
+	}
+	line("Verdict:         %s\n", verdict)
+	return err
+}
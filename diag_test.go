@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/mylh/bdedup/bbloom"
+)
+
+// collidingPairs returns n disjoint pairs of keys with the same bit
+// positions in bf, found by brute force.
+func collidingPairs(bf *bbloom.Bloom, n int) []string {
+	bySig := make(map[string]string)
+	var keys []string
+	for i := 0; len(keys) < 2*n; i++ {
+		key := fmt.Sprintf("k-%d", i)
+		pos := bf.Positions([]byte(key))
+		slices.Sort(pos)
+		sig := fmt.Sprint(slices.Compact(pos))
+		if first, ok := bySig[sig]; ok && first != "" {
+			keys = append(keys, first, key)
+			bySig[sig] = "" // keep the pairs disjoint
+		} else if !ok {
+			bySig[sig] = key
+		}
+	}
+	return keys
+}
+
+func TestDiagCollisionsCrafted(t *testing.T) {
+	bf := bbloom.New(512, 2)
+	keys := collidingPairs(&bf, 20)
+	r := diagCollisions(&bf, keys)
+	if r.positionPairs != 20 {
+		t.Errorf("%d pairs share all positions, want 20", r.positionPairs)
+	}
+	// Each second key of a pair tests present: its bits are all set.
+	if r.falsePositives < 20 {
+		t.Errorf("%d false positives, want at least the 20 second keys", r.falsePositives)
+	}
+	if r.positionExample != [2]string{keys[0], keys[1]} {
+		t.Errorf("example %q, want the first pair %q", r.positionExample, keys[:2])
+	}
+	var out strings.Builder
+	if err := r.print(&out, 3); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"Same positions:  20 pairs share all bit positions",
+		"suspect the hash or the key options",
+		"Most-set bits:",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("report lacks %q:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestDiagCollisionsUniform(t *testing.T) {
+	keys := make([]string, 20000)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key-%d", i)
+	}
+	// An undersized filter: false positives, but only those the size gives.
+	bf := bbloom.New(1<<16, 7)
+	r := diagCollisions(&bf, keys)
+	if r.hashPairs != 0 {
+		t.Errorf("%d pairs share the full hash", r.hashPairs)
+	}
+	if r.falsePositives == 0 || unlikely(float64(r.falsePositives), r.expectedFP) {
+		t.Errorf("%d false positives, want about %.0f", r.falsePositives, r.expectedFP)
+	}
+	var out strings.Builder
+	if err := r.print(&out, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "the filter is too small for its load") {
+		t.Errorf("report does not blame sizing:\n%s", out.String())
+	}
+	if strings.Contains(out.String(), "Most-set bits") {
+		t.Errorf("-top 0 lists bits:\n%s", out.String())
+	}
+}
+
+func TestDiagCollisionsCommand(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "sample.txt", numbered("key-", 1000)+numbered("key-", 10))
+	res := runBdedup(t, dir, "", "diag-collisions", "-input", "sample.txt", "-top", "2")
+	if res.code != 0 {
+		t.Fatalf("exit status %d: %s", res.code, res.stderr)
+	}
+	for _, want := range []string{
+		"Sample:          1010 lines, 1000 distinct keys",
+		"Verdict:",
+	} {
+		if !strings.Contains(res.stdout, want) {
+			t.Errorf("report lacks %q:\n%s", want, res.stdout)
+		}
+	}
+	if res := runBdedup(t, dir, "", "diag-collisions", "-input", "sample.txt", "-top", "-1"); res.code != 2 {
+		t.Errorf("-top -1: exit status %d, want 2", res.code)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+)
+
+// diffMain implements "bdedup diff": it builds a filter from one input and
+// streams the other against it, writing the lines that are not in the first.
+// The filter never forgets a key, so a line that is in the filtered input is
+// never written; a false positive can only hide a line that is not.
+func diffMain(args []string) {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	var fileA, fileB, out, save string
+	var added, removed bool
+	fs.StringVar(&fileA, "a", "", "Old input")
+	fs.StringVar(&fileB, "b", "", "New input")
+	fs.BoolVar(&added, "added", false, "Write the lines of -b that are not in -a (the default)")
+	fs.BoolVar(&removed, "removed", false, "Write the lines of -a that are not in -b")
+	fs.StringVar(&out, "o", "", "Output file (default: stdout)")
+	fs.StringVar(&save, "save", "", "Also save the filter built from the filtered input to this state file")
+	fs.Float64Var(&falsePositive, "p", 0.01, "False positive probability of the filter")
+	fs.Func("hash", "Hash of the filter: siphash, murmur3 or xxhash (default: siphash)", parseHash)
+	fs.BoolVar(&roundDown, "round-down", false, "Round the filter's size down to a power of two instead of up")
+	fs.BoolVar(&noGzip, "no-gzip", false, "Disable gzip compression for the -save state file")
+	registerRetryFlags(fs)
+	registerLogFlags(fs)
+	registerKeyFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), `Write the lines of one input that are not in another: by default the lines
+of -b not in -a, or with -removed the lines of -a not in -b. The input the
+filter is built from must be a regular file; the other may be - for stdin.
+
+Usage: %[1]s diff -a old.txt -b new.txt [-added | -removed] [-o out.txt] [-save filter.gz] [-p 0.01]
+
+Options:
+`, os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	checkKeyRegexFlags()
+
+	if fileA == "" || fileB == "" {
+		logErrorf("diff requires both -a and -b")
+		fs.Usage()
+		os.Exit(2)
+	}
+	if added && removed {
+		logErrorf("-added cannot be combined with -removed")
+		os.Exit(2)
+	}
+	base, stream := fileA, fileB
+	if removed {
+		base, stream = fileB, fileA
+	}
+	if base == "-" {
+		logErrorf("the filtered input cannot be stdin")
+		os.Exit(2)
+	}
+
+	bf, _ := filterFromLines(base, "input "+base)
+	if save != "" {
+		if err := saveBloomFilter(save, bf); err != nil {
+			logErrorf("%v", err)
+			os.Exit(1)
+		}
+	}
+
+	var input io.Reader = os.Stdin
+	if stream != "-" {
+		file, err := os.Open(stream)
+		if err != nil {
+			logErrorf("opening input %s: %v", stream, err)
+			os.Exit(1)
+		}
+		defer file.Close()
+		input = file
+	}
+	var output io.Writer = os.Stdout
+	if out != "" {
+		file, err := os.Create(out)
+		if err != nil {
+			logErrorf("creating output file: %v", err)
+			os.Exit(1)
+		}
+		defer file.Close()
+		output = file
+	}
+	w := newFlushWriter(output, 0)
+
+	scanner := newLineScanner(input)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if bf.Has(dedupKey(line)) {
+			continue
+		}
+		w.Write(line)
+		w.Write([]byte{'\n'})
+	}
+	if err := scanner.Err(); err != nil {
+		logErrorf("reading input %s: %v", stream, err)
+		os.Exit(1)
+	}
+	if err := w.Close(); err != nil {
+		logErrorf("writing output: %v", err)
+		os.Exit(1)
+	}
+}
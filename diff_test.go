@@ -0,0 +1,48 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	dir := t.TempDir()
+	a := writeFile(t, dir, "a.txt", "one\ntwo\nthree\n")
+	b := writeFile(t, dir, "b.txt", "two\nfour\none\nfive\nfour\n")
+	// Lines are checked against a filter of the other input, which never
+	// misses a line it holds, so nothing in it is ever written. A false
+	// positive can only leave out a line that belongs in the difference;
+	// at these sizes none occurs.
+	if got := mustRun(t, dir, "", "diff", "-a", a, "-b", b); got != "four\nfive\nfour\n" {
+		t.Errorf("added: %q, want four, five and four again", got)
+	}
+	if got := mustRun(t, dir, "", "diff", "-a", a, "-b", b, "-removed"); got != "three\n" {
+		t.Errorf("removed: %q, want three", got)
+	}
+	if got := mustRun(t, dir, "four\nsix\n", "diff", "-a", a, "-b", "-"); got != "four\nsix\n" {
+		t.Errorf("added from stdin: %q, want four and six", got)
+	}
+	if got := mustRun(t, dir, "", "diff", "-a", a, "-b", a); got != "" {
+		t.Errorf("an input against itself: %q, want nothing", got)
+	}
+	if res := runBdedup(t, dir, "", "diff", "-a", "-", "-b", b); res.code != 2 {
+		t.Errorf("filtered input on stdin: exit status %d, want 2", res.code)
+	}
+}
+
+func TestDiffNeverWritesFilteredLines(t *testing.T) {
+	dir := t.TempDir()
+	a := writeFile(t, dir, "a.txt", numbered("old-", 20000))
+	b := writeFile(t, dir, "b.txt", numbered("new-", 20000)+numbered("old-", 20000))
+	got := mustRun(t, dir, "", "diff", "-a", a, "-b", b, "-p", "0.2")
+	for _, line := range strings.SplitAfter(got, "\n") {
+		if strings.HasPrefix(line, "old-") {
+			t.Fatalf("line %q of -a written", line)
+		}
+	}
+	// A false positive may hide a new line, so fewer may come out, but not
+	// many at a 20% rate.
+	if n := lineCount(got); n > 20000 || n < 14000 {
+		t.Errorf("%d new lines written, want up to 20000", n)
+	}
+}
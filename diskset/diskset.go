@@ -0,0 +1,400 @@
+// Package diskset implements an exact, disk-backed set of byte strings.
+//
+// Keys added during a session are buffered in memory and spilled to sorted
+// run files once the buffer grows past MemLimit. Lookups consult the buffer
+// and every run, each of which keeps only a sparse index in memory, so the
+// set can hold far more keys than fit in RAM. Close merges everything into a
+// single sorted file at the set's path, which Open reads back next time.
+//
+// A run file is a sequence of records in ascending byte order, each record
+// being the key length as a uvarint followed by the key bytes.
+package diskset
+
+import (
+	"bufio"
+	"bytes"
+	"container/heap"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// DefaultMemLimit is the number of key bytes buffered in memory before they
+// are spilled to a sorted run file on disk.
+const DefaultMemLimit = 64 << 20
+
+// indexInterval is the number of records between sparse index entries; a
+// lookup reads at most one block of this many records from each run.
+const indexInterval = 128
+
+// maxKeyLen bounds the length prefix of a record so a corrupt file fails
+// cleanly instead of triggering a huge allocation.
+const maxKeyLen = 1 << 30
+
+var errCorrupt = errors.New("diskset: corrupt run file")
+
+// Set is an exact set of byte strings backed by sorted files on disk.
+type Set struct {
+	Mtx      *sync.Mutex
+	MemLimit int
+
+	path     string
+	runs     []*run
+	mem      map[string]struct{}
+	memBytes int
+	dirty    bool
+	err      error
+}
+
+// run is one sorted file together with its sparse in-memory index.
+type run struct {
+	f     *os.File
+	temp  bool
+	size  int64
+	index []indexEntry
+}
+
+// indexEntry records the first key of a block and the block's file offset.
+type indexEntry struct {
+	key []byte
+	off int64
+}
+
+// Open opens the set persisted at path, or returns an empty set if the file
+// does not exist yet. Run files spilled during the session are created in the
+// same directory.
+func Open(path string) (*Set, error) {
+	s := &Set{
+		Mtx:      &sync.Mutex{},
+		MemLimit: DefaultMemLimit,
+		path:     path,
+		mem:      make(map[string]struct{}),
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	r, err := openRun(f, false)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	s.runs = append(s.runs, r)
+	return s, nil
+}
+
+// Has reports whether entry is in the set. I/O errors are recorded and
+// returned by Close; the entry is then reported as absent.
+func (s *Set) Has(entry []byte) bool {
+	if _, ok := s.mem[string(entry)]; ok {
+		return true
+	}
+	for _, r := range s.runs {
+		ok, err := r.has(entry)
+		if err != nil {
+			s.setErr(err)
+			return false
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+// HasTS is the thread safe variant of Has.
+func (s *Set) HasTS(entry []byte) bool {
+	s.Mtx.Lock()
+	defer s.Mtx.Unlock()
+	return s.Has(entry)
+}
+
+// Add inserts entry into the set, spilling the in-memory buffer to a new run
+// file once it exceeds MemLimit bytes.
+func (s *Set) Add(entry []byte) {
+	if _, ok := s.mem[string(entry)]; ok {
+		return
+	}
+	s.mem[string(entry)] = struct{}{}
+	s.memBytes += len(entry)
+	s.dirty = true
+	if s.memBytes >= s.MemLimit {
+		if err := s.spill(); err != nil {
+			s.setErr(err)
+		}
+	}
+}
+
+// AddTS is the thread safe variant of Add.
+func (s *Set) AddTS(entry []byte) {
+	s.Mtx.Lock()
+	defer s.Mtx.Unlock()
+	s.Add(entry)
+}
+
+// AddIfNotHas adds entry unless it is already present and reports whether it
+// was added.
+func (s *Set) AddIfNotHas(entry []byte) bool {
+	if s.Has(entry) {
+		return false
+	}
+	s.Add(entry)
+	return true
+}
+
+// AddIfNotHasTS is the thread safe variant of AddIfNotHas.
+func (s *Set) AddIfNotHasTS(entry []byte) bool {
+	s.Mtx.Lock()
+	defer s.Mtx.Unlock()
+	return s.AddIfNotHas(entry)
+}
+
+// Close merges the persisted set, every spilled run and the in-memory buffer
+// into a single sorted file at the set's path and removes the run files. The
+// file is only rewritten if keys were added. Close returns the first error
+// encountered during the session, if any.
+func (s *Set) Close() error {
+	err := s.err
+	var merged string
+	if err == nil && s.dirty {
+		merged, err = s.merge()
+	}
+	for _, r := range s.runs {
+		r.f.Close()
+		if r.temp {
+			os.Remove(r.f.Name())
+		}
+	}
+	s.runs = nil
+	if err == nil && merged != "" {
+		if err = os.Rename(merged, s.path); err != nil {
+			os.Remove(merged)
+		}
+	}
+	return err
+}
+
+func (s *Set) setErr(err error) {
+	if s.err == nil {
+		s.err = err
+	}
+}
+
+// spill writes the in-memory buffer to a new sorted run file.
+func (s *Set) spill() error {
+	if len(s.mem) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(s.mem))
+	for k := range s.mem {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	f, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".run-*")
+	if err != nil {
+		return err
+	}
+	r := &run{f: f, temp: true}
+	w := bufio.NewWriter(f)
+	for i, k := range keys {
+		key := []byte(k)
+		if i%indexInterval == 0 {
+			r.index = append(r.index, indexEntry{key: key, off: r.size})
+		}
+		n, err := writeRecord(w, key)
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+			return err
+		}
+		r.size += int64(n)
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+
+	s.runs = append(s.runs, r)
+	s.mem = make(map[string]struct{})
+	s.memBytes = 0
+	return nil
+}
+
+// merge k-way merges all runs into a new temporary file next to the set's
+// path and returns its name.
+func (s *Set) merge() (string, error) {
+	if err := s.spill(); err != nil {
+		return "", err
+	}
+	out, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".merge-*")
+	if err != nil {
+		return "", err
+	}
+	fail := func(err error) (string, error) {
+		out.Close()
+		os.Remove(out.Name())
+		return "", err
+	}
+
+	h := make(cursorHeap, 0, len(s.runs))
+	for _, r := range s.runs {
+		c := &cursor{r: bufio.NewReader(io.NewSectionReader(r.f, 0, r.size))}
+		key, _, err := readRecord(c.r)
+		if err == io.EOF {
+			continue
+		}
+		if err != nil {
+			return fail(err)
+		}
+		c.key = key
+		h = append(h, c)
+	}
+	heap.Init(&h)
+
+	w := bufio.NewWriter(out)
+	var last []byte
+	for h.Len() > 0 {
+		c := h[0]
+		if last == nil || !bytes.Equal(c.key, last) {
+			if _, err := writeRecord(w, c.key); err != nil {
+				return fail(err)
+			}
+			last = c.key
+		}
+		key, _, err := readRecord(c.r)
+		switch {
+		case err == io.EOF:
+			heap.Pop(&h)
+		case err != nil:
+			return fail(err)
+		default:
+			c.key = key
+			heap.Fix(&h, 0)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return fail(err)
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(out.Name())
+		return "", err
+	}
+	return out.Name(), nil
+}
+
+// openRun builds the sparse index of an existing sorted run file.
+func openRun(f *os.File, temp bool) (*run, error) {
+	st, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	r := &run{f: f, temp: temp, size: st.Size()}
+	br := bufio.NewReader(io.NewSectionReader(f, 0, r.size))
+	var off int64
+	for n := 0; ; n++ {
+		key, sz, err := readRecord(br)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if n%indexInterval == 0 {
+			r.index = append(r.index, indexEntry{key: key, off: off})
+		}
+		off += int64(sz)
+	}
+	return r, nil
+}
+
+// has looks entry up by reading the single block of the run that may hold it.
+func (r *run) has(entry []byte) (bool, error) {
+	i := sort.Search(len(r.index), func(i int) bool {
+		return bytes.Compare(r.index[i].key, entry) > 0
+	}) - 1
+	if i < 0 {
+		return false, nil
+	}
+	end := r.size
+	if i+1 < len(r.index) {
+		end = r.index[i+1].off
+	}
+	block := make([]byte, end-r.index[i].off)
+	if _, err := r.f.ReadAt(block, r.index[i].off); err != nil {
+		return false, err
+	}
+	for len(block) > 0 {
+		n, w := binary.Uvarint(block)
+		if w <= 0 || uint64(len(block)-w) < n {
+			return false, errCorrupt
+		}
+		switch bytes.Compare(block[w:w+int(n)], entry) {
+		case 0:
+			return true, nil
+		case 1:
+			return false, nil
+		}
+		block = block[w+int(n):]
+	}
+	return false, nil
+}
+
+// readRecord reads one record, returning the key and the number of bytes the
+// record occupied. It returns io.EOF only at a record boundary.
+func readRecord(r *bufio.Reader) ([]byte, int, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, 0, err
+	}
+	if n > maxKeyLen {
+		return nil, 0, errCorrupt
+	}
+	key := make([]byte, n)
+	if _, err := io.ReadFull(r, key); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, 0, err
+	}
+	var buf [binary.MaxVarintLen64]byte
+	return key, binary.PutUvarint(buf[:], n) + int(n), nil
+}
+
+// writeRecord writes one record and returns the number of bytes written.
+func writeRecord(w *bufio.Writer, key []byte) (int, error) {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], uint64(len(key)))
+	if _, err := w.Write(buf[:n]); err != nil {
+		return 0, err
+	}
+	m, err := w.Write(key)
+	return n + m, err
+}
+
+// cursor walks one run during a merge.
+type cursor struct {
+	r   *bufio.Reader
+	key []byte
+}
+
+type cursorHeap []*cursor
+
+func (h cursorHeap) Len() int           { return len(h) }
+func (h cursorHeap) Less(i, j int) bool { return bytes.Compare(h[i].key, h[j].key) < 0 }
+func (h cursorHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *cursorHeap) Push(x any)        { *h = append(*h, x.(*cursor)) }
+func (h *cursorHeap) Pop() any {
+	old := *h
+	c := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return c
+}
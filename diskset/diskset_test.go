@@ -0,0 +1,57 @@
+package diskset
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func key(i int) []byte {
+	return fmt.Appendf(nil, "key-%08d", i)
+}
+
+func TestSetSpillsAndPersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "set")
+	s, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A tiny buffer forces many run files.
+	s.MemLimit = 4 << 10
+	const n = 20000
+	for i := range n {
+		if !s.AddIfNotHas(key(i)) {
+			t.Fatalf("key %d reported present before it was added", i)
+		}
+	}
+	if len(s.runs) < 10 {
+		t.Fatalf("got %d run files, want the buffer to have spilled many times", len(s.runs))
+	}
+	for i := range n {
+		if s.AddIfNotHas(key(i)) {
+			t.Fatalf("key %d added twice", i)
+		}
+	}
+	if s.Has(key(n)) {
+		t.Fatalf("key %d reported present but never added", n)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for i := range n {
+		if !s.Has(key(i)) {
+			t.Fatalf("key %d lost after reopening", i)
+		}
+	}
+	for i := n; i < 2*n; i++ {
+		if s.Has(key(i)) {
+			t.Fatalf("key %d reported present after reopening but never added", i)
+		}
+	}
+}
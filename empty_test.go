@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEmptyInput(t *testing.T) {
+	for _, c := range []string{"1", "4"} {
+		// No state and nothing to remember: no state file.
+		dir := t.TempDir()
+		if got := mustRun(t, dir, "", "-concurrency", c); got != "" {
+			t.Errorf("-concurrency %s: empty input emitted %q", c, got)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "bloom.gz")); !os.IsNotExist(err) {
+			t.Errorf("-concurrency %s: empty input created a state file: %v", c, err)
+		}
+
+		// A state file is left exactly as it was, by empty input or
+		// by input with nothing new.
+		mustRun(t, dir, "a\nb\n", "-concurrency", c)
+		state := filepath.Join(dir, "bloom.gz")
+		before, err := os.ReadFile(state)
+		if err != nil {
+			t.Fatal(err)
+		}
+		old := time.Now().Add(-time.Hour)
+		os.Chtimes(state, old, old)
+		for _, in := range []string{"", "a\nb\na\n"} {
+			mustRun(t, dir, in, "-concurrency", c)
+			after, _ := os.ReadFile(state)
+			if fi, _ := os.Stat(state); !bytes.Equal(before, after) || !fi.ModTime().Equal(old) {
+				t.Errorf("-concurrency %s: input %q rewrote the state file", c, in)
+			}
+		}
+	}
+
+	// A zero-byte state file is a new filter, with a warning.
+	dir := t.TempDir()
+	writeFile(t, dir, "bloom.gz", "")
+	res := runBdedup(t, dir, "a\na\n")
+	if res.code != 0 || res.stdout != "a\n" || !strings.Contains(res.stderr, "Warning") {
+		t.Errorf("empty state file: exit status %d, output %q, log %q; want a fresh filter and a warning", res.code, res.stdout, res.stderr)
+	}
+	if fi, err := os.Stat(filepath.Join(dir, "bloom.gz")); err != nil || fi.Size() == 0 {
+		t.Errorf("empty state file was not replaced by the run's filter: %v", err)
+	}
+}
+
+func TestWhitespaceOnlyLines(t *testing.T) {
+	in := "\n \n\t\n\n \nx\n"
+	if got := mustRun(t, t.TempDir(), in); got != "\n \n\t\nx\n" {
+		t.Errorf("output %q, want each blank and whitespace line once", got)
+	}
+	if got := mustRun(t, t.TempDir(), in, "-transform", "trim"); got != "\nx\n" {
+		t.Errorf("-transform trim: output %q, want whitespace-only lines as one key", got)
+	}
+	if got := mustRun(t, t.TempDir(), in, "-min-len", "1"); got != " \n\t\nx\n" {
+		t.Errorf("-min-len 1: output %q, want blank lines rejected", got)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/mylh/bdedup/diskset"
+)
+
+// exportMain implements "bdedup export": it lists the keys logged with -wal,
+// the exact set of keys ever added to the filter the log belongs to, which
+// the filter itself cannot enumerate.
+func exportMain(args []string) {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	var walPath, out string
+	fs.StringVar(&walPath, "wal", "", "Log written with -wal to list the keys of")
+	fs.StringVar(&out, "o", "", "Output file (default: stdout)")
+	registerLogFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), `List every key logged with -wal, one per line, in the order they were first
+added. Keys are written as they were hashed, after options such as -field,
+-transform and -namespace, rather than as the original lines.
+
+Usage: %[1]s export -wal keys.wal [-o keys.txt]
+
+Options:
+`, os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if walPath == "" {
+		logErrorf("export requires -wal")
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	var output io.Writer = os.Stdout
+	if out != "" {
+		file, err := os.Create(out)
+		if err != nil {
+			logErrorf("creating output file: %v", err)
+			os.Exit(1)
+		}
+		defer file.Close()
+		output = file
+	}
+	w := newFlushWriter(output, 0)
+
+	// A key is logged once per filter that found it new, so a log shared by
+	// runs on different state files, or replayed by -grow-at, can repeat
+	// keys. An exact set on disk drops the repeats without holding every
+	// key in memory.
+	dir, err := os.MkdirTemp("", "bdedup-export-*")
+	if err != nil {
+		logErrorf("creating temporary directory: %v", err)
+		os.Exit(1)
+	}
+	defer os.RemoveAll(dir)
+	seen, err := diskset.Open(filepath.Join(dir, "keys"))
+	if err != nil {
+		logErrorf("opening key set: %v", err)
+		os.Exit(1)
+	}
+
+	var written int
+	_, err = readWAL(walPath, func(key []byte) {
+		if seen.Has(key) {
+			return
+		}
+		seen.Add(key)
+		w.Write(key)
+		w.Write([]byte{'\n'})
+		written++
+	})
+	status := 0
+	if err != nil {
+		logErrorf("reading WAL: %v", err)
+		status = 1
+	}
+	if err := seen.Close(); err != nil {
+		logErrorf("deduplicating keys: %v", err)
+		status = 1
+	}
+	if err := w.Close(); err != nil {
+		logErrorf("writing output: %v", err)
+		status = 1
+	}
+	logInfof("Exported %d keys", written)
+	if status != 0 {
+		os.RemoveAll(dir)
+		os.Exit(status)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+
+	"github.com/mylh/bdedup/bbloom"
+)
+
+// growAt is the -grow-at fill ratio; 0 disables growth.
+var growAt float64
+
+// growth rebuilds the filter at twice its size when -grow-at is set.
+var growth *grower
+
+// grower replaces a filter that has filled up to -grow-at with one of twice
+// the size, rebuilt from the -wal log. A filter cannot list its keys, so the
+// log is the only way to fill the new one; it must therefore hold every key
+// the filter does, having been kept since the state file was created.
+type grower struct {
+	bf *bbloom.Bloom
+	// at is the ElemNum at which the filter is expected to reach growAt.
+	// Counting keys avoids scanning the bitset for the fill ratio.
+	at uint64
+}
+
+func newGrower(bf *bbloom.Bloom) *grower {
+	g := &grower{bf: bf}
+	g.plan()
+	return g
+}
+
+// plan sets at for the current filter: the expected fill after n keys is
+// 1 - e^(-k*n/m), solved for n.
+func (g *grower) plan() {
+	m := g.bf.Metrics()
+	g.at = uint64(-float64(m.SizeBits) / float64(m.HashLocs) * math.Log(1-growAt))
+}
+
+// keyAdded grows the filter if the key just added brought it to -grow-at.
+// If the log cannot be read or lacks keys the filter holds, growth is given
+// up with a warning and the run continues on the full filter.
+func (g *grower) keyAdded() {
+	if g.bf.ElemNum < g.at {
+		return
+	}
+	if err := g.grow(); err != nil {
+		logWarnf("not growing the filter: %v", err)
+		g.at = math.MaxUint64
+	}
+}
+
+func (g *grower) grow() error {
+	if err := wal.flush(); err != nil {
+		return fmt.Errorf("writing WAL: %w", err)
+	}
+	m := g.bf.Metrics()
+	bigger, err := bbloom.NewWithLocs(float64(2*m.SizeBits), float64(m.HashLocs))
+	if err != nil {
+		return err
+	}
+	bigger.HashFunc, bigger.SipKey, bigger.Namespace = g.bf.HashFunc, g.bf.SipKey, g.bf.Namespace
+	count, err := readWAL(walFile, bigger.Add)
+	if err != nil {
+		return fmt.Errorf("reading WAL: %w", err)
+	}
+	if uint64(count) < g.bf.ElemNum {
+		return fmt.Errorf("WAL %s has %d keys but the filter holds %d; it must be kept from the start", walFile, count, g.bf.ElemNum)
+	}
+	logInfof("Grew filter from %d to %d bits, replaying %d keys from %s", m.SizeBits, 2*m.SizeBits, count, walFile)
+	*g.bf = bigger
+	g.plan()
+	return nil
+}
+
+// checkGrowFlags validates -grow-at and rejects what it cannot be combined
+// with: it needs the -wal log of a Bloom filter, and a resumed run's log may
+// hold keys from past the checkpoint.
+func checkGrowFlags() {
+	var conflict string
+	switch {
+	case !(growAt > 0 && growAt < 1):
+		logErrorf("-grow-at must be between 0 and 1")
+		os.Exit(2)
+	case walFile == "":
+		logErrorf("-grow-at requires -wal")
+		os.Exit(2)
+	case exact:
+		conflict = "-exact"
+	case resume:
+		conflict = "-resume"
+	}
+	if conflict != "" {
+		logErrorf("-grow-at cannot be combined with %s", conflict)
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGrowAtThreshold(t *testing.T) {
+	dir := t.TempDir()
+	// 512 bits hold 50 keys at p 0.01; 3000 keys cross a 0.5 fill many times.
+	res := runBdedup(t, dir, numbered("key-", 3000), "-n", "50", "-wal", "keys.wal", "-grow-at", "0.5")
+	if res.code != 0 {
+		t.Fatalf("exit status %d\n%s", res.code, res.stderr)
+	}
+	if !strings.Contains(res.stderr, "Grew filter from 512 to 1024 bits") {
+		t.Errorf("no growth logged:\n%s", res.stderr)
+	}
+	if lineCount(res.stdout) < 2990 {
+		t.Errorf("%d of 3000 distinct keys written; growth should keep false positives rare", lineCount(res.stdout))
+	}
+	bf := loadState(t, filepath.Join(dir, "bloom.gz"))
+	if bits := bf.Metrics().SizeBits; bits < 16384 {
+		t.Errorf("saved filter has %d bits, want it grown for 3000 keys", bits)
+	}
+	if fill := bf.FillRatio(); fill > 0.5 {
+		t.Errorf("saved filter is %.2f full, past -grow-at", fill)
+	}
+	for _, key := range strings.Split(strings.TrimSpace(res.stdout), "\n") {
+		if !bf.Has([]byte(key)) {
+			t.Fatalf("%s lost in growing", key)
+		}
+	}
+	// A key taken for a false positive before was never logged, so it is
+	// missing after growing; every key written is still there.
+	written := make(map[string]bool)
+	for _, key := range strings.Split(res.stdout, "\n") {
+		written[key] = true
+	}
+	for _, key := range strings.Split(strings.TrimSpace(mustRun(t, dir, numbered("key-", 3000))), "\n") {
+		if written[key] {
+			t.Errorf("rerun on the grown filter emitted %s, which it holds", key)
+		}
+	}
+}
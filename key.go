@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+var (
+	namespace      string
+	keyFields      []int
+	fieldDelimiter string
+	keySeparator   string
+	inputFormat    = "lines"
+	normalizeNFC   bool
+	trimTrailing   bool
+	foldKeys       bool
+	keyMask        *regexp.Regexp
+)
+
+// maskPlaceholder replaces each -mask match. A NUL byte rarely occurs in
+// text, so a masked key seldom collides with an unmasked one.
+var maskPlaceholder = []byte{0}
+
+// registerKeyFlags defines the flags that shape the dedup key on fs, so every
+// command derives keys from lines the same way.
+func registerKeyFlags(fs *flag.FlagSet) {
+	fs.StringVar(&namespace, "namespace", "", "Prefix prepended to every key before hashing")
+	fs.Func("field", "Comma-separated 1-based fields forming the key (default: whole line)", parseFields)
+	fs.StringVar(&fieldDelimiter, "delimiter", "", "Field delimiter for -field (default: tab, or comma for -input-format csv)")
+	fs.StringVar(&keySeparator, "key-sep", "", "Separator joining the -field values into the key (default: the delimiter)")
+	fs.Func("input-format", "Input record format: lines, or csv for quoted fields that may span lines (default: lines)", parseInputFormat)
+	fs.BoolVar(&trimTrailing, "trim-trailing", false, "Drop trailing delimiters from lines before deriving keys, so padded records match")
+	fs.BoolVar(&normalizeNFC, "normalize-unicode", false, "Normalize keys to Unicode NFC, so composed and decomposed accents match")
+	fs.BoolVar(&foldKeys, "fold", false, "Lowercase keys and strip accents from Latin letters, so José matches jose")
+	fs.Func("key-regex", "Regexp whose first capture group, or whole match, in the line is the key, e.g. user=(\\w+)", parseKeyRegex)
+	fs.Func("mask", "Regexp whose matches in the key are replaced by a placeholder, e.g. a volatile request ID", parseMask)
+	fs.Func("transform", "Pipeline applied to the key before hashing, e.g. lower|trim|prefix:id=|take:16", parseTransform)
+}
+
+// parseInputFormat parses -input-format.
+func parseInputFormat(s string) error {
+	if s != "lines" && s != "csv" {
+		return fmt.Errorf("unknown input format %q (known: lines, csv)", s)
+	}
+	inputFormat = s
+	return nil
+}
+
+// delimiter returns the field delimiter: -delimiter, or by default a tab for
+// lines and a comma for CSV.
+func delimiter() string {
+	switch {
+	case fieldDelimiter != "":
+		return fieldDelimiter
+	case csvInput():
+		return ","
+	}
+	return "\t"
+}
+
+// splitFields splits a record into its fields, honoring CSV quoting under
+// -input-format csv.
+func splitFields(line []byte) [][]byte {
+	if csvInput() {
+		return parseCSVRecord(line)
+	}
+	return bytes.Split(line, []byte(delimiter()))
+}
+
+// parseMask parses -mask.
+func parseMask(s string) error {
+	re, err := regexp.Compile(s)
+	if err != nil {
+		return err
+	}
+	keyMask = re
+	return nil
+}
+
+// parseFields parses the -field list.
+func parseFields(s string) error {
+	keyFields = keyFields[:0]
+	for _, part := range strings.Split(s, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || n < 1 {
+			return fmt.Errorf("invalid field %q: fields are 1-based integers", part)
+		}
+		keyFields = append(keyFields, n)
+	}
+	return nil
+}
+
+// dedupKey returns the key a line is deduplicated on: the -key-regex capture
+// or the -field values of the line, less trailing delimiters under
+// -trim-trailing, normalized, folded, masked, run through the -transform
+// pipeline, behind the namespace.
+func dedupKey(line []byte) []byte {
+	if keyRegex != nil {
+		line = regexKey(line)
+	}
+	if trimTrailing {
+		line = trimDelimiters(line)
+	}
+	// CSV keys are always built from the parsed fields, so the same record
+	// quoted differently gets the same key.
+	if len(keyFields) > 0 || csvInput() {
+		line = selectFields(line)
+	}
+	if normalizeNFC {
+		line = nfcKey(line)
+	}
+	if foldKeys {
+		line = foldKey(line)
+	}
+	if keyMask != nil {
+		line = keyMask.ReplaceAllLiteral(line, maskPlaceholder)
+	}
+	if len(keyTransforms) > 0 {
+		line = transformKey(line)
+	}
+	if namespace == "" {
+		return line
+	}
+	return append([]byte(namespace), line...)
+}
+
+// trimDelimiters returns line without any trailing delimiters, as
+// spreadsheet exports pad short rows with them.
+func trimDelimiters(line []byte) []byte {
+	d := []byte(delimiter())
+	for bytes.HasSuffix(line, d) {
+		line = line[:len(line)-len(d)]
+	}
+	return line
+}
+
+// selectFields joins the -field values of line with the key separator. Fields
+// never contain the delimiter, so joining with it (the default) cannot make
+// "a|bc" and "ab|c" collide; a custom -key-sep only keeps that guarantee if it
+// never occurs inside a field. CSV fields can contain the delimiter, so with
+// the default separator they are quoted as in CSV. Under -input-format csv
+// without -field, all fields form the key. Fields missing from a short line
+// are empty.
+func selectFields(line []byte) []byte {
+	sep := keySeparator
+	if sep == "" {
+		sep = delimiter()
+	}
+	quote := csvInput() && keySeparator == ""
+	fields := splitFields(line)
+	picks := keyFields
+	if len(picks) == 0 {
+		picks = make([]int, len(fields))
+		for i := range picks {
+			picks[i] = i + 1
+		}
+	}
+	key := make([]byte, 0, len(line))
+	for i, f := range picks {
+		if i > 0 {
+			key = append(key, sep...)
+		}
+		switch {
+		case f > len(fields):
+		case quote:
+			key = appendCSVField(key, fields[f-1], sep)
+		default:
+			key = append(key, fields[f-1]...)
+		}
+	}
+	return key
+}
+
+// nfcKey returns key in Unicode Normalization Form C. Keys that are already
+// normalized, as most are, are returned without copying, and keys that are
+// not valid UTF-8 are returned unchanged.
+func nfcKey(key []byte) []byte {
+	if !utf8.Valid(key) || norm.NFC.IsNormal(key) {
+		return key
+	}
+	return norm.NFC.Bytes(key)
+}
+
+// foldKey lowercases key and strips the accents (combining marks) of Latin
+// letters, so "José" and "JOSE" both become "jose". Marks on letters of other
+// scripts, where they are often essential, as in Devanagari vowel signs, are
+// kept. Letters that do not decompose into a base and a mark, such as "ø" or
+// "ł", are only lowercased. Keys that are not valid UTF-8 only have their
+// ASCII letters lowercased: bytes.ToLower would turn every invalid byte into
+// U+FFFD and make keys differing only in those bytes match.
+func foldKey(key []byte) []byte {
+	if !utf8.Valid(key) {
+		return lowerASCII(key)
+	}
+	if isASCII(key) {
+		return bytes.ToLower(key)
+	}
+	decomposed := norm.NFD.Bytes(key)
+	folded := make([]byte, 0, len(decomposed))
+	latin := false
+	for rest := decomposed; len(rest) > 0; {
+		r, n := utf8.DecodeRune(rest)
+		if !unicode.Is(unicode.Mn, r) {
+			latin = unicode.Is(unicode.Latin, r)
+			folded = append(folded, rest[:n]...)
+		} else if !latin {
+			folded = append(folded, rest[:n]...)
+		}
+		rest = rest[n:]
+	}
+	return bytes.ToLower(norm.NFC.Bytes(folded))
+}
+
+// lowerASCII returns a copy of b with its ASCII letters lowercased and every
+// other byte as it is.
+func lowerASCII(b []byte) []byte {
+	lower := make([]byte, len(b))
+	for i, c := range b {
+		if 'A' <= c && c <= 'Z' {
+			c += 'a' - 'A'
+		}
+		lower[i] = c
+	}
+	return lower
+}
+
+func isASCII(b []byte) bool {
+	for _, c := range b {
+		if c >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
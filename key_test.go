@@ -0,0 +1,118 @@
+package main
+
+import "testing"
+
+func TestNamespaceKeepsValuesApart(t *testing.T) {
+	dir := t.TempDir()
+	in := "alice\nbob\nalice\n"
+	if got := mustRun(t, dir, in, "-namespace", "users:"); got != "alice\nbob\n" {
+		t.Fatalf("first namespace emitted %q", got)
+	}
+	// Same state, other namespace: the values are new again.
+	if got := mustRun(t, dir, in, "-namespace", "admins:"); got != "alice\nbob\n" {
+		t.Fatalf("second namespace emitted %q, want both values as new", got)
+	}
+	if got := mustRun(t, dir, in, "-namespace", "users:"); got != "" {
+		t.Fatalf("rerun in the first namespace emitted %q, want nothing", got)
+	}
+}
+
+func TestCompositeKey(t *testing.T) {
+	in := "1\tx\ta\n1\ty\ta\n1\tx\tb\n2\tx\ta\n"
+	got := mustRun(t, t.TempDir(), in, "-field", "1,3")
+	if want := "1\tx\ta\n1\tx\tb\n2\tx\ta\n"; got != want {
+		t.Errorf("-field 1,3: output %q, want %q", got, want)
+	}
+
+	// The separator keeps "a,bc" and "ab,c" apart.
+	in = "a,bc,1\nab,c,2\na,bc,3\n"
+	got = mustRun(t, t.TempDir(), in, "-field", "1,2", "-delimiter", ",", "-key-sep", "\x1f")
+	if want := "a,bc,1\nab,c,2\n"; got != want {
+		t.Errorf("-field 1,2 -delimiter ,: output %q, want %q", got, want)
+	}
+}
+
+func TestNormalizeUnicode(t *testing.T) {
+	// An e acute precomposed, then as "e" and a combining accent.
+	in := "caf\u00e9\ncafe\u0301\ncafe\n"
+	if got := mustRun(t, t.TempDir(), in); got != in {
+		t.Errorf("without -normalize-unicode: output %q, want every line", got)
+	}
+	// The first spelling is emitted as it was written.
+	if got := mustRun(t, t.TempDir(), in, "-normalize-unicode"); got != "caf\u00e9\ncafe\n" {
+		t.Errorf("-normalize-unicode: output %q, want the accented forms as one", got)
+	}
+	got := mustRun(t, t.TempDir(), "cafe\u0301\ncaf\u00e9\n", "-normalize-unicode")
+	if got != "cafe\u0301\n" {
+		t.Errorf("-normalize-unicode: output %q, want the decomposed form only", got)
+	}
+
+	// Invalid UTF-8 is hashed as it is.
+	bad := "caf\xe9\ncaf\xe9\ncaf\u00e9\n"
+	if got := mustRun(t, t.TempDir(), bad, "-normalize-unicode"); got != "caf\xe9\ncaf\u00e9\n" {
+		t.Errorf("-normalize-unicode on invalid UTF-8: output %q", got)
+	}
+	if got := string(nfcKey([]byte("caf\xe9"))); got != "caf\xe9" {
+		t.Errorf("nfcKey changed invalid UTF-8 to %q", got)
+	}
+}
+
+func TestMaskIgnoresVolatilePart(t *testing.T) {
+	in := "GET /a req=123 ok\nGET /a req=456 ok\nGET /b req=123 ok\nGET /a req=789 fail\nGET /a req=9 ok\n"
+	want := "GET /a req=123 ok\nGET /b req=123 ok\nGET /a req=789 fail\n"
+	for _, args := range [][]string{
+		{"-concurrency", "1"},
+		{"-concurrency", "4"},
+		{"-concurrency", "4", "-parallel-hash"},
+		{"-exact"},
+	} {
+		args = append(args, "-mask", `req=\d+`)
+		if got := mustRun(t, t.TempDir(), in, args...); got != want {
+			t.Errorf("%v: output %q, want %q", args, got, want)
+		}
+	}
+
+	// Two masked regions mask independently.
+	in = "id=1 at=5 x\nid=2 at=6 x\nid=3 at=7 y\n"
+	if got := mustRun(t, t.TempDir(), in, "-mask", `=\d+`); got != "id=1 at=5 x\nid=3 at=7 y\n" {
+		t.Errorf("-mask with two matches: output %q", got)
+	}
+
+	if res := runBdedup(t, t.TempDir(), "", "-mask", "("); res.code != 2 {
+		t.Errorf("invalid -mask exited %d, want 2", res.code)
+	}
+}
+
+func TestFold(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"José", "jose"},
+		{"JOSÉ", "jose"},
+		{"François MüLLER", "francois muller"},
+		{"Ångström", "angstrom"},
+		// No base letter and mark to split: only lowercased.
+		{"Øster", "øster"},
+		// Marks on non-Latin letters carry meaning and are kept.
+		{"नि", "नि"},
+		{"Москва", "москва"},
+		{"CAF\xe9", "caf\xe9"},
+	}
+	for _, tt := range tests {
+		if got := string(foldKey([]byte(tt.in))); got != tt.want {
+			t.Errorf("foldKey(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+
+	// Invalid bytes stay distinct rather than all becoming U+FFFD.
+	if got := mustRun(t, t.TempDir(), "caf\xe9\ncaf\xe8\nCAF\xe9\n", "-fold"); got != "caf\xe9\ncaf\xe8\n" {
+		t.Errorf("-fold on invalid UTF-8: output %q", got)
+	}
+
+	in := "José\njose\nJOSÉ\nJosé García\njose garcia\nØster\nOster\n"
+	want := "José\nJosé García\nØster\nOster\n"
+	for _, args := range [][]string{{"-concurrency", "1"}, {"-concurrency", "4"}, {"-exact"}} {
+		args = append(args, "-fold")
+		if got := mustRun(t, t.TempDir(), in, args...); got != want {
+			t.Errorf("%v: output %q, want %q", args, got, want)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+)
+
+var keyInputFile string
+
+// keyInput is the open -key-input file, or nil to take keys from the input
+// records themselves.
+var keyInput io.Reader
+
+// checkKeyInputFlags exits if -key-input is combined with options that would
+// break the alignment of keys and records: -skip-errors drops bad records
+// but not their keys, -reverse and -resume move through the input but not
+// the key file, and -with-counts derives keys again from the records it
+// spools.
+func checkKeyInputFlags() {
+	if skipErrors || reverse || resume || withCounts {
+		logErrorf("-key-input cannot be combined with -skip-errors, -reverse, -resume or -with-counts")
+		os.Exit(2)
+	}
+}
+
+// openKeyInput opens -key-input into keyInput, if it is set. The caller
+// closes the returned file, which is nil without -key-input.
+func openKeyInput() *os.File {
+	if keyInputFile == "" {
+		return nil
+	}
+	file, err := os.Open(keyInputFile)
+	if err != nil {
+		logErrorf("opening key input: %v", err)
+		os.Exit(1)
+	}
+	keyInput = file
+	return file
+}
+
+var (
+	errKeysShort = errors.New("-key-input has fewer lines than the input")
+	errKeysLong  = errors.New("-key-input has more lines than the input")
+)
+
+// keyedScanner scans the input records together with the lines of
+// -key-input, which hold their keys: the nth key line is the key of the nth
+// record. The key lines are plain lines whatever -input-format or
+// -record-delimiter the records use, and go through the key options like a
+// record would. Running out of either before the other is an error.
+type keyedScanner struct {
+	recordScanner
+	keys *bufio.Scanner
+	err  error
+}
+
+// withKeyInput returns scanner reading its keys from -key-input, or scanner
+// itself without -key-input.
+func withKeyInput(scanner recordScanner) recordScanner {
+	if keyInput == nil {
+		return scanner
+	}
+	keys := bufio.NewScanner(readBuffered(keyInput))
+	keys.Buffer(nil, maxLineSize)
+	return &keyedScanner{recordScanner: scanner, keys: keys}
+}
+
+func (s *keyedScanner) Scan() bool {
+	if s.err != nil {
+		return false
+	}
+	if !s.recordScanner.Scan() {
+		if s.recordScanner.Err() == nil && s.keys.Scan() {
+			s.err = errKeysLong
+		}
+		return false
+	}
+	if !s.keys.Scan() {
+		s.err = s.keys.Err()
+		if s.err == nil {
+			s.err = errKeysShort
+		}
+		return false
+	}
+	return true
+}
+
+func (s *keyedScanner) Err() error {
+	if err := s.recordScanner.Err(); err != nil {
+		return err
+	}
+	return s.err
+}
+
+// Key returns the key line of the current record.
+func (s *keyedScanner) Key() []byte {
+	return s.keys.Bytes()
+}
+
+// recordKey returns the key of the record scanner is at: derived from the
+// record, or from its -key-input line, and tagged with the record's shard
+// under -shard-field.
+func recordKey(scanner recordScanner) []byte {
+	var key []byte
+	if ks, ok := scanner.(*keyedScanner); ok {
+		key = dedupKey(ks.Key())
+	} else {
+		key = dedupKey(scanner.Bytes())
+	}
+	if shards != nil {
+		return shardKey(scanner.Bytes(), key)
+	}
+	return key
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestKeyInput(t *testing.T) {
+	records := "r1 alice\nr2 bob\nr3 alice again\nr4 carol\nr5 bob again\n"
+	keys := "k1\nk2\nk1\nk3\nk2\n"
+	for _, c := range []string{"1", "4"} {
+		dir := t.TempDir()
+		writeFile(t, dir, "keys", keys)
+		got := mustRun(t, dir, records, "-key-input", "keys", "-concurrency", c)
+		if want := "r1 alice\nr2 bob\nr4 carol\n"; got != want {
+			t.Errorf("-concurrency %s: output %q, want %q", c, got, want)
+		}
+		// The filter holds the keys, not the records.
+		if got := mustRun(t, dir, "k1\nk3\nk4\nr1 alice\n"); got != "k4\nr1 alice\n" {
+			t.Errorf("-concurrency %s: rerun on the keys emitted %q", c, got)
+		}
+	}
+
+	// Key lines go through the key options, and the window skips both.
+	dir := t.TempDir()
+	writeFile(t, dir, "keys", "1\tK1\n2\tk2\n3\tk1\n")
+	got := mustRun(t, dir, "a\nb\nc\n", "-key-input", "keys", "-field", "2", "-transform", "lower")
+	if got != "a\nb\n" {
+		t.Errorf("-field 2 -transform lower on key lines: output %q, want a and b", got)
+	}
+	if got := mustRun(t, t.TempDir(), records, "-key-input", writeFile(t, dir, "keys2", keys), "-skip", "1"); got != "r2 bob\nr3 alice again\nr4 carol\n" {
+		t.Errorf("-skip 1: output %q, want keys and records skipped together", got)
+	}
+
+	for name, k := range map[string]string{"fewer": "k1\nk2\n", "more": keys + "k9\n"} {
+		writeFile(t, dir, name, k)
+		res := runBdedup(t, dir, records, "-key-input", name, "-state", name+".gz")
+		if res.code != 1 || !strings.Contains(res.stderr, name+" lines than the input") {
+			t.Errorf("%s keys than records: exit status %d, %q; want 1 and a length error", name, res.code, res.stderr)
+		}
+	}
+	if res := runBdedup(t, dir, records, "-key-input", "keys", "-skip-errors"); res.code != 2 {
+		t.Errorf("-key-input -skip-errors exited %d, want 2", res.code)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"math"
+	"math/bits"
+)
+
+var keyLengthStats bool
+
+// keyLengths accumulates the length of every key when -key-length-stats is
+// set. Only the goroutine writing the output updates it.
+var keyLengths *lengthHistogram
+
+// exactLengths is the number of key lengths lengthHistogram counts exactly.
+// Longer lengths share buckets 1/64 of their size wide.
+const exactLengths = 128
+
+// lengthHistogram is a streaming summary of key lengths in bytes. Lengths
+// below exactLengths have a bucket each; longer ones are bucketed by their
+// top 7 significant bits, so the percentiles it reports are within 1/64
+// (1.6%) of the true ones, in a few thousand counters at most whatever the
+// input size.
+type lengthHistogram struct {
+	count    uint64
+	sum      uint64
+	min, max int
+	buckets  []uint64
+}
+
+// lengthBucket returns the bucket counting length n.
+func lengthBucket(n int) int {
+	if n < exactLengths {
+		return n
+	}
+	e := bits.Len(uint(n)) - 7
+	return exactLengths + (e-1)*64 + (n>>e - 64)
+}
+
+// bucketLength returns the length bucket b stands for: the length itself
+// below exactLengths, else the middle of the lengths it counts.
+func bucketLength(b int) int {
+	if b < exactLengths {
+		return b
+	}
+	e := (b-exactLengths)/64 + 1
+	lo := ((b-exactLengths)%64 + 64) << e
+	return lo + (1<<e-1)/2
+}
+
+func (h *lengthHistogram) add(n int) {
+	if h.count == 0 || n < h.min {
+		h.min = n
+	}
+	h.max = max(h.max, n)
+	h.count++
+	h.sum += uint64(n)
+	b := lengthBucket(n)
+	if b >= len(h.buckets) {
+		h.buckets = append(h.buckets, make([]uint64, b+1-len(h.buckets))...)
+	}
+	h.buckets[b]++
+}
+
+// quantile returns the length at or below which a fraction q of the keys
+// fall, clamped to the lengths seen.
+func (h *lengthHistogram) quantile(q float64) int {
+	rank := uint64(math.Ceil(q * float64(h.count)))
+	var seen uint64
+	for b, c := range h.buckets {
+		if seen += c; seen >= max(rank, 1) {
+			return min(max(bucketLength(b), h.min), h.max)
+		}
+	}
+	return h.max
+}
+
+// keyLengthSummary is what -key-length-stats reports, in bytes.
+type keyLengthSummary struct {
+	Keys uint64  `json:"keys"`
+	Min  int     `json:"min"`
+	Max  int     `json:"max"`
+	Mean float64 `json:"mean"`
+	P50  int     `json:"p50"`
+	P90  int     `json:"p90"`
+	P99  int     `json:"p99"`
+}
+
+func (h *lengthHistogram) summary() *keyLengthSummary {
+	s := &keyLengthSummary{Keys: h.count}
+	if h.count == 0 {
+		return s
+	}
+	s.Min, s.Max = h.min, h.max
+	s.Mean = float64(h.sum) / float64(h.count)
+	s.P50, s.P90, s.P99 = h.quantile(0.5), h.quantile(0.9), h.quantile(0.99)
+	return s
+}
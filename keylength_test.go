@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestLengthBuckets(t *testing.T) {
+	for n := range 1 << 20 {
+		b := lengthBucket(n)
+		if got := bucketLength(b); math.Abs(float64(got-n)) > float64(n)/64 {
+			t.Fatalf("length %d in bucket %d, which stands for %d", n, b, got)
+		}
+		if lengthBucket(bucketLength(b)) != b {
+			t.Fatalf("bucket %d stands for a length of another bucket", b)
+		}
+	}
+}
+
+func TestLengthPercentiles(t *testing.T) {
+	// Each length from 1 to 100 once: counted exactly.
+	var h lengthHistogram
+	for n := 1; n <= 100; n++ {
+		h.add(n)
+	}
+	s := h.summary()
+	if *s != (keyLengthSummary{Keys: 100, Min: 1, Max: 100, Mean: 50.5, P50: 50, P90: 90, P99: 99}) {
+		t.Errorf("lengths 1 to 100: %+v", *s)
+	}
+
+	// Long keys of random lengths: within the bucket width.
+	rng := rand.New(rand.NewSource(1))
+	var long lengthHistogram
+	var lengths []int
+	for range 100000 {
+		n := 1000 + rng.Intn(100000)
+		long.add(n)
+		lengths = append(lengths, n)
+	}
+	slices.Sort(lengths)
+	s = long.summary()
+	for q, got := range map[float64]int{0.5: s.P50, 0.9: s.P90, 0.99: s.P99} {
+		want := lengths[int(math.Ceil(q*float64(len(lengths))))-1]
+		if math.Abs(float64(got-want))/float64(want) > 1.0/64 {
+			t.Errorf("p%g %d, want within 1/64 of %d", q*100, got, want)
+		}
+	}
+	if s.Min != lengths[0] || s.Max != lengths[len(lengths)-1] {
+		t.Errorf("min %d and max %d, want %d and %d", s.Min, s.Max, lengths[0], lengths[len(lengths)-1])
+	}
+	if empty := new(lengthHistogram).summary(); *empty != (keyLengthSummary{}) {
+		t.Errorf("no keys: %+v", *empty)
+	}
+}
+
+func TestKeyLengthStats(t *testing.T) {
+	// 90 keys of 4 bytes, 9 of 20 and one of 200, twice over: duplicates
+	// count too.
+	var b strings.Builder
+	for i := range 100 {
+		n := 4
+		switch {
+		case i >= 99:
+			n = 200
+		case i >= 90:
+			n = 20
+		}
+		fmt.Fprintf(&b, "%0*d\n", n, i)
+	}
+	in := b.String() + b.String()
+	res := runBdedup(t, t.TempDir(), in, "-key-length-stats", "-json")
+	var s summary
+	if err := json.Unmarshal([]byte(res.stderr), &s); err != nil {
+		t.Fatalf("stats are not JSON: %v\n%s", err, res.stderr)
+	}
+	k := s.KeyLengths
+	if k == nil || k.Keys != 200 || k.Min != 4 || k.Max != 200 || k.P50 != 4 || k.P90 != 4 || k.P99 != 20 {
+		t.Errorf("key lengths %+v, want 200 keys with p50 and p90 of 4, p99 of 20 and a max of 200", k)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+)
+
+var (
+	keyRegex *regexp.Regexp
+	noMatch  = "line"
+	// noMatchSet records that -no-match was given, which needs -key-regex.
+	noMatchSet bool
+)
+
+// parseKeyRegex parses -key-regex.
+func parseKeyRegex(s string) error {
+	re, err := regexp.Compile(s)
+	if err != nil {
+		return err
+	}
+	keyRegex = re
+	return nil
+}
+
+// parseNoMatch parses -no-match.
+func parseNoMatch(s string) error {
+	if s != "line" && s != "drop" && s != "pass" {
+		return fmt.Errorf("unknown -no-match policy %q (known: line, drop, pass)", s)
+	}
+	noMatch, noMatchSet = s, true
+	return nil
+}
+
+// checkKeyRegexFlags exits if -key-regex is combined with another way of
+// choosing the part of the line the key comes from.
+func checkKeyRegexFlags() {
+	if keyRegex != nil && (len(keyFields) > 0 || csvInput() || keyInputFile != "") {
+		logErrorf("-key-regex cannot be combined with -field, -input-format csv or -key-input")
+		os.Exit(2)
+	}
+	if noMatchSet && keyRegex == nil {
+		logErrorf("-no-match requires -key-regex")
+		os.Exit(2)
+	}
+}
+
+// regexKey returns the key -key-regex extracts from line: the first
+// capture group of the leftmost match, or the whole match if the pattern
+// has no groups. A group that takes no part in the match gives an empty
+// key. A line without a match is its own key, unless -no-match drop
+// rejected it before; under -no-match pass, the key goes unused.
+func regexKey(line []byte) []byte {
+	m := keyRegex.FindSubmatchIndex(line)
+	switch {
+	case m == nil:
+		return line
+	case len(m) > 2:
+		if m[2] < 0 {
+			return line[:0]
+		}
+		return line[m[2]:m[3]]
+	}
+	return line[m[0]:m[1]]
+}
+
+// unmatchedLine reports whether line is to be rejected under -no-match
+// drop for not matching -key-regex.
+func unmatchedLine(line []byte) bool {
+	return keyRegex != nil && noMatch == "drop" && !keyRegex.Match(line)
+}
+
+// passedLine reports whether line is to pass through undeduplicated under
+// -no-match pass for not matching -key-regex: it is written as a new line
+// every time, and its key is never looked up or added.
+func passedLine(line []byte) bool {
+	return keyRegex != nil && noMatch == "pass" && !keyRegex.Match(line)
+}
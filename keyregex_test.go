@@ -0,0 +1,85 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+)
+
+func TestRegexKey(t *testing.T) {
+	defer func() { keyRegex = nil }()
+	tests := []struct {
+		pattern, line, want string
+	}{
+		{`user=(\w+)`, "GET / user=alice id=1", "alice"},
+		// The leftmost match wins when there are several.
+		{`user=(\w+)`, "user=bob user=alice", "bob"},
+		// Without a group the whole match is the key.
+		{`id=\d+`, "a id=42 b", "id=42"},
+		// A group that takes no part in the match gives an empty key.
+		{`x=(\d+)|y`, "only y", ""},
+		// No match: the line is its own key.
+		{`user=(\w+)`, "no user here", "no user here"},
+	}
+	for _, tt := range tests {
+		keyRegex = regexp.MustCompile(tt.pattern)
+		if got := string(regexKey([]byte(tt.line))); got != tt.want {
+			t.Errorf("%s on %q: key %q, want %q", tt.pattern, tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestKeyRegex(t *testing.T) {
+	in := "1 user=alice\n2 user=bob\n3 user=alice\nno user\n4 user=bob user=carol\nno user\n5 user=carol\n"
+	tests := []struct {
+		policy, want string
+	}{
+		// Unmatched lines are their own keys.
+		{"line", "1 user=alice\n2 user=bob\nno user\n5 user=carol\n"},
+		{"drop", "1 user=alice\n2 user=bob\n5 user=carol\n"},
+		// Unmatched lines pass every time.
+		{"pass", "1 user=alice\n2 user=bob\nno user\nno user\n5 user=carol\n"},
+	}
+	for _, c := range []string{"1", "4"} {
+		for _, tt := range tests {
+			dir := t.TempDir()
+			args := []string{"-key-regex", `user=(\w+)`, "-no-match", tt.policy, "-concurrency", c}
+			if got := mustRun(t, dir, in, args...); got != tt.want {
+				t.Errorf("%v: output %q, want %q", args, got, tt.want)
+			}
+			// Passed lines are never added.
+			if tt.policy == "pass" {
+				if got := mustRun(t, dir, "no user\n"); got != "no user\n" {
+					t.Errorf("%v: a passed line was added to the filter", args)
+				}
+			}
+		}
+	}
+
+	// Passed lines are not duplicates, whichever path processes them.
+	in = "user=alice\nno user\nuser=alice\nno user\n"
+	for _, path := range [][]string{
+		{"-concurrency", "1"},
+		{"-concurrency", "4"},
+		{"-concurrency", "4", "-parallel-hash"},
+	} {
+		dir := t.TempDir()
+		args := append([]string{"-key-regex", `user=(\w+)`, "-no-match", "pass", "-dup-lines", "dups.txt"}, path...)
+		mustRun(t, dir, in, args...)
+		if got, _ := os.ReadFile(filepath.Join(dir, "dups.txt")); string(got) != "3\n" {
+			t.Errorf("%v: duplicate line numbers %q, want 3", args, got)
+		}
+	}
+
+	for _, args := range [][]string{
+		{"-key-regex", "("},
+		{"-no-match", "drop"},
+		{"-key-regex", "x", "-no-match", "keep"},
+		{"-key-regex", "x", "-field", "1"},
+	} {
+		if res := runBdedup(t, t.TempDir(), in, args...); res.code != 2 {
+			t.Errorf("%v exited %d, want 2", args, res.code)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+)
+
+// logLevel is the least severe level logged, set by -log-level.
+var logLevel = new(slog.LevelVar)
+
+// logger receives every diagnostic the commands write: errors, warnings and
+// progress notes. Results, -stats summaries and -profile reports are data
+// and are written directly instead.
+var logger = slog.New(newPlainHandler(os.Stderr))
+
+// registerLogFlags defines -log-level and -log-format on fs, for every
+// command.
+func registerLogFlags(fs *flag.FlagSet) {
+	fs.Func("log-level", "Least severe diagnostics to log: debug, info, warn or error (default: info)", parseLogLevel)
+	fs.Func("log-format", "Format of diagnostics on stderr: plain, text or json (default: plain)", parseLogFormat)
+}
+
+func parseLogLevel(s string) error {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(s)); err != nil {
+		return fmt.Errorf("unknown level %q: want debug, info, warn or error", s)
+	}
+	logLevel.Set(level)
+	return nil
+}
+
+func parseLogFormat(s string) error {
+	opts := &slog.HandlerOptions{Level: logLevel}
+	switch s {
+	case "plain":
+		logger = slog.New(newPlainHandler(os.Stderr))
+	case "text":
+		logger = slog.New(slog.NewTextHandler(os.Stderr, opts))
+	case "json":
+		logger = slog.New(slog.NewJSONHandler(os.Stderr, opts))
+	default:
+		return fmt.Errorf("unknown format %q: want plain, text or json", s)
+	}
+	return nil
+}
+
+func logErrorf(format string, args ...any) {
+	logger.Error(fmt.Sprintf(format, args...))
+}
+
+func logWarnf(format string, args ...any) {
+	logger.Warn(fmt.Sprintf(format, args...))
+}
+
+func logInfof(format string, args ...any) {
+	logger.Info(fmt.Sprintf(format, args...))
+}
+
+// plainHandler is the default -log-format: one line per record, as the
+// commands have always written them. Errors and warnings are prefixed
+// "Error: " and "Warning: ", info records are written bare, and any
+// attributes follow the message as key=value pairs.
+type plainHandler struct {
+	mu    *sync.Mutex
+	w     io.Writer
+	attrs []slog.Attr
+}
+
+func newPlainHandler(w io.Writer) *plainHandler {
+	return &plainHandler{mu: new(sync.Mutex), w: w}
+}
+
+func (h *plainHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= logLevel.Level()
+}
+
+func (h *plainHandler) Handle(_ context.Context, r slog.Record) error {
+	var buf bytes.Buffer
+	switch {
+	case r.Level >= slog.LevelError:
+		buf.WriteString("Error: ")
+	case r.Level >= slog.LevelWarn:
+		buf.WriteString("Warning: ")
+	case r.Level < slog.LevelInfo:
+		buf.WriteString("Debug: ")
+	}
+	buf.WriteString(r.Message)
+	write := func(a slog.Attr) bool {
+		if a.Equal(slog.Attr{}) {
+			return true
+		}
+		v := a.Value.Resolve().String()
+		if strings.ContainsAny(v, " \t\"=") {
+			v = fmt.Sprintf("%q", v)
+		}
+		fmt.Fprintf(&buf, " %s=%s", a.Key, v)
+		return true
+	}
+	for _, a := range h.attrs {
+		write(a)
+	}
+	r.Attrs(write)
+	buf.WriteByte('\n')
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := h.w.Write(buf.Bytes())
+	return err
+}
+
+func (h *plainHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h2 := *h
+	h2.attrs = append(h.attrs[:len(h.attrs):len(h.attrs)], attrs...)
+	return &h2
+}
+
+// WithGroup is not needed by the commands, which log no groups; attributes
+// in a group are written without its name.
+func (h *plainHandler) WithGroup(string) slog.Handler {
+	return h
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+// logRecords parses the JSON log lines in stderr.
+func logRecords(t *testing.T, stderr string) []map[string]any {
+	t.Helper()
+	var records []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(stderr), "\n") {
+		if line == "" {
+			continue
+		}
+		var r map[string]any
+		if err := json.Unmarshal([]byte(line), &r); err != nil {
+			t.Fatalf("log line %q is not JSON: %v", line, err)
+		}
+		records = append(records, r)
+	}
+	return records
+}
+
+// findRecord returns the first record with message msg, or nil.
+func findRecord(records []map[string]any, msg string) map[string]any {
+	for _, r := range records {
+		if m, _ := r["msg"].(string); strings.Contains(m, msg) {
+			return r
+		}
+	}
+	return nil
+}
+
+func TestJSONLog(t *testing.T) {
+	dir := t.TempDir()
+	res := runBdedup(t, dir, "a\nb\n", "-log-format", "json", "-log-level", "debug")
+	records := logRecords(t, res.stderr)
+	if findRecord(records, "no saved state") == nil || findRecord(records, "saved state") == nil {
+		t.Errorf("first run logged %q, want no saved state and saved state", res.stderr)
+	}
+	res = runBdedup(t, dir, "a\nc\n", "-log-level", "debug", "-log-format", "json")
+	r := findRecord(logRecords(t, res.stderr), "loaded state")
+	if r == nil || r["level"] != "DEBUG" || r["elements"] != 2.0 || !strings.HasSuffix(r["path"].(string), "bloom.gz") {
+		t.Errorf("second run logged %v for the load, want a debug record of 2 elements", r)
+	}
+
+	// Debug records are left out at the default level, info ones from warn up.
+	if res := runBdedup(t, dir, "", "-log-format", "json"); findRecord(logRecords(t, res.stderr), "state") != nil {
+		t.Errorf("default level logged %q, want no debug records", res.stderr)
+	}
+	sat := t.TempDir()
+	mustRun(t, sat, numbered("key-", 5000), "-n", "50")
+	res = runBdedup(t, sat, "", "-n", "50", "-log-format", "json", "-log-level", "warn")
+	records = logRecords(t, res.stderr)
+	if r := findRecord(records, "estimated false positive rate"); r == nil || r["level"] != "WARN" {
+		t.Errorf("saturated state logged %q, want a warning", res.stderr)
+	}
+	for _, r := range records {
+		if r["level"] == "INFO" || r["level"] == "DEBUG" {
+			t.Errorf("-log-level warn logged %v", r)
+		}
+	}
+	res = runBdedup(t, sat, "", "-n", "50", "-log-format", "json", "-log-level", "error")
+	if res.stderr != "" {
+		t.Errorf("-log-level error logged %q, want nothing", res.stderr)
+	}
+
+	res = runBdedup(t, t.TempDir(), "x\n", "-log-format", "json", "-p", "2")
+	if r := findRecord(logRecords(t, res.stderr), "invalid -n or -p"); r == nil || r["level"] != "ERROR" {
+		t.Errorf("invalid -p logged %q, want an error record", res.stderr)
+	}
+	for _, args := range [][]string{{"-log-format", "xml"}, {"-log-level", "loud"}} {
+		if res := runBdedup(t, t.TempDir(), "", args...); res.code != 2 {
+			t.Errorf("%v exited %d, want 2", args, res.code)
+		}
+	}
+}
+
+func TestPlainHandler(t *testing.T) {
+	defer func(level slog.Level) { logLevel.Set(level) }(logLevel.Level())
+	logLevel.Set(slog.LevelInfo)
+	var buf bytes.Buffer
+	log := slog.New(newPlainHandler(&buf)).With("run", 1)
+	log.Error("failed")
+	log.Warn("worn", "path", "a b.gz")
+	log.Info("done")
+	log.Debug("hidden")
+	want := "Error: failed run=1\nWarning: worn run=1 path=\"a b.gz\"\ndone run=1\n"
+	if buf.String() != want {
+		t.Errorf("plain log %q, want %q", buf.String(), want)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// maxAdds is -max-adds: the most keys one run may add to the filter. 0 means
+// no limit.
+var maxAdds uint64
+
+// checkMaxAddsFlags exits if -max-adds is combined with options that assume
+// every key emitted as new was added to the filter, or that never add.
+func checkMaxAddsFlags() {
+	var conflict string
+	switch {
+	case walFile != "":
+		conflict = "-wal"
+	case verify || verifyExact:
+		conflict = "-verify"
+	case deltaFile != "":
+		conflict = "-delta-output"
+	case parallelHash:
+		conflict = "-parallel-hash"
+	case adjacent:
+		conflict = "-adjacent"
+	case queryOnly:
+		conflict = "-query-only"
+	}
+	if conflict != "" {
+		logErrorf("-max-adds cannot be combined with %s", conflict)
+		os.Exit(2)
+	}
+}
+
+// cappedSet stops adding to set once maxAdds keys have been added through it,
+// so that a runaway job cannot fill a filter shared with others. Past the
+// cap, lookups still go to set: a key it lacks is reported as new every time
+// it is seen, since it is never added, and a key it holds as a duplicate.
+// Keys from -seed-file count towards the cap like input keys.
+type cappedSet struct {
+	set keySet
+	// mu serializes lookups with additions: set.Has is not safe while
+	// another worker adds, and every addition goes through here.
+	mu      sync.Mutex
+	adds    atomic.Uint64 // additions tried, which pass maxAdds by the refused ones
+	skipped atomic.Uint64 // new keys not added because of the cap
+	hit     sync.Once
+}
+
+func (s *cappedSet) Has(key []byte) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.set.Has(key)
+}
+
+// reserve reports whether one more key may be added, counting it if so.
+func (s *cappedSet) reserve() bool {
+	if s.adds.Add(1) <= maxAdds {
+		return true
+	}
+	s.skipped.Add(1)
+	s.hit.Do(func() {
+		logWarnf("-max-adds: reached %d additions; new keys from here on are emitted but not added to the filter", maxAdds)
+	})
+	return false
+}
+
+func (s *cappedSet) Add(key []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// The caller may not have asked set itself, as minCountSet does not.
+	if s.set.Has(key) || !s.reserve() {
+		return
+	}
+	s.set.Add(key)
+}
+
+func (s *cappedSet) AddIfNotHasTS(key []byte) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.set.Has(key) {
+		return false
+	}
+	if s.reserve() {
+		s.set.Add(key)
+	}
+	return true
+}
+
+// report logs how many new keys the cap kept out of the filter.
+func (s *cappedSet) report() {
+	if n := s.skipped.Load(); n > 0 {
+		logWarnf("-max-adds: %d new keys were not added to the filter", n)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestCappedSet(t *testing.T) {
+	defer func(n uint64) { maxAdds = n }(maxAdds)
+	maxAdds = 5
+	inner := newMapSet()
+	s := &cappedSet{set: inner}
+	for i := range 20 {
+		if !s.AddIfNotHasTS(fmt.Appendf(nil, "k%d", i)) {
+			t.Fatalf("k%d reported present before it was added", i)
+		}
+	}
+	if len(inner.keys) != 5 {
+		t.Fatalf("%d keys added, want the cap of 5", len(inner.keys))
+	}
+	if n := s.skipped.Load(); n != 15 {
+		t.Errorf("%d keys counted as skipped, want 15", n)
+	}
+	// Querying continues past the cap.
+	if s.AddIfNotHasTS([]byte("k0")) || !s.Has([]byte("k4")) {
+		t.Error("a key added before the cap is not a duplicate")
+	}
+	if !s.AddIfNotHasTS([]byte("k10")) || s.Has([]byte("k10")) {
+		t.Error("a key refused by the cap is not new again")
+	}
+	s.Add([]byte("k11"))
+	if len(inner.keys) != 5 {
+		t.Errorf("Add past the cap added a key")
+	}
+}
+
+func TestCappedSetConcurrent(t *testing.T) {
+	defer func(n uint64) { maxAdds = n }(maxAdds)
+	maxAdds = 1000
+	inner := newMapSet()
+	s := &cappedSet{set: inner}
+	var wg sync.WaitGroup
+	for w := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 500 {
+				// Workers overlap on half their keys.
+				s.AddIfNotHasTS(fmt.Appendf(nil, "k%d", w/2*500+i))
+			}
+		}()
+	}
+	wg.Wait()
+	if len(inner.keys) != 1000 {
+		t.Errorf("%d keys added, want the cap of 1000", len(inner.keys))
+	}
+}
+
+func TestMaxAdds(t *testing.T) {
+	dir := t.TempDir()
+	res := runBdedup(t, dir, numbered("k", 20), "-max-adds", "5")
+	if res.code != 0 {
+		t.Fatalf("exit status %d: %s", res.code, res.stderr)
+	}
+	if res.stdout != numbered("k", 20) {
+		t.Errorf("output %q, want every line, all new", res.stdout)
+	}
+	if !strings.Contains(res.stderr, "reached 5 additions") || !strings.Contains(res.stderr, "15 new keys were not added") {
+		t.Errorf("stderr %q does not report the cap", res.stderr)
+	}
+	if bf := loadState(t, filepath.Join(dir, "bloom.gz")); bf.ElemNum != 5 {
+		t.Errorf("saved state holds %d elements, want 5", bf.ElemNum)
+	}
+	// A rerun suppresses the 5 held keys and adds 2 more.
+	got := mustRun(t, dir, numbered("k", 10)+"k9\n", "-max-adds", "2")
+	if want := "k5\nk6\nk7\nk8\nk9\nk9\n"; got != want {
+		t.Errorf("rerun: output %q, want %q", got, want)
+	}
+	if got := mustRun(t, dir, numbered("k", 10), "-seen"); got != numbered("k", 7) {
+		t.Errorf("after the rerun: seen %q, want k0 to k6", got)
+	}
+
+	for _, c := range []string{"1", "4"} {
+		dir := t.TempDir()
+		mustRun(t, dir, numbered("k", 5000), "-max-adds", "1000", "-concurrency", c)
+		if bf := loadState(t, filepath.Join(dir, "bloom.gz")); bf.ElemNum != 1000 {
+			t.Errorf("-concurrency %s: saved state holds %d elements, want 1000", c, bf.ElemNum)
+		}
+	}
+	if res := runBdedup(t, t.TempDir(), "a\n", "-max-adds", "1", "-wal", "w"); res.code != 2 {
+		t.Errorf("-max-adds with -wal: exit status %d, want 2", res.code)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/mylh/bdedup/bbloom"
+)
+
+// mergeMain implements "bdedup merge": it ORs shard filters of the same
+// geometry into one. Only the merged filter is held in memory; each shard is
+// streamed into it a chunk at a time, so any number of shards can be merged
+// in the memory of one.
+func mergeMain(args []string) {
+	fs := flag.NewFlagSet("merge", flag.ExitOnError)
+	var out string
+	fs.StringVar(&out, "o", "", "Merged state file")
+	fs.BoolVar(&noGzip, "no-gzip", false, "Disable gzip compression for state files")
+	registerRetryFlags(fs)
+	registerLogFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), `Merge Bloom filter state files of the same size, hash locations and hash
+into one that holds the keys of all of them.
+
+Usage: %[1]s merge -o merged.gz shard1.gz shard2.gz ...
+
+Options:
+`, os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	shards := fs.Args()
+	if out == "" || len(shards) == 0 {
+		logErrorf("merge requires -o and at least one shard")
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	// Check every header before reading any bits, so a mismatched shard
+	// at the end of a long list fails fast.
+	var first bbloom.BinaryHeader
+	for i, path := range shards {
+		hdr, err := readStateHeader(path)
+		if err != nil {
+			logErrorf("reading shard %s: %v", path, err)
+			os.Exit(1)
+		}
+		if i == 0 {
+			first = hdr
+		} else if err := first.Compatible(hdr); err != nil {
+			logErrorf("cannot merge %s into %s: %v", path, shards[0], err)
+			os.Exit(1)
+		}
+	}
+
+	bf, err := readBloomFilter(shards[0])
+	if err != nil {
+		logErrorf("reading shard %s: %v", shards[0], err)
+		os.Exit(1)
+	}
+	for _, path := range shards[1:] {
+		if err := mergeShard(&bf, path); err != nil {
+			logErrorf("merging shard %s: %v", path, err)
+			os.Exit(1)
+		}
+	}
+	logInfof("Merged %d shards: fill %.4f, estimated FPR %.6f", len(shards), bf.FillRatio(), bf.EstimatedFPR())
+
+	if err := saveBloomFilter(out, bf); err != nil {
+		logErrorf("%v", err)
+		os.Exit(1)
+	}
+}
+
+// readStateHeader reads only the header of the filter persisted at path.
+func readStateHeader(path string) (bbloom.BinaryHeader, error) {
+	r, err := openState(path)
+	if err != nil {
+		return bbloom.BinaryHeader{}, err
+	}
+	defer r.Close()
+	return bbloom.ReadBinaryHeader(r)
+}
+
+// mergeShard streams the filter persisted at path into bf, and any filters
+// concatenated after it.
+func mergeShard(bf *bbloom.Bloom, path string) error {
+	r, err := openState(path)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if err := bf.MergeBinary(r); err != nil {
+		return err
+	}
+	_, err = mergeConcatenated(bf, r)
+	return err
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func TestMergeShards(t *testing.T) {
+	dir := t.TempDir()
+	var shards []string
+	for i := range 4 {
+		name := fmt.Sprintf("shard%d.gz", i)
+		mustRun(t, dir, numbered(fmt.Sprintf("s%d-", i), 500), "-state", name, "-n", "10000")
+		shards = append(shards, name)
+	}
+	mustRun(t, dir, "", append([]string{"merge", "-o", "merged.gz"}, shards...)...)
+	merged := loadState(t, filepath.Join(dir, "merged.gz"))
+	for i := range 4 {
+		for j := range 500 {
+			if key := fmt.Sprintf("s%d-%d", i, j); !merged.Has([]byte(key)) {
+				t.Fatalf("%s missing from the merged filter", key)
+			}
+		}
+	}
+
+	mustRun(t, dir, "x\n", "-state", "other.gz", "-n", "1000000")
+	res := runBdedup(t, dir, "", "merge", "-o", "bad.gz", "shard0.gz", "other.gz")
+	if res.code != 1 {
+		t.Errorf("merging filters of different sizes: exit status %d, want 1", res.code)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/mylh/bdedup/bbloom"
+)
+
+// minCount is -min-count: keep up to this many copies of each key. 0 keeps
+// the default of one.
+var minCount int
+
+// minCountSet lets the first minCount occurrences of each key through and
+// reports the rest as present. Occurrences are counted in a count-min sketch
+// sized like the -with-counts one. The sketch never undercounts, but may
+// overcount a key that shares its counters with frequent ones, so a line can
+// be suppressed a little before its minCount-th copy. Counts only cover the
+// current run: a key the underlying set already held from earlier runs
+// counts as one occurrence. Has records an occurrence, so it must be called
+// once per line, as processStream does.
+type minCountSet struct {
+	set    keySet
+	counts bbloom.CountMin
+	mu     sync.Mutex
+}
+
+func newMinCountSet(set keySet) *minCountSet {
+	return &minCountSet{set: set, counts: bbloom.NewCountMin(countEpsilon, countDelta)}
+}
+
+func (s *minCountSet) Has(key []byte) bool {
+	seen := s.counts.Count(key)
+	if seen == 0 && s.set.Has(key) {
+		// Seen in an earlier run.
+		seen = s.counts.Increment(key)
+	}
+	s.counts.Increment(key)
+	return seen >= uint64(minCount)
+}
+
+func (s *minCountSet) Add(key []byte) {
+	s.set.Add(key)
+}
+
+func (s *minCountSet) AddIfNotHasTS(key []byte) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.Has(key) {
+		return false
+	}
+	s.Add(key)
+	return true
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestMinCountBoundary(t *testing.T) {
+	// key-i appears i times, interleaved so copies of a key are apart.
+	var b strings.Builder
+	for round := range 6 {
+		for i := 1; i <= 6; i++ {
+			if round < i {
+				fmt.Fprintf(&b, "key-%d\n", i)
+			}
+		}
+	}
+	for _, n := range []int{1, 2, 3, 5} {
+		got := make(map[string]int)
+		out := mustRun(t, t.TempDir(), b.String(), "-min-count", fmt.Sprint(n))
+		for _, line := range strings.Split(strings.TrimSuffix(out, "\n"), "\n") {
+			got[line]++
+		}
+		for i := 1; i <= 6; i++ {
+			key := fmt.Sprintf("key-%d", i)
+			if want := min(i, n); got[key] != want {
+				t.Errorf("-min-count %d: %s emitted %d times, want %d", n, key, got[key], want)
+			}
+		}
+	}
+
+	// A key held from an earlier run has already had one copy.
+	dir := t.TempDir()
+	mustRun(t, dir, "old\n")
+	if got := mustRun(t, dir, "old\nold\nold\nnew\nnew\nnew\n", "-min-count", "2"); got != "old\nnew\nnew\n" {
+		t.Errorf("second run emitted %q, want one more old and two new", got)
+	}
+}
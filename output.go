@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"sync"
+	"time"
+)
+
+// flushWriter buffers output and, with a non-zero interval, flushes it on a
+// timer so downstream consumers see lines promptly. Writes and flushes are
+// serialized, so every line written with a single Write reaches the
+// underlying writer whole. If the underlying writer has its own Flush, as a
+// compressor does, it is flushed too.
+type flushWriter struct {
+	mu   sync.Mutex
+	w    *bufio.Writer
+	dst  io.Writer
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newFlushWriter(w io.Writer, interval time.Duration) *flushWriter {
+	fw := &flushWriter{w: bufio.NewWriterSize(w, 64<<10), dst: w}
+	if interval > 0 {
+		fw.stop = make(chan struct{})
+		fw.done = make(chan struct{})
+		go fw.flushEvery(interval)
+	}
+	return fw
+}
+
+func (fw *flushWriter) Write(p []byte) (int, error) {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	return fw.w.Write(p)
+}
+
+func (fw *flushWriter) Flush() error {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	if err := fw.w.Flush(); err != nil {
+		return err
+	}
+	if f, ok := fw.dst.(interface{ Flush() error }); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+// Close stops the flush timer, waiting for an in-progress tick to finish, and
+// then writes out whatever is still buffered. It does not close the
+// underlying writer.
+func (fw *flushWriter) Close() error {
+	if fw.stop != nil {
+		close(fw.stop)
+		<-fw.done
+	}
+	return fw.Flush()
+}
+
+func (fw *flushWriter) flushEvery(interval time.Duration) {
+	defer close(fw.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			// A failed flush leaves a sticky error that Close reports.
+			fw.Flush()
+		case <-fw.stop:
+			return
+		}
+	}
+}
+
+// recordWriterBuffer is the number of records a recordWriter queues before
+// Write waits for its goroutine to catch up.
+const recordWriterBuffer = 1024
+
+// recordWriter is the single writer of an output. It owns w, and nothing
+// else may write to w until Close. Write errors are sticky and reported by
+// drain and Close.
+//
+// With several producers, one goroutine writes every record passed to Write
+// to w, in the order the Writes were made. Producers on any number of
+// goroutines can then share the recordWriter, and since each Write is one
+// whole record and only that goroutine touches w, records are never
+// interleaved or split, even when w, like heldEndWriter, is not safe for
+// concurrent use. With a single producer, Write writes to w directly,
+// which saves a copy and a channel send per record.
+type recordWriter struct {
+	w       io.Writer
+	records chan queuedRecord // nil when writing directly
+	done    chan struct{}
+	err     error
+}
+
+// newRecordWriter returns the single writer of w. Pass shared if Write is
+// to be called from more than one goroutine.
+func newRecordWriter(w io.Writer, shared bool) *recordWriter {
+	rw := &recordWriter{w: w}
+	if shared {
+		rw.records = make(chan queuedRecord, recordWriterBuffer)
+		rw.done = make(chan struct{})
+		go rw.run()
+	}
+	return rw
+}
+
+// queuedRecord is a record for the goroutine to write, or with drained set,
+// a marker that everything queued before it has been written, answered with
+// the write error so far.
+type queuedRecord struct {
+	rec     []byte
+	drained chan error
+}
+
+func (rw *recordWriter) run() {
+	defer close(rw.done)
+	for q := range rw.records {
+		if q.drained != nil {
+			q.drained <- rw.err
+			continue
+		}
+		if rw.err == nil {
+			_, rw.err = rw.w.Write(q.rec)
+		}
+	}
+}
+
+// Write writes the record p, or queues a copy of it, so the caller may
+// reuse p. It must not be called after Close.
+func (rw *recordWriter) Write(p []byte) (int, error) {
+	switch {
+	case len(p) == 0:
+	case rw.records == nil:
+		if rw.err == nil {
+			_, rw.err = rw.w.Write(p)
+		}
+	default:
+		rw.records <- queuedRecord{rec: bytes.Clone(p)}
+	}
+	return len(p), nil
+}
+
+// drain waits until every record queued so far has been written to w.
+func (rw *recordWriter) drain() error {
+	if rw.records == nil {
+		return rw.err
+	}
+	drained := make(chan error)
+	rw.records <- queuedRecord{drained: drained}
+	return <-drained
+}
+
+// Close writes the queued records and stops the goroutine. It does not close
+// w.
+func (rw *recordWriter) Close() error {
+	if rw.records != nil {
+		close(rw.records)
+		<-rw.done
+	}
+	return rw.err
+}
+
+// heldEndWriter passes writes through to w, except that a write's trailing
+// end (a newline, or the record delimiter) is held back until the next write,
+// so that finish can leave the last one off. Every write must be whole
+// records, as emit's are.
+type heldEndWriter struct {
+	w    io.Writer
+	end  []byte
+	held bool
+}
+
+func (hw *heldEndWriter) Write(p []byte) (int, error) {
+	if hw.held {
+		if _, err := hw.w.Write(hw.end); err != nil {
+			return 0, err
+		}
+		hw.held = false
+	}
+	n := len(p)
+	if bytes.HasSuffix(p, hw.end) {
+		p = p[:len(p)-len(hw.end)]
+		hw.held = true
+	}
+	if _, err := hw.w.Write(p); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// finish writes the held end, if any, unless keep is false.
+func (hw *heldEndWriter) finish(keep bool) error {
+	if !hw.held || !keep {
+		return nil
+	}
+	hw.held = false
+	_, err := hw.w.Write(hw.end)
+	return err
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFlushIntervalWritesTricklingInput(t *testing.T) {
+	cmd := exec.Command(os.Args[0], "-flush-interval", "50ms", "-concurrency", "1")
+	cmd.Dir = t.TempDir()
+	cmd.Env = append(os.Environ(), "BDEDUP_TEST_MAIN=1")
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Wait()
+	defer stdin.Close()
+
+	lines := make(chan string)
+	go func() {
+		r := bufio.NewReader(stdout)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				close(lines)
+				return
+			}
+			lines <- line
+		}
+	}()
+	// The input stays open, so each line can only show up through a flush.
+	steps := []struct{ in, want string }{
+		{"first\n", "first\n"},
+		{"second\n", "second\n"},
+		{"first\n", ""}, // a duplicate; a stray line fails the next step
+		{"third\n", "third\n"},
+	}
+	for _, step := range steps {
+		if _, err := stdin.Write([]byte(step.in)); err != nil {
+			t.Fatal(err)
+		}
+		if step.want == "" {
+			continue
+		}
+		select {
+		case got := <-lines:
+			if got != step.want {
+				t.Fatalf("got %q, want %q", got, step.want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%q not written while the input stayed open", step.want)
+		}
+	}
+}
+
+func TestNoTrailingNewline(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"a\nb", "a\nb"},
+		{"a\nb\n", "a\nb\n"},
+		// The last input line's framing, even when it is not emitted.
+		{"a\nb\na", "a\nb"},
+		{"a\nb\na\n", "a\nb\n"},
+		{"a\r\nb", "a\nb"},
+		{"", ""},
+	}
+	for _, c := range []string{"1", "4"} {
+		for _, tt := range tests {
+			got := mustRun(t, t.TempDir(), tt.in, "-no-trailing-newline", "-concurrency", c)
+			if got != tt.want {
+				t.Errorf("-concurrency %s: input %q gave %q, want %q", c, tt.in, got, tt.want)
+			}
+		}
+	}
+	// Without the flag every line is ended.
+	if got := mustRun(t, t.TempDir(), "a\nb"); got != "a\nb\n" {
+		t.Errorf("without -no-trailing-newline: output %q, want a final newline", got)
+	}
+	got := mustRun(t, t.TempDir(), "p\n\nq", "-no-trailing-newline", "-record-delimiter", `\n\n`)
+	if got != "p\n\nq" {
+		t.Errorf("-record-delimiter: output %q, want the last delimiter held back", got)
+	}
+}
+
+// splittingWriter writes each write a byte at a time, so that writes from
+// two goroutines at once would interleave. It is not safe for concurrent use;
+// under -race, a second writer is reported.
+type splittingWriter struct{ buf bytes.Buffer }
+
+func (w *splittingWriter) Write(p []byte) (int, error) {
+	for _, b := range p {
+		w.buf.WriteByte(b)
+	}
+	return len(p), nil
+}
+
+// TestRecordWriterProducers is meant for go test -race: producers share one
+// recordWriter, and every record must come out whole and in each producer's
+// order.
+func TestRecordWriterProducers(t *testing.T) {
+	const producers, perProducer = 8, 2000
+	var w splittingWriter
+	rw := newRecordWriter(&w, true)
+	var wg sync.WaitGroup
+	for p := range producers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rec := make([]byte, 0, 64)
+			for i := range perProducer {
+				// The caller may reuse the record once Write returns.
+				rec = fmt.Appendf(rec[:0], "producer-%d record-%d %s\n", p, i, strings.Repeat("x", i%20))
+				rw.Write(rec)
+				if i == perProducer/2 {
+					if err := rw.drain(); err != nil {
+						t.Error(err)
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if err := rw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	next := make([]int, producers)
+	lines := strings.Split(strings.TrimSuffix(w.buf.String(), "\n"), "\n")
+	if len(lines) != producers*perProducer {
+		t.Fatalf("%d lines written, want %d", len(lines), producers*perProducer)
+	}
+	for _, line := range lines {
+		var p, i int
+		var pad string
+		n, _ := fmt.Sscanf(line, "producer-%d record-%d %s", &p, &i, &pad)
+		if n < 2 || p < 0 || p >= producers || line != fmt.Sprintf("producer-%d record-%d %s", p, i, strings.Repeat("x", i%20)) {
+			t.Fatalf("line %q is not a whole record", line)
+		}
+		if i != next[p] {
+			t.Fatalf("producer %d: record %d written after %d", p, i, next[p]-1)
+		}
+		next[p]++
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/mylh/bdedup/bbloom"
+)
+
+var parallelHash bool
+
+// checkParallelHashFlags exits if -parallel-hash is combined with options
+// that need more than a plain Bloom filter, whose hashing and bit setting
+// can be done apart, or that need one worker.
+func checkParallelHashFlags() {
+	var conflict string
+	switch {
+	case exact:
+		conflict = "-exact"
+	case adjacent:
+		conflict = "-adjacent"
+	case baseFile != "":
+		conflict = "-base"
+	case shingleSize > 0:
+		conflict = "-shingle"
+	case minCount > 0:
+		conflict = "-min-count"
+	case preHashed:
+		conflict = "-pre-hashed"
+	case growAt != 0:
+		conflict = "-grow-at"
+	case resume:
+		conflict = "-resume"
+	case profileRun:
+		conflict = "-profile"
+	}
+	if conflict != "" {
+		logErrorf("-parallel-hash cannot be combined with %s", conflict)
+		os.Exit(2)
+	}
+}
+
+// hashBatch is up to -chunk-lines consecutive input lines, with their keys
+// and, once a worker has been at it, the hashes of the keys.
+type hashBatch struct {
+	seq     uint64
+	lineNos []uint64
+	lines   []string
+	keys    [][]byte
+	passed  []bool // lines -no-match pass lets through
+	sums    []uint64
+}
+
+// processHashedInParallel is the -parallel-hash pipeline: -concurrency
+// workers hash the keys, and the calling goroutine alone tests and sets
+// their bits, in input order, then writes the lines. No lock or atomic
+// operation touches the bitset, and since every decision is made in input
+// order the output is exactly that of a sequential run. It pays off when
+// hashing long keys costs more than setting bits; with short keys the
+// applier is the bottleneck and processInParallel is faster.
+func processHashedInParallel(input io.Reader, output io.Writer, bf *bbloom.Bloom, st *runStats) error {
+	var wg sync.WaitGroup
+	work := make(chan *hashBatch, concurrency*chanBuffer)
+	results := make(chan *hashBatch, concurrency*chanBuffer)
+	// window bounds the batches between the reader and the applier, so
+	// the reorder buffer stays small however far one worker falls behind.
+	window := make(chan struct{}, 2*concurrency*max(chanBuffer, 1))
+
+	for range concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for b := range work {
+				b.sums = make([]uint64, len(b.keys))
+				for i, key := range b.keys {
+					b.sums[i] = bf.Sum(key)
+				}
+				results <- b
+			}
+		}()
+	}
+
+	var readErr error
+	go func() {
+		defer close(work)
+		scanner := withKeyInput(newLineScanner(input))
+		var seq, scanned uint64
+		b := &hashBatch{}
+		send := func() {
+			if len(b.lines) > 0 {
+				window <- struct{}{}
+				work <- b
+				seq++
+				b = &hashBatch{seq: seq}
+			}
+		}
+		for !windowDone(scanned) && scanner.Scan() {
+			scanned++
+			if beforeWindow(scanned) {
+				continue
+			}
+			if validateLines() && !validLine(scanner.Bytes()) {
+				rejectLine(scanner.Bytes())
+				continue
+			}
+			b.lineNos = append(b.lineNos, scanned+uint64(skippedRecords))
+			b.lines = append(b.lines, scanner.Text())
+			// The key may share the scanner's buffer.
+			b.keys = append(b.keys, bytes.Clone(recordKey(scanner)))
+			b.passed = append(b.passed, passedLine(scanner.Bytes()))
+			if len(b.lines) >= chunkLines {
+				send()
+			}
+		}
+		send()
+		readErr = scanner.Err()
+	}()
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	pending := make(map[uint64]*hashBatch)
+	var next uint64
+	for b := range results {
+		pending[b.seq] = b
+		for {
+			b, ok := pending[next]
+			if !ok {
+				break
+			}
+			delete(pending, next)
+			next++
+			for i, key := range b.keys {
+				if lineCounts != nil {
+					lineCounts.Increment(key)
+				}
+				if distinctKeys != nil {
+					distinctKeys.Add(key)
+				}
+				passed := b.passed[i]
+				hasNew := passed || bf.AddIfNotHasHash(b.sums[i])
+				emit(output, b.lines[i], key, hasNew)
+				if keyLengths != nil {
+					keyLengths.add(len(key))
+				}
+				if hasNew && !passed {
+					if wal != nil {
+						wal.append(key)
+					}
+					if deltaLines != nil {
+						recordDelta(b.lines[i])
+					}
+				} else if !hasNew && dupLines != nil {
+					recordDupLine(b.lineNos[i])
+				}
+				st.record(hasNew)
+			}
+			<-window
+		}
+	}
+	return readErr
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/mylh/bdedup/bbloom"
+)
+
+// largeKeyStream is syntheticStream with keys padded to size bytes, where
+// hashing rather than setting bits dominates.
+func largeKeyStream(n, distinct, size int) (input, uniques string) {
+	in, out := syntheticStream(n, distinct)
+	pad := strings.Repeat("x", size)
+	widen := func(s string) string {
+		return strings.ReplaceAll(s, "\n", pad+"\n")
+	}
+	return widen(in), widen(out)
+}
+
+func TestParallelHashMatchesSequential(t *testing.T) {
+	input, want := largeKeyStream(20000, 5000, 512)
+	for _, n := range []string{"1", "64"} {
+		got := mustRun(t, t.TempDir(), input, "-concurrency", "4", "-parallel-hash", "-chunk-lines", n)
+		if got != want {
+			t.Errorf("-chunk-lines %s: output differs from the first occurrences in input order", n)
+		}
+	}
+	if res := runBdedup(t, t.TempDir(), "a\n", "-concurrency", "4", "-parallel-hash", "-exact"); res.code != 2 {
+		t.Errorf("-parallel-hash with -exact: exit status %d, want 2", res.code)
+	}
+}
+
+// BenchmarkParallelHash compares hashing on the workers and setting bits on
+// one goroutine with workers calling AddTS, over keys of growing size.
+func BenchmarkParallelHash(b *testing.B) {
+	defer func(c, buf, n int) { concurrency, chanBuffer, chunkLines = c, buf, n }(concurrency, chanBuffer, chunkLines)
+	concurrency, chanBuffer, chunkLines = 4, defaultChanBuffer, 64
+	pipelines := []struct {
+		name string
+		run  func(io.Reader, io.Writer, *bbloom.Bloom, *runStats) error
+	}{
+		{"addts", func(r io.Reader, w io.Writer, bf *bbloom.Bloom, st *runStats) error {
+			return processInParallel(r, w, bf, st)
+		}},
+		{"parallel-hash", processHashedInParallel},
+	}
+	for _, size := range []int{16, 1024, 16384} {
+		input, _ := largeKeyStream(20000, 10000, size)
+		for _, p := range pipelines {
+			b.Run(fmt.Sprintf("%s/key=%d", p.name, size), func(b *testing.B) {
+				b.SetBytes(int64(len(input)))
+				for range b.N {
+					b.StopTimer()
+					bf := bbloom.New(1e6, 0.001)
+					b.StartTimer()
+					if err := p.run(strings.NewReader(input), io.Discard, &bf, &runStats{}); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
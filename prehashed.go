@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"os"
+
+	"github.com/mylh/bdedup/bbloom"
+)
+
+var preHashed bool
+
+// checkPreHashedFlags exits if -pre-hashed is combined with options that
+// hash keys themselves or need the keys rather than their hashes.
+func checkPreHashedFlags() {
+	if exact || adjacent || shingleSize > 0 || baseFile != "" {
+		logErrorf("-pre-hashed cannot be combined with -exact, -adjacent, -shingle or -base")
+		os.Exit(2)
+	}
+	if walFile != "" || growAt != 0 {
+		logErrorf("-pre-hashed cannot be combined with -wal or -grow-at")
+		os.Exit(2)
+	}
+	// The namespace would be prepended to the hex digits, which are then
+	// no longer a hash.
+	if namespace != "" {
+		logErrorf("-pre-hashed cannot be combined with -namespace; apply the namespace when computing the hashes")
+		os.Exit(2)
+	}
+}
+
+// preHashedSet is the filter under -pre-hashed, where every key is the
+// 64-bit hash of the real key, written as 16 hex digits. The hash sets and
+// tests the filter's bits directly, as if the real key had been hashed with
+// the filter's -hash.
+type preHashedSet struct {
+	bf *bbloom.Bloom
+}
+
+// sum parses key as a hash, exiting on a key that is not one.
+func (s preHashedSet) sum(key []byte) uint64 {
+	var b [8]byte
+	if len(key) != 2*len(b) {
+		s.invalid(key)
+	}
+	if _, err := hex.Decode(b[:], key); err != nil {
+		s.invalid(key)
+	}
+	return binary.BigEndian.Uint64(b[:])
+}
+
+func (preHashedSet) invalid(key []byte) {
+	logErrorf("-pre-hashed key %q is not a 64-bit hash in 16 hex digits", key)
+	os.Exit(1)
+}
+
+func (s preHashedSet) Has(key []byte) bool {
+	return s.bf.HasHash(s.sum(key))
+}
+
+func (s preHashedSet) Add(key []byte) {
+	s.bf.AddHash(s.sum(key))
+}
+
+func (s preHashedSet) AddIfNotHasTS(key []byte) bool {
+	return s.bf.AddIfNotHasHashTS(s.sum(key))
+}
+
+func (s preHashedSet) AddIfNotHasAtomic(key []byte) bool {
+	return s.bf.AddIfNotHasHashAtomic(s.sum(key))
+}
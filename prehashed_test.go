@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/mylh/bdedup/bbloom"
+)
+
+func TestPreHashed(t *testing.T) {
+	for _, hash := range []bbloom.Hash{bbloom.SipHash, bbloom.XXHash} {
+		// The upstream stage hashes the keys with the filter's hash.
+		var hashed, keys strings.Builder
+		for _, key := range []string{"a", "b", "a", "c"} {
+			fmt.Fprintf(&hashed, "%016x\n", hash.Sum64([]byte(key)))
+			keys.WriteString(key + "\n")
+		}
+		dir := t.TempDir()
+		args := []string{"-hash", hash.String()}
+		got := mustRun(t, dir, hashed.String(), append(args, "-pre-hashed")...)
+		if lines := strings.Split(hashed.String(), "\n"); got != lines[0]+"\n"+lines[1]+"\n"+lines[3]+"\n" {
+			t.Errorf("%s: -pre-hashed emitted %q, want the three distinct hashes", hash, got)
+		}
+		// The same bits as hashing the keys would have set.
+		if got := mustRun(t, dir, keys.String()+"d\n", args...); got != "d\n" {
+			t.Errorf("%s: keys after their hashes emitted %q, want d only", hash, got)
+		}
+	}
+
+	for _, bad := range []string{"xyz\n", "0123456789abcdeg\n", "0123456789abcdef0\n"} {
+		if res := runBdedup(t, t.TempDir(), bad, "-pre-hashed"); res.code != 1 {
+			t.Errorf("-pre-hashed on %q exited %d, want 1", bad, res.code)
+		}
+	}
+}
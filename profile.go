@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/mylh/bdedup/bbloom"
+)
+
+// prof collects the -profile timings; it is nil unless -profile is set, and
+// every hook checks that first, so an unprofiled run pays nothing else.
+var prof *runProfile
+
+// runProfile is where a run's time went. Input reads and output writes are
+// timed by wrapping the input scanner and the output writer, the filter times
+// its own hashing and bit accesses, and everything unaccounted for (key
+// derivation, counters, bookkeeping) is reported as other.
+type runProfile struct {
+	start     time.Time
+	read      time.Duration
+	write     time.Duration
+	stateLoad time.Duration
+	stateSave time.Duration
+	filters   []*bbloom.Bloom
+}
+
+func newRunProfile() *runProfile {
+	return &runProfile{start: time.Now()}
+}
+
+// watch enables timing on bf and includes it in the report.
+func (p *runProfile) watch(bf *bbloom.Bloom) {
+	bf.EnableProfile()
+	p.filters = append(p.filters, bf)
+}
+
+// report writes the breakdown to w, as durations and shares of the time
+// since the run started.
+func (p *runProfile) report(w io.Writer) {
+	total := time.Since(p.start)
+	var hashing, bits time.Duration
+	for _, bf := range p.filters {
+		h, b := bf.Profile()
+		hashing += h
+		bits += b
+	}
+	other := total - p.read - p.write - p.stateLoad - p.stateSave - hashing - bits
+	fmt.Fprintf(w, "Profile:         %v total\n", total.Round(time.Microsecond))
+	for _, row := range []struct {
+		name string
+		d    time.Duration
+	}{
+		{"read input", p.read},
+		{"filter hashing", hashing},
+		{"filter bits", bits},
+		{"write output", p.write},
+		{"state load", p.stateLoad},
+		{"state save", p.stateSave},
+		{"other", other},
+	} {
+		fmt.Fprintf(w, "  %-15s%12v %6.1f%%\n", row.name, row.d.Round(time.Microsecond), 100*row.d.Seconds()/total.Seconds())
+	}
+}
+
+// profiledScanner times the reads, and any decompression, behind Scan.
+type profiledScanner struct {
+	recordScanner
+	p *runProfile
+}
+
+func (s profiledScanner) Scan() bool {
+	t := time.Now()
+	ok := s.recordScanner.Scan()
+	s.p.read += time.Since(t)
+	return ok
+}
+
+// profiledWriter times the writes, and any compression, of the output.
+type profiledWriter struct {
+	w io.Writer
+	p *runProfile
+}
+
+func (pw profiledWriter) Write(b []byte) (int, error) {
+	t := time.Now()
+	n, err := pw.w.Write(b)
+	pw.p.write += time.Since(t)
+	return n, err
+}
+
+// Flush passes a flush on to a compressor underneath, timing it too.
+func (pw profiledWriter) Flush() error {
+	f, ok := pw.w.(interface{ Flush() error })
+	if !ok {
+		return nil
+	}
+	t := time.Now()
+	err := f.Flush()
+	pw.p.write += time.Since(t)
+	return err
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProfileSumsToTotal(t *testing.T) {
+	input, _ := syntheticStream(100000, 50000)
+	res := runBdedup(t, t.TempDir(), input, "-profile")
+	if res.code != 0 {
+		t.Fatalf("exit status %d\n%s", res.code, res.stderr)
+	}
+	var total, sum time.Duration
+	var percent float64
+	phases := make(map[string]bool)
+	for _, line := range strings.Split(strings.TrimSpace(res.stderr), "\n") {
+		if rest, ok := strings.CutPrefix(line, "Profile:"); ok {
+			d, err := time.ParseDuration(strings.TrimSuffix(strings.TrimSpace(rest), " total"))
+			if err != nil {
+				t.Fatalf("total in %q: %v", line, err)
+			}
+			total = d
+			continue
+		}
+		f := strings.Fields(line)
+		if len(f) < 3 {
+			t.Fatalf("unexpected profile line %q", line)
+		}
+		d, err := time.ParseDuration(f[len(f)-2])
+		if err != nil {
+			t.Fatalf("duration in %q: %v", line, err)
+		}
+		p, err := strconv.ParseFloat(strings.TrimSuffix(f[len(f)-1], "%"), 64)
+		if err != nil {
+			t.Fatalf("share in %q: %v", line, err)
+		}
+		phases[strings.Join(f[:len(f)-2], " ")] = true
+		sum += d
+		percent += p
+	}
+	for _, phase := range []string{"read input", "filter hashing", "filter bits", "write output", "state save", "other"} {
+		if !phases[phase] {
+			t.Errorf("phase %q missing from the profile:\n%s", phase, res.stderr)
+		}
+	}
+	if total <= 0 {
+		t.Fatalf("no total in the profile:\n%s", res.stderr)
+	}
+	if diff := (sum - total).Abs(); diff > total/100 {
+		t.Errorf("phases add up to %v, total is %v", sum, total)
+	}
+	if percent < 99 || percent > 101 {
+		t.Errorf("shares add up to %.1f%%", percent)
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"io"
+	"os"
+
+	"github.com/mylh/bdedup/bbloom"
+)
+
+var queryOnly bool
+
+// checkQueryFlags exits if -query-only is combined with options that add
+// keys to the filter or decide lines other than by membership.
+func checkQueryFlags() {
+	if exact || adjacent || shingleSize > 0 || minCount > 0 || withCounts || annotate || noMatch == "pass" {
+		logErrorf("-query-only cannot be combined with -exact, -adjacent, -shingle, -min-count, -with-counts, -annotate or -no-match pass")
+		os.Exit(2)
+	}
+	if walFile != "" || growAt != 0 || resume || seedFile != "" || twoPass || splitPrefix != "" {
+		logErrorf("-query-only cannot be combined with -wal, -grow-at, -resume, -seed-file, -two-pass or -split-output")
+		os.Exit(2)
+	}
+	// Output and reporting options runQuery does not implement.
+	if reverse || rejectOutput != "" || dupLinesFile != "" || summaryOnly || noTrailingNewline || cardinality || keyLengthStats || profileRun {
+		logErrorf("-query-only cannot be combined with -reverse, -reject-output, -dup-lines, -summary-only, -no-trailing-newline, -cardinality, -key-length-stats or -profile")
+		os.Exit(2)
+	}
+}
+
+// runQuery implements -query-only: it looks up the key of every input line
+// in the -state filter, and -base if given, writing each line followed by a
+// tab and "yes" or "no", or with -seen only the lines that are present.
+// Lines failing validation, -no-match drop included, are left out. The
+// output is compressed and encoded as run's would be. The filter is never
+// added to or saved.
+func runQuery() (status int) {
+	if _, err := os.Stat(stateFile); err != nil {
+		logErrorf("-query-only needs an existing state file: %v", err)
+		os.Exit(1)
+	}
+	bf := loadBloomFilter(stateFile)
+	checkHash(&bf, "state file "+stateFile)
+	var set interface{ Has([]byte) bool } = &bf
+	if preHashed {
+		set = preHashedSet{&bf}
+	}
+	if baseFile != "" {
+		base := loadBaseFilter(baseFile)
+		set = &bbloom.Layered{Base: &base, Overlay: &bf}
+	}
+
+	var input io.Reader = os.Stdin
+	if inputFile != "" {
+		file, err := os.Open(inputFile)
+		if err != nil {
+			logErrorf("opening input file: %v", err)
+			os.Exit(1)
+		}
+		defer file.Close()
+		input = file
+	}
+	input = decodeInput(input)
+	var output io.Writer = os.Stdout
+	if outputFile != "" {
+		file, err := os.Create(outputFile)
+		if err != nil {
+			logErrorf("creating output file: %v", err)
+			os.Exit(1)
+		}
+		defer file.Close()
+		output = file
+	}
+	var cw io.WriteCloser
+	if outputCompress != "none" {
+		var err error
+		if cw, err = newCompressor(outputCompress, output); err != nil {
+			logErrorf("-output-compress: %v", err)
+			os.Exit(2)
+		}
+		output = cw
+	}
+	ew := encodeOutput(output)
+	out := newFlushWriter(ew, flushInterval)
+
+	var st runStats
+	if file := openKeyInput(); file != nil {
+		defer file.Close()
+	}
+	scanner := withKeyInput(newLineScanner(input))
+	var scanned uint64
+	for !windowDone(scanned) && scanner.Scan() {
+		scanned++
+		if beforeWindow(scanned) {
+			continue
+		}
+		if validateLines() && !validLine(scanner.Bytes()) {
+			rejectLine(scanner.Bytes())
+			continue
+		}
+		present := set.Has(recordKey(scanner))
+		st.record(!present)
+		switch {
+		case !returnSeen:
+			answer := "\tno"
+			if present {
+				answer = "\tyes"
+			}
+			out.Write([]byte(scanner.Text() + answer + recordEnd()))
+		case present:
+			out.Write([]byte(scanner.Text() + recordEnd()))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		logErrorf("reading input: %v", err)
+		status = 1
+	}
+	if err := out.Close(); err != nil {
+		logErrorf("writing output: %v", err)
+		status = 1
+	}
+	if err := ew.Close(); err != nil {
+		logErrorf("writing output: %v", err)
+		status = 1
+	}
+	if cw != nil {
+		if err := cw.Close(); err != nil {
+			logErrorf("writing output: %v", err)
+			status = 1
+		}
+	}
+	if rejectedLines > 0 {
+		st.Rejected = uint64(rejectedLines)
+		logInfof("Rejected %d invalid lines", rejectedLines)
+	}
+	if showStats {
+		w := os.Stderr
+		if statsToStdout {
+			w = os.Stdout
+		}
+		if err := printSummary(w, summary{Run: &st, Filter: bloomInfo(&bf)}); err != nil {
+			logErrorf("writing stats: %v", err)
+			status = 1
+		}
+	}
+	return status
+}
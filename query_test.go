@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestQueryOnly(t *testing.T) {
+	dir := t.TempDir()
+	mustRun(t, dir, "a\nb\nc\n")
+	state := filepath.Join(dir, "bloom.gz")
+	before, err := os.ReadFile(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	in := "a\nx\nc\nx\ny\n"
+	if got := mustRun(t, dir, in, "-query-only"); got != "a\tyes\nx\tno\nc\tyes\nx\tno\ny\tno\n" {
+		t.Errorf("-query-only: output %q", got)
+	}
+	if got := mustRun(t, dir, in, "-query-only", "-seen"); got != "a\nc\n" {
+		t.Errorf("-query-only -seen: output %q, want the present lines", got)
+	}
+	// Queries never add: x is still absent, and the state is untouched.
+	if got := mustRun(t, dir, "x\n", "-query-only"); got != "x\tno\n" {
+		t.Errorf("x after querying it: %q, want still absent", got)
+	}
+	if after, _ := os.ReadFile(state); !bytes.Equal(before, after) {
+		t.Error("-query-only changed the state file")
+	}
+
+	if res := runBdedup(t, t.TempDir(), in, "-query-only"); res.code != 1 || res.stdout != "" {
+		t.Errorf("-query-only without a state file: exit status %d, output %q; want 1 and no output", res.code, res.stdout)
+	}
+	if res := runBdedup(t, dir, in, "-query-only", "-exact"); res.code != 2 {
+		t.Errorf("-query-only -exact exited %d, want 2", res.code)
+	}
+}
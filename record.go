@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"strconv"
+)
+
+// recordDelimiter separates input records under -record-delimiter; empty
+// means records are lines.
+var recordDelimiter string
+
+// parseRecordDelimiter parses -record-delimiter, which takes Go escapes such
+// as \n and \t so that "\n\n" can be given on a command line.
+func parseRecordDelimiter(s string) error {
+	d, err := strconv.Unquote(`"` + s + `"`)
+	if err != nil {
+		return errors.New("invalid escape in record delimiter")
+	}
+	if d == "" {
+		return errors.New("record delimiter must not be empty")
+	}
+	recordDelimiter = d
+	return nil
+}
+
+// recordEnd returns what is written after each output record: the record
+// delimiter, or a newline for lines.
+func recordEnd() string {
+	if recordDelimiter != "" {
+		return recordDelimiter
+	}
+	return "\n"
+}
+
+// splitRecords returns a bufio.SplitFunc yielding the records between
+// occurrences of delim. Empty records, as a delimiter repeated back to back
+// leaves, are skipped. The last record needs no delimiter after it; a line
+// ending left at the end of the input is not part of it, so a file that ends
+// in a newline rather than a full delimiter keeps its last key intact.
+func splitRecords(delim []byte) bufio.SplitFunc {
+	return func(data []byte, atEOF bool) (int, []byte, error) {
+		if i := bytes.Index(data, delim); i >= 0 {
+			if i == 0 {
+				return len(delim), nil, nil
+			}
+			return i + len(delim), data[:i], nil
+		}
+		if !atEOF {
+			return 0, nil, nil
+		}
+		last := bytes.TrimSuffix(bytes.TrimSuffix(data, []byte("\n")), []byte("\r"))
+		if len(last) == 0 {
+			return len(data), nil, nil
+		}
+		return len(data), last, nil
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bufio"
+	"slices"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestParagraphRecords(t *testing.T) {
+	in := "From: a\nhello\n\nFrom: b\nbye\n\nFrom: a\nhello\n\n\n\nFrom: a\nhello again\n\nFrom: b\nbye\n"
+	want := "From: a\nhello\n\nFrom: b\nbye\n\nFrom: a\nhello again\n\n"
+	for _, c := range []string{"1", "4"} {
+		if got := mustRun(t, t.TempDir(), in, "-record-delimiter", `\n\n`, "-concurrency", c); got != want {
+			t.Errorf("-concurrency %s: output %q, want %q", c, got, want)
+		}
+	}
+
+	// A final record without a delimiter, or with only a line ending,
+	// matches the same record followed by one.
+	for _, last := range []string{"From: b\nbye", "From: b\nbye\n", "From: b\nbye\r\n"} {
+		got := mustRun(t, t.TempDir(), "From: b\nbye\n\n"+last, "-record-delimiter", `\n\n`)
+		if got != "From: b\nbye\n\n" {
+			t.Errorf("final record %q: output %q, want it taken as a duplicate", last, got)
+		}
+	}
+	if got := mustRun(t, t.TempDir(), "x\n\ny", "-record-delimiter", `\n\n`); got != "x\n\ny\n\n" {
+		t.Errorf("new final record: output %q, want it with the delimiter restored", got)
+	}
+
+	for _, bad := range []string{"", `\q`} {
+		if res := runBdedup(t, t.TempDir(), "", "-record-delimiter", bad); res.code != 2 {
+			t.Errorf("-record-delimiter %q exited %d, want 2", bad, res.code)
+		}
+	}
+}
+
+func TestSplitRecordsAcrossReads(t *testing.T) {
+	in := "a1\na2;;b;;;;c\n"
+	// One byte per read, so delimiters straddle reads.
+	s := bufio.NewScanner(iotest.OneByteReader(strings.NewReader(in)))
+	s.Split(splitRecords([]byte(";;")))
+	var got []string
+	for s.Scan() {
+		got = append(got, s.Text())
+	}
+	if err := s.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a1\na2", "b", "c"}; !slices.Equal(got, want) {
+		t.Errorf("records %q, want %q", got, want)
+	}
+}
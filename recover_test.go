@@ -0,0 +1,47 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRecoverState(t *testing.T) {
+	const n = 5000
+	input := numbered("key-", n)
+	dir := t.TempDir()
+	mustRun(t, dir, input, "-n", "10000")
+	path := filepath.Join(dir, "bloom.gz")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data[:len(data)*97/100], 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if res := runBdedup(t, dir, input, "-seen"); res.code == 0 {
+		t.Fatal("truncated state file loaded without -recover-state")
+	}
+	res := runBdedup(t, dir, input, "-seen", "-recover-state")
+	if res.code != 0 {
+		t.Fatalf("-recover-state: exit status %d: %s", res.code, res.stderr)
+	}
+	// With 7 hash locations, a key survives the loss of 3% of the bitset
+	// about 0.97^7 = 81% of the time.
+	if seen := lineCount(res.stdout); seen < n/2 || seen == n {
+		t.Errorf("%d of %d keys still seen after recovery, want most but not all", seen, n)
+	}
+	if res.stderr == "" {
+		t.Error("recovery logged nothing")
+	}
+
+	// The recovered filter, with the run's keys added back, is saved whole.
+	bf := loadState(t, path)
+	if seen := mustRun(t, dir, input, "-seen"); lineCount(seen) != n {
+		t.Errorf("after recovery: %d of %d keys seen, want all", lineCount(seen), n)
+	}
+	if bf.ElemNum == 0 {
+		t.Error("recovered state saved empty")
+	}
+}
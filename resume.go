@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/mylh/bdedup/bbloom"
+)
+
+// checkpoints writes -resume checkpoints while the input is processed.
+var checkpoints *checkpointer
+
+// checkpointMagic starts every checkpoint file.
+var checkpointMagic = [8]byte{'b', 'd', 'e', 'd', 'c', 'k', 'p', '2'}
+
+// resumePoint is where an interrupted run stopped: the input offset just past
+// the last line it processed and the length of the output it had written.
+// inputSize and inputModTime, in Unix nanoseconds, identify the input file
+// the offset belongs to.
+type resumePoint struct {
+	input        int64
+	output       int64
+	inputSize    int64
+	inputModTime int64
+}
+
+// checkpointPath returns the checkpoint file kept next to the state file.
+func checkpointPath() string {
+	return stateFile + ".resume"
+}
+
+// checkpointer periodically saves the filter together with the resumePoint
+// it corresponds to. Both go into one file that replaces the previous one
+// with a rename, so a checkpoint never pairs a filter with an offset from a
+// different moment.
+type checkpointer struct {
+	path string
+	bf   *bbloom.Bloom
+	// records queues the output lines on their way to out.
+	records *recordWriter
+	out     *flushWriter
+	file    *os.File // output file, or nil for stdout
+	base    int64    // input offset the scan started at
+	every   int
+	lines   int
+	err     error
+	// inputSize and inputModTime are saved with every checkpoint.
+	inputSize    int64
+	inputModTime int64
+}
+
+// stamp records the size and modification time of the input file, which a
+// resumed run must find unchanged.
+func (c *checkpointer) stamp(file *os.File) {
+	info, err := file.Stat()
+	if err != nil {
+		logErrorf("resuming input: %v", err)
+		os.Exit(1)
+	}
+	c.inputSize, c.inputModTime = info.Size(), info.ModTime().UnixNano()
+}
+
+// lineDone records that the input up to consumed bytes past base has been
+// processed, writing a checkpoint every -checkpoint-every lines. After a
+// failure it stops checkpointing and keeps the error for run to report.
+func (c *checkpointer) lineDone(consumed int64) {
+	c.lines++
+	if c.err != nil || c.lines%c.every != 0 {
+		return
+	}
+	c.err = c.save(resumePoint{input: c.base + consumed, inputSize: c.inputSize, inputModTime: c.inputModTime})
+}
+
+func (c *checkpointer) save(pt resumePoint) error {
+	// The output must be durable up to pt before the checkpoint claims it.
+	if err := c.records.drain(); err != nil {
+		return err
+	}
+	if err := c.out.Flush(); err != nil {
+		return err
+	}
+	if c.file != nil {
+		if err := c.file.Sync(); err != nil {
+			return err
+		}
+		var err error
+		if pt.output, err = c.file.Seek(0, io.SeekCurrent); err != nil {
+			return err
+		}
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(c.path), filepath.Base(c.path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	err = binary.Write(w, binary.LittleEndian, checkpointMagic)
+	if err == nil {
+		err = binary.Write(w, binary.LittleEndian, [4]int64{pt.input, pt.output, pt.inputSize, pt.inputModTime})
+	}
+	if err == nil {
+		err = c.bf.BinaryMarshal(w)
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), c.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// loadCheckpoint reads the checkpoint at path. It returns false if there is
+// none, so the run starts from the beginning.
+func loadCheckpoint(path string) (bbloom.Bloom, resumePoint, bool) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return bbloom.Bloom{}, resumePoint{}, false
+	}
+	if err != nil {
+		logErrorf("opening checkpoint: %v", err)
+		os.Exit(1)
+	}
+	defer file.Close()
+
+	r := bufio.NewReader(file)
+	var magic [8]byte
+	var offsets [4]int64
+	err = binary.Read(r, binary.LittleEndian, &magic)
+	if err == nil && magic != checkpointMagic {
+		err = errors.New("not a checkpoint file")
+	}
+	if err == nil {
+		err = binary.Read(r, binary.LittleEndian, &offsets)
+	}
+	var bf bbloom.Bloom
+	if err == nil {
+		bf, err = bbloom.BinaryUnmarshal(r)
+	}
+	if err != nil {
+		logErrorf("reading checkpoint %s: %v", path, err)
+		os.Exit(1)
+	}
+	applySipKey(&bf)
+	return bf, resumePoint{input: offsets[0], output: offsets[1], inputSize: offsets[2], inputModTime: offsets[3]}, true
+}
+
+// checkResumeFlags rejects the flags -resume cannot be combined with: it
+// needs to seek the input and truncate the output, and a Bloom filter it can
+// snapshot.
+func checkResumeFlags() {
+	var conflict string
+	switch {
+	case inputFile == "":
+		logErrorf("-resume requires a seekable -input file")
+		os.Exit(2)
+	case checkpointEvery < 1:
+		logErrorf("-checkpoint-every must be at least 1")
+		os.Exit(2)
+	case exact:
+		conflict = "-exact"
+	case reverse:
+		conflict = "-reverse"
+	case withCounts:
+		conflict = "-with-counts"
+	case outputCompress != "none":
+		conflict = "-output-compress"
+	case noTrailingNewline:
+		// The held last line end is missing from the output offset a
+		// checkpoint records, so a resumed run would join two lines.
+		conflict = "-no-trailing-newline"
+	case dupLinesFile != "":
+		// A resumed run would recreate the file and number lines from the
+		// checkpoint.
+		conflict = "-dup-lines"
+	case deltaFile != "":
+		// Recreated on resuming, it would lose the keys added before the
+		// checkpoint, though the state keeps them.
+		conflict = "-delta-output"
+	case rejectOutput != "":
+		// Recreated on resuming, it would lose the lines rejected before
+		// the checkpoint.
+		conflict = "-reject-output"
+	}
+	if conflict != "" {
+		logErrorf("-resume cannot be combined with %s", conflict)
+		os.Exit(2)
+	}
+}
+
+// seekInput positions the input file at the resume offset, after checking
+// that it is the file the checkpoint was written for.
+func seekInput(file *os.File, from resumePoint) {
+	info, err := file.Stat()
+	if err == nil && (info.Size() != from.inputSize || info.ModTime().UnixNano() != from.inputModTime) {
+		err = fmt.Errorf("input changed since the interrupted run (its size or modification time differ); remove %s to start over", checkpointPath())
+	}
+	if err == nil {
+		_, err = file.Seek(from.input, io.SeekStart)
+	}
+	if err != nil {
+		logErrorf("resuming input: %v", err)
+		os.Exit(1)
+	}
+}
+
+// openResumedOutput opens the output file cut back to the length it had at
+// the checkpoint, dropping lines written after it, which are written again.
+func openResumedOutput(path string, size int64) *os.File {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0o666)
+	if err == nil {
+		err = file.Truncate(size)
+		if err == nil {
+			_, err = file.Seek(size, io.SeekStart)
+		}
+		if err != nil {
+			file.Close()
+		}
+	}
+	if err != nil {
+		logErrorf("resuming output file: %v", err)
+		os.Exit(1)
+	}
+	return file
+}
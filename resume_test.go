@@ -0,0 +1,119 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// interruptedRun starts a -resume run over input and kills it once it has
+// written a checkpoint, as a crash would.
+func interruptedRun(t *testing.T, dir string, args ...string) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "BDEDUP_TEST_MAIN=1")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	for {
+		select {
+		case err := <-done:
+			t.Fatalf("run ended (%v) before it could be interrupted; make the input larger", err)
+		case <-time.After(time.Millisecond):
+		}
+		if _, err := os.Stat(filepath.Join(dir, "state.gz.resume")); err == nil {
+			cmd.Process.Kill()
+			<-done
+			return
+		}
+	}
+}
+
+func TestResumeAfterRestart(t *testing.T) {
+	dir := t.TempDir()
+	input, want := syntheticStream(300000, 100000)
+	writeFile(t, dir, "in.txt", input)
+	args := []string{"-input", "in.txt", "-output", "out.txt", "-state", "state.gz", "-resume", "-checkpoint-every", "1000", "-n", "200000"}
+	interruptedRun(t, dir, args...)
+	partial, _ := os.ReadFile(filepath.Join(dir, "out.txt"))
+	if len(partial) >= len(want) {
+		t.Fatalf("interrupted run wrote %d of %d output bytes", len(partial), len(want))
+	}
+
+	res := runBdedup(t, dir, "", args...)
+	if res.code != 0 {
+		t.Fatalf("resumed run: exit status %d\n%s", res.code, res.stderr)
+	}
+	got, _ := os.ReadFile(filepath.Join(dir, "out.txt"))
+	// Compare with an uninterrupted run, false positives included.
+	plain := mustRun(t, dir, input, "-state", "plain.gz", "-n", "200000")
+	if string(got) != plain {
+		t.Errorf("resumed output has %d lines, an uninterrupted run %d", lineCount(string(got)), lineCount(plain))
+	}
+	if _, err := os.Stat(filepath.Join(dir, "state.gz.resume")); !os.IsNotExist(err) {
+		t.Errorf("checkpoint left behind after the run finished: %v", err)
+	}
+}
+
+func TestResumeRefusesChangedInput(t *testing.T) {
+	dir := t.TempDir()
+	input, _ := syntheticStream(300000, 100000)
+	path := writeFile(t, dir, "in.txt", input)
+	args := []string{"-input", "in.txt", "-output", "out.txt", "-state", "state.gz", "-resume", "-checkpoint-every", "1000", "-n", "200000"}
+	interruptedRun(t, dir, args...)
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("appended\n")
+	f.Close()
+	res := runBdedup(t, dir, "", args...)
+	if res.code != 1 || !strings.Contains(res.stderr, "input changed") {
+		t.Errorf("resume on a changed input: exit status %d, %q; want 1 and an input changed error", res.code, res.stderr)
+	}
+}
+
+func TestResumeRemovesCheckpointOnExitOnDup(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "in.txt", "a\nb\na\n")
+	res := runBdedup(t, dir, "", "-input", "in.txt", "-output", "out.txt", "-state", "state.gz", "-resume", "-checkpoint-every", "1", "-exit-on-dup")
+	if res.code != 1 {
+		t.Fatalf("exit status %d, want 1 for the duplicate", res.code)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "state.gz.resume")); !os.IsNotExist(err) {
+		t.Errorf("checkpoint left behind after -exit-on-dup: %v", err)
+	}
+}
+
+func TestResumeRejectsNoTrailingNewline(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "in.txt", "a\nb")
+	res := runBdedup(t, dir, "", "-input", "in.txt", "-output", "out.txt", "-state", "state.gz", "-resume", "-no-trailing-newline")
+	if res.code != 2 || !strings.Contains(res.stderr, "-no-trailing-newline") {
+		t.Errorf("exit status %d, %q; want 2 and the conflicting flag named", res.code, res.stderr)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "out.txt")); !os.IsNotExist(err) {
+		t.Errorf("output written before the flags were checked: %v", err)
+	}
+}
+
+func TestResumeRejectsSideOutputs(t *testing.T) {
+	for _, flag := range []string{"-dup-lines", "-delta-output", "-reject-output"} {
+		dir := t.TempDir()
+		writeFile(t, dir, "in.txt", "a\nb\na\n")
+		res := runBdedup(t, dir, "", "-input", "in.txt", "-output", "out.txt", "-state", "state.gz", "-resume", flag, "side.txt")
+		if res.code != 2 || !strings.Contains(res.stderr, flag) {
+			t.Errorf("-resume %s: exit status %d, %q; want 2 and the conflicting flag named", flag, res.code, res.stderr)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "side.txt")); !os.IsNotExist(err) {
+			t.Errorf("-resume %s: side output created before the flags were checked: %v", flag, err)
+		}
+	}
+}
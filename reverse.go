@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+)
+
+// reverseBlockSize is how much of the file reverseReader reads per step.
+const reverseBlockSize = 64 << 10
+
+// reverseInput returns a reader yielding the lines of input last line first.
+// Regular files are read backwards in blocks, so memory is bounded by the
+// longest line; any other input (a pipe, a terminal) has to be read into
+// memory in full first.
+func reverseInput(input io.Reader) (io.Reader, error) {
+	if f, ok := input.(*os.File); ok {
+		if st, err := f.Stat(); err == nil && st.Mode().IsRegular() {
+			return &reverseReader{r: f, off: st.Size()}, nil
+		}
+	}
+	data, err := io.ReadAll(input)
+	if err != nil {
+		return nil, err
+	}
+	return &reverseReader{r: bytes.NewReader(data), off: int64(len(data))}, nil
+}
+
+// reverseReader reads the lines of r before off in reverse order, each
+// terminated by a newline.
+type reverseReader struct {
+	r       io.ReaderAt
+	off     int64  // start of the part of r not read yet
+	tail    []byte // partial line read from just after off
+	out     []byte // reversed lines ready to be returned
+	started bool
+}
+
+func (rr *reverseReader) Read(p []byte) (int, error) {
+	for len(rr.out) == 0 {
+		if rr.off == 0 {
+			if !rr.started || rr.tail == nil {
+				return 0, io.EOF
+			}
+			// The first line of the input comes out last, so its byte
+			// order mark would not be at the start of the output.
+			rr.out = append(bytes.TrimPrefix(rr.tail, utf8BOM), '\n')
+			rr.tail = nil
+			break
+		}
+		if err := rr.readBlock(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, rr.out)
+	rr.out = rr.out[n:]
+	return n, nil
+}
+
+// readBlock reads the block before off and queues every line it completes.
+func (rr *reverseReader) readBlock() error {
+	n := min(int64(reverseBlockSize), rr.off)
+	block := make([]byte, n, n+int64(len(rr.tail)))
+	if _, err := rr.r.ReadAt(block, rr.off-n); err != nil && err != io.EOF {
+		return err
+	}
+	rr.off -= n
+	data := append(block, rr.tail...)
+	if !rr.started {
+		// The final newline terminates the last line rather than starting
+		// an empty one.
+		data = bytes.TrimSuffix(data, []byte("\n"))
+		rr.started = true
+	}
+
+	// Everything after the first newline is complete lines; what precedes
+	// it may continue in the previous block unless this is the file start.
+	first := bytes.IndexByte(data, '\n')
+	if first < 0 {
+		rr.tail = data
+		return nil
+	}
+	rr.tail = data[:first:first]
+	rest := data[first+1:]
+	for {
+		i := bytes.LastIndexByte(rest, '\n')
+		rr.out = append(append(rr.out, rest[i+1:]...), '\n')
+		if i < 0 {
+			break
+		}
+		rest = rest[:i]
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestReverseKeepsLastOccurrence(t *testing.T) {
+	in := "k1\tfirst\nk2\tonly\nk1\tlast\nk3\tx\n"
+	// Lines come out last first.
+	want := "k3\tx\nk1\tlast\nk2\tonly\n"
+	dir := t.TempDir()
+	path := writeFile(t, dir, "in.tsv", in)
+	if got := mustRun(t, dir, "", "-reverse", "-field", "1", "-input", path, "-state", "file.gz"); got != want {
+		t.Errorf("file input: output %q, want %q", got, want)
+	}
+	if got := mustRun(t, dir, in, "-reverse", "-field", "1", "-state", "stdin.gz"); got != want {
+		t.Errorf("piped input: output %q, want %q", got, want)
+	}
+}
+
+func TestReverseAcrossBlocks(t *testing.T) {
+	// Enough lines to be read back in several blocks, each key twice.
+	var in, want strings.Builder
+	const n = 20000
+	for i := range n {
+		fmt.Fprintf(&in, "%d\tfirst\n", i)
+	}
+	for i := range n {
+		fmt.Fprintf(&in, "%d\tlast\n", i)
+	}
+	for i := n - 1; i >= 0; i-- {
+		fmt.Fprintf(&want, "%d\tlast\n", i)
+	}
+	if in.Len() < 4*reverseBlockSize {
+		t.Fatalf("input of %d bytes fits in few blocks", in.Len())
+	}
+	dir := t.TempDir()
+	path := writeFile(t, dir, "in.tsv", in.String())
+	if got := mustRun(t, dir, "", "-reverse", "-field", "1", "-input", path); got != want.String() {
+		t.Errorf("output differs from the last occurrences in reverse order")
+	}
+}
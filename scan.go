@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+)
+
+// maxLineSize is the longest line the scanners accept. A longer line is a
+// bad record: it fails the scan, or is skipped under -skip-errors.
+const maxLineSize = bufio.MaxScanTokenSize
+
+// defaultReadBuffer is the default -read-buffer. Reading in chunks this
+// large takes a fraction of the system calls of the 4 KiB reads the
+// scanners make on their own, which shows on large files and pipes.
+const defaultReadBuffer = 256 << 10
+
+// maxReadBuffer bounds -read-buffer. Beyond a few MiB larger reads gain
+// nothing, so this leaves room to experiment without letting a typo
+// allocate gigabytes.
+const maxReadBuffer = 64 << 20
+
+// readBuffer is the size of the reads the input is taken in, independent
+// of maxLineSize, which only bounds the records. 0 leaves the reads to the
+// scanners.
+var readBuffer = byteSize(defaultReadBuffer)
+
+// readBuffered returns r read through a -read-buffer sized buffer, or r
+// itself if -read-buffer is 0. Reads of a pipe still return as soon as
+// data arrives, so streaming input is not held back to fill the buffer.
+func readBuffered(r io.Reader) io.Reader {
+	if readBuffer == 0 {
+		return r
+	}
+	return bufio.NewReaderSize(r, int(readBuffer))
+}
+
+// skippedRecords counts the bad records dropped under -skip-errors. It is
+// only updated by the goroutine scanning the input and read once the scan
+// has finished.
+var skippedRecords int
+
+// lastRecordTerminated reports whether the last record scanned, by any
+// scanner, was followed by a line ending (or record delimiter) rather than
+// the end of the input.
+var lastRecordTerminated bool
+
+// utf8BOM is the byte order mark some tools, spreadsheets in particular,
+// put at the start of UTF-8 files. The scanners drop it from the first
+// record, where it would otherwise make that record's key differ.
+var utf8BOM = []byte("\xef\xbb\xbf")
+
+// recordScanner yields the input records one at a time: lines, the records
+// between -record-delimiter, or CSV records under -input-format csv. *bufio.Scanner is one.
+type recordScanner interface {
+	Scan() bool
+	Bytes() []byte
+	Text() string
+	Err() error
+}
+
+// newLineScanner returns a record scanner over r. With -skip-errors it drops
+// bad records, logging and counting each, instead of stopping at the first.
+func newLineScanner(r io.Reader) recordScanner {
+	return newOffsetScanner(r, nil)
+}
+
+// newOffsetScanner is newLineScanner that also keeps *consumed, if not nil,
+// at the number of bytes of r that the records scanned so far took up,
+// including their line endings and any byte order mark.
+func newOffsetScanner(r io.Reader, consumed *int64) recordScanner {
+	if csvInput() {
+		return newCSVScanner(r, consumed)
+	}
+	scanner := bufio.NewScanner(readBuffered(r))
+	scanner.Buffer(nil, maxLineSize)
+	split := bufio.ScanLines
+	switch {
+	case recordDelimiter != "":
+		split = splitRecords([]byte(recordDelimiter))
+	case skipErrors:
+		ls := &lineSplitter{}
+		split = ls.split
+	}
+	first, inner, end := true, split, []byte(recordEnd())
+	split = func(data []byte, atEOF bool) (int, []byte, error) {
+		advance, token, err := inner(data, atEOF)
+		if token != nil {
+			lastRecordTerminated = bytes.HasSuffix(data[:advance], end)
+		}
+		if first && token != nil {
+			first = false
+			token = bytes.TrimPrefix(token, utf8BOM)
+		}
+		return advance, token, err
+	}
+	if consumed != nil {
+		inner := split
+		split = func(data []byte, atEOF bool) (int, []byte, error) {
+			advance, token, err := inner(data, atEOF)
+			*consumed += int64(advance)
+			return advance, token, err
+		}
+	}
+	scanner.Split(split)
+	return scanner
+}
+
+// lineSplitter is bufio.ScanLines, except that a line that cannot fit in
+// the scanner's buffer is discarded up to its newline rather than ending the
+// scan with bufio.ErrTooLong.
+type lineSplitter struct {
+	line       int
+	discarding bool
+}
+
+func (ls *lineSplitter) split(data []byte, atEOF bool) (int, []byte, error) {
+	if ls.discarding {
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			ls.discarding = false
+			return i + 1, nil, nil
+		}
+		return len(data), nil, nil
+	}
+	advance, token, err := bufio.ScanLines(data, atEOF)
+	if advance == 0 && token == nil && len(data) >= maxLineSize {
+		ls.line++
+		ls.discarding = true
+		skippedRecords++
+		logWarnf("skipping line %d: longer than %d bytes", ls.line, maxLineSize)
+		return len(data), nil, nil
+	}
+	if token != nil {
+		ls.line++
+	}
+	return advance, token, err
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestCRLFAndLFLinesDedup(t *testing.T) {
+	in := "a\r\nb\na\nb\r\nc\r\n"
+	for _, args := range [][]string{
+		{"-concurrency", "1"},
+		{"-concurrency", "4"},
+	} {
+		got := mustRun(t, t.TempDir(), in, args...)
+		if got != "a\nb\nc\n" {
+			t.Errorf("%v: output %q, want each line once with LF endings", args, got)
+		}
+	}
+}
+
+func TestSkipErrors(t *testing.T) {
+	dir := t.TempDir()
+	in := "a\n" + strings.Repeat("x", maxLineSize+10) + "\nb\na\nc\n"
+	res := runBdedup(t, dir, in, "-state", "strict.gz")
+	if res.code != 1 {
+		t.Errorf("overlong line without -skip-errors: exit status %d, want 1", res.code)
+	}
+	res = runBdedup(t, dir, in, "-skip-errors", "-state", "skip.gz")
+	if res.code != 0 || res.stdout != "a\nb\nc\n" {
+		t.Fatalf("-skip-errors: exit status %d, output %q; want 0 and the other lines deduplicated", res.code, res.stdout)
+	}
+	if !strings.Contains(res.stderr, "Skipped 1 bad records") {
+		t.Errorf("-skip-errors logged %q, want the skipped count", res.stderr)
+	}
+
+	// A malformed CSV record is skipped without losing the rest.
+	csv := "a,1\n\"b,2\nc,\"3\"x\nd,4\na,1\n"
+	res = runBdedup(t, dir, csv, "-skip-errors", "-input-format", "csv", "-state", "csv.gz")
+	if res.code != 0 || res.stdout != "a,1\nd,4\n" {
+		t.Errorf("-skip-errors on CSV: exit status %d, output %q; want 0 and the good records", res.code, res.stdout)
+	}
+}
+
+func TestBOMAndTrailingDelimiters(t *testing.T) {
+	in := "\ufeffa\tx\nb\tx\t\t\na\tx\nb\tx\n\ufeffc\n"
+	for _, c := range []string{"1", "4"} {
+		// Only the first line's BOM is a byte order mark.
+		got := mustRun(t, t.TempDir(), in, "-concurrency", c)
+		if want := "a\tx\nb\tx\t\t\nb\tx\n\ufeffc\n"; got != want {
+			t.Errorf("-concurrency %s: output %q, want %q", c, got, want)
+		}
+		// Padded records match, and are written as they were read.
+		got = mustRun(t, t.TempDir(), in, "-concurrency", c, "-trim-trailing")
+		if want := "a\tx\nb\tx\t\t\n\ufeffc\n"; got != want {
+			t.Errorf("-concurrency %s -trim-trailing: output %q, want %q", c, got, want)
+		}
+	}
+
+	in = "\ufeffid,name,\n1,a,,\n1,a\n2,b\n"
+	got := mustRun(t, t.TempDir(), in, "-field", "1,2", "-delimiter", ",", "-trim-trailing")
+	if want := "id,name,\n1,a,,\n2,b\n"; got != want {
+		t.Errorf("-delimiter , -trim-trailing: output %q, want %q", got, want)
+	}
+}
+
+// countingReader counts the reads made of r.
+type countingReader struct {
+	r     io.Reader
+	reads int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	c.reads++
+	return c.r.Read(p)
+}
+
+// scanAll scans input with a -read-buffer of size and returns the records
+// and the reads it took.
+func scanAll(input string, size byteSize) (records, reads int) {
+	defer func(saved byteSize) { readBuffer = saved }(readBuffer)
+	readBuffer = size
+	cr := &countingReader{r: strings.NewReader(input)}
+	scanner := newLineScanner(cr)
+	for scanner.Scan() {
+		records++
+	}
+	return records, cr.reads
+}
+
+func TestReadBufferCutsReads(t *testing.T) {
+	input := numbered("line-with-some-padding-", 200000)
+	wantRecords, prevReads := scanAll(input, 0)
+	for _, size := range []byteSize{64 << 10, defaultReadBuffer, 1 << 20} {
+		records, reads := scanAll(input, size)
+		if records != wantRecords {
+			t.Errorf("-read-buffer %v: %d records, want %d", size, records, wantRecords)
+		}
+		if reads >= prevReads {
+			t.Errorf("-read-buffer %v: %d reads, want fewer than %d", size, reads, prevReads)
+		}
+		prevReads = reads
+	}
+}
+
+func BenchmarkReadBuffer(b *testing.B) {
+	input := numbered("line-with-some-padding-", 500000)
+	for _, size := range []byteSize{0, 64 << 10, defaultReadBuffer, 1 << 20} {
+		b.Run(fmt.Sprintf("buffer=%d", size), func(b *testing.B) {
+			b.SetBytes(int64(len(input)))
+			var reads int
+			for range b.N {
+				_, reads = scanAll(input, size)
+			}
+			b.ReportMetric(float64(reads), "reads/op")
+		})
+	}
+}
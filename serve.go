@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/mylh/bdedup/bbloom"
+)
+
+// serveMain implements "bdedup serve": it keeps one filter in memory and
+// answers add and membership queries over HTTP, saving the filter
+// periodically and on shutdown.
+func serveMain(args []string) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	var addr string
+	var saveEvery time.Duration
+	fs.StringVar(&stateFile, "state", "bloom.gz", "Bloom filter state file")
+	fs.StringVar(&addr, "addr", "localhost:8080", "Address to listen on")
+	fs.DurationVar(&saveEvery, "save-every", time.Minute, "Save the filter at this interval if it changed (0: only on shutdown)")
+	fs.Float64Var(&numValues, "n", 1000000, "Expected number of values of a new filter")
+	fs.Float64Var(&falsePositive, "p", 0.01, "False positive probability of a new filter")
+	fs.Func("hash", "Hash of a new filter: siphash, murmur3 or xxhash (default: siphash, or the state file's)", parseHash)
+	fs.BoolVar(&noGzip, "no-gzip", false, "Disable gzip compression for state file")
+	registerRetryFlags(fs)
+	registerLogFlags(fs)
+	registerKeyFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), `Serve a Bloom filter over HTTP:
+
+  POST /add        add each line of the body; the response has one line per
+                   input line, "new" or "seen"
+  GET  /has?key=K  report whether the line K has been added, as JSON
+  GET  /stats      run and filter statistics, as JSON
+
+Usage: %[1]s serve [-state bloom.gz] [-addr localhost:8080] [-save-every 1m]
+
+Options:
+`, os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	checkKeyRegexFlags()
+
+	bf := loadBloomFilter(stateFile)
+	checkHash(&bf, "state file "+stateFile)
+	srv := &server{bf: &bf}
+	jsonOutput = true
+	// Request bodies are small and arrive already buffered; a read buffer
+	// per request would only cost an allocation.
+	readBuffer = 0
+
+	httpServer := &http.Server{Addr: addr, Handler: srv.handler()}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		httpServer.Shutdown(shutdownCtx)
+	}()
+	if saveEvery > 0 {
+		go srv.saveEvery(ctx, saveEvery)
+	}
+
+	logInfof("Serving %s on %s", stateFile, addr)
+	err := httpServer.ListenAndServe()
+	status := 0
+	if !errors.Is(err, http.ErrServerClosed) {
+		logErrorf("serving: %v", err)
+		status = 1
+	}
+	if err := srv.save(); err != nil {
+		logErrorf("%v", err)
+		status = 1
+	}
+	os.Exit(status)
+}
+
+// server is the state behind the serve endpoints. The filter is only used
+// through its TS methods, or with its Mtx held.
+type server struct {
+	bf *bbloom.Bloom
+	mu sync.Mutex
+	st runStats
+	// dirty is set by adds of new keys and cleared by saves.
+	dirty bool
+	// saving serializes saves, so an older snapshot never replaces a newer
+	// one.
+	saving sync.Mutex
+}
+
+func (s *server) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /add", s.handleAdd)
+	mux.HandleFunc("GET /has", s.handleHas)
+	mux.HandleFunc("GET /stats", s.handleStats)
+	return mux
+}
+
+func (s *server) handleAdd(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	out := bufio.NewWriter(w)
+	scanner := newLineScanner(r.Body)
+	for scanner.Scan() {
+		added := s.bf.AddIfNotHasTS(dedupKey(scanner.Bytes()))
+		s.mu.Lock()
+		s.st.record(added)
+		s.dirty = s.dirty || added
+		s.mu.Unlock()
+		if added {
+			out.WriteString("new\n")
+		} else {
+			out.WriteString("seen\n")
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		// Lines before the bad one were added and answered.
+		out.WriteString("error: " + err.Error() + "\n")
+	}
+	out.Flush()
+}
+
+func (s *server) handleHas(w http.ResponseWriter, r *http.Request) {
+	if !r.URL.Query().Has("key") {
+		http.Error(w, "missing key parameter", http.StatusBadRequest)
+		return
+	}
+	present := s.bf.HasTS(dedupKey([]byte(r.URL.Query().Get("key"))))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Present bool `json:"present"`
+	}{present})
+}
+
+func (s *server) handleStats(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	st := s.st
+	s.mu.Unlock()
+	s.bf.Mtx.Lock()
+	info := bloomInfo(s.bf)
+	s.bf.Mtx.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	printSummary(w, summary{Run: &st, Filter: info})
+}
+
+// save writes the filter to the state file if it has new keys. It saves a
+// snapshot, so adds only wait while the bitset is copied, not while it is
+// compressed and written.
+func (s *server) save() error {
+	s.saving.Lock()
+	defer s.saving.Unlock()
+	s.mu.Lock()
+	dirty := s.dirty
+	s.dirty = false
+	s.mu.Unlock()
+	if !dirty {
+		return nil
+	}
+	// Adds between clearing dirty and the snapshot are saved now and again
+	// next time.
+	if err := saveBloomFilter(stateFile, s.bf.SnapshotFilter()); err != nil {
+		s.mu.Lock()
+		s.dirty = true
+		s.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+func (s *server) saveEvery(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.save(); err != nil {
+				logErrorf("%v", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
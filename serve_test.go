@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mylh/bdedup/bbloom"
+)
+
+func TestServeRoundTrip(t *testing.T) {
+	savedState, savedJSON := stateFile, jsonOutput
+	t.Cleanup(func() { stateFile, jsonOutput = savedState, savedJSON })
+	stateFile = filepath.Join(t.TempDir(), "served.gz")
+	jsonOutput = true
+
+	bf := bbloom.New(10000, 0.001)
+	srv := &server{bf: &bf}
+	ts := httptest.NewServer(srv.handler())
+	defer ts.Close()
+
+	get := func(path string) string {
+		t.Helper()
+		resp, err := http.Get(ts.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("GET %s: %s: %s", path, resp.Status, body)
+		}
+		return string(body)
+	}
+	has := func(key string) bool {
+		t.Helper()
+		var got struct{ Present bool }
+		if err := json.Unmarshal([]byte(get("/has?key="+url.QueryEscape(key))), &got); err != nil {
+			t.Fatal(err)
+		}
+		return got.Present
+	}
+
+	if has("a") {
+		t.Fatal("a present before it was added")
+	}
+	resp, err := http.Post(ts.URL+"/add", "text/plain", strings.NewReader("a\nb\na\nc d\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if want := "new\nnew\nseen\nnew\n"; string(body) != want {
+		t.Errorf("POST /add answered %q, want %q", body, want)
+	}
+	for _, key := range []string{"a", "b", "c d"} {
+		if !has(key) {
+			t.Errorf("%q missing after it was added", key)
+		}
+	}
+	if has("d") {
+		t.Error("d present but never added")
+	}
+
+	resp, err = http.Get(ts.URL + "/has")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("GET /has without a key: %s, want 400", resp.Status)
+	}
+
+	var st struct {
+		Run struct {
+			Lines  int `json:"lines"`
+			Unique int `json:"unique"`
+		}
+		Filter map[string]any
+	}
+	if err := json.Unmarshal([]byte(get("/stats")), &st); err != nil {
+		t.Fatal(err)
+	}
+	if st.Run.Lines != 4 || st.Run.Unique != 3 {
+		t.Errorf("stats count %d lines and %d unique, want 4 and 3", st.Run.Lines, st.Run.Unique)
+	}
+	if len(st.Filter) == 0 {
+		t.Error("stats have no filter section")
+	}
+
+	// Only a changed filter is saved, and the saved one holds the adds.
+	if err := srv.save(); err != nil {
+		t.Fatal(err)
+	}
+	saved := loadState(t, stateFile)
+	if !saved.Has([]byte("c d")) {
+		t.Error("saved filter is missing an added key")
+	}
+	os.Remove(stateFile)
+	if err := srv.save(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(stateFile); !os.IsNotExist(err) {
+		t.Errorf("unchanged filter was saved again: %v", err)
+	}
+}
+
+func TestFileStoreReplacesOnClose(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "state.gz")
+	if err := os.WriteFile(path, []byte("old"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	w, err := fileStore(path).Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(w, "new")
+	if data, _ := os.ReadFile(path); string(data) != "old" {
+		t.Errorf("state is %q before Close, want the old one", data)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "new" {
+		t.Errorf("state is %q after Close, want the new one", data)
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0o644 {
+		t.Errorf("state file mode %v, %v; want 0644", fi.Mode(), err)
+	}
+
+	// A failed write leaves the previous state in place.
+	w, err = fileStore(path).Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rf := w.(*replacingFile)
+	io.WriteString(w, "partial")
+	rf.File.Close()
+	if _, err := w.Write([]byte("more")); err == nil {
+		t.Fatal("write to a closed file succeeded")
+	}
+	w.Close()
+	if data, _ := os.ReadFile(path); string(data) != "new" {
+		t.Errorf("state is %q after a failed write, want it untouched", data)
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Errorf("%d files left in the state directory, want no temporary ones", len(entries))
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mylh/bdedup/bbloom"
+)
+
+var (
+	shardField int
+	shardCount int
+)
+
+// maxShards bounds -shard-count, so the shard fits in the one byte
+// shardKey puts in front of the key.
+const maxShards = 256
+
+// shards is the filter under -shard-field, or nil.
+var shards *shardedSet
+
+// checkShardFlags exits if -shard-field and -shard-count are not given
+// together, or are combined with options that need a single filter or
+// derive keys without the line they route on.
+func checkShardFlags() {
+	if shardField == 0 {
+		logErrorf("-shard-count requires -shard-field")
+		os.Exit(2)
+	}
+	if shardCount < 1 || shardCount > maxShards {
+		logErrorf("-shard-field needs -shard-count between 1 and %d", maxShards)
+		os.Exit(2)
+	}
+	var conflict string
+	switch {
+	case exact:
+		conflict = "-exact"
+	case adjacent:
+		conflict = "-adjacent"
+	case baseFile != "":
+		conflict = "-base"
+	case shingleSize > 0:
+		conflict = "-shingle"
+	case preHashed:
+		conflict = "-pre-hashed"
+	case parallelHash:
+		conflict = "-parallel-hash"
+	case twoPass:
+		conflict = "-two-pass"
+	case queryOnly:
+		conflict = "-query-only"
+	case resume:
+		conflict = "-resume"
+	case walFile != "":
+		conflict = "-wal"
+	case growAt != 0:
+		conflict = "-grow-at"
+	case seedFile != "":
+		conflict = "-seed-file"
+	}
+	if conflict != "" {
+		logErrorf("-shard-field cannot be combined with %s", conflict)
+		os.Exit(2)
+	}
+}
+
+// shardPath returns the state file of shard i: path with the shard number
+// before its extension, so bloom.gz becomes bloom.0.gz, bloom.1.gz, ...
+func shardPath(path string, i int) string {
+	ext := filepath.Ext(path)
+	return fmt.Sprintf("%s.%d%s", strings.TrimSuffix(path, ext), i, ext)
+}
+
+// shardedSet is the filter under -shard-field: one Bloom filter per shard,
+// each loaded from and saved to its own state file. A line's shard is
+// SipHash of its -shard-field value modulo -shard-count, so one value, a
+// tenant say, always lands in the same shard and never suppresses another
+// shard's lines. shardKey tags each key with its shard; the filters hold the
+// keys without the tag but behind the value, so a shard file can be used on
+// its own later with -namespace set to the value and the delimiter.
+type shardedSet struct {
+	filters []*bbloom.Bloom
+	// loaded is each filter's ElemNum when it was read, so that only shards
+	// that gained keys are saved.
+	loaded []uint64
+}
+
+// loadShards reads or creates the -shard-count filters of path.
+func loadShards(path string, k int) *shardedSet {
+	s := &shardedSet{}
+	for i := range k {
+		p := shardPath(path, i)
+		bf := loadBloomFilter(p)
+		checkHash(&bf, "state file "+p)
+		s.filters = append(s.filters, &bf)
+		s.loaded = append(s.loaded, bf.ElemNum)
+	}
+	return s
+}
+
+// save writes every shard that gained keys to its state file, returning
+// the first error.
+func (s *shardedSet) save(path string) error {
+	var first error
+	for i, bf := range s.filters {
+		if bf.ElemNum == s.loaded[i] {
+			continue
+		}
+		if err := saveBloomFilter(shardPath(path, i), *bf); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// shardKey returns key behind the -shard-field value of line and the
+// delimiter, so that lines with different values never share a key even in
+// one shard, and all of it behind a byte naming the shard.
+func shardKey(line, key []byte) []byte {
+	var value []byte
+	if fields := splitFields(line); shardField <= len(fields) {
+		value = fields[shardField-1]
+	}
+	i := bbloom.SipHash.Sum64(value) % uint64(shardCount)
+	tagged := make([]byte, 0, 1+len(value)+len(delimiter())+len(key))
+	tagged = append(append(append(tagged, byte(i)), value...), delimiter()...)
+	return append(tagged, key...)
+}
+
+// route returns the filter a tagged key belongs to, and the key without
+// the tag.
+func (s *shardedSet) route(key []byte) (*bbloom.Bloom, []byte) {
+	return s.filters[key[0]], key[1:]
+}
+
+func (s *shardedSet) Has(key []byte) bool {
+	bf, key := s.route(key)
+	return bf.Has(key)
+}
+
+func (s *shardedSet) Add(key []byte) {
+	bf, key := s.route(key)
+	bf.Add(key)
+}
+
+func (s *shardedSet) AddIfNotHasTS(key []byte) bool {
+	bf, key := s.route(key)
+	return bf.AddIfNotHasTS(key)
+}
+
+func (s *shardedSet) AddIfNotHasAtomic(key []byte) bool {
+	bf, key := s.route(key)
+	return bf.AddIfNotHasAtomic(key)
+}
+
+// info describes the shards together: their total size and entries, and
+// the fill and false positive rate of the fullest, which bounds the rest.
+func (s *shardedSet) info() *filterInfo {
+	fi := &filterInfo{Kind: "sharded", Shards: len(s.filters), Hash: s.filters[0].HashFunc.String()}
+	for _, bf := range s.filters {
+		m := bf.Metrics()
+		fi.SizeBits += m.SizeBits
+		fi.HashLocs = m.HashLocs
+		fi.Elements += bf.ElemNum
+		fi.FillRatio = max(fi.FillRatio, m.FillRatio)
+		fi.EstimatedFPR = max(fi.EstimatedFPR, m.EstimatedFPR)
+	}
+	return fi
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mylh/bdedup/bbloom"
+)
+
+func TestShardRouting(t *testing.T) {
+	const k = 4
+	dir := t.TempDir()
+	var in, want strings.Builder
+	tenants := []string{"acme", "globex", "initech", "umbrella", "hooli", "stark"}
+	for i := range 50 {
+		for _, tenant := range tenants {
+			fmt.Fprintf(&in, "%s\tevent-%d\n", tenant, i)
+		}
+	}
+	want.WriteString(in.String())
+	// Each line again: duplicates within a tenant are dropped.
+	in.WriteString(in.String())
+	got := mustRun(t, dir, in.String(), "-shard-field", "1", "-shard-count", fmt.Sprint(k))
+	if got != want.String() {
+		t.Errorf("output has %d lines, want the %d first occurrences of each tenant's lines", lineCount(got), lineCount(want.String()))
+	}
+
+	filters := make([]bbloom.Bloom, k)
+	for i := range k {
+		filters[i] = loadState(t, filepath.Join(dir, fmt.Sprintf("bloom.%d.gz", i)))
+	}
+	if _, err := os.Stat(filepath.Join(dir, "bloom.gz")); err == nil {
+		t.Error("unsharded state file written under -shard-field")
+	}
+	used := make(map[uint64]bool)
+	for _, tenant := range tenants {
+		shard := bbloom.SipHash.Sum64([]byte(tenant)) % k
+		used[shard] = true
+		// A shard file holds its keys behind the tenant and the delimiter.
+		key := []byte(tenant + "\t" + tenant + "\tevent-0")
+		for i := range filters {
+			if has := filters[i].Has(key); has != (uint64(i) == shard) {
+				t.Errorf("tenant %s: shard %d has its key: %v, want it only in shard %d", tenant, i, has, shard)
+			}
+		}
+	}
+	if len(used) < 2 {
+		t.Fatalf("all tenants route to one shard; pick tenants that spread")
+	}
+	for i, bf := range filters {
+		if !used[uint64(i)] && bf.ElemNum != 0 {
+			t.Errorf("shard %d holds %d entries but no tenant routes to it", i, bf.ElemNum)
+		}
+	}
+}
+
+func TestShardCrossTenantDuplicates(t *testing.T) {
+	// The same key under different tenants is never suppressed, whether or
+	// not the tenants share a shard.
+	in := "a\tx\nb\tx\nc\tx\na\tx\nb\tx\n"
+	for _, k := range []string{"1", "2", "256"} {
+		got := mustRun(t, t.TempDir(), in, "-shard-field", "1", "-shard-count", k, "-field", "2")
+		if want := "a\tx\nb\tx\nc\tx\n"; got != want {
+			t.Errorf("-shard-count %s: output %q, want %q", k, got, want)
+		}
+	}
+	// Across runs, too.
+	dir := t.TempDir()
+	mustRun(t, dir, "a\tx\n", "-shard-field", "1", "-shard-count", "2", "-field", "2")
+	if got := mustRun(t, dir, "a\tx\nb\tx\n", "-shard-field", "1", "-shard-count", "2", "-field", "2"); got != "b\tx\n" {
+		t.Errorf("second run: output %q, want only the other tenant's line", got)
+	}
+}
+
+func TestShardWithCounts(t *testing.T) {
+	in := "a\tx\nb\tx\na\tx\na\ty\na\tx\n"
+	want := "3\ta\tx\n1\tb\tx\n1\ta\ty\n"
+	got := mustRun(t, t.TempDir(), in, "-shard-field", "1", "-shard-count", "2", "-with-counts")
+	if got != want {
+		t.Errorf("output %q, want %q", got, want)
+	}
+}
+
+func TestShardFlags(t *testing.T) {
+	for _, args := range [][]string{
+		{"-shard-field", "1"},
+		{"-shard-count", "2"},
+		{"-shard-field", "1", "-shard-count", "257"},
+		{"-shard-field", "1", "-shard-count", "2", "-exact"},
+	} {
+		if res := runBdedup(t, t.TempDir(), "a\n", args...); res.code != 2 {
+			t.Errorf("%v: exit status %d, want 2", args, res.code)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import "sync"
+
+var (
+	shingleSize      int
+	shingleThreshold float64
+)
+
+// shingleSet makes a set judge lines by their shingles, the overlapping
+// shingleSize-byte windows of the key, instead of by the whole key. A key
+// counts as present if at least shingleThreshold of its shingles are, so a
+// slightly edited copy of an earlier line is a duplicate too. Adding a key
+// adds all of its shingles.
+type shingleSet struct {
+	set keySet
+	mu  sync.Mutex
+}
+
+// shingles returns the windows of key; a key shorter than a window is its
+// own single shingle. The -namespace dedupKey put in front of key is not
+// windowed but prefixed to every window, so that lines in different
+// namespaces share no shingles.
+func shingles(key []byte) [][]byte {
+	ns, text := key[:len(namespace)], key[len(namespace):]
+	window := func(w []byte) []byte {
+		if len(ns) == 0 {
+			return w
+		}
+		return append(append(make([]byte, 0, len(ns)+len(w)), ns...), w...)
+	}
+	if len(text) <= shingleSize {
+		return [][]byte{key}
+	}
+	out := make([][]byte, 0, len(text)-shingleSize+1)
+	for i := 0; i+shingleSize <= len(text); i++ {
+		out = append(out, window(text[i:i+shingleSize]))
+	}
+	return out
+}
+
+func (s *shingleSet) Has(key []byte) bool {
+	sh := shingles(key)
+	present := 0
+	for _, w := range sh {
+		if s.set.Has(w) {
+			present++
+		}
+	}
+	return float64(present) >= shingleThreshold*float64(len(sh))
+}
+
+func (s *shingleSet) Add(key []byte) {
+	for _, w := range shingles(key) {
+		s.set.Add(w)
+	}
+}
+
+func (s *shingleSet) AddIfNotHasTS(key []byte) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.Has(key) {
+		return false
+	}
+	s.Add(key)
+	return true
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestShingles(t *testing.T) {
+	defer func(n string, s int) { namespace, shingleSize = n, s }(namespace, shingleSize)
+	shingleSize = 3
+	namespace = ""
+	want := [][]byte{[]byte("abc"), []byte("bcd"), []byte("cde")}
+	if got := shingles([]byte("abcde")); !slices.EqualFunc(got, want, slices.Equal) {
+		t.Errorf("shingles of abcde: %q, want %q", got, want)
+	}
+	if got := shingles([]byte("ab")); len(got) != 1 || string(got[0]) != "ab" {
+		t.Errorf("shingles of a short key: %q, want the key itself", got)
+	}
+
+	// The namespace prefixes every window instead of being windowed.
+	namespace = "ns:"
+	want = [][]byte{[]byte("ns:abc"), []byte("ns:bcd"), []byte("ns:cde")}
+	if got := shingles([]byte("ns:abcde")); !slices.EqualFunc(got, want, slices.Equal) {
+		t.Errorf("shingles of ns:abcde: %q, want %q", got, want)
+	}
+}
+
+func TestShingleNearDuplicates(t *testing.T) {
+	original := "the quick brown fox jumps over the lazy dog"
+	tests := []struct {
+		name, line string
+		threshold  string
+		dup        bool
+	}{
+		{"one word changed", "the quick brown fox jumped over the lazy dog", "0.8", true},
+		{"one word changed, strict threshold", "the quick brown fox jumped over the lazy dog", "1", false},
+		{"exact copy, strict threshold", original, "1", true},
+		{"unrelated", "pack my box with five dozen liquor jugs", "0.8", false},
+		{"half rewritten", "the quick brown fox sat quietly on a mat", "0.8", false},
+	}
+	for _, tt := range tests {
+		in := original + "\n" + tt.line + "\n"
+		got := mustRun(t, t.TempDir(), in, "-shingle", "5", "-shingle-threshold", tt.threshold)
+		want := in
+		if tt.dup {
+			want = original + "\n"
+		}
+		if got != want {
+			t.Errorf("%s: output %q, want %q", tt.name, got, want)
+		}
+	}
+
+	// Shingles of different namespaces do not match.
+	dir := t.TempDir()
+	mustRun(t, dir, original+"\n", "-shingle", "5", "-namespace", "a:")
+	if got := mustRun(t, dir, original+"\n", "-shingle", "5", "-namespace", "b:"); got != original+"\n" {
+		t.Errorf("line in a new namespace suppressed by its shingles in another")
+	}
+}
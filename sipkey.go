@@ -0,0 +1,40 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/mylh/bdedup/bbloom"
+)
+
+// sipKeyEnv names the environment variable holding the SipHash key. It is
+// read from the environment rather than a flag to keep it out of process
+// listings.
+const sipKeyEnv = "BDEDUP_SEED"
+
+// envSipKey returns the key in $BDEDUP_SEED, or nil for bbloom's default
+// when it is unset or empty, exiting if it is malformed. The value is two
+// 64-bit hex numbers separated by a colon. It is never logged.
+var envSipKey = sync.OnceValue(func() *bbloom.SipKey {
+	s := os.Getenv(sipKeyEnv)
+	if s == "" {
+		return nil
+	}
+	hi, lo, ok := strings.Cut(s, ":")
+	k0, err0 := strconv.ParseUint(hi, 16, 64)
+	k1, err1 := strconv.ParseUint(lo, 16, 64)
+	if !ok || err0 != nil || err1 != nil {
+		logErrorf("%s must be two 64-bit hex numbers separated by a colon, as 0123456789abcdef:fedcba9876543210", sipKeyEnv)
+		os.Exit(2)
+	}
+	logger.Debug("using SipHash key from the environment", "variable", sipKeyEnv)
+	return &bbloom.SipKey{K0: k0, K1: k1}
+})
+
+// applySipKey gives bf the $BDEDUP_SEED key. Only filters using the
+// siphash hash are affected.
+func applySipKey(bf *bbloom.Bloom) {
+	bf.SipKey = envSipKey()
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/mylh/bdedup/bbloom"
+)
+
+func TestEnvSipKey(t *testing.T) {
+	const n = 200
+	input := numbered("key-", n)
+	dir := t.TempDir()
+	t.Setenv(sipKeyEnv, "0123456789abcdef:fedcba9876543210")
+	mustRun(t, dir, input)
+	if got := mustRun(t, dir, input); got != "" {
+		t.Errorf("rerun with the same key: %d lines emitted, want none", lineCount(got))
+	}
+
+	// The saved bits are those of the environment's key.
+	bf := loadState(t, filepath.Join(dir, "bloom.gz"))
+	key := bbloom.SipKey{K0: 0x0123456789abcdef, K1: 0xfedcba9876543210}
+	var underDefault int
+	for i := range n {
+		entry := fmt.Appendf(nil, "key-%d", i)
+		bf.SipKey = &key
+		if !bf.Has(entry) {
+			t.Fatalf("%s not in the filter under the environment's key", entry)
+		}
+		bf.SipKey = nil
+		if bf.Has(entry) {
+			underDefault++
+		}
+	}
+	if underDefault > n/10 {
+		t.Errorf("%d of %d keys also found under the default key", underDefault, n)
+	}
+
+	// Another key, or none, does not recognize the state's keys.
+	for _, seed := range []string{"1:2", ""} {
+		t.Setenv(sipKeyEnv, seed)
+		if got := mustRun(t, t.TempDir(), input, "-state", filepath.Join(dir, "bloom.gz"), "-seen"); lineCount(got) > n/10 {
+			t.Errorf("%s=%q: %d of %d keys seen under a different key", sipKeyEnv, seed, lineCount(got), n)
+		}
+	}
+
+	for _, seed := range []string{"0123", "xyz:1", "1:2:3", "10000000000000000:1"} {
+		t.Setenv(sipKeyEnv, seed)
+		if res := runBdedup(t, t.TempDir(), "a\n"); res.code != 2 {
+			t.Errorf("%s=%q: exit status %d, want 2", sipKeyEnv, seed, res.code)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/mylh/bdedup/bbloom"
+)
+
+var (
+	splitPrefix string
+	splitCount  int
+)
+
+// splits routes emitted lines to the -split-output shards; it is nil unless
+// -split-output is set.
+var splits *splitOutput
+
+// splitOutput is the -split-output shard files. A line goes to shard
+// SipHash(key) % K, whatever hash the filter uses, so a key lands in the same
+// file on every run and for every filter.
+type splitOutput struct {
+	files   []*os.File
+	codecs  []io.WriteCloser
+	writers []*flushWriter
+	// records are the shards' single writers, in front of writers.
+	records []*recordWriter
+}
+
+// checkSplitFlags exits if -split-output is combined with options it cannot
+// honor. Checkpoints record a single output offset, so -resume cannot
+// continue a split run.
+func checkSplitFlags() {
+	if splitCount < 1 {
+		logErrorf("-split-output needs -splits of at least 1")
+		os.Exit(2)
+	}
+	if outputFile != "" {
+		logErrorf("-split-output cannot be combined with -output")
+		os.Exit(2)
+	}
+	if resume {
+		logErrorf("-split-output cannot be combined with -resume")
+		os.Exit(2)
+	}
+	if _, err := newCompressor(outputCompress, io.Discard); err != nil {
+		logErrorf("-output-compress: %v", err)
+		os.Exit(2)
+	}
+}
+
+// openSplitOutput creates prefix.0 to prefix.K-1, each compressed with
+// -output-compress and buffered and flushed like the main output.
+func openSplitOutput(prefix string, k int) (*splitOutput, error) {
+	so := &splitOutput{}
+	for i := range k {
+		file, err := os.Create(fmt.Sprintf("%s.%d", prefix, i))
+		if err != nil {
+			so.Close()
+			return nil, err
+		}
+		so.files = append(so.files, file)
+		var w io.Writer = file
+		if outputCompress != "none" {
+			cw, err := newCompressor(outputCompress, file)
+			if err != nil {
+				so.Close()
+				return nil, err
+			}
+			so.codecs = append(so.codecs, cw)
+			w = cw
+		}
+		if prof != nil {
+			w = profiledWriter{w: w, p: prof}
+		}
+		fw := newFlushWriter(w, flushInterval)
+		so.writers = append(so.writers, fw)
+		so.records = append(so.records, newRecordWriter(fw, parallelRun()))
+	}
+	return so, nil
+}
+
+// shard returns the writer for the shard key belongs to.
+func (so *splitOutput) shard(key []byte) io.Writer {
+	return so.records[bbloom.SipHash.Sum64(key)%uint64(len(so.records))]
+}
+
+// Close flushes and closes every shard, returning the first error.
+func (so *splitOutput) Close() error {
+	var first error
+	keep := func(err error) {
+		if first == nil {
+			first = err
+		}
+	}
+	for _, rw := range so.records {
+		if err := rw.Close(); err != nil {
+			keep(err)
+		}
+	}
+	for _, w := range so.writers {
+		if err := w.Close(); err != nil {
+			keep(err)
+		}
+	}
+	for _, cw := range so.codecs {
+		if err := cw.Close(); err != nil {
+			keep(err)
+		}
+	}
+	for _, f := range so.files {
+		if err := f.Close(); err != nil {
+			keep(err)
+		}
+	}
+	return first
+}
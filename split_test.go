@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/mylh/bdedup/bbloom"
+)
+
+// readShards returns the lines of prefix.0 to prefix.k-1.
+func readShards(t *testing.T, prefix string, k int) [][]string {
+	t.Helper()
+	shards := make([][]string, k)
+	for i := range k {
+		data, err := os.ReadFile(fmt.Sprintf("%s.%d", prefix, i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(data) > 0 {
+			shards[i] = strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+		}
+	}
+	return shards
+}
+
+func TestSplitOutput(t *testing.T) {
+	const k = 4
+	input, uniques := syntheticStream(5000, 500)
+	for _, c := range []string{"1", "4"} {
+		dir := t.TempDir()
+		prefix := filepath.Join(dir, "part")
+		if got := mustRun(t, dir, input, "-split-output", prefix, "-splits", fmt.Sprint(k), "-concurrency", c); got != "" {
+			t.Fatalf("-concurrency %s: %d lines on stdout, want all in the shards", c, lineCount(got))
+		}
+		var all []string
+		for i, shard := range readShards(t, prefix, k) {
+			if len(shard) == 0 {
+				t.Errorf("-concurrency %s: shard %d is empty", c, i)
+			}
+			for _, line := range shard {
+				if want := bbloom.SipHash.Sum64([]byte(line)) % k; want != uint64(i) {
+					t.Errorf("-concurrency %s: %q in shard %d, want %d", c, line, i, want)
+				}
+			}
+			all = append(all, shard...)
+		}
+		want := strings.Split(strings.TrimSuffix(uniques, "\n"), "\n")
+		slices.Sort(all)
+		slices.Sort(want)
+		if !slices.Equal(all, want) {
+			t.Errorf("-concurrency %s: shards hold %d lines, want the %d unique ones", c, len(all), len(want))
+		}
+	}
+
+	// The same key goes to the same file in another run and filter.
+	dir := t.TempDir()
+	for _, hash := range []string{"siphash", "xxhash"} {
+		prefix := filepath.Join(dir, hash)
+		mustRun(t, dir, "k1\nk2\nk3\nk4\nk5\n", "-state", hash+".gz", "-hash", hash, "-split-output", prefix, "-splits", "3")
+	}
+	if s, x := readShards(t, filepath.Join(dir, "siphash"), 3), readShards(t, filepath.Join(dir, "xxhash"), 3); !slices.EqualFunc(s, x, slices.Equal) {
+		t.Errorf("shards differ between filters: %q and %q", s, x)
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/mylh/bdedup/bbloom"
+)
+
+// summarySchemaVersion versions the -json form of the -stats and -info
+// reports. Fields may be added within a version; renaming or removing one
+// bumps it.
+const summarySchemaVersion = 1
+
+// summary is the report printed by -stats (run and filter), -info (filter
+// only) and -cardinality (distinct estimate).
+type summary struct {
+	SchemaVersion    int         `json:"schema_version"`
+	Run              *runStats   `json:"run,omitempty"`
+	Filter           *filterInfo `json:"filter,omitempty"`
+	DistinctEstimate *uint64     `json:"distinct_estimate,omitempty"`
+	// KeyLengths summarizes the key lengths under -key-length-stats.
+	KeyLengths *keyLengthSummary `json:"key_lengths,omitempty"`
+}
+
+// runStats counts the lines of one run by dedup decision.
+type runStats struct {
+	Lines      uint64 `json:"lines"`
+	Unique     uint64 `json:"unique"`
+	Duplicates uint64 `json:"duplicates"`
+	// Rejected counts lines failing validation, which are not in Lines.
+	Rejected uint64 `json:"rejected"`
+}
+
+func (st *runStats) record(hasNew bool) {
+	st.Lines++
+	if hasNew {
+		st.Unique++
+	} else {
+		st.Duplicates++
+	}
+}
+
+// filterInfo describes the set lines are deduplicated against. Every
+// numeric field is always present, so the schema does not depend on the
+// filter's contents; the Bloom fields are 0 for an exact set.
+type filterInfo struct {
+	Kind string `json:"kind"`
+	// Shards is the number of filters of a sharded one, whose FillRatio
+	// and EstimatedFPR are those of the fullest shard, and 0 otherwise.
+	Shards       int     `json:"shards"`
+	SizeBits     uint64  `json:"size_bits"`
+	HashLocs     uint64  `json:"hash_locs"`
+	Hash         string  `json:"hash,omitempty"`
+	Elements     uint64  `json:"elements"`
+	FillRatio    float64 `json:"fill_ratio"`
+	EstimatedFPR float64 `json:"estimated_fpr"`
+	// BitsPerElement is SizeBits/Elements, or 0 for an empty filter, and
+	// OptimalBitsPerElement the -1.44*log2(p) bits an ideally sized filter
+	// spends per element at TargetFPR, the rate the filter was built for.
+	BitsPerElement        float64 `json:"bits_per_element"`
+	OptimalBitsPerElement float64 `json:"optimal_bits_per_element"`
+	TargetFPR             float64 `json:"target_fpr"`
+	// SizingNote explains a bits per element far from the optimum.
+	SizingNote string `json:"sizing_note,omitempty"`
+}
+
+// Thresholds for the sizing note. Sizes are rounded up to a power of two,
+// so up to twice the optimal bits per element is normal.
+const (
+	oversizedRatio = 4
+	overfullRatio  = 0.75
+)
+
+// builtFPR returns the false positive rate bf was sized for. The file does
+// not record it, but sizing for a rate p gives ceil(-log2 p) hash
+// locations: the -p of the run is taken if it gives bf's, and otherwise
+// 2^-k, the rate bf's k locations are optimal for.
+func builtFPR(bf *bbloom.Bloom) float64 {
+	k := float64(bf.Metrics().HashLocs)
+	if math.Ceil(-math.Log2(falsePositive)) == k {
+		return falsePositive
+	}
+	return math.Exp2(-k)
+}
+
+func bloomInfo(bf *bbloom.Bloom) *filterInfo {
+	m := bf.Metrics()
+	target := builtFPR(bf)
+	optimal := -1.44 * math.Log2(target)
+	var bpe float64
+	if bf.ElemNum > 0 {
+		bpe = float64(m.SizeBits) / float64(bf.ElemNum)
+	}
+	var note string
+	switch ratio := bpe / optimal; {
+	case bf.ElemNum == 0:
+	case ratio > oversizedRatio:
+		note = fmt.Sprintf("%.1f times the optimum for p %g: room for %d entries, so the filter is mostly empty or -n is larger than needed",
+			ratio, target, bf.Capacity(target))
+	case ratio < overfullRatio:
+		note = fmt.Sprintf("%.2f of the optimum for p %g; the filter holds more than it was sized for and misses that rate, so rebuild it larger", ratio, target)
+	}
+	return &filterInfo{
+		Kind:         "bloom",
+		SizeBits:     m.SizeBits,
+		HashLocs:     m.HashLocs,
+		Hash:         bf.HashFunc.String(),
+		Elements:     bf.ElemNum,
+		FillRatio:    m.FillRatio,
+		EstimatedFPR: m.EstimatedFPR,
+
+		BitsPerElement:        bpe,
+		OptimalBitsPerElement: optimal,
+		TargetFPR:             target,
+		SizingNote:            note,
+	}
+}
+
+// printSummary writes s to w as one JSON object under -json, or as aligned
+// text otherwise.
+func printSummary(w io.Writer, s summary) error {
+	if jsonOutput {
+		s.SchemaVersion = summarySchemaVersion
+		return json.NewEncoder(w).Encode(s)
+	}
+	var err error
+	line := func(format string, args ...any) {
+		if err == nil {
+			_, err = fmt.Fprintf(w, format, args...)
+		}
+	}
+	if r := s.Run; r != nil {
+		line("Lines processed: %d\n", r.Lines)
+		line("Unique:          %d\n", r.Unique)
+		line("Duplicates:      %d\n", r.Duplicates)
+		if r.Rejected > 0 {
+			line("Rejected:        %d\n", r.Rejected)
+		}
+	}
+	if s.DistinctEstimate != nil {
+		line("Distinct (est.): %d\n", *s.DistinctEstimate)
+	}
+	if k := s.KeyLengths; k != nil && k.Keys > 0 {
+		line("Key lengths:     min %d, mean %.1f, p50 %d, p90 %d, p99 %d, max %d bytes\n", k.Min, k.Mean, k.P50, k.P90, k.P99, k.Max)
+	} else if k != nil {
+		line("Key lengths:     no keys\n")
+	}
+	if f := s.Filter; f != nil {
+		if f.Kind == "sharded" {
+			line("Filter:          %d bloom shards, %d bits in total, %d hash locations, %s\n", f.Shards, f.SizeBits, f.HashLocs, f.Hash)
+			line("Elements:        %d\n", f.Elements)
+			line("Fill ratio:      %.4f (fullest shard)\n", f.FillRatio)
+			line("Estimated FPR:   %.6g (fullest shard)\n", f.EstimatedFPR)
+			return err
+		}
+		if f.Kind != "bloom" {
+			line("Filter:          %s\n", f.Kind)
+			return err
+		}
+		line("Filter:          bloom, %d bits, %d hash locations, %s\n", f.SizeBits, f.HashLocs, f.Hash)
+		line("Elements:        %d\n", f.Elements)
+		line("Fill ratio:      %.4f\n", f.FillRatio)
+		line("Estimated FPR:   %.6g\n", f.EstimatedFPR)
+		if f.Elements == 0 {
+			line("Bits/element:    none, the filter is empty (optimum %.2f at p %g)\n", f.OptimalBitsPerElement, f.TargetFPR)
+		} else {
+			line("Bits/element:    %.2f (optimum %.2f at p %g)\n", f.BitsPerElement, f.OptimalBitsPerElement, f.TargetFPR)
+		}
+		if f.SizingNote != "" {
+			line("Sizing note:     %s\n", f.SizingNote)
+		}
+	}
+	return err
+}
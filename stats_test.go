@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestStatsJSON(t *testing.T) {
+	dir := t.TempDir()
+	res := runBdedup(t, dir, "a\nb\na\nc\n", "-stats", "-json", "-n", "1000")
+	if res.code != 0 {
+		t.Fatalf("exit status %d\n%s", res.code, res.stderr)
+	}
+	var s summary
+	if err := json.Unmarshal([]byte(res.stderr), &s); err != nil {
+		t.Fatalf("stats are not JSON: %v\n%s", err, res.stderr)
+	}
+	if s.SchemaVersion != 1 {
+		t.Errorf("schema_version %d, want 1", s.SchemaVersion)
+	}
+	if s.Run == nil || *s.Run != (runStats{Lines: 4, Unique: 3, Duplicates: 1}) {
+		t.Errorf("run %+v, want 4 lines, 3 unique and 1 duplicate", s.Run)
+	}
+	f := s.Filter
+	if f == nil || f.Kind != "bloom" || f.Elements != 3 || f.SizeBits == 0 || f.HashLocs == 0 || f.FillRatio == 0 {
+		t.Errorf("filter %+v, want a bloom filter holding 3 elements", f)
+	}
+
+	// -info reports the saved filter without a run section.
+	out := mustRun(t, dir, "", "-info", "-json")
+	var info summary
+	if err := json.Unmarshal([]byte(out), &info); err != nil {
+		t.Fatalf("-info is not JSON: %v\n%s", err, out)
+	}
+	if info.Run != nil || info.Filter == nil || info.Filter.Elements != 3 {
+		t.Errorf("-info %s, want the filter with 3 elements and no run", out)
+	}
+
+	// Zero counts are written, not left out.
+	res = runBdedup(t, t.TempDir(), "", "-stats", "-json")
+	var raw struct{ Run, Filter map[string]any }
+	if err := json.Unmarshal([]byte(res.stderr), &raw); err != nil {
+		t.Fatal(err)
+	}
+	for _, field := range []string{"lines", "unique", "duplicates", "rejected"} {
+		if _, ok := raw.Run[field]; !ok {
+			t.Errorf("empty run: %q missing from %s", field, res.stderr)
+		}
+	}
+	for _, field := range []string{"elements", "fill_ratio", "estimated_fpr", "bits_per_element"} {
+		if _, ok := raw.Filter[field]; !ok {
+			t.Errorf("empty run: %q missing from %s", field, res.stderr)
+		}
+	}
+}
+
+func TestSummaryOnly(t *testing.T) {
+	dir := t.TempDir()
+	res := runBdedup(t, dir, "a\nb\na\nc\n", "-summary-only", "-json")
+	if res.code != 0 || res.stdout != "" {
+		t.Fatalf("-summary-only: exit status %d, output %q; want 0 and no output", res.code, res.stdout)
+	}
+	var s summary
+	if err := json.Unmarshal([]byte(res.stderr), &s); err != nil {
+		t.Fatalf("stats are not JSON: %v\n%s", err, res.stderr)
+	}
+	if s.Run == nil || *s.Run != (runStats{Lines: 4, Unique: 3, Duplicates: 1}) {
+		t.Errorf("run %+v, want 4 lines, 3 unique and 1 duplicate", s.Run)
+	}
+	// The filter was saved with the run's keys.
+	if got := mustRun(t, dir, "a\nb\nc\nd\n"); got != "d\n" {
+		t.Errorf("run after -summary-only emitted %q, want d only", got)
+	}
+
+	// With -stats-to-stdout the summary is all stdout holds.
+	res = runBdedup(t, t.TempDir(), "a\nb\n", "-summary-only", "-json", "-stats-to-stdout")
+	if err := json.Unmarshal([]byte(res.stdout), &s); err != nil || s.Run.Lines != 2 {
+		t.Errorf("-stats-to-stdout: stdout %q, want only the summary", res.stdout)
+	}
+	if res := runBdedup(t, t.TempDir(), "a\n", "-summary-only", "-output", "out.txt"); res.code != 2 {
+		t.Errorf("-summary-only -output exited %d, want 2", res.code)
+	}
+}
+
+func TestBitsPerElement(t *testing.T) {
+	dir := t.TempDir()
+	res := runBdedup(t, dir, numbered("key-", 1000), "-n", "1000", "-p", "0.01", "-stats", "-json")
+	var s summary
+	if err := json.Unmarshal([]byte(res.stderr), &s); err != nil {
+		t.Fatalf("stats are not JSON: %v\n%s", err, res.stderr)
+	}
+	f := s.Filter
+	// -n 1000 -p 0.01 asks for 9585 bits, rounded up to 2^14.
+	if f.SizeBits != 16384 || f.HashLocs != 7 || f.Elements < 995 || f.Elements > 1000 {
+		t.Fatalf("filter %+v, want 16384 bits, 7 locations and about 1000 elements", f)
+	}
+	if want := 16384 / float64(f.Elements); math.Abs(f.BitsPerElement-want) > 1e-9 {
+		t.Errorf("bits per element %v, want %v", f.BitsPerElement, want)
+	}
+	// -1.44 * log2(0.01)
+	if math.Abs(f.OptimalBitsPerElement-9.567) > 0.001 || f.TargetFPR != 0.01 {
+		t.Errorf("optimum %v at p %v, want 9.567 at 0.01", f.OptimalBitsPerElement, f.TargetFPR)
+	}
+	if f.SizingNote != "" {
+		t.Errorf("a filter 1.7 times the optimum has the note %q", f.SizingNote)
+	}
+
+	out := mustRun(t, dir, "", "-info")
+	if want := fmt.Sprintf("Bits/element:    %.2f (optimum 9.57 at p 0.01)", 16384/float64(f.Elements)); !strings.Contains(out, want) {
+		t.Errorf("-info %q, want %q", out, want)
+	}
+
+	// Far off the optimum either way gets a note.
+	res = runBdedup(t, t.TempDir(), numbered("key-", 10), "-n", "100000", "-stats")
+	if !strings.Contains(res.stderr, "times the optimum") {
+		t.Errorf("oversized filter: %q, want a sizing note", res.stderr)
+	}
+	res = runBdedup(t, t.TempDir(), numbered("key-", 3000), "-n", "100", "-stats")
+	if !strings.Contains(res.stderr, "rebuild it larger") {
+		t.Errorf("overfull filter: %q, want a sizing note", res.stderr)
+	}
+	if res := runBdedup(t, t.TempDir(), "", "-stats"); !strings.Contains(res.stderr, "none, the filter is empty") {
+		t.Errorf("empty filter: %q", res.stderr)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"io"
+	"io/fs"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+var (
+	ioRetries    int
+	ioRetryDelay time.Duration
+)
+
+// maxRetryDelay caps the doubling wait between -io-retries attempts.
+const maxRetryDelay = time.Minute
+
+// registerRetryFlags defines the flags for retrying state loads and saves
+// on fs, for every command that goes through the state store.
+func registerRetryFlags(fs *flag.FlagSet) {
+	fs.IntVar(&ioRetries, "io-retries", 0, "Retry a failed state load or save this many times")
+	fs.DurationVar(&ioRetryDelay, "io-retry-delay", time.Second, "Wait before the first -io-retries retry, doubling for each one after it")
+}
+
+// StateStore is where a filter's state is persisted. Load and Save exchange
+// the serialized filter, compressed unless -no-gzip is set, so a store only
+// moves bytes. The default keeps state in a local file; a store backed by
+// object storage or a key-value service plugs in through openStore. The
+// -exact set, -wal log and -resume checkpoints need a local file system and
+// do not go through it.
+type StateStore interface {
+	// Load opens the saved state. If nothing has been saved yet, the
+	// error wraps fs.ErrNotExist and a new filter is started.
+	Load() (io.ReadCloser, error)
+	// Save starts replacing the saved state. Close finishes the write, and
+	// its error reports whether the state was saved.
+	Save() (io.WriteCloser, error)
+}
+
+// openStore returns the store for the state named by -state, -base, or a
+// subcommand's state flags.
+var openStore = func(path string) StateStore {
+	return fileStore(path)
+}
+
+// retryIO runs op, a whole load or save of the state named in what, and
+// retries it up to -io-retries times while it fails, waiting -io-retry-delay
+// before the first retry and twice as long before each one after it, up to
+// maxRetryDelay. A missing state file is not retried. SIGINT or SIGTERM
+// during a wait gives up and returns the last error, so a stuck store does
+// not hold up an interrupted run.
+func retryIO(what string, op func() error) error {
+	err := op()
+	if err == nil || ioRetries == 0 || !retryable(err) {
+		return err
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	delay := ioRetryDelay
+	for retry := 1; retry <= ioRetries; retry++ {
+		logWarnf("%s: %v; retry %d of %d in %v", what, err, retry, ioRetries, delay)
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+		if err = op(); err == nil || !retryable(err) {
+			return err
+		}
+		delay = min(2*delay, maxRetryDelay)
+	}
+	return err
+}
+
+// retryable reports whether retrying could help: not when the state is
+// missing or empty, which retrying would only confirm.
+func retryable(err error) bool {
+	return !errors.Is(err, fs.ErrNotExist) && !errors.Is(err, errEmptyState)
+}
+
+// fileStore keeps state in the local file it names.
+type fileStore string
+
+func (f fileStore) Load() (io.ReadCloser, error) {
+	return os.Open(string(f))
+}
+
+// Save writes to a temporary file next to the state file and renames it into
+// place on Close, so a crash or a failed write leaves the previous state
+// intact.
+func (f fileStore) Save() (io.WriteCloser, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(string(f)), filepath.Base(string(f))+".tmp*")
+	if err != nil {
+		return nil, err
+	}
+	// CreateTemp makes the file private; state files are not.
+	if err := tmp.Chmod(0o644); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+	return &replacingFile{File: tmp, path: string(f)}, nil
+}
+
+// replacingFile is a temporary file that replaces path when it is closed.
+type replacingFile struct {
+	*os.File
+	path   string
+	failed bool
+}
+
+// Write remembers a failed write, so that Close does not replace the state
+// with a partial file.
+func (r *replacingFile) Write(p []byte) (int, error) {
+	n, err := r.File.Write(p)
+	if err != nil {
+		r.failed = true
+	}
+	return n, err
+}
+
+func (r *replacingFile) Close() error {
+	err := r.Sync()
+	if cerr := r.File.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && !r.failed {
+		err = os.Rename(r.Name(), r.path)
+	}
+	if err != nil || r.failed {
+		os.Remove(r.Name())
+	}
+	return err
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mylh/bdedup/bbloom"
+)
+
+// memStore is a StateStore keeping state in memory, shared by name.
+type memStore struct {
+	mu    *sync.Mutex
+	files map[string][]byte
+	name  string
+}
+
+func (s memStore) Load() (io.ReadCloser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.files[s.name]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", s.name, fs.ErrNotExist)
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (s memStore) Save() (io.WriteCloser, error) {
+	return &memWriter{store: s}, nil
+}
+
+// memWriter commits what was written to its store on Close.
+type memWriter struct {
+	bytes.Buffer
+	store memStore
+}
+
+func (w *memWriter) Close() error {
+	w.store.mu.Lock()
+	defer w.store.mu.Unlock()
+	w.store.files[w.store.name] = w.Bytes()
+	return nil
+}
+
+// useMemStore makes state go through memory for the rest of the test, and
+// returns the stored files.
+func useMemStore(t *testing.T) map[string][]byte {
+	files := make(map[string][]byte)
+	mu := &sync.Mutex{}
+	saved := openStore
+	openStore = func(path string) StateStore { return memStore{mu: mu, files: files, name: path} }
+	t.Cleanup(func() { openStore = saved })
+	return files
+}
+
+func TestStateStoreRoundTrip(t *testing.T) {
+	files := useMemStore(t)
+
+	// Nothing saved yet: a new, empty filter.
+	bf, err := readBloomFilter("state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bf.ElemNum != 0 || bf.FillRatio() != 0 {
+		t.Fatal("missing state did not give an empty filter")
+	}
+
+	bf.Add([]byte("a"))
+	bf.Add([]byte("b"))
+	if err := saveBloomFilter("state", bf); err != nil {
+		t.Fatal(err)
+	}
+	if len(files["state"]) == 0 {
+		t.Fatal("nothing saved to the store")
+	}
+	back, err := readBloomFilter("state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !back.Equal(&bf) || back.ElemNum != 2 {
+		t.Error("filter changed in a round trip through the store")
+	}
+
+	// Empty state reads as a new filter; garbage is an error.
+	files["empty"] = nil
+	if empty, err := readBloomFilter("empty"); err != nil || empty.ElemNum != 0 {
+		t.Errorf("empty state: %v", err)
+	}
+	files["garbage"] = []byte("not gzip")
+	if _, err := readBloomFilter("garbage"); err == nil {
+		t.Error("garbage state loaded")
+	}
+}
+
+// failingStore fails every load and save with err.
+type failingStore struct{ err error }
+
+func (s failingStore) Load() (io.ReadCloser, error)  { return nil, s.err }
+func (s failingStore) Save() (io.WriteCloser, error) { return nil, s.err }
+
+func TestStateStoreSaveError(t *testing.T) {
+	saved := openStore
+	defer func() { openStore = saved }()
+	openStore = func(string) StateStore { return failingStore{err: fmt.Errorf("store offline")} }
+	bf := bbloom.New(1000, 0.01)
+	if err := saveBloomFilter("state", bf); err == nil {
+		t.Error("save to a failing store succeeded")
+	}
+	if _, err := readBloomFilter("state"); err == nil {
+		t.Error("load from a failing store succeeded")
+	}
+}
+
+// flakyStore fails the first fails loads and saves of a memStore, then
+// passes them through. It counts every attempt.
+type flakyStore struct {
+	memStore
+	fails    int
+	attempts *int
+}
+
+func (s flakyStore) Load() (io.ReadCloser, error) {
+	if *s.attempts++; *s.attempts <= s.fails {
+		return nil, fmt.Errorf("store unreachable")
+	}
+	return s.memStore.Load()
+}
+
+func (s flakyStore) Save() (io.WriteCloser, error) {
+	if *s.attempts++; *s.attempts <= s.fails {
+		return nil, fmt.Errorf("store unreachable")
+	}
+	return s.memStore.Save()
+}
+
+func TestIORetries(t *testing.T) {
+	savedStore, savedRetries, savedDelay := openStore, ioRetries, ioRetryDelay
+	defer func() { openStore, ioRetries, ioRetryDelay = savedStore, savedRetries, savedDelay }()
+	ioRetryDelay = time.Millisecond
+	mem := memStore{mu: &sync.Mutex{}, files: make(map[string][]byte), name: "state"}
+	var attempts int
+	useFlaky := func(fails int) {
+		attempts = 0
+		openStore = func(string) StateStore { return flakyStore{memStore: mem, fails: fails, attempts: &attempts} }
+	}
+
+	bf := bbloom.New(1000, 0.01)
+	bf.Add([]byte("a"))
+	ioRetries = 3
+	useFlaky(3)
+	if err := saveBloomFilter("state", bf); err != nil {
+		t.Fatalf("save failing 3 times with 3 retries: %v", err)
+	}
+	if attempts != 4 {
+		t.Errorf("save took %d attempts, want 4", attempts)
+	}
+	useFlaky(2)
+	back, err := readBloomFilter("state")
+	if err != nil {
+		t.Fatalf("load failing twice with 3 retries: %v", err)
+	}
+	if !back.Has([]byte("a")) || attempts != 3 {
+		t.Errorf("load took %d attempts and has a: %v; want 3 and true", attempts, back.Has([]byte("a")))
+	}
+
+	// Out of retries.
+	useFlaky(4)
+	if _, err := readBloomFilter("state"); err == nil {
+		t.Error("load failing 4 times with 3 retries succeeded")
+	}
+	ioRetries = 0
+	useFlaky(1)
+	if err := saveBloomFilter("state", bf); err == nil || attempts != 1 {
+		t.Errorf("save without -io-retries: %v after %d attempts, want an error after 1", err, attempts)
+	}
+
+	// Missing state is not worth retrying.
+	ioRetries = 3
+	useFlaky(0)
+	openStore = func(string) StateStore {
+		return flakyStore{memStore: memStore{mu: mem.mu, files: mem.files, name: "missing"}, attempts: &attempts}
+	}
+	if _, err := readBloomFilter("missing"); err != nil || attempts != 1 {
+		t.Errorf("missing state: %v after %d attempts, want a new filter after 1", err, attempts)
+	}
+}
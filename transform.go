@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// keyTransforms is the -transform pipeline, applied in order to each key.
+var keyTransforms []func([]byte) []byte
+
+// parseTransform parses a -transform spec: operations separated by "|", each
+// either a bare name or name:argument. Arguments cannot contain "|".
+// Transforms never modify their input in place, since it may be the line
+// that is still to be written out.
+func parseTransform(spec string) error {
+	keyTransforms = keyTransforms[:0]
+	for _, op := range strings.Split(spec, "|") {
+		name, arg, hasArg := strings.Cut(strings.TrimSpace(op), ":")
+		var fn func([]byte) []byte
+		switch name {
+		case "lower":
+			fn = bytes.ToLower
+		case "upper":
+			fn = bytes.ToUpper
+		case "trim":
+			fn = bytes.TrimSpace
+		case "prefix":
+			fn = func(b []byte) []byte { return bytes.TrimPrefix(b, []byte(arg)) }
+		case "suffix":
+			fn = func(b []byte) []byte { return bytes.TrimSuffix(b, []byte(arg)) }
+		case "take":
+			n, err := strconv.Atoi(arg)
+			if err != nil || n < 0 {
+				return fmt.Errorf("invalid transform %q: take needs a character count", op)
+			}
+			fn = func(b []byte) []byte { return takeChars(b, n) }
+		default:
+			return fmt.Errorf("unknown transform %q (known: lower, upper, trim, prefix:S, suffix:S, take:N)", op)
+		}
+		if hasArg != (name == "prefix" || name == "suffix" || name == "take") {
+			return fmt.Errorf("invalid transform %q: only prefix, suffix and take take an argument", op)
+		}
+		keyTransforms = append(keyTransforms, fn)
+	}
+	return nil
+}
+
+// transformKey runs key through the -transform pipeline.
+func transformKey(key []byte) []byte {
+	for _, fn := range keyTransforms {
+		key = fn(key)
+	}
+	return key
+}
+
+// takeChars returns the first n UTF-8 characters of b.
+func takeChars(b []byte, n int) []byte {
+	i := 0
+	for ; n > 0 && i < len(b); n-- {
+		_, size := utf8.DecodeRune(b[i:])
+		i += size
+	}
+	return b[:i]
+}
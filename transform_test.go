@@ -0,0 +1,46 @@
+package main
+
+import "testing"
+
+func TestTransform(t *testing.T) {
+	defer func() { keyTransforms = nil }()
+	tests := []struct {
+		spec, in, want string
+	}{
+		{"lower", "MiXeD", "mixed"},
+		{"upper", "MiXeD", "MIXED"},
+		{"trim", "  padded\t", "padded"},
+		{"prefix:www.", "www.example.com", "example.com"},
+		{"prefix:www.", "example.com", "example.com"},
+		{"suffix:/", "example.com/", "example.com"},
+		{"take:3", "héllo", "hél"},
+		{"take:10", "short", "short"},
+		{"trim | lower | prefix:www. | suffix:/ | take:7", "  WWW.Example.COM/ ", "example"},
+	}
+	for _, tt := range tests {
+		if err := parseTransform(tt.spec); err != nil {
+			t.Fatalf("%q: %v", tt.spec, err)
+		}
+		in := []byte(tt.in)
+		if got := string(transformKey(in)); got != tt.want {
+			t.Errorf("%q on %q: got %q, want %q", tt.spec, tt.in, got, tt.want)
+		}
+		if string(in) != tt.in {
+			t.Errorf("%q modified its input to %q", tt.spec, in)
+		}
+	}
+
+	for _, spec := range []string{"reverse", "take", "take:x", "take:-1", "lower:1", "prefix", "lower||upper"} {
+		if err := parseTransform(spec); err == nil {
+			t.Errorf("%q accepted", spec)
+		}
+	}
+}
+
+func TestTransformDedup(t *testing.T) {
+	in := "WWW.Example.com/\nexample.com\nwww.example.COM\nother.org\n"
+	got := mustRun(t, t.TempDir(), in, "-transform", "lower|prefix:www.|suffix:/")
+	if want := "WWW.Example.com/\nother.org\n"; got != want {
+		t.Errorf("output %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	mathbits "math/bits"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/mylh/bdedup/bbloom"
+)
+
+var (
+	tune       bool
+	tuneMemory byteSize
+)
+
+// tuneMinFPR is the lowest false positive rate -tune recommends. Below it a
+// larger budget only adds hash locations, slowing every lookup, for a gain
+// no run could measure.
+const tuneMinFPR = 1e-9
+
+// tuneMaxFPR is the rate at which -tune gives up on a budget: a filter that
+// wrongly drops every other new line deduplicates nothing useful.
+const tuneMaxFPR = 0.5
+
+// byteSize is a flag value for an amount of memory: a number of bytes,
+// optionally followed by KiB, MiB, GiB or TiB (or K, M, G, T), all powers
+// of 1024.
+type byteSize uint64
+
+var byteUnits = []struct {
+	suffix string
+	size   uint64
+}{
+	{"TiB", 1 << 40}, {"GiB", 1 << 30}, {"MiB", 1 << 20}, {"KiB", 1 << 10},
+	{"T", 1 << 40}, {"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10}, {"B", 1},
+}
+
+func (b *byteSize) Set(s string) error {
+	num, unit := s, uint64(1)
+	for _, u := range byteUnits {
+		if strings.HasSuffix(s, u.suffix) {
+			num, unit = strings.TrimSpace(strings.TrimSuffix(s, u.suffix)), u.size
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(num, 64)
+	if err != nil || !(n >= 0) || n*float64(unit) >= 1<<63 {
+		return fmt.Errorf("%q is not a size like 512MiB or 2GiB", s)
+	}
+	*b = byteSize(n * float64(unit))
+	return nil
+}
+
+func (b byteSize) String() string {
+	n, unit := float64(b), "B"
+	for _, u := range []string{"KiB", "MiB", "GiB", "TiB"} {
+		if n < 1024 {
+			break
+		}
+		n, unit = n/1024, u
+	}
+	return strconv.FormatFloat(n, 'g', 4, 64) + " " + unit
+}
+
+// tuneReport is what -tune prints, as aligned text or under -json as one
+// JSON object.
+type tuneReport struct {
+	SampleLines      uint64   `json:"sample_lines"`
+	DistinctEstimate uint64   `json:"distinct_estimate"`
+	MemoryBudget     uint64   `json:"memory_budget_bytes,omitempty"`
+	TargetFPR        *float64 `json:"target_fpr,omitempty"`
+	SizeBits         uint64   `json:"size_bits"`
+	HashLocs         uint64   `json:"hash_locs"`
+	FPR              float64  `json:"fpr"`
+	ExpectedFPR      float64  `json:"expected_fpr"`
+	Capacity         uint64   `json:"capacity"`
+	Command          string   `json:"command"`
+}
+
+// runTune implements -tune: it estimates the distinct keys of the input,
+// which is taken as a sample of what the filter will hold, and sizes a
+// filter for them. With -tune-memory it reports the lowest -p the budget
+// allows; otherwise the memory -p needs. Nothing is read from or written to
+// the state file.
+func runTune() (status int) {
+	// The keys are in -key-input when it is given.
+	var input io.Reader = os.Stdin
+	if path := cmp.Or(keyInputFile, inputFile); path != "" {
+		file, err := os.Open(path)
+		if err != nil {
+			logErrorf("opening input file: %v", err)
+			os.Exit(1)
+		}
+		defer file.Close()
+		input = file
+	}
+	if keyInputFile == "" {
+		input = decodeInput(input)
+	}
+	hll := bbloom.NewHyperLogLog(hllPrecision)
+	lines, err := addDistinct(&hll, input, true)
+	if err != nil {
+		logErrorf("reading input: %v", err)
+		os.Exit(1)
+	}
+	if lines == 0 {
+		logErrorf("-tune needs a sample of at least one input line")
+		os.Exit(1)
+	}
+	rep := tuneReport{SampleLines: lines, DistinctEstimate: max(hll.Count(), 1)}
+	n := float64(rep.DistinctEstimate)
+
+	fpr := falsePositive
+	if tuneMemory > 0 {
+		rep.MemoryBudget = uint64(tuneMemory)
+		if fpr, err = budgetFPR(uint64(tuneMemory), n); err != nil {
+			logErrorf("%v", err)
+			os.Exit(2)
+		}
+	} else {
+		rep.TargetFPR = &falsePositive
+	}
+	rep.SizeBits, rep.HashLocs, err = bbloom.SizeWithFPR(n, fpr)
+	if err != nil {
+		logErrorf("invalid -n or -p: %v", err)
+		os.Exit(2)
+	}
+	rep.FPR = fpr
+	rep.ExpectedFPR = bbloom.ExpectedFPROf(rep.SizeBits, rep.HashLocs, n)
+	rep.Capacity = bbloom.CapacityOf(rep.SizeBits, rep.HashLocs, fpr)
+	rep.Command = fmt.Sprintf("%s -n %d -p %g", filepath.Base(os.Args[0]), rep.DistinctEstimate, fpr)
+
+	if err := printTuneReport(os.Stdout, &rep); err != nil {
+		logErrorf("writing report: %v", err)
+		status = 1
+	}
+	return status
+}
+
+// budgetFPR returns the lowest false positive rate, to three significant
+// digits, at which n entries fit a filter of at most budget bytes, but not
+// below tuneMinFPR. Filters are a power of two bits, so the budget is
+// rounded down to one.
+func budgetFPR(budget uint64, n float64) (float64, error) {
+	bits := min(budget, bbloom.MaxSize/8) * 8
+	if bits < bbloom.MinSize {
+		return 0, fmt.Errorf("-tune-memory %v is below the smallest filter, %d bytes", byteSize(budget), bbloom.MinSize/8)
+	}
+	bits = 1 << (63 - mathbits.LeadingZeros64(bits))
+	// The bits NewWithFPR asks for, -n*ln(p)/ln(2)^2, solved for p.
+	ln2 := 0.69314718056
+	p := roundUpSig(math.Exp(-float64(bits)*ln2*ln2/n), 3)
+	if p >= tuneMaxFPR {
+		return 0, fmt.Errorf("-tune-memory %v cannot hold %g entries at a false positive rate below %g", byteSize(budget), n, tuneMaxFPR)
+	}
+	p = max(p, tuneMinFPR)
+	// Rounding can leave the size just over a power of two, doubling it.
+	for {
+		size, _, err := bbloom.SizeWithFPR(n, p)
+		if err != nil {
+			return 0, err
+		}
+		if size <= bits {
+			return p, nil
+		}
+		p = roundUpSig(p*1.001, 3)
+	}
+}
+
+// roundUpSig rounds x > 0 up to digits significant digits.
+func roundUpSig(x float64, digits int) float64 {
+	if x <= 0 {
+		return x
+	}
+	scale := math.Pow(10, float64(digits)-math.Ceil(math.Log10(x)))
+	return math.Ceil(x*scale) / scale
+}
+
+func printTuneReport(w io.Writer, rep *tuneReport) error {
+	if jsonOutput {
+		return json.NewEncoder(w).Encode(rep)
+	}
+	var err error
+	line := func(format string, args ...any) {
+		if err == nil {
+			_, err = fmt.Fprintf(w, format, args...)
+		}
+	}
+	line("Sample lines:    %d\n", rep.SampleLines)
+	line("Distinct (est.): %d\n", rep.DistinctEstimate)
+	if rep.MemoryBudget > 0 {
+		line("Memory budget:   %v\n", byteSize(rep.MemoryBudget))
+		line("Achievable -p:   %g\n", rep.FPR)
+	} else {
+		line("Target -p:       %g\n", rep.FPR)
+	}
+	line("Filter:          %d bits (%v), %d hash locations\n", rep.SizeBits, byteSize(rep.SizeBits/8), rep.HashLocs)
+	line("Expected FPR:    %.6g at the estimated distinct count\n", rep.ExpectedFPR)
+	line("Capacity:        %d entries at -p %g\n", rep.Capacity, rep.FPR)
+	line("Recommended:     %s\n", rep.Command)
+	return err
+}
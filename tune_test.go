@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"strings"
+	"testing"
+)
+
+func runTuneJSON(t *testing.T, input string, args ...string) tuneReport {
+	t.Helper()
+	out := mustRun(t, t.TempDir(), input, append([]string{"-tune", "-json"}, args...)...)
+	var rep tuneReport
+	if err := json.Unmarshal([]byte(out), &rep); err != nil {
+		t.Fatalf("-tune %v: %v\n%s", args, err, out)
+	}
+	return rep
+}
+
+func TestTuneRecommendation(t *testing.T) {
+	const distinct = 20000
+	input, _ := syntheticStream(100000, distinct)
+
+	rep := runTuneJSON(t, input, "-p", "0.001")
+	if rep.SampleLines != 100000 {
+		t.Errorf("sample of %d lines, want 100000", rep.SampleLines)
+	}
+	if d := float64(rep.DistinctEstimate); math.Abs(d-distinct)/distinct > 0.03 {
+		t.Errorf("distinct estimate %d, want within 3%% of %d", rep.DistinctEstimate, distinct)
+	}
+	optimal := -float64(rep.DistinctEstimate) * math.Log(0.001) / (math.Ln2 * math.Ln2)
+	if b := float64(rep.SizeBits); b < optimal || b > 2*optimal || rep.SizeBits&(rep.SizeBits-1) != 0 {
+		t.Errorf("%d bits for -p 0.001, want the power of two above %.0f", rep.SizeBits, optimal)
+	}
+	if rep.ExpectedFPR > 0.001 || rep.Capacity < rep.DistinctEstimate {
+		t.Errorf("expected FPR %g and capacity %d, want at most 0.001 and room for the sample", rep.ExpectedFPR, rep.Capacity)
+	}
+	if !strings.HasSuffix(rep.Command, " -p 0.001") {
+		t.Errorf("recommended %q, want -p 0.001", rep.Command)
+	}
+
+	// A budget gives the best rate that fits it.
+	rep = runTuneJSON(t, input, "-tune-memory", "16KiB")
+	if rep.SizeBits > 16<<13 {
+		t.Errorf("%d bits recommended for a 16KiB budget", rep.SizeBits)
+	}
+	// The whole number of hash locations can cost a little over the rate.
+	if rep.FPR <= 0 || rep.FPR >= tuneMaxFPR || rep.ExpectedFPR > 1.01*rep.FPR {
+		t.Errorf("16KiB budget: -p %g with expected %g, want a rate it achieves", rep.FPR, rep.ExpectedFPR)
+	}
+	// Twice the budget does better.
+	if larger := runTuneJSON(t, input, "-tune-memory", "32KiB"); larger.FPR >= rep.FPR {
+		t.Errorf("32KiB budget allows -p %g, not below the 16KiB one's %g", larger.FPR, rep.FPR)
+	}
+
+	if res := runBdedup(t, t.TempDir(), input, "-tune", "-tune-memory", "100B"); res.code != 2 {
+		t.Errorf("-tune-memory below the smallest filter exited %d, want 2", res.code)
+	}
+	if res := runBdedup(t, t.TempDir(), input, "-tune", "-tune-memory", "1KiB"); res.code != 2 {
+		t.Errorf("-tune-memory far too small for the sample exited %d, want 2", res.code)
+	}
+}
+
+func TestByteSize(t *testing.T) {
+	for in, want := range map[string]byteSize{"512": 512, "2KiB": 2048, "1.5M": 3 << 19, "1GiB": 1 << 30, "4 KiB": 4096} {
+		var b byteSize
+		if err := b.Set(in); err != nil || b != want {
+			t.Errorf("%q: %d, %v; want %d", in, b, err, want)
+		}
+	}
+	for _, in := range []string{"", "KiB", "-1", "1XB", "1e30"} {
+		var b byteSize
+		if err := b.Set(in); err == nil {
+			t.Errorf("%q accepted as %d", in, b)
+		}
+	}
+}
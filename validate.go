@@ -0,0 +1,49 @@
+package main
+
+import "io"
+
+var (
+	minLen        int
+	maxLen        int
+	requireFields int
+	rejectOutput  string
+)
+
+// rejects receives lines failing validation when -reject-output is set;
+// otherwise they are dropped. rejectedLines counts them either way.
+var (
+	rejects       io.Writer
+	rejectedLines int
+)
+
+// validateLines reports whether any line constraint is set.
+func validateLines() bool {
+	return minLen > 0 || maxLen > 0 || requireFields > 0 || (keyRegex != nil && noMatch == "drop")
+}
+
+// validLine reports whether line satisfies -min-len, -max-len (in bytes),
+// -require-fields (exactly that many -delimiter separated fields) and, under
+// -no-match drop, -key-regex.
+func validLine(line []byte) bool {
+	switch {
+	case len(line) < minLen:
+		return false
+	case maxLen > 0 && len(line) > maxLen:
+		return false
+	case requireFields > 0 && len(splitFields(line)) != requireFields:
+		return false
+	case unmatchedLine(line):
+		return false
+	}
+	return true
+}
+
+// rejectLine counts line as rejected and writes it to the rejects output.
+func rejectLine(line []byte) {
+	rejectedLines++
+	if rejects != nil {
+		// line is the scanner's buffer, which appending to would overwrite.
+		rec := make([]byte, 0, len(line)+len(recordEnd()))
+		rejects.Write(append(append(rec, line...), recordEnd()...))
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLineValidation(t *testing.T) {
+	tests := []struct {
+		name           string
+		args           []string
+		in             string
+		want, rejected string
+	}{
+		{"min-len", []string{"-min-len", "3"}, "ab\nabc\nabcd\nab\n", "abc\nabcd\n", "ab\nab\n"},
+		{"max-len", []string{"-max-len", "3"}, "ab\nabc\nabcd\n", "ab\nabc\n", "abcd\n"},
+		{"require-fields", []string{"-require-fields", "3"}, "a\tb\tc\na\tb\na\tb\tc\td\nx\ty\tz\n", "a\tb\tc\nx\ty\tz\n", "a\tb\na\tb\tc\td\n"},
+		{"require-fields csv", []string{"-require-fields", "2", "-delimiter", ","}, "a,b\na\na,b,c\n", "a,b\n", "a\na,b,c\n"},
+		{"combined", []string{"-min-len", "2", "-max-len", "4", "-require-fields", "2"}, "a\ta\nb\nlong\tline\nc\tc\n", "a\ta\nc\tc\n", "b\nlong\tline\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			args := append([]string{"-reject-output", "rejects.txt"}, tt.args...)
+			if got := mustRun(t, dir, tt.in, args...); got != tt.want {
+				t.Errorf("output %q, want %q", got, tt.want)
+			}
+			got, err := os.ReadFile(filepath.Join(dir, "rejects.txt"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.rejected {
+				t.Errorf("rejected %q, want %q", got, tt.rejected)
+			}
+		})
+	}
+}
+
+func TestRejectLineKeepsBuffer(t *testing.T) {
+	defer func(w io.Writer, n int, d string) { rejects, rejectedLines, recordDelimiter = w, n, d }(rejects, rejectedLines, recordDelimiter)
+	var out bytes.Buffer
+	rejects, recordDelimiter = &out, "\n--\n"
+	// A token as the scanner hands it out, with whatever the scanner read
+	// after it still in the same buffer.
+	buf := []byte("short|next record\n--\n")
+	rejectLine(buf[:5])
+	if got := out.String(); got != "short\n--\n" {
+		t.Errorf("wrote %q, want the line and the record delimiter", got)
+	}
+	if got := string(buf); got != "short|next record\n--\n" {
+		t.Errorf("buffer changed to %q", got)
+	}
+}
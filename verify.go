@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/mylh/bdedup/diskset"
+)
+
+var (
+	verify      bool
+	verifyExact bool
+)
+
+// maxVerifyReports is how many inconsistent output lines -verify logs one
+// by one before only counting them.
+const maxVerifyReports = 10
+
+// checkVerifyFlags exits if -verify is set without an output file it can
+// read back as the lines that were emitted, keys and all.
+func checkVerifyFlags() {
+	if verifyExact {
+		verify = true
+		if returnSeen || minCount > 0 {
+			logErrorf("-verify-exact cannot be combined with -seen or -min-count, whose output repeats keys")
+			os.Exit(2)
+		}
+	}
+	if outputFile == "" || splitPrefix != "" || summaryOnly {
+		logErrorf("-verify requires -output, and cannot be combined with -split-output or -summary-only")
+		os.Exit(2)
+	}
+	var conflict string
+	switch {
+	case outputCompress != "none":
+		conflict = "-output-compress"
+	case outputEncoding != nil:
+		conflict = "-output-charset"
+	case annotate:
+		conflict = "-annotate"
+	case withCounts:
+		conflict = "-with-counts"
+	case keyInputFile != "":
+		conflict = "-key-input"
+	case adjacent:
+		conflict = "-adjacent"
+	case queryOnly:
+		conflict = "-query-only"
+	case noMatch == "pass":
+		// Passed lines are written without being added.
+		conflict = "-no-match pass"
+	}
+	if conflict != "" {
+		logErrorf("-verify cannot be combined with %s", conflict)
+		os.Exit(2)
+	}
+}
+
+// verifyOutput reads back the lines written to path and checks that the
+// key of every one of them is in set, as it must be once the line has been
+// emitted, whether as new or as seen. Under -verify-exact it also checks,
+// with an exact set of the emitted keys, that no key was emitted as new
+// twice, which means the filter missed the first line's Add. It logs the
+// first inconsistencies and returns an error counting them all.
+func verifyOutput(path string, set keySet) error {
+	// minCountSet.Has counts an occurrence; the filter under it is what
+	// the emitted keys were added to.
+	if mc, ok := set.(*minCountSet); ok {
+		set = mc.set
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var emitted *diskset.Set
+	if verifyExact {
+		dir, err := os.MkdirTemp("", "bdedup-verify-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		if emitted, err = diskset.Open(filepath.Join(dir, "emitted")); err != nil {
+			return err
+		}
+		defer emitted.Close()
+	}
+
+	var lineNo, missing, repeated uint64
+	report := func(format string, args ...any) {
+		if missing+repeated <= maxVerifyReports {
+			logErrorf(format, args...)
+		}
+	}
+	scanner := newLineScanner(file)
+	for scanner.Scan() {
+		lineNo++
+		key := recordKey(scanner)
+		if !set.Has(key) {
+			missing++
+			report("-verify: output line %d is not in the filter: %q", lineNo, scanner.Bytes())
+		}
+		if emitted != nil && !emitted.AddIfNotHas(key) {
+			repeated++
+			report("-verify-exact: output line %d repeats the key of an earlier output line: %q", lineNo, scanner.Bytes())
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if missing+repeated > 0 {
+		return fmt.Errorf("-verify: %d of %d output lines not in the filter, %d repeating an earlier key", missing, lineNo, repeated)
+	}
+	logInfof("Verified %d output lines", lineNo)
+	return nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// lossySet reports every dropEvery-th new key as new without ever adding
+// it, like a parallel path that emits lines but loses their Adds.
+type lossySet struct {
+	*mapSet
+	dropEvery int64
+	calls     atomic.Int64
+	dropped   sync.Map
+}
+
+func (s *lossySet) AddIfNotHasTS(key []byte) bool {
+	if _, ok := s.dropped.Load(string(key)); ok {
+		return true
+	}
+	if !s.Has(key) && s.calls.Add(1)%s.dropEvery == 0 {
+		s.dropped.Store(string(key), true)
+		return true
+	}
+	return s.mapSet.AddIfNotHasTS(key)
+}
+
+func TestVerifyFlagsLostAdds(t *testing.T) {
+	defer func(c, buf, n int, v bool) {
+		concurrency, chanBuffer, chunkLines, verifyExact = c, buf, n, v
+	}(concurrency, chanBuffer, chunkLines, verifyExact)
+	concurrency, chanBuffer, chunkLines = 4, defaultChanBuffer, 1
+	input, _ := syntheticStream(20000, 2000)
+
+	run := func(set keySet) string {
+		t.Helper()
+		path := filepath.Join(t.TempDir(), "out")
+		out, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := processInParallel(strings.NewReader(input), out, set, &runStats{}); err != nil {
+			t.Fatal(err)
+		}
+		if err := out.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	for _, exact := range []bool{false, true} {
+		verifyExact = exact
+		set := newMapSet()
+		if err := verifyOutput(run(set), set); err != nil {
+			t.Errorf("exact=%v: correct run failed verification: %v", exact, err)
+		}
+		lossy := &lossySet{mapSet: newMapSet(), dropEvery: 100}
+		err := verifyOutput(run(lossy), lossy)
+		if err == nil {
+			t.Fatalf("exact=%v: run losing every 100th Add passed verification", exact)
+		}
+		if !strings.Contains(err.Error(), "not in the filter") {
+			t.Errorf("exact=%v: error %q does not report missing lines", exact, err)
+		}
+		if exact && strings.Contains(err.Error(), " 0 repeating") {
+			t.Errorf("-verify-exact: error %q reports no repeated keys", err)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	input, _ := syntheticStream(5000, 1000)
+	for _, args := range [][]string{
+		{"-verify"},
+		{"-verify-exact", "-concurrency", "4"},
+		{"-verify", "-seen"},
+	} {
+		dir := t.TempDir()
+		res := runBdedup(t, dir, input, append(args, "-output", "out")...)
+		if res.code != 0 {
+			t.Errorf("%v: exit status %d: %s", args, res.code, res.stderr)
+		}
+	}
+	for _, args := range [][]string{
+		{"-verify"},
+		{"-verify", "-output", "out", "-annotate"},
+		{"-verify-exact", "-output", "out", "-seen"},
+	} {
+		if res := runBdedup(t, t.TempDir(), "a\n", args...); res.code != 2 {
+			t.Errorf("%v: exit status %d, want 2", args, res.code)
+		}
+	}
+}
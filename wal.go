@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// wal logs every newly seen key when -wal is set.
+var wal *walWriter
+
+// maxWALKey bounds the length prefix of a record so a corrupt log fails
+// cleanly instead of triggering a huge allocation.
+const maxWALKey = 1 << 30
+
+// walWriter appends keys to a log file, one record per key: the key length
+// as a uvarint followed by the key bytes. The file is fsynced after every
+// syncEvery keys and on Close, so a crash loses at most the keys since the
+// last sync. Write errors are sticky and returned by Close.
+type walWriter struct {
+	f         *os.File
+	w         *bufio.Writer
+	syncEvery int
+	unsynced  int
+	err       error
+}
+
+func openWAL(path string, syncEvery int) (*walWriter, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &walWriter{f: f, w: bufio.NewWriter(f), syncEvery: syncEvery}, nil
+}
+
+func (l *walWriter) append(key []byte) {
+	if l.err != nil {
+		return
+	}
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], uint64(len(key)))
+	if _, err := l.w.Write(buf[:n]); err != nil {
+		l.err = err
+		return
+	}
+	if _, err := l.w.Write(key); err != nil {
+		l.err = err
+		return
+	}
+	l.unsynced++
+	if l.syncEvery > 0 && l.unsynced >= l.syncEvery {
+		l.err = l.sync()
+	}
+}
+
+func (l *walWriter) sync() error {
+	l.unsynced = 0
+	if err := l.w.Flush(); err != nil {
+		return err
+	}
+	return l.f.Sync()
+}
+
+// flush writes out the buffered records without syncing them, so that the
+// log can be read back during the run.
+func (l *walWriter) flush() error {
+	if l.err == nil {
+		l.err = l.w.Flush()
+	}
+	return l.err
+}
+
+func (l *walWriter) Close() error {
+	err := l.err
+	if err == nil {
+		err = l.sync()
+	}
+	if cerr := l.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// readWAL calls fn with every key in the log at path, in the order they were
+// logged, and returns how many there were. A record cut short at the end of
+// the file, as a crash mid-write leaves it, ends the log without an error.
+func readWAL(path string, fn func(key []byte)) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	for count := 0; ; count++ {
+		n, err := binary.ReadUvarint(r)
+		if err == io.EOF || errors.Is(err, io.ErrUnexpectedEOF) {
+			return count, nil
+		}
+		if err != nil {
+			return count, err
+		}
+		if n > maxWALKey {
+			return count, fmt.Errorf("corrupt record %d: length %d", count+1, n)
+		}
+		key := make([]byte, n)
+		if _, err := io.ReadFull(r, key); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return count, nil
+			}
+			return count, err
+		}
+		fn(key)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/mylh/bdedup/bbloom"
+)
+
+func TestWALReplayRebuildsFilter(t *testing.T) {
+	dir := t.TempDir()
+	for _, in := range []string{numbered("a-", 300), numbered("b-", 300) + numbered("a-", 50), numbered("c-", 10)} {
+		mustRun(t, dir, in, "-wal", "keys.wal", "-n", "10000")
+	}
+	state := loadState(t, filepath.Join(dir, "bloom.gz"))
+
+	// Replaying the log into a filter of the same geometry gives the same
+	// bits as the runs did.
+	replayed, err := bbloom.NewWithFPR(10000, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count, err := readWAL(filepath.Join(dir, "keys.wal"), replayed.Add)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 610 {
+		t.Errorf("log holds %d keys, want the 610 new ones", count)
+	}
+	if !replayed.Equal(&state) {
+		t.Error("replayed filter differs from the state filter")
+	}
+
+	mustRun(t, dir, "", "compact", "-from-wal", "keys.wal", "-o", "rebuilt.gz")
+	rebuilt := loadState(t, filepath.Join(dir, "rebuilt.gz"))
+	for _, prefix := range []string{"a-", "b-", "c-"} {
+		for i := range 10 {
+			if key := prefix + string(rune('0'+i)); !rebuilt.Has([]byte(key)) {
+				t.Errorf("%s missing from the filter compacted from the log", key)
+			}
+		}
+	}
+	if got := mustRun(t, dir, "a-0\nc-9\nd-0\n", "-state", "rebuilt.gz"); got != "d-0\n" {
+		t.Errorf("run on the compacted filter emitted %q, want d-0 only", got)
+	}
+}
+
+func TestExportListsUnion(t *testing.T) {
+	dir := t.TempDir()
+	mustRun(t, dir, "x\ny\nx\n", "-wal", "keys.wal")
+	mustRun(t, dir, "y\nz\n", "-wal", "keys.wal")
+	// Another state file logs y again; export lists it once.
+	mustRun(t, dir, "y\nw\n", "-wal", "keys.wal", "-state", "other.gz")
+	if got := mustRun(t, dir, "", "export", "-wal", "keys.wal"); got != "x\ny\nz\nw\n" {
+		t.Errorf("export listed %q, want the union in first-added order", got)
+	}
+
+	in := numbered("k-", 2000)
+	mustRun(t, dir, in, "-wal", "big.wal", "-concurrency", "4", "-state", "big.gz")
+	mustRun(t, dir, "", "export", "-wal", "big.wal", "-o", "keys.txt")
+	data, err := os.ReadFile(filepath.Join(dir, "keys.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	want := strings.Split(strings.TrimSuffix(in, "\n"), "\n")
+	slices.Sort(got)
+	slices.Sort(want)
+	if !slices.Equal(got, want) {
+		t.Errorf("export -o listed %d keys, want the %d added", len(got), len(want))
+	}
+
+	if res := runBdedup(t, dir, "", "export"); res.code != 2 {
+		t.Errorf("export without -wal exited %d, want 2", res.code)
+	}
+}
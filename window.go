@@ -0,0 +1,34 @@
+package main
+
+import "os"
+
+var (
+	skipLines int
+	takeLines int
+)
+
+// checkWindowFlags validates -skip and -take. The window counts input
+// records from the start of the input, so it cannot apply to -reverse,
+// which reads from the end, or to -resume, which starts partway through.
+func checkWindowFlags() {
+	if skipLines < 0 || takeLines < 0 {
+		logErrorf("-skip and -take must not be negative")
+		os.Exit(2)
+	}
+	if (skipLines > 0 || takeLines > 0) && (reverse || resume) {
+		logErrorf("-skip and -take cannot be combined with -reverse or -resume")
+		os.Exit(2)
+	}
+}
+
+// beforeWindow reports whether the scanned'th input record, counting from
+// 1, is one of the first -skip records, which are read but not processed.
+func beforeWindow(scanned uint64) bool {
+	return scanned <= uint64(skipLines)
+}
+
+// windowDone reports whether the scanned records so far include all -take
+// records after the -skip ones, so no more of the input needs reading.
+func windowDone(scanned uint64) bool {
+	return takeLines > 0 && scanned >= uint64(skipLines)+uint64(takeLines)
+}
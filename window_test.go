@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestSkipTake(t *testing.T) {
+	in := "a\nb\na\nc\nb\nd\n"
+	tests := []struct {
+		skip, take int
+		want       string
+	}{
+		{0, 0, "a\nb\nc\nd\n"},
+		{2, 0, "a\nc\nb\nd\n"},
+		{0, 3, "a\nb\n"},
+		{2, 3, "a\nc\nb\n"},
+		{5, 10, "d\n"},
+		{6, 0, ""},
+		{100, 1, ""},
+	}
+	for _, c := range []string{"1", "4"} {
+		for _, tt := range tests {
+			args := []string{"-skip", fmt.Sprint(tt.skip), "-take", fmt.Sprint(tt.take), "-concurrency", c}
+			if got := mustRun(t, t.TempDir(), in, args...); got != tt.want {
+				t.Errorf("%v: output %q, want %q", args, got, tt.want)
+			}
+		}
+	}
+
+	// Lines outside the window are not added to the filter.
+	dir := t.TempDir()
+	mustRun(t, dir, numbered("l", 10), "-skip", "3", "-take", "4")
+	if got := mustRun(t, dir, numbered("l", 10)); got != "l0\nl1\nl2\nl7\nl8\nl9\n" {
+		t.Errorf("rerun emitted %q, want the lines outside the window", got)
+	}
+	// -query-only answers only for the window.
+	if got := mustRun(t, dir, numbered("l", 10), "-query-only", "-skip", "6", "-take", "2"); got != "l6\tyes\nl7\tyes\n" {
+		t.Errorf("-query-only in a window: %q", got)
+	}
+
+	if res := runBdedup(t, t.TempDir(), in, "-skip", "-1"); res.code != 2 {
+		t.Errorf("-skip -1 exited %d, want 2", res.code)
+	}
+}